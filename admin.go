@@ -0,0 +1,129 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// bearerToken returns the bearer token in the Authorization header, or an
+// empty string if there is no token.
+func bearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, prefix) {
+		return ""
+	}
+	return h[len(prefix):]
+}
+
+// isAdmin reports whether the request has the admin token in the
+// Authorization header, as a bearer token or as the password of Basic
+// authentication for the dashboard. Browsers send the Basic credentials even
+// from other sites, so the state-changing requests with them also need the
+// CSRF token. No one is an admin if the token is not set.
+func (s *server) isAdmin(r *http.Request) bool {
+	if s.adminToken == "" {
+		return false
+	}
+	token := bearerToken(r)
+	if token == "" {
+		var ok bool
+		_, token, ok = r.BasicAuth()
+		if !ok || !isSafeMethod(r.Method) && !s.hasCSRFToken(r) {
+			return false
+		}
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) == 1
+}
+
+// checkAdmin reports whether the request is from an admin. If not, checkAdmin
+// writes an error response.
+func (s *server) checkAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if s.isAdmin(r) {
+		return true
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer realm="chatserver"`)
+	if r.URL.Path == "/admin" {
+		// Let browsers ask for the credentials of the dashboard.
+		w.Header().Add("WWW-Authenticate", `Basic realm="chatserver"`)
+	}
+	code := http.StatusUnauthorized
+	writeError(w, r, code, http.StatusText(code))
+	return false
+}
+
+func (s *server) handleAdmin(w http.ResponseWriter, r *http.Request) {
+	// The responses can have secrets like API keys.
+	noStore(w)
+	if !s.checkAdmin(w, r) {
+		return
+	}
+
+	ctx := r.Context()
+	switch {
+	case r.URL.Path == "/admin":
+		s.handleDashboard(ctx, w, r)
+		return
+	case r.URL.Path == "/admin/wordfilter":
+		s.handleWordFilter(ctx, w, r)
+		return
+	case r.URL.Path == "/admin/bans" || strings.HasPrefix(r.URL.Path, "/admin/bans/"):
+		s.handleBans(ctx, w, r)
+		return
+	case r.URL.Path == "/admin/bots" || strings.HasPrefix(r.URL.Path, "/admin/bots/"):
+		s.handleBots(ctx, w, r)
+		return
+	case r.URL.Path == "/admin/webhooks" || strings.HasPrefix(r.URL.Path, "/admin/webhooks/"):
+		s.handleWebhooks(ctx, w, r)
+		return
+	case r.URL.Path == "/admin/export":
+		s.handleExport(ctx, w, r)
+		return
+	case r.URL.Path == "/admin/queue" || strings.HasPrefix(r.URL.Path, "/admin/queue/"):
+		s.handleModerationQueue(ctx, w, r)
+		return
+	case r.URL.Path == "/admin/trusted":
+		s.handleTrustedNames(ctx, w, r)
+		return
+	case r.URL.Path == "/admin/reports" || strings.HasPrefix(r.URL.Path, "/admin/reports/"):
+		s.handleReports(ctx, w, r)
+		return
+	case r.URL.Path == "/admin/spam" || strings.HasPrefix(r.URL.Path, "/admin/spam/"):
+		s.handleSpam(ctx, w, r)
+		return
+	case r.URL.Path == "/admin/audit":
+		s.handleAudit(ctx, w, r)
+		return
+	case r.URL.Path == "/admin/templates":
+		s.handleTemplates(ctx, w, r)
+		return
+	case r.URL.Path == "/admin/scheduled" || strings.HasPrefix(r.URL.Path, "/admin/scheduled/"):
+		s.handleScheduledMessages(ctx, w, r)
+		return
+	case r.URL.Path == "/admin/rooms" || strings.HasPrefix(r.URL.Path, "/admin/rooms/"):
+		s.handleRooms(ctx, w, r)
+		return
+	}
+
+	notFound(w, r)
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	code := http.StatusMethodNotAllowed
+	writeError(w, r, code, http.StatusText(code))
+}
@@ -0,0 +1,103 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// MessagesResponse is the JSON representation of the message list.
+type MessagesResponse struct {
+	// Messages are in the posted order.
+	Messages    []Message `json:"messages"`
+	Count       int       `json:"count"`
+	GeneratedAt time.Time `json:"generated_at"`
+
+	// Next is the URL of the older messages. Next is empty if there are no
+	// older messages.
+	Next string `json:"next,omitempty"`
+
+	// Pinned is the pinned messages in the pinned order. Pinned messages
+	// are kept even after they are trimmed from the latest messages.
+	Pinned []Message `json:"pinned,omitempty"`
+
+	// Stale is true if the store is unavailable and the messages are the
+	// latest ones read in the server. They might be out of date.
+	Stale bool `json:"stale,omitempty"`
+
+	// Revision is the revision of the messages in the room. Revision is
+	// used in If-Match to change the messages only when they have not been
+	// changed by others.
+	Revision int64 `json:"revision"`
+}
+
+// maxAdminContentSize is the maximum size of a request body to the admin
+// API, which is larger than max_content_size for lists like the word filter.
+const maxAdminContentSize = 1 << 20
+
+// errBodyTooLarge is the error message of http.MaxBytesReader.
+const errBodyTooLarge = "http: request body too large"
+
+// decodeJSON decodes the request body, which must be a single JSON value up
+// to limit bytes, into v. The body is read as a stream, and reading stops as
+// soon as it exceeds the limit. If the body is invalid, decodeJSON writes 413
+// Request Entity Too Large or 400 Bad Request, and returns false.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}, limit int64) bool {
+	d := json.NewDecoder(http.MaxBytesReader(w, r.Body, limit))
+	err := d.Decode(v)
+	if err == nil {
+		// Only spaces can follow the value.
+		if _, err = d.Token(); err == io.EOF {
+			return true
+		}
+		if err == nil {
+			err = errors.New("unexpected data after the JSON value")
+		}
+	}
+	if err.Error() == errBodyTooLarge {
+		writeBodyTooLarge(w, r, limit)
+		return false
+	}
+	msg := fmt.Sprintf("Unmarshal JSON error: %v", err)
+	writeError(w, r, http.StatusBadRequest, msg)
+	return false
+}
+
+// wantsJSON reports whether the client prefers JSON to HTML. Protocol Buffers
+// and MessagePack are regarded as JSON.
+func wantsJSON(r *http.Request) bool {
+	for _, t := range strings.Split(r.Header.Get("Accept"), ",") {
+		t = strings.TrimSpace(strings.SplitN(t, ";", 2)[0])
+		switch normalizeMediaType(t) {
+		case mediaJSON, mediaProtobuf, mediaMsgpack:
+			return true
+		case "text/html":
+			return false
+		}
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
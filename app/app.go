@@ -0,0 +1,34 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command app is the App Engine app of the chat server. The chat is served at
+// the root of the app.
+package main
+
+import (
+	"net/http"
+	"os"
+
+	"github.com/golangtokyo/chatserver"
+	"google.golang.org/appengine/v2"
+)
+
+func main() {
+	config, err := chatserver.LoadConfig(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		panic(err)
+	}
+	http.Handle("/", chatserver.NewAppEngineHandler(config))
+	appengine.Main()
+}
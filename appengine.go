@@ -0,0 +1,104 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sync"
+
+	"google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/log"
+	"google.golang.org/appengine/v2/runtime"
+	"google.golang.org/appengine/v2/urlfetch"
+)
+
+// NewAppEngineHandler returns a handler serving the chat on App Engine.
+// Messages are stored in datastore and cached in memcache, and the other
+// states are stored in datastore and memcache. The handler is not
+// registered anywhere, so the app mounts it on its own mux.
+func NewAppEngineHandler(config Config) http.Handler {
+	s := &server{
+		store:     newCachedStore(&memcacheStore{key: messagesKey, shards: config.CacheShards}, datastoreStore{}, config.HistoryLength),
+		cache:     memcacheKV{},
+		db:        datastoreKV{},
+		hub:       newHub(),
+		fallback:  newFallback(),
+		batcher:   newPostBatcher(),
+		webhooks:  &webhookDispatcher{},
+		config:    config,
+		rateLimit: rateLimitFromEnv("RATE_LIMIT", defaultRateLimit),
+
+		botRateLimit: rateLimitFromEnv("BOT_RATE_LIMIT", defaultBotRateLimit),
+
+		adminToken:    os.Getenv("ADMIN_TOKEN"),
+		loginRequired: os.Getenv("LOGIN_REQUIRED") == "true",
+		sessionSecret: sessionSecretFromEnv(),
+
+		logf:       log.Infof,
+		httpClient: urlfetch.Client,
+		slackToken: os.Getenv("SLACK_TOKEN"),
+		accounts:   true,
+		dev:        appengine.IsDevAppServer(),
+		cron:       true,
+		postQueue:  taskQueue{},
+		scheduler:  taskScheduler{},
+		index:      searchAPIIndex{name: "messages"},
+
+		spamScorers: defaultSpamScorers,
+	}
+	if config.AsyncPosts {
+		s.pipeline = taskPipeline{}
+	}
+	if config.TraceProject != "" {
+		s.enableTracing(&cloudTraceExporter{
+			project: config.TraceProject,
+			token: func(ctx context.Context) (string, error) {
+				token, _, err := appengine.AccessToken(ctx, cloudTraceScope)
+				return token, err
+			},
+			client: urlfetch.Client,
+		})
+	}
+
+	if webhook := os.Getenv("SLACK_WEBHOOK_URL"); webhook != "" {
+		s.slack = &slackForwarder{
+			url:    webhook,
+			client: urlfetch.Client,
+		}
+	}
+
+	h := s.handler()
+
+	// Posted messages are relayed between instances via Cloud Pub/Sub if
+	// PUBSUB_TOPIC is set. The subscriber is started in the background at the
+	// first request, which is available only with manual and basic scaling.
+	if topic := os.Getenv("PUBSUB_TOPIC"); topic != "" {
+		s.broker = &pubsubBroker{topicID: topic}
+		next := h
+		var once sync.Once
+		h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			once.Do(func() {
+				ctx := r.Context()
+				if err := runtime.RunInBackground(ctx, s.relay); err != nil {
+					log.Errorf(ctx, "RunInBackground error: %v", err)
+				}
+			})
+			next.ServeHTTP(w, r)
+		})
+	}
+	return h
+}
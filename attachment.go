@@ -0,0 +1,346 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// maxAttachments is the maximum number of images attached to a message.
+	maxAttachments = 4
+
+	// maxAttachmentUploadSize is the maximum number of bytes of an uploaded
+	// image.
+	maxAttachmentUploadSize = 8 << 20
+
+	// maxAttachmentPixels is the maximum number of the pixels of an uploaded
+	// image, so that a small file can't make the server decode a huge image.
+	maxAttachmentPixels = 4096 * 4096
+
+	// maxAttachmentDataSize is the maximum number of bytes of a stored image,
+	// so that the image fits in a KV value.
+	maxAttachmentDataSize = 640 << 10
+
+	// attachmentSize is the maximum width and height of a stored image in
+	// pixels. Larger images are scaled down.
+	attachmentSize = 1280
+
+	// thumbnailSize is the maximum width and height of a thumbnail in pixels.
+	thumbnailSize = 240
+
+	// thumbnailQuality is the JPEG quality of a thumbnail.
+	thumbnailQuality = 80
+
+	// attachmentUploadExpiration is the duration to keep an uploaded image
+	// that is not attached to any message.
+	attachmentUploadExpiration = 24 * time.Hour
+
+	// thumbnailExpiration is the duration to cache a thumbnail.
+	thumbnailExpiration = 7 * 24 * time.Hour
+)
+
+// attachmentQualities are the JPEG qualities tried in order until a stored
+// image is small enough.
+var attachmentQualities = []int{85, 70, 50}
+
+// Attachment is the JSON representation of an image attached to a message.
+// Only ID is used when a message is posted.
+type Attachment struct {
+	// ID is assigned by the server when the image is uploaded.
+	ID string `json:"id"`
+
+	// Width and Height are the size of the image in pixels.
+	Width  int `json:"width"`
+	Height int `json:"height"`
+
+	URL          string `json:"url"`
+	ThumbnailURL string `json:"thumbnail_url"`
+}
+
+func newAttachment(id string, width, height int) Attachment {
+	return Attachment{
+		ID:           id,
+		Width:        width,
+		Height:       height,
+		URL:          "/images/" + id + ".jpg",
+		ThumbnailURL: "/images/" + id + "/thumbnail.jpg",
+	}
+}
+
+// attachmentImage is a stored image in JPEG.
+type attachmentImage struct {
+	Width  int
+	Height int
+	Data   []byte
+}
+
+func attachmentKey(id string) string {
+	return "attachment:" + id
+}
+
+func thumbnailKey(id string) string {
+	return "attachment-thumbnail:" + id
+}
+
+func newAttachmentID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// fitSize returns the size of an image of width x height scaled down to fit in
+// size x size. Smaller images keep their size.
+func fitSize(width, height, size int) (int, int) {
+	if width <= size && height <= size {
+		return width, height
+	}
+	if width >= height {
+		height = height * size / width
+		if height < 1 {
+			height = 1
+		}
+		return size, height
+	}
+	width = width * size / height
+	if width < 1 {
+		width = 1
+	}
+	return width, size
+}
+
+// scaleImage scales the image down to fit in the size with the average of the
+// pixels, on a white background for transparent images. The source pixels are
+// read as they are averaged so that a large image is not copied.
+func scaleImage(src image.Image, size int) *image.RGBA {
+	b := src.Bounds()
+	w, h := fitSize(b.Dx(), b.Dy(), size)
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0 := b.Min.Y + y*b.Dy()/h
+		y1 := b.Min.Y + (y+1)*b.Dy()/h
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < w; x++ {
+			x0 := b.Min.X + x*b.Dx()/w
+			x1 := b.Min.X + (x+1)*b.Dx()/w
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var r, g, bl, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					// The colors are alpha-premultiplied, so adding the
+					// transparency draws them over white.
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r += uint64(cr + 0xffff - ca)
+					g += uint64(cg + 0xffff - ca)
+					bl += uint64(cb + 0xffff - ca)
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{uint8(r / n >> 8), uint8(g / n >> 8), uint8(bl / n >> 8), 0xff})
+		}
+	}
+	return dst
+}
+
+// encodeAttachment scales the uploaded image down and encodes it in JPEG. The
+// metadata of the upload like the location is not kept.
+func encodeAttachment(data []byte) (*attachmentImage, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width*config.Height > maxAttachmentPixels {
+		return nil, fmt.Errorf("chatserver: the image is too large: %dx%d", config.Width, config.Height)
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	img := scaleImage(src, attachmentSize)
+	for _, q := range attachmentQualities {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: q}); err != nil {
+			return nil, err
+		}
+		if buf.Len() <= maxAttachmentDataSize {
+			return &attachmentImage{
+				Width:  img.Bounds().Dx(),
+				Height: img.Bounds().Dy(),
+				Data:   buf.Bytes(),
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("chatserver: the image is too large after encoding")
+}
+
+// postAttachment handles POST /attachments. The request body is a PNG, JPEG
+// or GIF image. The image is kept for attachmentUploadExpiration until it is
+// attached to a message.
+func (s *server) postAttachment(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if !s.checkRateLimit(ctx, w, r) {
+		return
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxAttachmentUploadSize+1))
+	if err != nil {
+		msg := fmt.Sprintf("Could not read the request body: %v", err)
+		writeError(w, r, http.StatusBadRequest, msg)
+		return
+	}
+	if len(data) > maxAttachmentUploadSize {
+		writeBodyTooLarge(w, r, maxAttachmentUploadSize)
+		return
+	}
+	img, err := encodeAttachment(data)
+	if err != nil {
+		msg := fmt.Sprintf("Image error: %v", err)
+		writeError(w, r, http.StatusBadRequest, msg)
+		return
+	}
+
+	id, err := newAttachmentID()
+	if err != nil {
+		msg := fmt.Sprintf("Attachment error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	if err := s.db.Set(ctx, attachmentKey(id), img, attachmentUploadExpiration); err != nil {
+		msg := fmt.Sprintf("Attachment error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	a := newAttachment(id, img.Width, img.Height)
+	writeJSON(w, http.StatusCreated, &a)
+}
+
+// attachImages resolves the uploaded images of the message, and keeps them as
+// long as the message is kept by the retention period. If an image is not
+// found, attachImages returns a *ValidationError.
+func (s *server) attachImages(ctx context.Context, message *Message) error {
+	for i, a := range message.Attachments {
+		var img attachmentImage
+		if err := s.db.Get(ctx, attachmentKey(a.ID), &img); err != nil {
+			if err == ErrNotFound {
+				return &ValidationError{
+					Errors: []FieldError{newFieldError("attachments", "image %q is not found", a.ID)},
+				}
+			}
+			return err
+		}
+		if err := s.db.Set(ctx, attachmentKey(a.ID), &img, s.config.Retention); err != nil {
+			return err
+		}
+		message.Attachments[i] = newAttachment(a.ID, img.Width, img.Height)
+	}
+	return nil
+}
+
+// handleImage handles GET /images/{id}.jpg and /images/{id}/thumbnail.jpg.
+// Thumbnails are made when they are requested first, and are cached. The
+// images never change, so clients can cache them forever.
+func (s *server) handleImage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		methodNotAllowed(w, r)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/images/")
+	id, thumbnail := strings.TrimSuffix(path, "/thumbnail.jpg"), true
+	if id == path {
+		id, thumbnail = strings.TrimSuffix(path, ".jpg"), false
+	}
+	if id == path || id == "" || strings.Contains(id, "/") {
+		notFound(w, r)
+		return
+	}
+
+	ctx := r.Context()
+	var data []byte
+	var err error
+	if thumbnail {
+		data, err = s.thumbnail(ctx, id)
+	} else {
+		data, err = s.attachmentData(ctx, id)
+	}
+	if err != nil {
+		if err == ErrNotFound {
+			notFound(w, r)
+			return
+		}
+		msg := fmt.Sprintf("Attachment error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("Content-Type", "image/jpeg")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+// attachmentData returns the stored image in JPEG.
+func (s *server) attachmentData(ctx context.Context, id string) ([]byte, error) {
+	var img attachmentImage
+	if err := s.db.Get(ctx, attachmentKey(id), &img); err != nil {
+		return nil, err
+	}
+	return img.Data, nil
+}
+
+// thumbnail returns the thumbnail of the stored image in JPEG.
+func (s *server) thumbnail(ctx context.Context, id string) ([]byte, error) {
+	var data []byte
+	if err := s.cache.Get(ctx, thumbnailKey(id), &data); err == nil {
+		return data, nil
+	} else if err != ErrNotFound {
+		s.logf(ctx, "Thumbnail error: %v", err)
+	}
+
+	data, err := s.attachmentData(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	src, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, scaleImage(src, thumbnailSize), &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+		return nil, err
+	}
+	if err := s.cache.Set(ctx, thumbnailKey(id), buf.Bytes(), thumbnailExpiration); err != nil {
+		s.logf(ctx, "Thumbnail error: %v", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,166 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	auditKey = "audit"
+
+	// maxAuditEntries is the number of the latest entries kept in the audit
+	// log.
+	maxAuditEntries = 1000
+
+	// defaultAuditLimit is the number of the entries in GET /admin/audit
+	// without limit.
+	defaultAuditLimit = 100
+
+	// actorHeader is the request header for the name of the organizer who
+	// uses the shared admin token.
+	actorHeader = "X-Chatserver-Actor"
+)
+
+// AuditEntry is an administrative action in the audit log.
+type AuditEntry struct {
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+
+	// Actor is the signed-in user, or the name in the X-Chatserver-Actor
+	// header. Actor is "admin" if neither is available.
+	Actor string `json:"actor"`
+	IP    string `json:"ip"`
+
+	// Action is the kind of the action like "message.delete".
+	Action string `json:"action"`
+	Room   string `json:"room,omitempty"`
+
+	// Target is the ID of the changed thing like the message ID.
+	Target string `json:"target,omitempty"`
+
+	// Previous is the value before the action, and Value is the value after
+	// the action.
+	Previous json.RawMessage `json:"previous,omitempty"`
+	Value    json.RawMessage `json:"value,omitempty"`
+}
+
+// auditActor returns the name of the organizer who makes the request.
+func (s *server) auditActor(ctx context.Context, r *http.Request) string {
+	if name := s.userName(ctx); name != "" {
+		return name
+	}
+	if name := strings.TrimSpace(r.Header.Get(actorHeader)); name != "" {
+		return name
+	}
+	// Organizers on the dashboard are named by the Basic user name.
+	if name, _, ok := r.BasicAuth(); ok && strings.TrimSpace(name) != "" {
+		return strings.TrimSpace(name)
+	}
+	return "admin"
+}
+
+// audit records the administrative action. previous and value are the values
+// before and after the action, and are omitted if nil. Secrets like API keys
+// must be removed from them. The action is already done, so errors are only
+// logged.
+func (s *server) audit(ctx context.Context, r *http.Request, action, room, target string, previous, value interface{}) {
+	id, err := newID()
+	if err != nil {
+		s.logf(ctx, "Audit error: %v", err)
+		return
+	}
+	e := AuditEntry{
+		ID:     id,
+		Time:   time.Now(),
+		Actor:  s.auditActor(ctx, r),
+		IP:     clientIP(r),
+		Action: action,
+		Room:   room,
+		Target: target,
+	}
+	if previous != nil {
+		if e.Previous, err = json.Marshal(previous); err != nil {
+			s.logf(ctx, "Audit error: %v", err)
+			return
+		}
+	}
+	if value != nil {
+		if e.Value, err = json.Marshal(value); err != nil {
+			s.logf(ctx, "Audit error: %v", err)
+			return
+		}
+	}
+
+	var entries []AuditEntry
+	if err := s.db.Update(ctx, auditKey, &entries, 0, func() error {
+		entries = append(entries, e)
+		if len(entries) > maxAuditEntries {
+			entries = entries[len(entries)-maxAuditEntries:]
+		}
+		return nil
+	}); err != nil {
+		s.logf(ctx, "Audit error: %v", err)
+	}
+}
+
+// handleAudit handles GET /admin/audit?action={action}&actor={actor}&limit={n},
+// which lists the audit log in the newest first order.
+func (s *server) handleAudit(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		methodNotAllowed(w, r)
+		return
+	}
+	q := r.URL.Query()
+	limit := defaultAuditLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			msg := fmt.Sprintf("Invalid limit: %q", v)
+			writeError(w, r, http.StatusBadRequest, msg)
+			return
+		}
+		limit = n
+	}
+	action := q.Get("action")
+	actor := q.Get("actor")
+
+	var entries []AuditEntry
+	if err := s.db.Get(ctx, auditKey, &entries); err != nil && err != ErrNotFound {
+		msg := fmt.Sprintf("Audit error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	result := []AuditEntry{}
+	for i := len(entries) - 1; i >= 0 && len(result) < limit; i-- {
+		e := entries[i]
+		// An action like "ban" matches "ban.create" and "ban.delete".
+		if action != "" && e.Action != action && !strings.HasPrefix(e.Action, action+".") {
+			continue
+		}
+		if actor != "" && e.Actor != actor {
+			continue
+		}
+		result = append(result, e)
+	}
+	writeJSON(w, http.StatusOK, result)
+}
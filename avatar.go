@@ -0,0 +1,168 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// avatarGrid is the number of the cells in a row of an identicon.
+	avatarGrid = 5
+
+	// avatarCellSize is the size of a cell of an identicon in pixels.
+	avatarCellSize = 10
+
+	// avatarMargin is the margin around the cells in pixels.
+	avatarMargin = 7
+
+	// avatarSize is the width and the height of an identicon, 64 pixels.
+	avatarSize = avatarGrid*avatarCellSize + 2*avatarMargin
+)
+
+var avatarBackground = color.RGBA{0xf0, 0xf0, 0xf0, 0xff}
+
+// avatarPath returns the path of the identicon of the name.
+func avatarPath(name string) string {
+	return "/avatar/" + url.PathEscape(name) + ".png"
+}
+
+// avatarURL returns the URL of the avatar of the poster of the message for
+// the templates. The avatar in the profile is used if any, and otherwise the
+// identicon of the name.
+func avatarURL(m Message) string {
+	if m.Profile != nil && m.Profile.AvatarURL != "" {
+		return m.Profile.AvatarURL
+	}
+	if m.Name == "" {
+		return ""
+	}
+	return avatarPath(m.Name)
+}
+
+// avatarHash returns the hash to draw the identicon of the name. The names are
+// normalized in the same way as the registered names, so that the same
+// poster gets the same identicon.
+func avatarHash(name string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(nameKey(name)))
+}
+
+// hslColor converts a color in HSL to RGB. h is in [0, 360), and s and l are in
+// [0, 1].
+func hslColor(h, s, l float64) color.RGBA {
+	c := (1 - math.Abs(2*l-1)) * s
+	hh := h / 60
+	x := c * (1 - math.Abs(math.Mod(hh, 2)-1))
+	var r, g, b float64
+	switch int(hh) {
+	case 0:
+		r, g, b = c, x, 0
+	case 1:
+		r, g, b = x, c, 0
+	case 2:
+		r, g, b = 0, c, x
+	case 3:
+		r, g, b = 0, x, c
+	case 4:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+	m := l - c/2
+	return color.RGBA{
+		R: uint8((r + m) * 255),
+		G: uint8((g + m) * 255),
+		B: uint8((b + m) * 255),
+		A: 0xff,
+	}
+}
+
+// identicon draws the identicon of the hash. The cells are symmetric
+// horizontally like a face, and the left half and the center column are
+// filled by the bits of the hash. The color is also picked by the hash.
+func identicon(hash [sha256.Size]byte) image.Image {
+	hue := float64(int(hash[0])<<8|int(hash[1])) * 360 / 65536
+	fg := hslColor(hue, 0.5+float64(hash[2])/255*0.2, 0.45+float64(hash[3])/255*0.15)
+	img := image.NewPaletted(image.Rect(0, 0, avatarSize, avatarSize), color.Palette{avatarBackground, fg})
+
+	bits := hash[4:]
+	const cols = (avatarGrid + 1) / 2
+	for y := 0; y < avatarGrid; y++ {
+		for x := 0; x < cols; x++ {
+			i := y*cols + x
+			if bits[i/8]&(1<<uint(i%8)) == 0 {
+				continue
+			}
+			fillAvatarCell(img, x, y)
+			fillAvatarCell(img, avatarGrid-1-x, y)
+		}
+	}
+	return img
+}
+
+func fillAvatarCell(img *image.Paletted, x, y int) {
+	x0 := avatarMargin + x*avatarCellSize
+	y0 := avatarMargin + y*avatarCellSize
+	for j := y0; j < y0+avatarCellSize; j++ {
+		for i := x0; i < x0+avatarCellSize; i++ {
+			img.SetColorIndex(i, j, 1)
+		}
+	}
+}
+
+// handleAvatar handles GET /avatar/{name}.png, the identicon of the name.
+// The identicons never change, so they are cached for a year.
+func (s *server) handleAvatar(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		methodNotAllowed(w, r)
+		return
+	}
+	// The escaped path is used so that a name can contain slashes.
+	p := strings.TrimPrefix(r.URL.EscapedPath(), "/avatar/")
+	if !strings.HasSuffix(p, ".png") {
+		notFound(w, r)
+		return
+	}
+	name, err := url.PathUnescape(strings.TrimSuffix(p, ".png"))
+	if err != nil || name == "" || !utf8.ValidString(name) || utf8.RuneCountInString(name) > s.config.MaxNameLength {
+		notFound(w, r)
+		return
+	}
+
+	hash := avatarHash(name)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, identicon(hash)); err != nil {
+		msg := fmt.Sprintf("PNG error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	cacheImmutable(w, staticHashedMaxAge)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(hash[:8])+`"`)
+	w.Header().Set("Content-Type", "image/png")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(buf.Bytes()))
+}
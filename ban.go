@@ -0,0 +1,234 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const bansKey = "bans"
+
+// BanType is the kind of posters to ban.
+type BanType string
+
+const (
+	BanSession BanType = "session"
+	BanIP      BanType = "ip"
+	BanName    BanType = "name"
+)
+
+// Ban is a ban of posters.
+type Ban struct {
+	ID     string  `json:"id"`
+	Type   BanType `json:"type"`
+	Value  string  `json:"value"`
+	Reason string  `json:"reason,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+
+	// ExpiresAt is the time when the ban is lifted. If ExpiresAt is zero,
+	// the ban is permanent.
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+}
+
+func (b *Ban) expired(now time.Time) bool {
+	return !b.ExpiresAt.IsZero() && !now.Before(b.ExpiresAt)
+}
+
+// poster is the identity of a poster checked against bans.
+type poster struct {
+	sessionID string
+	ip        string
+	name      string
+}
+
+func (b *Ban) matches(p *poster) bool {
+	switch b.Type {
+	case BanSession:
+		return p.sessionID != "" && b.Value == p.sessionID
+	case BanIP:
+		return b.Value == p.ip
+	case BanName:
+		return strings.EqualFold(b.Value, p.name)
+	}
+	return false
+}
+
+// activeBans returns the bans that are not expired.
+func activeBans(bans []Ban, now time.Time) []Ban {
+	result := []Ban{}
+	for _, b := range bans {
+		if b.expired(now) {
+			continue
+		}
+		result = append(result, b)
+	}
+	return result
+}
+
+func (s *server) bans(ctx context.Context) ([]Ban, error) {
+	var bans []Ban
+	if err := s.db.Get(ctx, bansKey, &bans); err != nil && err != ErrNotFound {
+		return nil, err
+	}
+	return activeBans(bans, time.Now()), nil
+}
+
+// isBanned reports whether the poster is banned.
+func (s *server) isBanned(ctx context.Context, p *poster) (bool, error) {
+	bans, err := s.bans(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, b := range bans {
+		if b.matches(p) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// newID returns a random ID.
+func newID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// handleBans handles /admin/bans and /admin/bans/{id}.
+func (s *server) handleBans(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/bans"), "/")
+
+	switch {
+	case id == "" && isGet(r):
+		bans, err := s.bans(ctx)
+		if err != nil {
+			msg := fmt.Sprintf("Ban error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		writeJSON(w, http.StatusOK, bans)
+
+	case id == "" && r.Method == http.MethodPost:
+		var req struct {
+			Type   BanType `json:"type"`
+			Value  string  `json:"value"`
+			Reason string  `json:"reason"`
+
+			// Duration is the duration of the ban like "1h". If Duration
+			// is empty, the ban is permanent.
+			Duration string `json:"duration"`
+		}
+		if !decodeJSON(w, r, &req, maxAdminContentSize) {
+			return
+		}
+		switch req.Type {
+		case BanSession, BanIP, BanName:
+		default:
+			msg := fmt.Sprintf("Invalid type: %q", req.Type)
+			writeError(w, r, http.StatusBadRequest, msg)
+			return
+		}
+		if req.Value == "" {
+			msg := "Value must not be empty"
+			writeError(w, r, http.StatusBadRequest, msg)
+			return
+		}
+
+		now := time.Now()
+		ban := Ban{
+			Type:      req.Type,
+			Value:     req.Value,
+			Reason:    req.Reason,
+			CreatedAt: now,
+		}
+		if req.Duration != "" {
+			d, err := time.ParseDuration(req.Duration)
+			if err != nil || d <= 0 {
+				msg := fmt.Sprintf("Invalid duration: %q", req.Duration)
+				writeError(w, r, http.StatusBadRequest, msg)
+				return
+			}
+			ban.ExpiresAt = now.Add(d)
+		}
+		banID, err := newID()
+		if err != nil {
+			msg := fmt.Sprintf("Ban error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		ban.ID = banID
+
+		var bans []Ban
+		if err := s.db.Update(ctx, bansKey, &bans, 0, func() error {
+			bans = append(activeBans(bans, now), ban)
+			return nil
+		}); err != nil {
+			msg := fmt.Sprintf("Ban error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		s.audit(ctx, r, "ban.create", "", ban.ID, nil, &ban)
+		writeJSON(w, http.StatusCreated, &ban)
+
+	case id != "" && r.Method == http.MethodDelete:
+		var bans []Ban
+		var removed Ban
+		if err := s.db.Update(ctx, bansKey, &bans, 0, func() error {
+			found := false
+			rest := []Ban{}
+			for _, b := range activeBans(bans, time.Now()) {
+				if b.ID == id {
+					found = true
+					removed = b
+					continue
+				}
+				rest = append(rest, b)
+			}
+			if !found {
+				return ErrNotFound
+			}
+			bans = rest
+			return nil
+		}); err != nil {
+			if err == ErrNotFound {
+				notFound(w, r)
+				return
+			}
+			msg := fmt.Sprintf("Ban error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		s.audit(ctx, r, "ban.delete", "", id, &removed, nil)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		if id == "" {
+			w.Header().Set("Allow", "GET, HEAD, POST")
+		} else {
+			w.Header().Set("Allow", "DELETE")
+		}
+		methodNotAllowed(w, r)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// maxPostBatch is the maximum number of posts stored at once.
+	maxPostBatch = 100
+
+	// postBatchTimeout is how long storing a batch can take.
+	postBatchTimeout = 30 * time.Second
+)
+
+type pendingPost struct {
+	message Message
+	id      int64
+	err     error
+
+	// leader is true if the request of the post stores the batch.
+	leader bool
+
+	// wake is closed when the post is stored, or when the request becomes
+	// the leader.
+	wake chan struct{}
+}
+
+// postBatcher stores the posts to a room in batches. While a batch is being
+// stored, the next posts wait, and the request of the oldest waiting post
+// stores them all in the next batch. Under burst load, the store and the cache
+// are updated once per batch instead of once per post, which saves round trips
+// and CAS conflicts.
+//
+// Posts are kept only while their requests are waiting, and each batch is
+// stored by one of their requests, since App Engine doesn't run goroutines
+// after the requests finish. The batch is stored with the values of the
+// leader's context but not with its deadline, so that the other posts don't
+// fail when the leader's request is canceled or times out.
+type postBatcher struct {
+	pending  map[string][]*pendingPost
+	flushing map[string]bool
+	m        sync.Mutex
+}
+
+func newPostBatcher() *postBatcher {
+	return &postBatcher{
+		pending:  map[string][]*pendingPost{},
+		flushing: map[string]bool{},
+	}
+}
+
+// append stores the message to the end of the room with the other posts
+// arriving at the same time, and returns the ID assigned to it.
+func (b *postBatcher) append(ctx context.Context, s *server, room string, message Message) (int64, error) {
+	p := &pendingPost{
+		message: message,
+		wake:    make(chan struct{}),
+	}
+
+	b.m.Lock()
+	b.pending[room] = append(b.pending[room], p)
+	first := !b.flushing[room]
+	if first {
+		b.flushing[room] = true
+		p.leader = true
+	}
+	b.m.Unlock()
+
+	if !first {
+		<-p.wake
+	}
+	if p.leader {
+		b.flush(ctx, s, room)
+	}
+	return p.id, p.err
+}
+
+// flush stores the pending posts in the room from the leader's post, and makes
+// the next waiting post the leader.
+func (b *postBatcher) flush(ctx context.Context, s *server, room string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), postBatchTimeout)
+	defer cancel()
+
+	b.m.Lock()
+	batch := b.pending[room]
+	if len(batch) > maxPostBatch {
+		batch = batch[:maxPostBatch]
+	}
+	b.pending[room] = b.pending[room][len(batch):]
+	b.m.Unlock()
+
+	messages := make([]Message, len(batch))
+	for i, p := range batch {
+		messages[i] = p.message
+	}
+	ids, err := appendMessages(ctx, s.store, room, messages)
+	for i, p := range batch {
+		if i < len(ids) {
+			p.id = ids[i]
+		} else {
+			p.err = err
+		}
+	}
+	postBatchSize.Observe(float64(len(batch)))
+
+	// Trimming can wait for the next batch if it fails.
+	if len(ids) > 0 {
+		if err := s.store.Trim(ctx, room, s.historyLength(ctx, room)); err != nil {
+			s.logf(ctx, "Trim error: %v", err)
+		}
+	}
+
+	for _, p := range batch {
+		if !p.leader {
+			close(p.wake)
+		}
+	}
+
+	b.m.Lock()
+	defer b.m.Unlock()
+	if len(b.pending[room]) == 0 {
+		delete(b.pending, room)
+		delete(b.flushing, room)
+		return
+	}
+	next := b.pending[room][0]
+	next.leader = true
+	close(next.wake)
+}
@@ -0,0 +1,423 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltRoomsBucket = []byte("rooms")
+	boltKVBucket    = []byte("kv")
+)
+
+// boltCompactTxSize is the size of the writes committed at once in
+// compaction.
+const boltCompactTxSize = 1 << 20
+
+// boltKey returns the key of the message ID. The keys are big endian so that
+// the messages are sorted by the IDs.
+func boltKey(id int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(id))
+	return b
+}
+
+// boltStore is a Store on a Bolt database file. Each room has its bucket in
+// the rooms bucket, where the messages are appended with the IDs from the
+// bucket sequence. All the messages are kept until they are purged. The file
+// doesn't shrink when messages are removed, so compact it with CompactBolt.
+type boltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore returns a Store that keeps messages in the Bolt database, for
+// a single server without any other servers, like a kiosk at the venue.
+func NewBoltStore(db *bolt.DB) (Store, error) {
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltRoomsBucket)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+// room returns the bucket of the room. room returns nil if the bucket doesn't
+// exist and the transaction is read-only.
+func (s *boltStore) room(tx *bolt.Tx, room string) (*bolt.Bucket, error) {
+	rooms := tx.Bucket(boltRoomsBucket)
+	if !tx.Writable() {
+		return rooms.Bucket([]byte(room)), nil
+	}
+	return rooms.CreateBucketIfNotExists([]byte(room))
+}
+
+// deleteKeys deletes the keys in the bucket. The keys are collected before
+// deleting them since deleting with a cursor skips the next key.
+func deleteKeys(b *bolt.Bucket, keys [][]byte) error {
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// boltMessage decodes the message in the value.
+func boltMessage(v []byte) (Message, error) {
+	var m Message
+	if err := json.Unmarshal(v, &m); err != nil {
+		return Message{}, err
+	}
+	return m, nil
+}
+
+func (s *boltStore) Get(ctx context.Context, room string) ([]Message, error) {
+	var messages []Message
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		b, err := s.room(tx, room)
+		if err != nil || b == nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			m, err := boltMessage(v)
+			if err != nil {
+				return err
+			}
+			messages = append(messages, m)
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+func (s *boltStore) Append(ctx context.Context, room string, message Message) (int64, error) {
+	ids, err := s.AppendMulti(ctx, room, []Message{message})
+	if err != nil {
+		return 0, err
+	}
+	return ids[0], nil
+}
+
+func (s *boltStore) AppendMulti(ctx context.Context, room string, messages []Message) ([]int64, error) {
+	var ids []int64
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := s.room(tx, room)
+		if err != nil {
+			return err
+		}
+		ids = make([]int64, len(messages))
+		for i, m := range messages {
+			seq, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			m.ID = int64(seq)
+			v, err := json.Marshal(&m)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(boltKey(m.ID), v); err != nil {
+				return err
+			}
+			ids[i] = m.ID
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// Trim does nothing. The file keeps the whole history for paging, search and
+// export, and old messages are removed by Purge and Remove.
+func (s *boltStore) Trim(ctx context.Context, room string, n int) error {
+	return nil
+}
+
+func (s *boltStore) History(ctx context.Context, room string, before int64, limit int) ([]Message, error) {
+	var messages []Message
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		b, err := s.room(tx, room)
+		if err != nil || b == nil {
+			return err
+		}
+		c := b.Cursor()
+		var k, v []byte
+		if before > 0 {
+			// Seek moves to the message of the ID or the next one, which is
+			// not included.
+			k, v = c.Seek(boltKey(before))
+			if k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
+			}
+		} else {
+			k, v = c.Last()
+		}
+		for ; k != nil && len(messages) < limit; k, v = c.Prev() {
+			m, err := boltMessage(v)
+			if err != nil {
+				return err
+			}
+			messages = append(messages, m)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+func (s *boltStore) Purge(ctx context.Context, room string, before time.Time) (int, error) {
+	n := 0
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := s.room(tx, room)
+		if err != nil {
+			return err
+		}
+		// The IDs increase in the posted order, so the old messages come
+		// first.
+		var keys [][]byte
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			m, err := boltMessage(v)
+			if err != nil {
+				return err
+			}
+			if !m.CreatedAt.Before(before) {
+				break
+			}
+			keys = append(keys, k)
+		}
+		n = len(keys)
+		return deleteKeys(b, keys)
+	}); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (s *boltStore) Remove(ctx context.Context, room string, ids []int64) (int, error) {
+	n := 0
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := s.room(tx, room)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if b.Get(boltKey(id)) == nil {
+				continue
+			}
+			if err := b.Delete(boltKey(id)); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (s *boltStore) Update(ctx context.Context, room string, id int64, f func(*Message)) (Message, error) {
+	var m Message
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := s.room(tx, room)
+		if err != nil {
+			return err
+		}
+		v := b.Get(boltKey(id))
+		if v == nil {
+			return ErrNotFound
+		}
+		m, err = boltMessage(v)
+		if err != nil {
+			return err
+		}
+		f(&m)
+		v, err = json.Marshal(&m)
+		if err != nil {
+			return err
+		}
+		return b.Put(boltKey(id), v)
+	}); err != nil {
+		return Message{}, err
+	}
+	return m, nil
+}
+
+// boltKVItem is a value in the kv bucket. Values are stored as JSON.
+type boltKVItem struct {
+	Data      json.RawMessage `json:"data"`
+	ExpiresAt time.Time       `json:"expires_at,omitempty"`
+}
+
+// boltKV is a KV on a Bolt database file. The expired values are ignored on
+// read, and replaced on write.
+type boltKV struct {
+	db *bolt.DB
+}
+
+// NewBoltKV returns a KV that keeps values in the Bolt database.
+func NewBoltKV(db *bolt.DB) (KV, error) {
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltKVBucket)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return &boltKV{db: db}, nil
+}
+
+func (kv *boltKV) get(tx *bolt.Tx, key string, v interface{}) error {
+	b := tx.Bucket(boltKVBucket).Get([]byte(key))
+	if b == nil {
+		return ErrNotFound
+	}
+	var item boltKVItem
+	if err := json.Unmarshal(b, &item); err != nil {
+		return err
+	}
+	if !item.ExpiresAt.IsZero() && !time.Now().Before(item.ExpiresAt) {
+		return ErrNotFound
+	}
+	return json.Unmarshal(item.Data, v)
+}
+
+func (kv *boltKV) set(tx *bolt.Tx, key string, v interface{}, expiration time.Duration) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	item := boltKVItem{
+		Data: data,
+	}
+	if expiration > 0 {
+		item.ExpiresAt = time.Now().Add(expiration)
+	}
+	b, err := json.Marshal(&item)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(boltKVBucket).Put([]byte(key), b)
+}
+
+func (kv *boltKV) Get(ctx context.Context, key string, v interface{}) error {
+	return kv.db.View(func(tx *bolt.Tx) error {
+		return kv.get(tx, key, v)
+	})
+}
+
+func (kv *boltKV) Set(ctx context.Context, key string, v interface{}, expiration time.Duration) error {
+	return kv.db.Update(func(tx *bolt.Tx) error {
+		return kv.set(tx, key, v, expiration)
+	})
+}
+
+func (kv *boltKV) Update(ctx context.Context, key string, v interface{}, expiration time.Duration, f func() error) error {
+	return kv.db.Update(func(tx *bolt.Tx) error {
+		resetValue(v)
+		if err := kv.get(tx, key, v); err != nil && err != ErrNotFound {
+			return err
+		}
+		if err := f(); err != nil {
+			return err
+		}
+		return kv.set(tx, key, v, expiration)
+	})
+}
+
+func (kv *boltKV) Delete(ctx context.Context, key string) error {
+	return kv.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltKVBucket).Delete([]byte(key))
+	})
+}
+
+// CompactBolt rewrites the Bolt database file at the path without the space
+// of the removed messages and values, and removes the expired values. The
+// file must not be open.
+func CompactBolt(path string) error {
+	src, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	tmp := path + ".compact"
+	if err := compactBolt(tmp, src); err != nil {
+		src.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := src.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// compactBolt copies src to a new file at the path without the removed and
+// expired data.
+func compactBolt(path string, src *bolt.DB) error {
+	dst, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return err
+	}
+	if err := bolt.Compact(dst, src, boltCompactTxSize); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := removeExpiredBolt(dst); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// removeExpiredBolt removes the expired values in the kv bucket.
+func removeExpiredBolt(db *bolt.DB) error {
+	now := time.Now()
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltKVBucket)
+		if b == nil {
+			return nil
+		}
+		var keys [][]byte
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var item boltKVItem
+			if err := json.Unmarshal(v, &item); err != nil {
+				return err
+			}
+			if !item.ExpiresAt.IsZero() && !now.Before(item.ExpiresAt) {
+				keys = append(keys, k)
+			}
+		}
+		return deleteKeys(b, keys)
+	})
+}
@@ -0,0 +1,275 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const botsKey = "bots"
+
+// Bot is a poster authenticated by an API key instead of a session.
+type Bot struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+
+	// Key is the API key. Key is shown only when the bot is created.
+	Key string `json:"key,omitempty"`
+
+	// KeyHash is the SHA-256 hash of the API key. Only the hash is stored.
+	KeyHash string `json:"key_hash,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func hashAPIKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+func (s *server) bots(ctx context.Context) ([]Bot, error) {
+	var bots []Bot
+	if err := s.db.Get(ctx, botsKey, &bots); err != nil && err != ErrNotFound {
+		return nil, err
+	}
+	return bots, nil
+}
+
+// botByKey returns the bot with the API key, or nil if there is no such bot.
+func (s *server) botByKey(ctx context.Context, key string) (*Bot, error) {
+	if key == "" {
+		return nil, nil
+	}
+	bots, err := s.bots(ctx)
+	if err != nil {
+		return nil, err
+	}
+	hash := hashAPIKey(key)
+	for _, b := range bots {
+		if subtle.ConstantTimeCompare([]byte(b.KeyHash), []byte(hash)) == 1 {
+			return &b, nil
+		}
+	}
+	return nil, nil
+}
+
+// postBotMessage handles POST /api/messages, which posts a message as the bot
+// of the API key.
+func (s *server) postBotMessage(ctx context.Context, w http.ResponseWriter, r *http.Request, room string) {
+	bot, err := s.botByKey(ctx, bearerToken(r))
+	if err != nil {
+		msg := fmt.Sprintf("Bot error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	if bot == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="chatserver"`)
+		code := http.StatusUnauthorized
+		writeError(w, r, code, http.StatusText(code))
+		return
+	}
+
+	if !s.checkRoomOpen(ctx, w, r, room) {
+		return
+	}
+
+	wait, err := s.takeToken(ctx, "bot:"+bot.ID, s.botRateLimit)
+	if err != nil {
+		msg := fmt.Sprintf("Rate limit error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	if wait > 0 {
+		writeTooManyRequests(w, r, wait)
+		return
+	}
+
+	var req Message
+	if !decodeBody(w, r, &req, int64(s.config.MaxContentSize)) {
+		return
+	}
+
+	message := Message{
+		Name:      bot.Name,
+		Body:      req.Body,
+		Bot:       true,
+		DeliverAt: req.DeliverAt,
+
+		TTLSeconds: req.TTLSeconds,
+	}
+	if err := s.runCommand(ctx, room, &message); err != nil {
+		if verr, ok := err.(*ValidationError); ok {
+			writeValidationError(w, r, verr)
+			return
+		}
+		msg := fmt.Sprintf("Command error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	if err := message.Validate(&s.config); err != nil {
+		writeValidationError(w, r, err)
+		return
+	}
+	message.Mentions = parseMentions(message.Body)
+	message.Preview = s.linkPreview(ctx, message.Body)
+	message.CreatedAt = time.Now()
+
+	if message.DeliverAt != nil {
+		s.scheduleMessage(ctx, w, r, room, message)
+		return
+	}
+	if err := s.storeMessage(ctx, room, &message); err != nil {
+		if err == errQueued {
+			writeBody(w, r, http.StatusAccepted, &PostResponse{
+				Message: message,
+				Queued:  true,
+			})
+			return
+		}
+		msg := fmt.Sprintf("Could not store the request body: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+
+	token, err := s.issueEditToken(ctx, room, message.ID)
+	if err != nil {
+		msg := fmt.Sprintf("Edit token error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	writeBody(w, r, http.StatusCreated, &PostResponse{
+		Message:   message,
+		EditToken: token,
+	})
+}
+
+// handleBots handles /admin/bots and /admin/bots/{id}.
+func (s *server) handleBots(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/bots"), "/")
+
+	switch {
+	case id == "" && isGet(r):
+		bots, err := s.bots(ctx)
+		if err != nil {
+			msg := fmt.Sprintf("Bot error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		result := []Bot{}
+		for _, b := range bots {
+			b.KeyHash = ""
+			result = append(result, b)
+		}
+		writeJSON(w, http.StatusOK, result)
+
+	case id == "" && r.Method == http.MethodPost:
+		var req struct {
+			Name string `json:"name"`
+		}
+		if !decodeJSON(w, r, &req, maxAdminContentSize) {
+			return
+		}
+		if f := validateField("name", &req.Name, s.config.MaxNameLength); f != nil {
+			writeValidationError(w, r, &ValidationError{
+				Errors: []FieldError{*f},
+			})
+			return
+		}
+
+		botID, err := newID()
+		if err != nil {
+			msg := fmt.Sprintf("Bot error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		b := make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, b); err != nil {
+			msg := fmt.Sprintf("Bot error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		key := base64.RawURLEncoding.EncodeToString(b)
+		bot := Bot{
+			ID:        botID,
+			Name:      req.Name,
+			KeyHash:   hashAPIKey(key),
+			CreatedAt: time.Now(),
+		}
+
+		var bots []Bot
+		if err := s.db.Update(ctx, botsKey, &bots, 0, func() error {
+			bots = append(bots, bot)
+			return nil
+		}); err != nil {
+			msg := fmt.Sprintf("Bot error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		bot.KeyHash = ""
+		s.audit(ctx, r, "bot.create", "", bot.ID, nil, &bot)
+		bot.Key = key
+		writeJSON(w, http.StatusCreated, &bot)
+
+	case id != "" && r.Method == http.MethodDelete:
+		var bots []Bot
+		var removed Bot
+		if err := s.db.Update(ctx, botsKey, &bots, 0, func() error {
+			found := false
+			rest := []Bot{}
+			for _, b := range bots {
+				if b.ID == id {
+					found = true
+					removed = b
+					continue
+				}
+				rest = append(rest, b)
+			}
+			if !found {
+				return ErrNotFound
+			}
+			bots = rest
+			return nil
+		}); err != nil {
+			if err == ErrNotFound {
+				notFound(w, r)
+				return
+			}
+			msg := fmt.Sprintf("Bot error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		removed.KeyHash = ""
+		s.audit(ctx, r, "bot.delete", "", id, &removed, nil)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		if id == "" {
+			w.Header().Set("Allow", "GET, HEAD, POST")
+		} else {
+			w.Header().Set("Allow", "DELETE")
+		}
+		methodNotAllowed(w, r)
+	}
+}
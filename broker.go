@@ -0,0 +1,99 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log"
+	"time"
+)
+
+const (
+	// brokerMinRetryInterval is the duration to wait before subscribing to
+	// the broker again after the first failure. The duration doubles on each
+	// failure up to brokerMaxRetryInterval.
+	brokerMinRetryInterval = time.Second
+	brokerMaxRetryInterval = time.Minute
+)
+
+// Broker relays posted messages between server instances so that clients
+// connected to any instance receive them.
+type Broker interface {
+	// Publish sends the message in the room to the other instances.
+	Publish(ctx context.Context, room string, message Message) error
+
+	// Subscribe calls f for each message published by the other instances.
+	// Subscribe blocks until an error occurs.
+	Subscribe(ctx context.Context, f func(room string, message Message)) error
+}
+
+// newOrigin returns a random ID to tell the messages published by this
+// instance.
+func newOrigin() string {
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// broadcast delivers the message to the subscribers of the room in this
+// instance, and publishes it to the other instances if there is a broker.
+func (s *server) broadcast(ctx context.Context, room string, message Message) {
+	if !message.Typing {
+		messages := []Message{message}
+		s.joinProfiles(ctx, messages)
+		message = messages[0]
+	}
+	s.hub.broadcast(room, message)
+	if s.broker == nil {
+		return
+	}
+	if err := s.broker.Publish(ctx, room, message); err != nil {
+		log.Printf("Broker error: %v", err)
+	}
+}
+
+// relay delivers the messages from the broker to the hub until ctx is done.
+func (s *server) relay(ctx context.Context) {
+	wait := brokerMinRetryInterval
+	for {
+		start := time.Now()
+		err := s.broker.Subscribe(ctx, s.hub.broadcast)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Broker error: %v", err)
+
+		// The subscription that lasted for a while is retried soon.
+		if time.Since(start) > brokerMaxRetryInterval {
+			wait = brokerMinRetryInterval
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return
+		}
+		wait *= 2
+		if wait > brokerMaxRetryInterval {
+			wait = brokerMaxRetryInterval
+		}
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+// captchaTTL is how long a challenge can be answered.
+const captchaTTL = 10 * time.Minute
+
+// Captcha is an arithmetic challenge to answer before posting.
+type Captcha struct {
+	ID       string `json:"id"`
+	Question string `json:"question"`
+}
+
+// CaptchaAnswer is the request body of POST /captcha.
+type CaptchaAnswer struct {
+	ID     string `json:"id"`
+	Answer int    `json:"answer"`
+}
+
+func captchaKey(id string) string {
+	return "captcha:" + id
+}
+
+func captchaSessionKey(sessionID string) string {
+	return "captcha:session:" + sessionID
+}
+
+// randomDigit returns a random number in [1, 9].
+func randomDigit() (int, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(9))
+	if err != nil {
+		return 0, err
+	}
+	return int(n.Int64()) + 1, nil
+}
+
+// newCaptcha returns a new challenge and its answer.
+func newCaptcha() (*Captcha, int, error) {
+	id, err := newID()
+	if err != nil {
+		return nil, 0, err
+	}
+	a, err := randomDigit()
+	if err != nil {
+		return nil, 0, err
+	}
+	b, err := randomDigit()
+	if err != nil {
+		return nil, 0, err
+	}
+	return &Captcha{
+		ID:       id,
+		Question: fmt.Sprintf("%d + %d", a, b),
+	}, a + b, nil
+}
+
+// captchaSolved reports whether the session has answered a challenge.
+func (s *server) captchaSolved(ctx context.Context, sessionID string) (bool, error) {
+	var solved bool
+	if err := s.db.Get(ctx, captchaSessionKey(sessionID), &solved); err != nil {
+		if err == ErrNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return solved, nil
+}
+
+// checkCaptcha reports whether the client can post. With captcha in the
+// configuration, a session must answer a challenge before the first post.
+// Signed-in users don't need to. If the client can't post, checkCaptcha
+// writes 403 Forbidden with the code captcha_required.
+func (s *server) checkCaptcha(ctx context.Context, w http.ResponseWriter, r *http.Request) bool {
+	if !s.config.Captcha || s.userName(ctx) != "" {
+		return true
+	}
+	solved, err := s.captchaSolved(ctx, sessionID(ctx))
+	if err != nil {
+		msg := fmt.Sprintf("CAPTCHA error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return false
+	}
+	if !solved {
+		msg := "Answer the challenge at /captcha before posting"
+		writeErrorCode(w, r, http.StatusForbidden, "captcha_required", msg)
+		return false
+	}
+	return true
+}
+
+// handleCaptcha handles GET /captcha, which returns a new challenge, and
+// POST /captcha, which answers it. Each challenge can be answered once.
+func (s *server) handleCaptcha(ctx context.Context, w http.ResponseWriter, r *http.Request, room string) {
+	noStore(w)
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		c, answer, err := newCaptcha()
+		if err != nil {
+			msg := fmt.Sprintf("CAPTCHA error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		if err := s.cache.Set(ctx, captchaKey(c.ID), answer, captchaTTL); err != nil {
+			msg := fmt.Sprintf("CAPTCHA error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		writeJSON(w, http.StatusOK, c)
+	case http.MethodPost:
+		var req CaptchaAnswer
+		if !decodeJSON(w, r, &req, int64(s.config.MaxContentSize)) {
+			return
+		}
+		var answer int
+		if err := s.cache.Get(ctx, captchaKey(req.ID), &answer); err != nil {
+			if err == ErrNotFound {
+				writeValidationError(w, r, &ValidationError{
+					Errors: []FieldError{newFieldError("id", "is expired")},
+				})
+				return
+			}
+			msg := fmt.Sprintf("CAPTCHA error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		// The challenge is removed so that it can't be guessed many times.
+		if err := s.cache.Delete(ctx, captchaKey(req.ID)); err != nil {
+			msg := fmt.Sprintf("CAPTCHA error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		if req.Answer != answer {
+			writeValidationError(w, r, &ValidationError{
+				Errors: []FieldError{newFieldError("answer", "is wrong")},
+			})
+			return
+		}
+		if err := s.db.Set(ctx, captchaSessionKey(sessionID(ctx)), true, sessionMaxAge); err != nil {
+			msg := fmt.Sprintf("CAPTCHA error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,385 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package client is a client of the chat server's HTTP and WebSocket API.
+//
+//	c := client.New("https://chat.example.com")
+//	res, err := c.PostMessage(ctx, client.Message{Name: "gopher", Body: "Hello"})
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultMaxRetries is the default number of retries of a failed
+	// request.
+	DefaultMaxRetries = 3
+
+	// retryInterval is the first interval of retries. The interval is
+	// doubled for each retry.
+	retryInterval = 500 * time.Millisecond
+
+	// maxRetryInterval is the maximum interval of retries including the
+	// Retry-After header.
+	maxRetryInterval = 30 * time.Second
+)
+
+// Message is a message in a room.
+type Message struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+	Deleted   bool      `json:"deleted,omitempty"`
+	Edited    bool      `json:"edited"`
+	Flagged   bool      `json:"flagged,omitempty"`
+	SessionID string    `json:"session_id,omitempty"`
+	Mentions  []string  `json:"mentions,omitempty"`
+	Pinned    bool      `json:"pinned,omitempty"`
+	Poll      *Poll     `json:"poll,omitempty"`
+	Action    bool      `json:"action,omitempty"`
+	Bot       bool      `json:"bot,omitempty"`
+	Source    string    `json:"source,omitempty"`
+}
+
+// Poll is an audience poll in a message.
+type Poll struct {
+	Options []PollOption `json:"options"`
+}
+
+// PollOption is an option of a poll with the number of votes.
+type PollOption struct {
+	Text  string `json:"text"`
+	Votes int    `json:"votes"`
+}
+
+// PostResponse is a posted message.
+type PostResponse struct {
+	Message
+
+	// EditToken is the token to edit the message.
+	EditToken string `json:"edit_token"`
+
+	// Queued is true if the message is queued to be stored later. A queued
+	// message has neither an ID nor an edit token.
+	Queued bool `json:"queued,omitempty"`
+}
+
+// ListOptions is the options of ListMessages.
+type ListOptions struct {
+	// Before is the ID to list the older messages than. The latest
+	// messages are listed if Before is 0.
+	Before int64
+
+	// Limit is the maximum number of the messages. The server's default is
+	// used if Limit is 0.
+	Limit int
+}
+
+// MessageList is a list of messages.
+type MessageList struct {
+	// Messages are in the posted order.
+	Messages []Message `json:"messages"`
+	Pinned   []Message `json:"pinned,omitempty"`
+
+	// Next is the URL of the older messages, or empty if there are no
+	// older messages.
+	Next string `json:"next,omitempty"`
+
+	// Stale is true if the messages might be out of date.
+	Stale bool `json:"stale,omitempty"`
+
+	// Revision is the revision of the messages in the room.
+	Revision int64 `json:"revision"`
+}
+
+// Error is an error response of the server.
+type Error struct {
+	StatusCode int `json:"-"`
+
+	// Code is a stable machine-readable code like "not_found".
+	Code    string       `json:"code"`
+	Message string       `json:"message"`
+	Fields  []FieldError `json:"fields,omitempty"`
+
+	// RetryAfter is the duration to wait before retrying, if the server
+	// asks.
+	RetryAfter time.Duration `json:"-"`
+}
+
+// FieldError is an invalid field of a request.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	msg := e.Message
+	if len(e.Fields) > 0 {
+		var fields []string
+		for _, f := range e.Fields {
+			fields = append(fields, f.Field+" "+f.Message)
+		}
+		msg += ": " + strings.Join(fields, ", ")
+	}
+	return fmt.Sprintf("client: %s (status %d, code %s)", msg, e.StatusCode, e.Code)
+}
+
+// Client is a client of a chat server.
+type Client struct {
+	// URL is the URL of the server like "https://chat.example.com".
+	URL string
+
+	// Room is the room. The default room is used if Room is empty.
+	Room string
+
+	// APIKey is the API key of a bot. If APIKey is set, messages are posted
+	// as the bot.
+	APIKey string
+
+	// HTTPClient is the HTTP client. http.DefaultClient is used if
+	// HTTPClient is nil.
+	HTTPClient *http.Client
+
+	// MaxRetries is the number of retries of a failed request. Requests
+	// are retried on network errors and 429, 502, 503 and 504 responses
+	// unless retrying might post a message twice.
+	MaxRetries int
+}
+
+// New returns a client of the server at the URL.
+func New(url string) *Client {
+	return &Client{
+		URL:        strings.TrimSuffix(url, "/"),
+		MaxRetries: DefaultMaxRetries,
+	}
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// roomURL returns the URL of the path in the room of the versioned API.
+func (c *Client) roomURL(path string) string {
+	u := strings.TrimSuffix(c.URL, "/") + "/v1"
+	if c.Room != "" {
+		u += "/rooms/" + url.PathEscape(c.Room)
+	}
+	return u + path
+}
+
+// request is a request to the server.
+type request struct {
+	method string
+	url    string
+	header http.Header
+	body   interface{}
+
+	// idempotent is true if the request can be retried on network errors.
+	idempotent bool
+}
+
+// do sends the request, and decodes the JSON response into v. The request is
+// retried with exponential backoff.
+func (c *Client) do(ctx context.Context, req *request, v interface{}) error {
+	var body []byte
+	if req.body != nil {
+		b, err := json.Marshal(req.body)
+		if err != nil {
+			return err
+		}
+		body = b
+	}
+
+	interval := retryInterval
+	for i := 0; ; i++ {
+		wait, err := c.send(ctx, req, body, v)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if i >= c.MaxRetries || !retryable(req, err) {
+			return err
+		}
+		if wait < interval {
+			wait = interval
+		}
+		if wait > maxRetryInterval {
+			wait = maxRetryInterval
+		}
+		if err := sleep(ctx, wait); err != nil {
+			return err
+		}
+		interval *= 2
+	}
+}
+
+// retryable reports whether the request can be retried after the error.
+// 429 and 503 responses are retried for any request since the server has not
+// processed the request.
+func retryable(req *request, err error) bool {
+	e, ok := err.(*Error)
+	if !ok {
+		return req.idempotent
+	}
+	switch e.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return true
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return req.idempotent
+	}
+	return false
+}
+
+// send sends the request once. If the server asks to wait, send returns the
+// duration to wait with the error.
+func (c *Client) send(ctx context.Context, req *request, body []byte, v interface{}) (time.Duration, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	hreq, err := http.NewRequest(req.method, req.url, r)
+	if err != nil {
+		return 0, err
+	}
+	for k, vs := range req.header {
+		hreq.Header[k] = vs
+	}
+	hreq.Header.Set("Accept", "application/json")
+	if body != nil {
+		hreq.Header.Set("Content-Type", "application/json")
+	}
+	res, err := c.httpClient().Do(hreq.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 400 {
+		e := &Error{
+			StatusCode: res.StatusCode,
+			Message:    http.StatusText(res.StatusCode),
+		}
+		var errRes struct {
+			Error *Error `json:"error"`
+		}
+		errRes.Error = e
+		b, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1<<16))
+		json.Unmarshal(b, &errRes)
+		if sec, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil {
+			e.RetryAfter = time.Duration(sec) * time.Second
+		}
+		return e.RetryAfter, e
+	}
+	if v == nil {
+		return 0, nil
+	}
+	return 0, json.NewDecoder(res.Body).Decode(v)
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func newIdempotencyKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// PostMessage posts the message. Only Name and Body are used, and Name is
+// ignored for a bot. The message is posted with an Idempotency-Key header, so
+// that it is posted only once even if it is retried.
+func (c *Client) PostMessage(ctx context.Context, m Message) (*PostResponse, error) {
+	req := &request{
+		method: http.MethodPost,
+		url:    c.roomURL("/messages"),
+		header: http.Header{},
+		body: map[string]string{
+			"name": m.Name,
+			"body": m.Body,
+		},
+	}
+	if c.APIKey != "" {
+		// The bot API doesn't support Idempotency-Key.
+		req.url = c.roomURL("/api/messages")
+		req.header.Set("Authorization", "Bearer "+c.APIKey)
+	} else {
+		key, err := newIdempotencyKey()
+		if err != nil {
+			return nil, err
+		}
+		req.header.Set("Idempotency-Key", key)
+		req.idempotent = true
+	}
+
+	var res PostResponse
+	if err := c.do(ctx, req, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// ListMessages lists the latest messages in the room, or the older ones if
+// opts.Before is set. opts can be nil.
+func (c *Client) ListMessages(ctx context.Context, opts *ListOptions) (*MessageList, error) {
+	q := url.Values{}
+	if opts != nil && opts.Before > 0 {
+		q.Set("before", strconv.FormatInt(opts.Before, 10))
+	}
+	if opts != nil && opts.Limit > 0 {
+		q.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	u := c.roomURL("/api/messages")
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+
+	var res MessageList
+	if err := c.do(ctx, &request{
+		method:     http.MethodGet,
+		url:        u,
+		idempotent: true,
+	}, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
@@ -0,0 +1,161 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// dialTimeout is the timeout to connect to the WebSocket API.
+const dialTimeout = 10 * time.Second
+
+// streamMessage is a message sent over WebSocket.
+type streamMessage struct {
+	Message
+	Typing bool `json:"typing,omitempty"`
+}
+
+// webSocketConfig returns the config of the WebSocket API of the room.
+func (c *Client) webSocketConfig() (*websocket.Config, error) {
+	u, err := url.Parse(strings.TrimSuffix(c.URL, "/") + "/ws")
+	if err != nil {
+		return nil, err
+	}
+	origin := *u
+	origin.Path = ""
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	default:
+		return nil, errors.New("client: the URL must be http or https")
+	}
+	if c.Room != "" {
+		u.RawQuery = url.Values{"room": {c.Room}}.Encode()
+	}
+	config, err := websocket.NewConfig(u.String(), origin.String())
+	if err != nil {
+		return nil, err
+	}
+	config.Dialer = &net.Dialer{Timeout: dialTimeout}
+	return config, nil
+}
+
+// dial connects to the WebSocket API. The connection is closed when ctx is
+// done.
+func (c *Client) dial(ctx context.Context, config *websocket.Config) (*websocket.Conn, error) {
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		<-ctx.Done()
+		ws.Close()
+	}()
+	return ws, nil
+}
+
+// Stream returns a channel of the new messages in the room over WebSocket.
+// A changed message, like an edited or a deleted one, is sent again with the
+// same ID. If the connection is lost, Stream reconnects with exponential
+// backoff, and sends the messages posted in the meantime. The channel is
+// closed when ctx is done.
+func (c *Client) Stream(ctx context.Context) (<-chan Message, error) {
+	config, err := c.webSocketConfig()
+	if err != nil {
+		return nil, err
+	}
+	connCtx, cancel := context.WithCancel(ctx)
+	ws, err := c.dial(connCtx, config)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	ch := make(chan Message)
+	go func() {
+		defer close(ch)
+		var last int64
+		interval := retryInterval
+		for {
+			for {
+				var m streamMessage
+				if err := websocket.JSON.Receive(ws, &m); err != nil {
+					break
+				}
+				if m.Typing {
+					continue
+				}
+				if m.ID > last {
+					last = m.ID
+				}
+				select {
+				case ch <- m.Message:
+				case <-ctx.Done():
+					cancel()
+					return
+				}
+				interval = retryInterval
+			}
+			cancel()
+
+			// Reconnect, and catch up with the messages posted while
+			// disconnected.
+			for {
+				if err := sleep(ctx, interval); err != nil {
+					return
+				}
+				if interval *= 2; interval > maxRetryInterval {
+					interval = maxRetryInterval
+				}
+				connCtx, cancel = context.WithCancel(ctx)
+				ws, err = c.dial(connCtx, config)
+				if err != nil {
+					cancel()
+					continue
+				}
+				break
+			}
+			if last == 0 {
+				continue
+			}
+			list, err := c.ListMessages(ctx, nil)
+			if err != nil {
+				continue
+			}
+			for _, m := range list.Messages {
+				if m.ID <= last {
+					continue
+				}
+				last = m.ID
+				select {
+				case ch <- m:
+				case <-ctx.Done():
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	return ch, nil
+}
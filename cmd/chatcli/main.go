@@ -0,0 +1,161 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command chatcli is a command line client of the chat server.
+//
+//	chatcli tail -url=https://chat.example.com
+//	chatcli post -url=https://chat.example.com -name=gopher -body=Hello
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/golangtokyo/chatserver/client"
+)
+
+const usage = `Usage: chatcli <command> [flags]
+
+Commands:
+  tail    Show the latest messages, and the new ones as they are posted
+  post    Post a message
+
+Run 'chatcli <command> -h' for the flags.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	go func() {
+		<-sig
+		cancel()
+	}()
+
+	var err error
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "tail":
+		err = tail(ctx, args)
+	case "post":
+		err = post(ctx, args)
+	case "-h", "-help", "--help", "help":
+		fmt.Fprint(os.Stdout, usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "chatcli: unknown command: %q\n\n%s", cmd, usage)
+		os.Exit(2)
+	}
+	if err != nil && err != context.Canceled {
+		fmt.Fprintf(os.Stderr, "chatcli: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// newFlagSet returns a flag set with the flags common to the commands.
+func newFlagSet(name string) (*flag.FlagSet, *client.Client) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	c := client.New("")
+	url := os.Getenv("CHAT_URL")
+	if url == "" {
+		url = "http://localhost:8080"
+	}
+	fs.StringVar(&c.URL, "url", url, "URL of the chat server (default: $CHAT_URL)")
+	fs.StringVar(&c.Room, "room", "", "room (default: the default room)")
+	fs.StringVar(&c.APIKey, "key", os.Getenv("CHAT_API_KEY"), "API key to post as a bot (default: $CHAT_API_KEY)")
+	return fs, c
+}
+
+func tail(ctx context.Context, args []string) error {
+	fs, c := newFlagSet("tail")
+	n := fs.Int("n", 20, "number of the latest messages to show first")
+	fs.Parse(args)
+
+	// Start streaming first so that no messages are missed.
+	ch, err := c.Stream(ctx)
+	if err != nil {
+		return err
+	}
+	var last int64
+	if *n > 0 {
+		list, err := c.ListMessages(ctx, &client.ListOptions{Limit: *n})
+		if err != nil {
+			return err
+		}
+		for _, m := range list.Messages {
+			printMessage(m)
+			last = m.ID
+		}
+	}
+	for m := range ch {
+		// Skip the messages already shown unless they are changed.
+		if m.ID <= last && !m.Edited && !m.Deleted {
+			continue
+		}
+		printMessage(m)
+	}
+	return ctx.Err()
+}
+
+func printMessage(m client.Message) {
+	t := m.CreatedAt.Local().Format("15:04:05")
+	switch {
+	case m.Deleted:
+		fmt.Printf("%s [deleted #%d]\n", t, m.ID)
+	case m.Action:
+		fmt.Printf("%s * %s %s\n", t, m.Name, m.Body)
+	case m.Edited:
+		fmt.Printf("%s %s: %s (edited #%d)\n", t, m.Name, m.Body, m.ID)
+	default:
+		fmt.Printf("%s %s: %s\n", t, m.Name, m.Body)
+	}
+}
+
+func post(ctx context.Context, args []string) error {
+	fs, c := newFlagSet("post")
+	name := fs.String("name", os.Getenv("USER"), "name of the poster, ignored for a bot")
+	body := fs.String("body", "", "body of the message (default: the standard input)")
+	fs.Parse(args)
+
+	if *body == "" {
+		b, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		*body = strings.TrimSpace(string(b))
+	}
+	res, err := c.PostMessage(ctx, client.Message{
+		Name: *name,
+		Body: *body,
+	})
+	if err != nil {
+		return err
+	}
+	if res.Queued {
+		fmt.Println("Queued")
+		return nil
+	}
+	fmt.Printf("Posted #%d\n", res.ID)
+	return nil
+}
@@ -0,0 +1,40 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build firestore
+
+package main
+
+import (
+	"context"
+
+	"cloud.google.com/go/firestore"
+	"github.com/golangtokyo/chatserver"
+)
+
+func init() {
+	stores["firestore"] = storeOpener{
+		defaultDSN: firestore.DetectProjectID,
+		open:       openFirestore,
+	}
+}
+
+// openFirestore opens Firestore of the Google Cloud project.
+func openFirestore(project string) (chatserver.Store, chatserver.KV, error) {
+	client, err := firestore.NewClient(context.Background(), project)
+	if err != nil {
+		return nil, nil, err
+	}
+	return chatserver.NewFirestoreStore(client), chatserver.NewFirestoreKV(client), nil
+}
@@ -0,0 +1,156 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command chatserver runs the chat server on a plain net/http server, outside
+// App Engine.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	"github.com/golangtokyo/chatserver"
+	"github.com/gomodule/redigo/redis"
+	_ "github.com/lib/pq"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	flagAddr   = flag.String("addr", "", "address to listen on (addr in the config or :$PORT if empty)")
+	flagStore  = flag.String("store", "", "message store: memory, bolt, redis, postgres, sqlite with -tags sqlite or firestore with -tags firestore (store in the config if empty)")
+	flagDSN    = flag.String("dsn", "", "where the store is, like the file path or the connection string (dsn in the config if empty)")
+	flagConfig = flag.String("config", "", "path to the YAML config file")
+	flagGRPC   = flag.String("grpc-addr", "", "address to serve the gRPC API on (grpc_addr in the config if empty)")
+)
+
+// storeOpener opens the message store and the KV at the DSN.
+type storeOpener struct {
+	// defaultDSN is used when the DSN is empty.
+	defaultDSN string
+	open       func(dsn string) (chatserver.Store, chatserver.KV, error)
+}
+
+// stores are the stores by the names. The stores that need cgo or large
+// clients are added by the files with their build tags.
+var stores = map[string]storeOpener{
+	"memory": {
+		open: func(dsn string) (chatserver.Store, chatserver.KV, error) {
+			return chatserver.NewMemoryStore(), chatserver.NewMemoryKV(), nil
+		},
+	},
+	"bolt": {
+		defaultDSN: "chatserver.bolt",
+		open:       openBolt,
+	},
+	"redis": {
+		defaultDSN: "localhost:6379",
+		open:       openRedis,
+	},
+	"postgres": {
+		open: openPostgres,
+	},
+}
+
+// openBolt compacts and opens the Bolt file at the path.
+func openBolt(path string) (chatserver.Store, chatserver.KV, error) {
+	if err := chatserver.CompactBolt(path); err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, nil, err
+	}
+	store, err := chatserver.NewBoltStore(db)
+	if err != nil {
+		return nil, nil, err
+	}
+	kv, err := chatserver.NewBoltKV(db)
+	if err != nil {
+		return nil, nil, err
+	}
+	return store, kv, nil
+}
+
+// openRedis connects to the Redis server at the address.
+func openRedis(addr string) (chatserver.Store, chatserver.KV, error) {
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr)
+		},
+		MaxIdle:     16,
+		IdleTimeout: 5 * time.Minute,
+	}
+	return chatserver.NewRedisStore(pool), chatserver.NewRedisKV(pool), nil
+}
+
+// openPostgres opens PostgreSQL at the connection string.
+func openPostgres(dsn string) (chatserver.Store, chatserver.KV, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, nil, err
+	}
+	store, err := chatserver.NewPostgresStore(db)
+	if err != nil {
+		return nil, nil, err
+	}
+	kv, err := chatserver.NewPostgresKV(db)
+	if err != nil {
+		return nil, nil, err
+	}
+	return store, kv, nil
+}
+
+func main() {
+	flag.Parse()
+
+	config, err := chatserver.LoadConfig(*flagConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *flagStore != "" {
+		config.StoreName = *flagStore
+	}
+	if *flagDSN != "" {
+		config.DSN = *flagDSN
+	}
+
+	s, ok := stores[config.StoreName]
+	if !ok {
+		log.Fatalf("unknown store: %q", config.StoreName)
+	}
+	dsn := config.DSN
+	if dsn == "" {
+		dsn = s.defaultDSN
+	}
+	store, kv, err := s.open(dsn)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *flagAddr != "" {
+		config.Addr = *flagAddr
+	}
+	if *flagGRPC != "" {
+		config.GRPCAddr = *flagGRPC
+	}
+	config.Store = store
+	config.KV = kv
+	if err := chatserver.Run(context.Background(), config); err != nil {
+		log.Fatal(err)
+	}
+}
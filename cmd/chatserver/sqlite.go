@@ -0,0 +1,50 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build sqlite
+
+package main
+
+import (
+	"database/sql"
+
+	"github.com/golangtokyo/chatserver"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func init() {
+	stores["sqlite"] = storeOpener{
+		defaultDSN: "chatserver.db",
+		open:       openSQLite,
+	}
+}
+
+// openSQLite opens the SQLite file at the path with one connection so that
+// the transactions don't fail with SQLITE_BUSY.
+func openSQLite(path string) (chatserver.Store, chatserver.KV, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, nil, err
+	}
+	db.SetMaxOpenConns(1)
+	store, err := chatserver.NewSQLiteStore(db)
+	if err != nil {
+		return nil, nil, err
+	}
+	kv, err := chatserver.NewSQLiteKV(db)
+	if err != nil {
+		return nil, nil, err
+	}
+	return store, kv, nil
+}
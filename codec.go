@@ -0,0 +1,290 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/golangtokyo/chatserver/chatpb"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// The media types of the request and response bodies. Bot clients and mobile
+// apps can use Protocol Buffers and MessagePack to cut the payload size.
+const (
+	mediaJSON     = "application/json"
+	mediaProtobuf = "application/x-protobuf"
+	mediaMsgpack  = "application/msgpack"
+)
+
+// mediaAliases is the other names of the media types.
+var mediaAliases = map[string]string{
+	"application/protobuf":  mediaProtobuf,
+	"application/x-msgpack": mediaMsgpack,
+}
+
+func normalizeMediaType(t string) string {
+	if a, ok := mediaAliases[t]; ok {
+		return a
+	}
+	return t
+}
+
+// requestMediaType returns the media type of the request body. JSON is
+// assumed for unknown types.
+func requestMediaType(r *http.Request) string {
+	t, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return mediaJSON
+	}
+	switch t = normalizeMediaType(t); t {
+	case mediaProtobuf, mediaMsgpack:
+		return t
+	}
+	return mediaJSON
+}
+
+// responseMediaType returns the media type of the response body that the
+// client prefers, or an empty string if the client prefers HTML.
+func responseMediaType(r *http.Request) string {
+	for _, t := range strings.Split(r.Header.Get("Accept"), ",") {
+		t = normalizeMediaType(strings.TrimSpace(strings.SplitN(t, ";", 2)[0]))
+		switch t {
+		case mediaJSON, mediaProtobuf, mediaMsgpack:
+			return t
+		case "text/html":
+			return ""
+		}
+	}
+	return ""
+}
+
+// protoUnmarshaler is implemented by the requests that can be decoded from
+// Protocol Buffers.
+type protoUnmarshaler interface {
+	unmarshalProto(b []byte) error
+}
+
+// protoMarshaler is implemented by the responses that can be encoded in
+// Protocol Buffers.
+type protoMarshaler interface {
+	toProto() proto.Message
+}
+
+// unmarshalProto decodes a chatpb.PostMessageRequest into the message. The
+// room in the request is ignored.
+func (m *Message) unmarshalProto(b []byte) error {
+	var req chatpb.PostMessageRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	m.Name = req.Name
+	m.Body = req.Body
+	return nil
+}
+
+// toProto returns the response as a chatpb.PostMessageResponse.
+func (res *PostResponse) toProto() proto.Message {
+	return &chatpb.PostMessageResponse{
+		Message:   messageToProto(&res.Message),
+		EditToken: res.EditToken,
+		Queued:    res.Queued,
+	}
+}
+
+// toProto returns the response as a chatpb.ListMessagesResponse.
+func (res *MessagesResponse) toProto() proto.Message {
+	pb := &chatpb.ListMessagesResponse{
+		NextBefore: nextBefore(res.Next),
+		Revision:   res.Revision,
+		Stale:      res.Stale,
+	}
+	for i := range res.Messages {
+		pb.Messages = append(pb.Messages, messageToProto(&res.Messages[i]))
+	}
+	for i := range res.Pinned {
+		pb.Pinned = append(pb.Pinned, messageToProto(&res.Pinned[i]))
+	}
+	return pb
+}
+
+func messageToProto(m *Message) *chatpb.Message {
+	pb := &chatpb.Message{
+		Id:        m.ID,
+		Name:      m.Name,
+		Body:      m.Body,
+		Deleted:   m.Deleted,
+		Edited:    m.Edited,
+		Flagged:   m.Flagged,
+		SessionId: m.SessionID,
+		Mentions:  m.Mentions,
+		Pinned:    m.Pinned,
+		Action:    m.Action,
+		Bot:       m.Bot,
+		Source:    m.Source,
+		Typing:    m.Typing,
+	}
+	if !m.CreatedAt.IsZero() {
+		pb.CreatedAt = timestamppb.New(m.CreatedAt)
+	}
+	if m.Poll != nil {
+		pb.Poll = &chatpb.Poll{}
+		for _, o := range m.Poll.Options {
+			pb.Poll.Options = append(pb.Poll.Options, &chatpb.PollOption{
+				Text:  o.Text,
+				Votes: int32(o.Votes),
+			})
+		}
+	}
+	return pb
+}
+
+// writeBodyTooLarge writes 413 Request Entity Too Large.
+func writeBodyTooLarge(w http.ResponseWriter, r *http.Request, limit int64) {
+	msg := translate(requestLanguage(r), "Request body is too big (must be up to %d bytes)", limit)
+	writeError(w, r, http.StatusRequestEntityTooLarge, msg)
+}
+
+// decodeBody decodes the request body up to limit bytes into v in the media
+// type of the request: JSON, Protocol Buffers or MessagePack. MessagePack
+// uses the same field names as JSON, and Protocol Buffers requires v to
+// implement protoUnmarshaler. If the body is invalid, decodeBody writes an
+// error response, and returns false.
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}, limit int64) bool {
+	t := requestMediaType(r)
+	if t == mediaJSON {
+		return decodeJSON(w, r, v, limit)
+	}
+
+	pu, ok := v.(protoUnmarshaler)
+	if t == mediaProtobuf && !ok {
+		msg := fmt.Sprintf("Unsupported Content-Type: %s", t)
+		writeError(w, r, http.StatusUnsupportedMediaType, msg)
+		return false
+	}
+	b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		if err.Error() == errBodyTooLarge {
+			writeBodyTooLarge(w, r, limit)
+			return false
+		}
+		msg := fmt.Sprintf("Read error: %v", err)
+		writeError(w, r, http.StatusBadRequest, msg)
+		return false
+	}
+
+	if t == mediaProtobuf {
+		if err := pu.unmarshalProto(b); err != nil {
+			msg := fmt.Sprintf("Unmarshal Protocol Buffers error: %v", err)
+			writeError(w, r, http.StatusBadRequest, msg)
+			return false
+		}
+		return true
+	}
+
+	br := bytes.NewReader(b)
+	d := msgpack.NewDecoder(br)
+	d.SetCustomStructTag("json")
+	err = d.Decode(v)
+	if err == nil && br.Len() > 0 {
+		err = errors.New("unexpected data after the MessagePack value")
+	}
+	if err != nil {
+		msg := fmt.Sprintf("Unmarshal MessagePack error: %v", err)
+		writeError(w, r, http.StatusBadRequest, msg)
+		return false
+	}
+	return true
+}
+
+// writeBody writes v in the media type that the client accepts: JSON,
+// Protocol Buffers or MessagePack. Values that don't implement protoMarshaler
+// are written in JSON instead of Protocol Buffers.
+func writeBody(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	switch responseMediaType(r) {
+	case mediaProtobuf:
+		pm, ok := v.(protoMarshaler)
+		if !ok {
+			break
+		}
+		b, err := proto.Marshal(pm.toProto())
+		if err != nil {
+			break
+		}
+		w.Header().Set("Content-Type", mediaProtobuf)
+		w.WriteHeader(status)
+		w.Write(b)
+		return
+	case mediaMsgpack:
+		var buf bytes.Buffer
+		e := msgpack.NewEncoder(&buf)
+		e.SetCustomStructTag("json")
+		if err := e.Encode(v); err != nil {
+			break
+		}
+		w.Header().Set("Content-Type", mediaMsgpack)
+		w.WriteHeader(status)
+		w.Write(buf.Bytes())
+		return
+	}
+	writeJSON(w, status, v)
+}
+
+// headWriter is a ResponseWriter that counts the bytes of the body instead
+// of writing them. The status is held until the body is counted.
+type headWriter struct {
+	http.ResponseWriter
+	status int
+	n      int
+}
+
+func (w *headWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *headWriter) Write(b []byte) (int, error) {
+	w.n += len(b)
+	return len(b), nil
+}
+
+// writeHead writes the headers of the response written by f for HEAD, with
+// the Content-Length of the body. The body is not written.
+func writeHead(w http.ResponseWriter, f func(w http.ResponseWriter)) {
+	hw := &headWriter{ResponseWriter: w, status: http.StatusOK}
+	f(hw)
+	w.Header().Set("Content-Length", strconv.Itoa(hw.n))
+	w.WriteHeader(hw.status)
+}
+
+// nextBefore returns the before parameter of the URL of the older messages,
+// or 0 if there are no older messages.
+func nextBefore(next string) int64 {
+	u, err := url.Parse(next)
+	if next == "" || err != nil {
+		return 0
+	}
+	before, _ := strconv.ParseInt(u.Query().Get("before"), 10, 64)
+	return before
+}
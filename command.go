@@ -0,0 +1,109 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Command is a handler of a slash command like /me at the beginning of a
+// message body.
+type Command interface {
+	// Run processes the message posted with the command. args is the rest
+	// of the body after the command name. Run modifies the message to be
+	// posted. If Run returns a *ValidationError, the message is not posted
+	// and the error is shown to the poster.
+	Run(ctx context.Context, s *server, room string, message *Message, args string) error
+}
+
+// CommandFunc is an adapter to use a function as a Command.
+type CommandFunc func(ctx context.Context, s *server, room string, message *Message, args string) error
+
+// Run calls f.
+func (f CommandFunc) Run(ctx context.Context, s *server, room string, message *Message, args string) error {
+	return f(ctx, s, room, message, args)
+}
+
+// commands is the registry of the slash commands by the names.
+var commands = map[string]Command{}
+
+// registerCommand registers the command with the name. registerCommand is
+// called in init functions.
+func registerCommand(name string, c Command) {
+	if _, ok := commands[name]; ok {
+		panic(fmt.Sprintf("chatserver: command /%s is already registered", name))
+	}
+	commands[name] = c
+}
+
+// commandUsage returns an error to show the usage of a command to the poster.
+func commandUsage(usage string) error {
+	return &ValidationError{
+		Errors: []FieldError{newFieldError("body", "usage: %s", usage)},
+	}
+}
+
+// parseCommand returns the command name and the arguments if the body starts
+// with a command like "/name args".
+func parseCommand(body string) (string, string, bool) {
+	if !strings.HasPrefix(body, "/") {
+		return "", "", false
+	}
+	name := body[1:]
+	args := ""
+	if i := strings.IndexAny(name, " \t\n"); i >= 0 {
+		name, args = name[:i], strings.TrimSpace(name[i+1:])
+	}
+	if name == "" {
+		return "", "", false
+	}
+	return strings.ToLower(name), args, true
+}
+
+// runCommand runs the command in the message body if any. A body starting
+// with an unknown command, like a path, is posted as it is.
+func (s *server) runCommand(ctx context.Context, room string, message *Message) error {
+	name, args, ok := parseCommand(message.Body)
+	if !ok {
+		return nil
+	}
+	c, ok := commands[name]
+	if !ok {
+		return nil
+	}
+	return c.Run(ctx, s, room, message, args)
+}
+
+func init() {
+	registerCommand("me", CommandFunc(func(ctx context.Context, s *server, room string, message *Message, args string) error {
+		if args == "" {
+			return commandUsage("/me <action>")
+		}
+		message.Body = args
+		message.Action = true
+		return nil
+	}))
+	registerCommand("shrug", CommandFunc(func(ctx context.Context, s *server, room string, message *Message, args string) error {
+		const shrug = `¯\_(ツ)_/¯`
+		if args == "" {
+			message.Body = shrug
+			return nil
+		}
+		message.Body = args + " " + shrug
+		return nil
+	}))
+}
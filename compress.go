@@ -0,0 +1,201 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// compressibleTypes is the media types of the responses to compress. Event
+// streams are not compressed so that each event reaches clients as it is.
+var compressibleTypes = []string{
+	"application/javascript",
+	"application/json",
+	"text/css",
+	"text/csv",
+	"text/html",
+	"text/plain",
+}
+
+// compressor is a gzip.Writer or a flate.Writer.
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+var compressorPools = map[string]*sync.Pool{
+	"gzip": {
+		New: func() interface{} {
+			return gzip.NewWriter(nil)
+		},
+	},
+	"deflate": {
+		New: func() interface{} {
+			// The error is always nil for a valid level.
+			w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+			return w
+		},
+	},
+}
+
+// acceptedEncoding returns the content coding to use for the Accept-Encoding
+// header value, or an empty string if the response should not be compressed.
+// gzip is preferred to deflate when their qualities are the same.
+func acceptedEncoding(acceptEncoding string) string {
+	var best string
+	var bestQ float64
+	for _, v := range strings.Split(acceptEncoding, ",") {
+		tokens := strings.Split(v, ";")
+		coding := strings.ToLower(strings.TrimSpace(tokens[0]))
+		if coding == "*" {
+			coding = "gzip"
+		}
+		if _, ok := compressorPools[coding]; !ok {
+			continue
+		}
+		q := 1.0
+		for _, p := range tokens[1:] {
+			p = strings.TrimSpace(p)
+			if !strings.HasPrefix(p, "q=") {
+				continue
+			}
+			f, err := strconv.ParseFloat(p[len("q="):], 64)
+			if err != nil {
+				continue
+			}
+			q = f
+		}
+		if q <= 0 {
+			continue
+		}
+		if q > bestQ || q == bestQ && coding == "gzip" {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+func isCompressible(contentType string) bool {
+	mediaType := strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0])
+	return contains(compressibleTypes, strings.ToLower(mediaType))
+}
+
+// compressWriter compresses the response body if the content type is
+// compressible. Whether to compress is decided when the header is written.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	c        compressor
+	decided  bool
+}
+
+func (w *compressWriter) decide(status int) {
+	w.decided = true
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified {
+		return
+	}
+	h := w.Header()
+	if h.Get("Content-Encoding") != "" || !isCompressible(h.Get("Content-Type")) {
+		return
+	}
+	h.Set("Content-Encoding", w.encoding)
+	h.Del("Content-Length")
+	w.c = compressorPools[w.encoding].Get().(compressor)
+	w.c.Reset(w.ResponseWriter)
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if !w.decided {
+		w.decide(status)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		// Sniff the content type as net/http does, before it is too late.
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.c != nil {
+		return w.c.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *compressWriter) Flush() {
+	if w.c != nil {
+		w.c.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("chatserver: hijacking is not supported")
+	}
+	return h.Hijack()
+}
+
+func (w *compressWriter) close() {
+	if w.c == nil {
+		return
+	}
+	w.c.Close()
+	compressorPools[w.encoding].Put(w.c)
+	w.c = nil
+}
+
+// withCompression returns a handler that compresses the responses of h with
+// gzip or deflate as Accept-Encoding allows. WebSocket upgrades and HEAD
+// requests are passed through as they are.
+func withCompression(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		// Caches must not serve a compressed response to the clients that
+		// don't accept it, and vice versa.
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := acceptedEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead {
+			h.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{
+			ResponseWriter: w,
+			encoding:       encoding,
+		}
+		defer cw.close()
+		h.ServeHTTP(cw, r)
+	})
+}
@@ -0,0 +1,525 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the configuration of the server.
+type Config struct {
+	// Rooms is the list of the available rooms. The default room is always
+	// available.
+	Rooms []string `yaml:"rooms"`
+
+	// MaxContentSize is the maximum size of a request body in bytes. This
+	// only guards against huge requests, and the name and the body are
+	// limited in characters after decoding.
+	MaxContentSize int `yaml:"max_content_size"`
+
+	// MaxNameLength is the maximum number of characters of a name.
+	MaxNameLength int `yaml:"max_name_length"`
+
+	// MaxBodyLength is the maximum number of characters of a body.
+	MaxBodyLength int `yaml:"max_body_length"`
+
+	// HistoryLength is the number of the latest messages kept in a room.
+	HistoryLength int `yaml:"history_length"`
+
+	// CacheShards is the number of the memcache keys that the latest messages
+	// in a room are spread over on App Engine. More shards reduce CAS
+	// conflicts when many messages are posted at once, and make reads fetch
+	// more keys.
+	CacheShards int `yaml:"cache_shards"`
+
+	// AsyncPosts is true if posts are accepted with 202 Accepted and stored
+	// later in the posted order by Task Queue on App Engine, so that posting
+	// doesn't wait for the store.
+	AsyncPosts bool `yaml:"async_posts"`
+
+	// ReloadInterval is the interval to reload the messages page in browsers
+	// without WebSocket.
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+
+	// PageMaxAge is how long browsers can cache the messages page and the
+	// messages API without revalidation. Proxies don't cache them since they
+	// depend on the session.
+	PageMaxAge time.Duration `yaml:"page_max_age"`
+
+	// StaticMaxAge is how long browsers and proxies can cache the static
+	// data like the emoji list.
+	StaticMaxAge time.Duration `yaml:"static_max_age"`
+
+	// CORSOrigins is the origins allowed to call the API from browsers. "*"
+	// allows all the origins without credentials.
+	CORSOrigins []string `yaml:"cors_origins"`
+
+	// CORSMethods is the methods allowed in cross-origin requests.
+	CORSMethods []string `yaml:"cors_methods"`
+
+	// CORSHeaders is the request headers allowed in cross-origin requests.
+	CORSHeaders []string `yaml:"cors_headers"`
+
+	// FrameAncestors is the sources allowed to embed the HTML pages in
+	// frames, like "https://example.com". No one can embed them if this is
+	// empty.
+	FrameAncestors []string `yaml:"frame_ancestors"`
+
+	// ReferrerPolicy is the Referrer-Policy header of the responses.
+	ReferrerPolicy string `yaml:"referrer_policy"`
+
+	// Retention is how long messages are kept in the store. Older messages
+	// are removed by /tasks/purge. Messages are kept forever if this is 0.
+	Retention time.Duration `yaml:"retention"`
+
+	// RequestTimeout is how long a request can take. Slow requests fail
+	// with 504 Gateway Timeout. Streaming requests like WebSocket are not
+	// limited. Requests are not limited if this is 0.
+	RequestTimeout time.Duration `yaml:"request_timeout"`
+
+	// BackendTimeout is how long each memcache call can take. Calls are not
+	// limited if this is 0.
+	BackendTimeout time.Duration `yaml:"backend_timeout"`
+
+	// ReportThreshold is the number of the reports from different clients to
+	// hide a message until a moderator dismisses them. Messages are never
+	// hidden by reports if this is 0.
+	ReportThreshold int `yaml:"report_threshold"`
+
+	// SpamThrottleScore is the spam score to reject a post with 429 Too Many
+	// Requests. Posts are not throttled by the score if this is 0.
+	SpamThrottleScore float64 `yaml:"spam_throttle_score"`
+
+	// SpamShadowBanScore is the spam score to shadow-ban the poster's session
+	// for a day. The posts of a shadow-banned session look accepted to the
+	// poster but are dropped. Sessions are not shadow-banned if this is 0.
+	SpamShadowBanScore float64 `yaml:"spam_shadow_ban_score"`
+
+	// Captcha is true if a session must answer an arithmetic challenge at
+	// /captcha before the first post. Signed-in users don't need to.
+	Captcha bool `yaml:"captcha"`
+
+	// Moderation is true if the posts from the users other than the trusted
+	// names wait for the approval of a moderator in /admin/queue before they
+	// are shown.
+	Moderation bool `yaml:"moderation"`
+
+	// TraceProject is the Google Cloud project to send traces to. Tracing is
+	// disabled if this is empty.
+	TraceProject string `yaml:"trace_project"`
+
+	// Theme is the branding of the HTML pages.
+	Theme Theme `yaml:"theme"`
+
+	// TemplateDir is the directory of the template files like footer.html
+	// that replace the built-in templates of the pages. The templates can
+	// also be replaced by /admin/templates.
+	TemplateDir string `yaml:"template_dir"`
+
+	// Addr is the address that Run listens on.
+	Addr string `yaml:"addr"`
+
+	// GRPCAddr is the address that Run serves the gRPC API on. The gRPC API
+	// is not served if this is empty.
+	GRPCAddr string `yaml:"grpc_addr"`
+
+	// ShutdownTimeout is how long Run waits for the requests to finish on
+	// shutdown. Run waits without a limit if this is 0.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+
+	// StoreName is the name of the message store that cmd/chatserver opens,
+	// like "sqlite" or "postgres".
+	StoreName string `yaml:"store"`
+
+	// DSN is where the store of StoreName is, like the path of the SQLite
+	// file or the connection string of PostgreSQL. The default of the store
+	// is used if this is empty.
+	DSN string `yaml:"dsn"`
+
+	// Store is the message store of Run. Messages are kept in memory if this
+	// is nil.
+	Store Store `yaml:"-"`
+
+	// KV is the store of the other states of Run. The states are kept in
+	// memory if this is nil.
+	KV KV `yaml:"-"`
+}
+
+// Theme is the branding of the HTML pages. The templates can use it as
+// .Theme.
+type Theme struct {
+	// Title is the title of the pages.
+	Title string `yaml:"title"`
+
+	// LogoURL is the URL of the logo image shown at the top of the messages
+	// page. No logo is shown if this is empty.
+	LogoURL string `yaml:"logo_url"`
+
+	// Footer is the text shown at the bottom of the messages page.
+	Footer string `yaml:"footer"`
+
+	// BackgroundColor is the CSS color of the background of the pages.
+	BackgroundColor string `yaml:"background_color"`
+
+	// TextColor is the CSS color of the text of the pages.
+	TextColor string `yaml:"text_color"`
+
+	// AccentColor is the CSS color of the names in the messages.
+	AccentColor string `yaml:"accent_color"`
+}
+
+// cssColorRegexp matches the CSS colors allowed in the theme: hex colors
+// like "#00add8" and names like "white".
+var cssColorRegexp = regexp.MustCompile(`^(#[0-9a-fA-F]{3,8}|[a-zA-Z]+)$`)
+
+func (t *Theme) validate() error {
+	if t.Title == "" {
+		return fmt.Errorf("chatserver: theme title must not be empty")
+	}
+	if t.LogoURL != "" {
+		u, err := url.Parse(t.LogoURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("chatserver: invalid theme logo URL: %q", t.LogoURL)
+		}
+	}
+	for _, c := range []string{t.BackgroundColor, t.TextColor, t.AccentColor} {
+		if !cssColorRegexp.MatchString(c) {
+			return fmt.Errorf("chatserver: invalid theme color: %q", c)
+		}
+	}
+	return nil
+}
+
+// DefaultConfig returns the default configuration.
+func DefaultConfig() Config {
+	return Config{
+		Rooms:              []string{defaultRoom},
+		MaxContentSize:     4096,
+		MaxNameLength:      32,
+		MaxBodyLength:      200,
+		HistoryLength:      50,
+		ReportThreshold:    3,
+		SpamThrottleScore:  1,
+		SpamShadowBanScore: 2,
+		CacheShards:        1,
+		ReloadInterval:     5 * time.Second,
+		PageMaxAge:         2 * time.Second,
+		StaticMaxAge:       time.Hour,
+		CORSOrigins:        []string{"*"},
+		CORSMethods:        []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"},
+		CORSHeaders:        []string{"Authorization", "Content-Type", "Idempotency-Key", "If-Match", "X-CSRF-Token", "X-Request-Id"},
+		ReferrerPolicy:     "strict-origin-when-cross-origin",
+		RequestTimeout:     30 * time.Second,
+		BackendTimeout:     5 * time.Second,
+		Addr:               ":8080",
+		ShutdownTimeout:    10 * time.Second,
+		StoreName:          "memory",
+		Theme: Theme{
+			Title:           "Chat Server - golang.tokyo #13",
+			BackgroundColor: "white",
+			TextColor:       "black",
+			AccentColor:     "inherit",
+		},
+	}
+}
+
+// LoadConfig loads the configuration from the YAML file at path, and then from
+// the environment variables ROOMS, MAX_CONTENT_SIZE, MAX_NAME_LENGTH,
+// MAX_BODY_LENGTH, HISTORY_LENGTH, CACHE_SHARDS, ASYNC_POSTS,
+// RELOAD_INTERVAL, PAGE_MAX_AGE, STATIC_MAX_AGE, CORS_ORIGINS, CORS_METHODS,
+// CORS_HEADERS, FRAME_ANCESTORS, REFERRER_POLICY, RETENTION, REQUEST_TIMEOUT,
+// BACKEND_TIMEOUT, PORT, GRPC_ADDR, SHUTDOWN_TIMEOUT, STORE, DSN,
+// REPORT_THRESHOLD, SPAM_THROTTLE_SCORE, SPAM_SHADOW_BAN_SCORE, CAPTCHA,
+// MODERATION, TRACE_PROJECT, THEME_TITLE, THEME_LOGO_URL, THEME_FOOTER,
+// THEME_BACKGROUND_COLOR, THEME_TEXT_COLOR, THEME_ACCENT_COLOR and
+// TEMPLATE_DIR. The file is skipped if path is empty. The values missing in
+// both are the defaults.
+func LoadConfig(path string) (Config, error) {
+	c := DefaultConfig()
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return Config{}, err
+		}
+		if err := yaml.Unmarshal(b, &c); err != nil {
+			return Config{}, fmt.Errorf("chatserver: invalid config file %s: %v", path, err)
+		}
+	}
+
+	if v := os.Getenv("ROOMS"); v != "" {
+		c.Rooms = strings.Split(v, ",")
+	}
+	if v := os.Getenv("MAX_CONTENT_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return Config{}, fmt.Errorf("chatserver: invalid MAX_CONTENT_SIZE: %q", v)
+		}
+		c.MaxContentSize = n
+	}
+	if v := os.Getenv("MAX_NAME_LENGTH"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return Config{}, fmt.Errorf("chatserver: invalid MAX_NAME_LENGTH: %q", v)
+		}
+		c.MaxNameLength = n
+	}
+	if v := os.Getenv("MAX_BODY_LENGTH"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return Config{}, fmt.Errorf("chatserver: invalid MAX_BODY_LENGTH: %q", v)
+		}
+		c.MaxBodyLength = n
+	}
+	if v := os.Getenv("HISTORY_LENGTH"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return Config{}, fmt.Errorf("chatserver: invalid HISTORY_LENGTH: %q", v)
+		}
+		c.HistoryLength = n
+	}
+	if v := os.Getenv("CACHE_SHARDS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return Config{}, fmt.Errorf("chatserver: invalid CACHE_SHARDS: %q", v)
+		}
+		c.CacheShards = n
+	}
+	if v := os.Getenv("ASYNC_POSTS"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return Config{}, fmt.Errorf("chatserver: invalid ASYNC_POSTS: %q", v)
+		}
+		c.AsyncPosts = b
+	}
+	if v := os.Getenv("RELOAD_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return Config{}, fmt.Errorf("chatserver: invalid RELOAD_INTERVAL: %q", v)
+		}
+		c.ReloadInterval = d
+	}
+	if v := os.Getenv("PAGE_MAX_AGE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return Config{}, fmt.Errorf("chatserver: invalid PAGE_MAX_AGE: %q", v)
+		}
+		c.PageMaxAge = d
+	}
+	if v := os.Getenv("STATIC_MAX_AGE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return Config{}, fmt.Errorf("chatserver: invalid STATIC_MAX_AGE: %q", v)
+		}
+		c.StaticMaxAge = d
+	}
+	if v := os.Getenv("CORS_ORIGINS"); v != "" {
+		c.CORSOrigins = splitList(v)
+	}
+	if v := os.Getenv("CORS_METHODS"); v != "" {
+		c.CORSMethods = splitList(v)
+	}
+	if v := os.Getenv("CORS_HEADERS"); v != "" {
+		c.CORSHeaders = splitList(v)
+	}
+	if v := os.Getenv("FRAME_ANCESTORS"); v != "" {
+		c.FrameAncestors = splitList(v)
+	}
+	if v := os.Getenv("REFERRER_POLICY"); v != "" {
+		c.ReferrerPolicy = v
+	}
+	if v := os.Getenv("RETENTION"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return Config{}, fmt.Errorf("chatserver: invalid RETENTION: %q", v)
+		}
+		c.Retention = d
+	}
+	if v := os.Getenv("REQUEST_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return Config{}, fmt.Errorf("chatserver: invalid REQUEST_TIMEOUT: %q", v)
+		}
+		c.RequestTimeout = d
+	}
+	if v := os.Getenv("BACKEND_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return Config{}, fmt.Errorf("chatserver: invalid BACKEND_TIMEOUT: %q", v)
+		}
+		c.BackendTimeout = d
+	}
+	if v := os.Getenv("PORT"); v != "" {
+		c.Addr = ":" + v
+	}
+	if v := os.Getenv("GRPC_ADDR"); v != "" {
+		c.GRPCAddr = v
+	}
+	if v := os.Getenv("SHUTDOWN_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return Config{}, fmt.Errorf("chatserver: invalid SHUTDOWN_TIMEOUT: %q", v)
+		}
+		c.ShutdownTimeout = d
+	}
+	if v := os.Getenv("STORE"); v != "" {
+		c.StoreName = v
+	}
+	if v := os.Getenv("DSN"); v != "" {
+		c.DSN = v
+	}
+	if v := os.Getenv("REPORT_THRESHOLD"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return Config{}, fmt.Errorf("chatserver: invalid REPORT_THRESHOLD: %q", v)
+		}
+		c.ReportThreshold = n
+	}
+	if v := os.Getenv("SPAM_THROTTLE_SCORE"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return Config{}, fmt.Errorf("chatserver: invalid SPAM_THROTTLE_SCORE: %q", v)
+		}
+		c.SpamThrottleScore = f
+	}
+	if v := os.Getenv("SPAM_SHADOW_BAN_SCORE"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return Config{}, fmt.Errorf("chatserver: invalid SPAM_SHADOW_BAN_SCORE: %q", v)
+		}
+		c.SpamShadowBanScore = f
+	}
+	if v := os.Getenv("CAPTCHA"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return Config{}, fmt.Errorf("chatserver: invalid CAPTCHA: %q", v)
+		}
+		c.Captcha = b
+	}
+	if v := os.Getenv("MODERATION"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return Config{}, fmt.Errorf("chatserver: invalid MODERATION: %q", v)
+		}
+		c.Moderation = b
+	}
+
+	if v := os.Getenv("TRACE_PROJECT"); v != "" {
+		c.TraceProject = v
+	}
+
+	if v := os.Getenv("THEME_TITLE"); v != "" {
+		c.Theme.Title = v
+	}
+	if v := os.Getenv("THEME_LOGO_URL"); v != "" {
+		c.Theme.LogoURL = v
+	}
+	if v := os.Getenv("THEME_FOOTER"); v != "" {
+		c.Theme.Footer = v
+	}
+	if v := os.Getenv("THEME_BACKGROUND_COLOR"); v != "" {
+		c.Theme.BackgroundColor = v
+	}
+	if v := os.Getenv("THEME_TEXT_COLOR"); v != "" {
+		c.Theme.TextColor = v
+	}
+	if v := os.Getenv("THEME_ACCENT_COLOR"); v != "" {
+		c.Theme.AccentColor = v
+	}
+	if v := os.Getenv("TEMPLATE_DIR"); v != "" {
+		c.TemplateDir = v
+	}
+
+	c.Rooms = normalizeRooms(c.Rooms)
+	if err := c.validate(); err != nil {
+		return Config{}, err
+	}
+	return c, nil
+}
+
+// splitList splits the comma-separated list. Spaces around the items are
+// removed.
+func splitList(str string) []string {
+	var items []string
+	for _, item := range strings.Split(str, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (c *Config) validate() error {
+	if c.MaxContentSize <= 0 {
+		return fmt.Errorf("chatserver: max content size must be positive: %d", c.MaxContentSize)
+	}
+	if c.MaxNameLength <= 0 {
+		return fmt.Errorf("chatserver: max name length must be positive: %d", c.MaxNameLength)
+	}
+	if c.MaxBodyLength <= 0 {
+		return fmt.Errorf("chatserver: max body length must be positive: %d", c.MaxBodyLength)
+	}
+	if c.HistoryLength <= 0 {
+		return fmt.Errorf("chatserver: history length must be positive: %d", c.HistoryLength)
+	}
+	if c.CacheShards <= 0 {
+		return fmt.Errorf("chatserver: cache shards must be positive: %d", c.CacheShards)
+	}
+	if c.ReloadInterval <= 0 {
+		return fmt.Errorf("chatserver: reload interval must be positive: %v", c.ReloadInterval)
+	}
+	if c.PageMaxAge < 0 {
+		return fmt.Errorf("chatserver: page max age must not be negative: %v", c.PageMaxAge)
+	}
+	if c.StaticMaxAge < 0 {
+		return fmt.Errorf("chatserver: static max age must not be negative: %v", c.StaticMaxAge)
+	}
+	if c.ReportThreshold < 0 {
+		return fmt.Errorf("chatserver: report threshold must not be negative: %d", c.ReportThreshold)
+	}
+	if c.SpamThrottleScore < 0 {
+		return fmt.Errorf("chatserver: spam throttle score must not be negative: %v", c.SpamThrottleScore)
+	}
+	if c.SpamShadowBanScore < 0 {
+		return fmt.Errorf("chatserver: spam shadow ban score must not be negative: %v", c.SpamShadowBanScore)
+	}
+	if c.Retention < 0 {
+		return fmt.Errorf("chatserver: retention must not be negative: %v", c.Retention)
+	}
+	if c.RequestTimeout < 0 {
+		return fmt.Errorf("chatserver: request timeout must not be negative: %v", c.RequestTimeout)
+	}
+	if c.BackendTimeout < 0 {
+		return fmt.Errorf("chatserver: backend timeout must not be negative: %v", c.BackendTimeout)
+	}
+	if c.ShutdownTimeout < 0 {
+		return fmt.Errorf("chatserver: shutdown timeout must not be negative: %v", c.ShutdownTimeout)
+	}
+	if c.StoreName == "" {
+		return fmt.Errorf("chatserver: store must not be empty")
+	}
+	if err := c.Theme.validate(); err != nil {
+		return err
+	}
+	return nil
+}
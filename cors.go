@@ -0,0 +1,72 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// corsMaxAge is how long browsers can cache the preflight results.
+const corsMaxAge = 10 * time.Minute
+
+// allowedOrigin returns the value of Access-Control-Allow-Origin for the
+// origin, or an empty string if the origin is not allowed.
+func (s *server) allowedOrigin(origin string) string {
+	for _, o := range s.config.CORSOrigins {
+		if o == "*" {
+			return "*"
+		}
+		if origin != "" && strings.EqualFold(o, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// handleCORS sets the CORS headers to the response. If the request is a
+// preflight or another OPTIONS request, handleCORS responds to it and returns
+// true.
+func (s *server) handleCORS(w http.ResponseWriter, r *http.Request) bool {
+	h := w.Header()
+	allowed := s.allowedOrigin(r.Header.Get("Origin"))
+	if allowed != "*" {
+		h.Add("Vary", "Origin")
+	}
+	if allowed != "" {
+		h.Set("Access-Control-Allow-Origin", allowed)
+		// The session cookie is sent only to the listed origins.
+		if allowed != "*" {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+	}
+
+	if r.Method != http.MethodOptions {
+		return false
+	}
+	if allowed != "" && r.Header.Get("Access-Control-Request-Method") != "" {
+		h.Set("Access-Control-Allow-Methods", strings.Join(s.config.CORSMethods, ", "))
+		if len(s.config.CORSHeaders) > 0 {
+			h.Set("Access-Control-Allow-Headers", strings.Join(s.config.CORSHeaders, ", "))
+		}
+		h.Set("Access-Control-Max-Age", strconv.FormatInt(int64(corsMaxAge/time.Second), 10))
+	}
+	methods := append([]string{}, s.config.CORSMethods...)
+	h.Set("Allow", strings.Join(append(methods, http.MethodOptions), ", "))
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
@@ -0,0 +1,97 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net/http"
+)
+
+// csrfHeader is the request header to send the CSRF token.
+const csrfHeader = "X-CSRF-Token"
+
+// csrfToken returns the CSRF token of the session. The token is derived from
+// the session ID, so it doesn't have to be stored.
+func (s *server) csrfToken(ctx context.Context) string {
+	return s.sessionCSRFToken(sessionID(ctx))
+}
+
+func (s *server) sessionCSRFToken(id string) string {
+	h := hmac.New(sha256.New, s.sessionSecret)
+	io.WriteString(h, "csrf:")
+	io.WriteString(h, id)
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// isSafeMethod reports whether the method doesn't change the state.
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// isCookieAuthenticated reports whether the request is authenticated only by
+// the session cookie, which browsers send even from other sites. Requests
+// with a bearer token are from API clients. Basic credentials are sent by
+// browsers like cookies.
+func (s *server) isCookieAuthenticated(r *http.Request) bool {
+	if bearerToken(r) != "" {
+		return false
+	}
+	c, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return false
+	}
+	_, ok := s.verifySession(c.Value)
+	return ok
+}
+
+// hasCSRFToken reports whether the request has the CSRF token of the session
+// in the cookie.
+func (s *server) hasCSRFToken(r *http.Request) bool {
+	c, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return false
+	}
+	id, ok := s.verifySession(c.Value)
+	if !ok {
+		return false
+	}
+	return hmac.Equal([]byte(r.Header.Get(csrfHeader)), []byte(s.sessionCSRFToken(id)))
+}
+
+// checkCSRF reports whether the state-changing request is not forged. Requests
+// authenticated by the session cookie must have the session's CSRF token in
+// the X-CSRF-Token header. If the request is forged, checkCSRF writes an
+// error response.
+func (s *server) checkCSRF(ctx context.Context, w http.ResponseWriter, r *http.Request) bool {
+	if isSafeMethod(r.Method) {
+		return true
+	}
+	if !s.isCookieAuthenticated(r) {
+		return true
+	}
+	if hmac.Equal([]byte(r.Header.Get(csrfHeader)), []byte(s.csrfToken(ctx))) {
+		return true
+	}
+	writeErrorCode(w, r, http.StatusForbidden, "invalid_csrf_token", "Invalid CSRF token")
+	return false
+}
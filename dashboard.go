@@ -0,0 +1,309 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const (
+	serverErrorsKey = "stats:errors"
+
+	// statsWindow is the period to compute the rates on the dashboard.
+	statsWindow = 10 * time.Minute
+
+	// maxServerErrors is the maximum number of the recent server errors
+	// counted on the dashboard.
+	maxServerErrors = 1000
+
+	// dashboardMessages is the number of the latest messages of each room
+	// on the dashboard.
+	dashboardMessages = 10
+
+	// dashboardReports is the number of the recently reported messages on
+	// the dashboard.
+	dashboardReports = 20
+
+	// dashboardReloadInterval is the interval to reload the dashboard to keep
+	// the stats live.
+	dashboardReloadInterval = 15 * time.Second
+)
+
+const (
+	dashboardHTMLTmpl = `<!DOCTYPE html>
+<html lang="{{.Lang}}">
+<meta charset="utf-8">
+<title>{{t .Lang "Dashboard"}} - {{.Theme.Title}}</title>
+<link rel="stylesheet" href="{{static "admin.css"}}" nonce="{{.Nonce}}">
+<meta name="csrf-token" content="{{.CSRFToken}}">
+<script src="{{static "admin.js"}}" nonce="{{.Nonce}}"
+  data-reload-interval="{{.ReloadInterval}}"
+  data-confirm-clear="{{t .Lang "Remove all the messages in %s?"}}"></script>
+<h1>{{t .Lang "Dashboard"}}</h1>
+<table class="stats">
+<tr><th>{{t .Lang "Messages per minute"}}</th><td>{{printf "%.1f" .Stats.MessagesPerMinute}}</td></tr>
+<tr><th>{{t .Lang "Active sessions"}}</th><td>{{.Stats.ActiveSessions}}</td></tr>
+<tr><th>{{t .Lang "Server errors in the last 10 minutes"}}</th><td>{{.Stats.Errors}}</td></tr>
+</table>
+<div id="error" class="error"></div>
+<h2>{{t .Lang "Rooms"}}</h2>
+{{range .Rooms}}{{$room := .}}
+<section class="room">
+<h3>{{.Name}}{{if ne .State "open"}} ({{t $.Lang (printf "%s" .State)}}){{end}} <small>{{printf "%.1f" .MessagesPerMinute}} {{t $.Lang "messages per minute"}}, {{.Online}} {{t $.Lang "people online"}}</small>
+<button class="action danger" data-method="DELETE" data-path="{{.ClearPath}}" data-confirm="{{.Name}}">{{t $.Lang "Clear room"}}</button></h3>
+<ul>
+{{- range .Messages}}
+<li>{{.CreatedAt.Format "15:04:05"}} <span class="name">{{.Name}}</span>: {{.Body}}
+<button class="action" data-method="PUT" data-path="{{$room.MessagesPath}}{{.ID}}/pin">{{t $.Lang "Pin"}}</button>
+<button class="action danger" data-method="DELETE" data-path="{{$room.MessagesPath}}{{.ID}}">{{t $.Lang "Delete"}}</button></li>
+{{- else}}
+<li>{{t $.Lang "No Message!"}}</li>
+{{- end}}
+</ul>
+</section>
+{{end}}
+<h2>{{t .Lang "Recent reports"}}</h2>
+<table>
+{{- range .Reports}}
+<tr><td>{{.Room}}</td><td><span class="name">{{.Message.Name}}</span>: {{.Message.Body}}</td><td>{{len .Reports}}{{if .Hidden}} ({{t $.Lang "hidden"}}){{end}}</td>
+<td><button class="action danger" data-method="DELETE" data-path="{{.MessagePath}}">{{t $.Lang "Delete"}}</button>
+<button class="action" data-method="DELETE" data-path="{{.DismissPath}}">{{t $.Lang "Dismiss"}}</button></td></tr>
+{{- else}}
+<tr><td>{{t .Lang "No reports"}}</td></tr>
+{{- end}}
+</table>
+<h2>{{t .Lang "Bans"}}</h2>
+<table>
+{{- range .Bans}}
+<tr><td>{{.Type}}</td><td>{{.Value}}</td><td>{{.Reason}}</td><td>{{if .ExpiresAt.IsZero}}{{t $.Lang "permanent"}}{{else}}{{.ExpiresAt.Format "2006-01-02 15:04:05"}}{{end}}</td>
+<td><button class="action" data-method="DELETE" data-path="/admin/bans/{{.ID}}">{{t $.Lang "Lift"}}</button></td></tr>
+{{- else}}
+<tr><td>{{t .Lang "No bans"}}</td></tr>
+{{- end}}
+</table>
+`
+)
+
+// DashboardStats is the live stats on the dashboard.
+type DashboardStats struct {
+	// MessagesPerMinute is the average rate of the posts in statsWindow.
+	MessagesPerMinute float64
+
+	// ActiveSessions is the number of the sessions viewing the rooms.
+	ActiveSessions int
+
+	// Errors is the number of the server errors in statsWindow.
+	Errors int
+}
+
+// dashboardRoom is a room on the dashboard.
+type dashboardRoom struct {
+	Name              string
+	State             RoomState
+	MessagesPerMinute float64
+	Online            int
+	Messages          []Message
+	MessagesPath      string
+	ClearPath         string
+}
+
+// dashboardReport is a reported message on the dashboard.
+type dashboardReport struct {
+	MessageReports
+	MessagePath string
+	DismissPath string
+}
+
+// lastReported returns the time of the latest report of the message.
+func (mr *MessageReports) lastReported() time.Time {
+	var t time.Time
+	for _, r := range mr.Reports {
+		if r.CreatedAt.After(t) {
+			t = r.CreatedAt
+		}
+	}
+	return t
+}
+
+// messagesPerMinute returns the average rate of the messages posted after
+// since.
+func messagesPerMinute(messages []Message, since time.Time) float64 {
+	n := 0
+	for _, m := range messages {
+		if m.CreatedAt.After(since) {
+			n++
+		}
+	}
+	return float64(n) / statsWindow.Minutes()
+}
+
+// recordServerError counts a server error for the dashboard. The errors are
+// counted in the cache so that all the instances share the count.
+func (s *server) recordServerError(ctx context.Context) error {
+	var times []time.Time
+	now := time.Now()
+	return s.cache.Update(ctx, serverErrorsKey, &times, statsWindow, func() error {
+		recent := times[:0]
+		for _, t := range times {
+			if now.Sub(t) < statsWindow {
+				recent = append(recent, t)
+			}
+		}
+		times = append(recent, now)
+		if len(times) > maxServerErrors {
+			times = times[len(times)-maxServerErrors:]
+		}
+		return nil
+	})
+}
+
+// serverErrors returns the number of the server errors in statsWindow.
+func (s *server) serverErrors(ctx context.Context) (int, error) {
+	var times []time.Time
+	if err := s.cache.Get(ctx, serverErrorsKey, &times); err != nil {
+		if err == ErrNotFound {
+			return 0, nil
+		}
+		return 0, err
+	}
+	now := time.Now()
+	n := 0
+	for _, t := range times {
+		if now.Sub(t) < statsWindow {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// handleDashboard handles GET /admin, the page for organizers to watch the
+// chat and moderate it without API clients. The stats are not essential, so
+// the page is shown without them on errors.
+func (s *server) handleDashboard(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		methodNotAllowed(w, r)
+		return
+	}
+	// The actions on the page are protected by the CSRF token of the
+	// session.
+	ctx, err := s.withSession(ctx, w, r)
+	if err != nil {
+		msg := fmt.Sprintf("Session error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+
+	var stats DashboardStats
+	since := time.Now().Add(-statsWindow)
+	all, err := s.rooms(ctx)
+	if err != nil {
+		s.logf(ctx, "Room error: %v", err)
+	}
+	rooms := make([]dashboardRoom, 0, len(all))
+	for _, rm := range all {
+		room := rm.Name
+		messages, err := s.store.Get(ctx, room)
+		if err != nil {
+			s.logf(ctx, "dashboard error: %v", err)
+			messages = s.fallback.recentMessages(room)
+		}
+		messages = visibleMessages(messages)
+		online, err := s.presence(ctx, room)
+		if err != nil {
+			s.logf(ctx, "presence error: %v", err)
+		}
+		dr := dashboardRoom{
+			Name:              room,
+			State:             rm.stateAt(time.Now()),
+			MessagesPerMinute: messagesPerMinute(messages, since),
+			Online:            online,
+			MessagesPath:      roomPath(room) + "messages/",
+			ClearPath:         "/admin/rooms/" + room + "/messages",
+		}
+		// The latest messages come first.
+		for i := len(messages) - 1; i >= 0 && len(dr.Messages) < dashboardMessages; i-- {
+			dr.Messages = append(dr.Messages, messages[i])
+		}
+		stats.MessagesPerMinute += dr.MessagesPerMinute
+		stats.ActiveSessions += online
+		rooms = append(rooms, dr)
+	}
+	if stats.Errors, err = s.serverErrors(ctx); err != nil {
+		s.logf(ctx, "dashboard error: %v", err)
+	}
+
+	var reported []MessageReports
+	if err := s.db.Get(ctx, reportsKey, &reported); err != nil && err != ErrNotFound {
+		s.logf(ctx, "Report error: %v", err)
+	}
+	sort.SliceStable(reported, func(i, j int) bool {
+		return reported[i].lastReported().After(reported[j].lastReported())
+	})
+	if len(reported) > dashboardReports {
+		reported = reported[:dashboardReports]
+	}
+	reports := make([]dashboardReport, len(reported))
+	for i, mr := range reported {
+		reports[i] = dashboardReport{
+			MessageReports: mr,
+			MessagePath:    fmt.Sprintf("%smessages/%d", roomPath(mr.Room), mr.Message.ID),
+			DismissPath:    fmt.Sprintf("/admin/reports/%s/%d", mr.Room, mr.Message.ID),
+		}
+	}
+
+	bans, err := s.bans(ctx)
+	if err != nil {
+		s.logf(ctx, "Ban error: %v", err)
+	}
+
+	data := map[string]interface{}{
+		"Stats":          &stats,
+		"Rooms":          rooms,
+		"Reports":        reports,
+		"Bans":           bans,
+		"CSRFToken":      s.csrfToken(ctx),
+		"ReloadInterval": int64(dashboardReloadInterval / time.Millisecond),
+	}
+	s.renderPage(ctx, w, r, "admin", data)
+}
+
+// clearRoom handles DELETE /admin/rooms/{room}/messages, which removes all
+// the messages in the room.
+func (s *server) clearRoom(ctx context.Context, w http.ResponseWriter, r *http.Request, room string) {
+	p, ok := s.store.(purger)
+	if !ok {
+		code := http.StatusNotImplemented
+		writeError(w, r, code, http.StatusText(code))
+		return
+	}
+	before := time.Now()
+	n, err := p.Purge(ctx, room, before)
+	if err != nil {
+		msg := fmt.Sprintf("Purge error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	if n > 0 {
+		s.bumpRevision(ctx, room)
+	}
+	res := &PurgeResponse{Purged: n, Before: before}
+	s.audit(ctx, r, "room.clear", room, "", nil, res)
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,389 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"google.golang.org/appengine/v2/datastore"
+)
+
+// purgeBatchSize is the number of messages read at once to purge.
+const purgeBatchSize = 500
+
+const (
+	roomKind    = "Room"
+	messageKind = "Message"
+	counterKind = "Counter"
+)
+
+// messageEntity is a message stored at Datastore. The key's integer ID is
+// the message ID, and the parent key is the room. Each room is an entity
+// group.
+type messageEntity struct {
+	Name     string `datastore:",noindex"`
+	Body     string `datastore:",noindex"`
+	PostedAt time.Time
+	Deleted  bool `datastore:",noindex"`
+	Hidden   bool `datastore:",noindex"`
+	Edited   bool `datastore:",noindex"`
+	Flagged  bool
+
+	SessionID string
+	Mentions  []string
+	Source    string `datastore:",noindex"`
+	Bot       bool   `datastore:",noindex"`
+	Action    bool   `datastore:",noindex"`
+
+	// The attachments are stored as the parallel lists.
+	AttachmentIDs     []string `datastore:",noindex"`
+	AttachmentWidths  []int    `datastore:",noindex"`
+	AttachmentHeights []int    `datastore:",noindex"`
+
+	TTLSeconds int64 `datastore:",noindex"`
+
+	PollOptions []string `datastore:",noindex"`
+	PollVotes   []int64  `datastore:",noindex"`
+
+	PreviewURL         string `datastore:",noindex"`
+	PreviewTitle       string `datastore:",noindex"`
+	PreviewDescription string `datastore:",noindex"`
+	PreviewImage       string `datastore:",noindex"`
+}
+
+type counterEntity struct {
+	Value int64 `datastore:",noindex"`
+}
+
+// datastoreStore is a Store on Cloud Datastore.
+type datastoreStore struct{}
+
+func roomKey(ctx context.Context, room string) *datastore.Key {
+	return datastore.NewKey(ctx, roomKind, room, 0, nil)
+}
+
+func (e *messageEntity) message(key *datastore.Key) Message {
+	var attachments []Attachment
+	for i, id := range e.AttachmentIDs {
+		attachments = append(attachments, newAttachment(id, e.AttachmentWidths[i], e.AttachmentHeights[i]))
+	}
+	var preview *LinkPreview
+	if e.PreviewURL != "" {
+		preview = &LinkPreview{
+			URL:         e.PreviewURL,
+			Title:       e.PreviewTitle,
+			Description: e.PreviewDescription,
+			Image:       e.PreviewImage,
+		}
+	}
+	var poll *Poll
+	if len(e.PollOptions) > 0 {
+		poll = &Poll{}
+		for i, o := range e.PollOptions {
+			var votes int
+			if i < len(e.PollVotes) {
+				votes = int(e.PollVotes[i])
+			}
+			poll.Options = append(poll.Options, PollOption{Text: o, Votes: votes})
+		}
+	}
+	return Message{
+		ID:        key.IntID(),
+		Name:      e.Name,
+		Body:      e.Body,
+		CreatedAt: e.PostedAt,
+		Deleted:   e.Deleted,
+		Hidden:    e.Hidden,
+		Edited:    e.Edited,
+		Flagged:   e.Flagged,
+		SessionID: e.SessionID,
+		Mentions:  e.Mentions,
+		Source:    e.Source,
+		Bot:       e.Bot,
+		Action:    e.Action,
+		Preview:   preview,
+		Poll:      poll,
+
+		Attachments: attachments,
+		TTLSeconds:  int(e.TTLSeconds),
+	}
+}
+
+func newMessageEntity(message *Message) *messageEntity {
+	e := &messageEntity{
+		Name:     message.Name,
+		Body:     message.Body,
+		PostedAt: message.CreatedAt,
+		Deleted:  message.Deleted,
+		Hidden:   message.Hidden,
+		Edited:   message.Edited,
+		Flagged:  message.Flagged,
+
+		SessionID: message.SessionID,
+		Mentions:  message.Mentions,
+		Source:    message.Source,
+		Bot:       message.Bot,
+		Action:    message.Action,
+
+		TTLSeconds: int64(message.TTLSeconds),
+	}
+	for _, a := range message.Attachments {
+		e.AttachmentIDs = append(e.AttachmentIDs, a.ID)
+		e.AttachmentWidths = append(e.AttachmentWidths, a.Width)
+		e.AttachmentHeights = append(e.AttachmentHeights, a.Height)
+	}
+	if p := message.Poll; p != nil {
+		for _, o := range p.Options {
+			e.PollOptions = append(e.PollOptions, o.Text)
+			e.PollVotes = append(e.PollVotes, int64(o.Votes))
+		}
+	}
+	if p := message.Preview; p != nil {
+		e.PreviewURL = p.URL
+		e.PreviewTitle = p.Title
+		e.PreviewDescription = p.Description
+		e.PreviewImage = p.Image
+	}
+	return e
+}
+
+func (datastoreStore) Get(ctx context.Context, room string) ([]Message, error) {
+	var es []messageEntity
+	q := datastore.NewQuery(messageKind).Ancestor(roomKey(ctx, room)).Order("__key__")
+	keys, err := q.GetAll(ctx, &es)
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]Message, len(es))
+	for i, e := range es {
+		messages[i] = e.message(keys[i])
+	}
+	return messages, nil
+}
+
+func (datastoreStore) History(ctx context.Context, room string, before int64, limit int) ([]Message, error) {
+	parent := roomKey(ctx, room)
+	q := datastore.NewQuery(messageKind).Ancestor(parent).Order("-__key__").Limit(limit)
+	if before > 0 {
+		q = q.Filter("__key__ <", datastore.NewKey(ctx, messageKind, "", before, parent))
+	}
+	var es []messageEntity
+	keys, err := q.GetAll(ctx, &es)
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]Message, len(es))
+	for i, e := range es {
+		messages[len(es)-i-1] = e.message(keys[i])
+	}
+	return messages, nil
+}
+
+func (datastoreStore) Append(ctx context.Context, room string, message Message) (int64, error) {
+	e := newMessageEntity(&message)
+	var id int64
+	parent := roomKey(ctx, room)
+	counterKey := datastore.NewKey(ctx, counterKind, messageKind, 0, parent)
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		var c counterEntity
+		if err := datastore.Get(ctx, counterKey, &c); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		c.Value++
+		if _, err := datastore.Put(ctx, counterKey, &c); err != nil {
+			return err
+		}
+		key := datastore.NewKey(ctx, messageKind, "", c.Value, parent)
+		if _, err := datastore.Put(ctx, key, e); err != nil {
+			return err
+		}
+		id = c.Value
+		return nil
+	}, nil); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func (datastoreStore) AppendMulti(ctx context.Context, room string, messages []Message) ([]int64, error) {
+	var ids []int64
+	parent := roomKey(ctx, room)
+	counterKey := datastore.NewKey(ctx, counterKind, messageKind, 0, parent)
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		var c counterEntity
+		if err := datastore.Get(ctx, counterKey, &c); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		ids = make([]int64, len(messages))
+		keys := make([]*datastore.Key, len(messages))
+		es := make([]*messageEntity, len(messages))
+		for i := range messages {
+			c.Value++
+			ids[i] = c.Value
+			keys[i] = datastore.NewKey(ctx, messageKind, "", c.Value, parent)
+			es[i] = newMessageEntity(&messages[i])
+		}
+		if _, err := datastore.Put(ctx, counterKey, &c); err != nil {
+			return err
+		}
+		if _, err := datastore.PutMulti(ctx, keys, es); err != nil {
+			return err
+		}
+		return nil
+	}, nil); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// Trim does nothing. Datastore keeps the whole history for paging, search and
+// export, and old messages are removed by Purge and Remove.
+func (datastoreStore) Trim(ctx context.Context, room string, n int) error {
+	return nil
+}
+
+func (datastoreStore) Purge(ctx context.Context, room string, before time.Time) (int, error) {
+	// The IDs increase in the posted order, so the old messages come first
+	// in the key order.
+	q := datastore.NewQuery(messageKind).Ancestor(roomKey(ctx, room)).Order("__key__").Limit(purgeBatchSize)
+	n := 0
+	for {
+		var es []messageEntity
+		keys, err := q.GetAll(ctx, &es)
+		if err != nil {
+			return n, err
+		}
+		old := len(es)
+		for i, e := range es {
+			if !e.PostedAt.Before(before) {
+				old = i
+				break
+			}
+		}
+		if err := datastore.DeleteMulti(ctx, keys[:old]); err != nil {
+			return n, err
+		}
+		n += old
+		if old < purgeBatchSize {
+			return n, nil
+		}
+	}
+}
+
+func (datastoreStore) Remove(ctx context.Context, room string, ids []int64) (int, error) {
+	keys := make([]*datastore.Key, len(ids))
+	for i, id := range ids {
+		keys[i] = datastore.NewKey(ctx, messageKind, "", id, roomKey(ctx, room))
+	}
+	if err := datastore.DeleteMulti(ctx, keys); err != nil {
+		return 0, err
+	}
+	return len(keys), nil
+}
+
+func (datastoreStore) Update(ctx context.Context, room string, id int64, f func(*Message)) (Message, error) {
+	key := datastore.NewKey(ctx, messageKind, "", id, roomKey(ctx, room))
+	var m Message
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		var e messageEntity
+		if err := datastore.Get(ctx, key, &e); err != nil {
+			if err == datastore.ErrNoSuchEntity {
+				return ErrNotFound
+			}
+			return err
+		}
+		m = e.message(key)
+		f(&m)
+		if _, err := datastore.Put(ctx, key, newMessageEntity(&m)); err != nil {
+			return err
+		}
+		return nil
+	}, nil); err != nil {
+		return Message{}, err
+	}
+	return m, nil
+}
+
+const kvKind = "KV"
+
+type kvEntity struct {
+	Value     []byte `datastore:",noindex"`
+	ExpiresAt time.Time
+}
+
+// datastoreKV is a KV on Cloud Datastore.
+type datastoreKV struct{}
+
+func (datastoreKV) get(ctx context.Context, key *datastore.Key, v interface{}) error {
+	var e kvEntity
+	if err := datastore.Get(ctx, key, &e); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return ErrNotFound
+		}
+		return err
+	}
+	if !e.ExpiresAt.IsZero() && !time.Now().Before(e.ExpiresAt) {
+		return ErrNotFound
+	}
+	return json.Unmarshal(e.Value, v)
+}
+
+func (datastoreKV) put(ctx context.Context, key *datastore.Key, v interface{}, expiration time.Duration) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	e := &kvEntity{
+		Value: b,
+	}
+	if expiration > 0 {
+		e.ExpiresAt = time.Now().Add(expiration)
+	}
+	if _, err := datastore.Put(ctx, key, e); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (kv datastoreKV) Get(ctx context.Context, key string, v interface{}) error {
+	return kv.get(ctx, datastore.NewKey(ctx, kvKind, key, 0, nil), v)
+}
+
+func (kv datastoreKV) Set(ctx context.Context, key string, v interface{}, expiration time.Duration) error {
+	return kv.put(ctx, datastore.NewKey(ctx, kvKind, key, 0, nil), v, expiration)
+}
+
+func (kv datastoreKV) Update(ctx context.Context, key string, v interface{}, expiration time.Duration, f func() error) error {
+	k := datastore.NewKey(ctx, kvKind, key, 0, nil)
+	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		resetValue(v)
+		if err := kv.get(ctx, k, v); err != nil && err != ErrNotFound {
+			return err
+		}
+		if err := f(); err != nil {
+			return err
+		}
+		return kv.put(ctx, k, v, expiration)
+	}, nil)
+}
+
+func (datastoreKV) Delete(ctx context.Context, key string) error {
+	if err := datastore.Delete(ctx, datastore.NewKey(ctx, kvKind, key, 0, nil)); err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// findMessage returns the message of the ID in the room. The message can be
+// older than the latest messages.
+func (s *server) findMessage(ctx context.Context, room string, id int64) (Message, error) {
+	messages, err := s.store.History(ctx, room, id+1, 1)
+	if err != nil {
+		return Message{}, err
+	}
+	if len(messages) == 0 || messages[0].ID != id {
+		return Message{}, ErrNotFound
+	}
+	return messages[0], nil
+}
+
+// deleteMessage handles DELETE /messages/{id}.
+func (s *server) deleteMessage(ctx context.Context, w http.ResponseWriter, r *http.Request, room string, id int64) {
+	if !s.checkAdmin(w, r) {
+		return
+	}
+	ctx, ok := s.checkRevision(ctx, w, r, room)
+	if !ok {
+		return
+	}
+	defer s.endRevision(ctx)
+
+	var prev Message
+	m, err := s.store.Update(ctx, room, id, func(m *Message) {
+		prev = *m
+		m.tombstone()
+	})
+	if err != nil {
+		if err == ErrNotFound {
+			notFound(w, r)
+			return
+		}
+		msg := fmt.Sprintf("Store error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	s.addTombstone(ctx, room, id)
+	s.bumpRevision(ctx, room)
+	s.broadcast(ctx, room, m)
+	s.updatePinned(ctx, room, m)
+	s.indexMessage(ctx, room, m)
+	s.audit(ctx, r, "message.delete", room, strconv.FormatInt(id, 10), &prev, nil)
+	if _, err := s.removeReports(ctx, room, id); err != nil && err != ErrNotFound {
+		s.logf(ctx, "Report error: %v", err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
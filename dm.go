@@ -0,0 +1,224 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// DirectMessage is a message sent to a user, which only the sender and the
+// recipient can read.
+type DirectMessage struct {
+	// ID is assigned in the order in the conversation.
+	ID int64 `json:"id"`
+
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// DirectMessageRequest is the request body of POST /dm/{user}.
+type DirectMessageRequest struct {
+	Body string `json:"body"`
+}
+
+// DirectMessagesResponse is the response of GET /dm/{user}.
+type DirectMessagesResponse struct {
+	// User is the other user of the conversation.
+	User string `json:"user"`
+
+	// Messages are in the sent order.
+	Messages    []DirectMessage `json:"messages"`
+	Count       int             `json:"count"`
+	GeneratedAt time.Time       `json:"generated_at"`
+}
+
+// directMessagesKey returns the key of the conversation between the two users.
+// The names are normalized and sorted, so both the users get the same key.
+func directMessagesKey(name1, name2 string) string {
+	a, b := normalizeName(name1), normalizeName(name2)
+	if a > b {
+		a, b = b, a
+	}
+	return "dm:" + url.PathEscape(a) + "/" + url.PathEscape(b)
+}
+
+// directMessageUser returns the name of the user to send and read direct
+// messages. The name is the account's name of a signed-in user or the name
+// registered by the session, and an empty string if there is neither.
+func (s *server) directMessageUser(ctx context.Context) (string, error) {
+	if name := s.userName(ctx); name != "" {
+		return name, nil
+	}
+	sid := sessionID(ctx)
+	var name string
+	if err := s.db.Get(ctx, sessionNameKey(sid), &name); err != nil {
+		if err == ErrNotFound {
+			return "", nil
+		}
+		return "", err
+	}
+	// The registration might be expired and taken by another session.
+	if err := s.checkName(ctx, sid, name); err != nil {
+		if err == errNameTaken {
+			return "", nil
+		}
+		return "", err
+	}
+	return name, nil
+}
+
+// checkDirectMessageUser returns the name of the user of the request. If the
+// user has no name, checkDirectMessageUser writes 403 Forbidden and returns an
+// empty string.
+func (s *server) checkDirectMessageUser(ctx context.Context, w http.ResponseWriter, r *http.Request) string {
+	name, err := s.directMessageUser(ctx)
+	if err != nil {
+		msg := fmt.Sprintf("Name error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return ""
+	}
+	if name == "" {
+		msg := "Register a name or sign in to use direct messages"
+		writeErrorCode(w, r, http.StatusForbidden, "name_required", msg)
+		return ""
+	}
+	return name
+}
+
+// listDirectMessages handles GET /dm/{user}, the conversation between the user
+// of the request and the other user.
+func (s *server) listDirectMessages(ctx context.Context, w http.ResponseWriter, r *http.Request, other string) {
+	noStore(w)
+	name := s.checkDirectMessageUser(ctx, w, r)
+	if name == "" {
+		return
+	}
+	var messages []DirectMessage
+	if err := s.db.Get(ctx, directMessagesKey(name, other), &messages); err != nil && err != ErrNotFound {
+		msg := fmt.Sprintf("Direct message error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	if messages == nil {
+		messages = []DirectMessage{}
+	}
+	writeJSON(w, http.StatusOK, &DirectMessagesResponse{
+		User:        other,
+		Messages:    messages,
+		Count:       len(messages),
+		GeneratedAt: time.Now(),
+	})
+}
+
+// postDirectMessage handles POST /dm/{user} to send a message to the user.
+// The latest history_length messages are kept in a conversation.
+func (s *server) postDirectMessage(ctx context.Context, w http.ResponseWriter, r *http.Request, other string) {
+	noStore(w)
+	name := s.checkDirectMessageUser(ctx, w, r)
+	if name == "" {
+		return
+	}
+	var req DirectMessageRequest
+	if !decodeJSON(w, r, &req, int64(s.config.MaxContentSize)) {
+		return
+	}
+
+	var errs []FieldError
+	if f := validateField("user", &other, s.config.MaxNameLength); f != nil {
+		errs = append(errs, *f)
+	} else if normalizeName(other) == normalizeName(name) {
+		errs = append(errs, newFieldError("user", "must not be yourself"))
+	}
+	if f := validateField("body", &req.Body, s.config.MaxBodyLength); f != nil {
+		errs = append(errs, *f)
+	}
+	if len(errs) > 0 {
+		writeValidationError(w, r, &ValidationError{Errors: errs})
+		return
+	}
+
+	if !s.checkRateLimit(ctx, w, r) {
+		return
+	}
+	banned, err := s.isBanned(ctx, &poster{
+		sessionID: sessionID(ctx),
+		ip:        clientIP(r),
+		name:      name,
+	})
+	if err != nil {
+		msg := fmt.Sprintf("Ban error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	if banned {
+		msg := "You are banned from posting"
+		writeErrorCode(w, r, http.StatusForbidden, "banned", msg)
+		return
+	}
+
+	filter, err := s.wordFilter(ctx)
+	if err != nil {
+		msg := fmt.Sprintf("Word filter error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	m := Message{Name: name, Body: req.Body}
+	if !filter.apply(&m) {
+		writeValidationError(w, r, &ValidationError{
+			Errors: []FieldError{{Field: "body", Message: "must not contain banned words"}},
+		})
+		return
+	}
+
+	// The recipient is shown as registered rather than as in the path.
+	var e nameClaimEntry
+	if err := s.db.Get(ctx, nameKey(other), &e); err == nil {
+		other = e.Name
+	} else if err != ErrNotFound {
+		msg := fmt.Sprintf("Name error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+
+	dm := DirectMessage{
+		From:      name,
+		To:        other,
+		Body:      m.Body,
+		CreatedAt: time.Now(),
+	}
+	var messages []DirectMessage
+	if err := s.db.Update(ctx, directMessagesKey(name, other), &messages, 0, func() error {
+		dm.ID = 1
+		if len(messages) > 0 {
+			dm.ID = messages[len(messages)-1].ID + 1
+		}
+		messages = append(messages, dm)
+		if n := s.config.HistoryLength; len(messages) > n {
+			messages = messages[len(messages)-n:]
+		}
+		return nil
+	}); err != nil {
+		msg := fmt.Sprintf("Direct message error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	writeJSON(w, http.StatusCreated, &dm)
+}
@@ -0,0 +1,183 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// editWindow is the duration while the poster can edit the message.
+const editWindow = 10 * time.Minute
+
+// PostResponse is the JSON representation of a posted message.
+type PostResponse struct {
+	Message
+
+	// EditToken is the token to edit the message. EditToken is shown only
+	// to the poster.
+	EditToken string `json:"edit_token"`
+
+	// Queued is true if the store is unavailable and the message is queued
+	// to be stored later. A queued message has neither an ID nor an edit
+	// token.
+	Queued bool `json:"queued,omitempty"`
+
+	// Pending is true if the message is waiting for the approval of a
+	// moderator in the moderation mode. A pending message has neither an ID
+	// nor an edit token.
+	Pending bool `json:"pending,omitempty"`
+
+	// Scheduled is true if the message is posted at deliver_at. A scheduled
+	// message has neither an ID nor an edit token, and can be canceled with
+	// ScheduledID.
+	Scheduled   bool   `json:"scheduled,omitempty"`
+	ScheduledID string `json:"scheduled_id,omitempty"`
+}
+
+// EditRequest is the JSON representation of a request to edit a message.
+type EditRequest struct {
+	Body string `json:"body"`
+}
+
+func editTokenKey(room string, id int64) string {
+	return "edittoken:" + room + ":" + strconv.FormatInt(id, 10)
+}
+
+func hashEditToken(token string) []byte {
+	h := sha256.Sum256([]byte(token))
+	return h[:]
+}
+
+// issueEditToken returns a new token to edit the message. The token expires
+// after editWindow.
+func (s *server) issueEditToken(ctx context.Context, room string, id int64) (string, error) {
+	b := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	if err := s.cache.Set(ctx, editTokenKey(room, id), hashEditToken(token), editWindow); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// checkEditToken reports whether the token is valid to edit the message.
+func (s *server) checkEditToken(ctx context.Context, room string, id int64, token string) (bool, error) {
+	var hash []byte
+	if err := s.cache.Get(ctx, editTokenKey(room, id), &hash); err != nil {
+		if err == ErrNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(hash, hashEditToken(token)) == 1, nil
+}
+
+// editMessage handles PATCH /messages/{id}.
+func (s *server) editMessage(ctx context.Context, w http.ResponseWriter, r *http.Request, room string, id int64) {
+	if !s.checkRoomOpen(ctx, w, r, room) {
+		return
+	}
+	token := bearerToken(r)
+	if token == "" {
+		msg := "The edit token is required"
+		writeError(w, r, http.StatusUnauthorized, msg)
+		return
+	}
+	ok, err := s.checkEditToken(ctx, room, id, token)
+	if err != nil {
+		msg := fmt.Sprintf("Edit token error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	if !ok {
+		msg := "The edit token is invalid or expired"
+		writeErrorCode(w, r, http.StatusForbidden, "invalid_edit_token", msg)
+		return
+	}
+
+	var req EditRequest
+	if !decodeJSON(w, r, &req, int64(s.config.MaxContentSize)) {
+		return
+	}
+	if f := validateField("body", &req.Body, s.config.MaxBodyLength); f != nil {
+		writeValidationError(w, r, &ValidationError{
+			Errors: []FieldError{*f},
+		})
+		return
+	}
+
+	filter, err := s.wordFilter(ctx)
+	if err != nil {
+		msg := fmt.Sprintf("Word filter error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	edited := Message{Body: req.Body}
+	if !filter.apply(&edited) {
+		writeValidationError(w, r, &ValidationError{
+			Errors: []FieldError{{Field: "body", Message: "must not contain banned words"}},
+		})
+		return
+	}
+
+	preview := s.linkPreview(ctx, edited.Body)
+	ctx, ok = s.checkRevision(ctx, w, r, room)
+	if !ok {
+		return
+	}
+	defer s.endRevision(ctx)
+	m, err := s.store.Update(ctx, room, id, func(m *Message) {
+		if m.Deleted {
+			return
+		}
+		m.Body = edited.Body
+		m.Mentions = parseMentions(edited.Body)
+		m.Preview = preview
+		m.Edited = true
+		if edited.Flagged {
+			m.Flagged = true
+		}
+	})
+	if err != nil {
+		if err == ErrNotFound {
+			notFound(w, r)
+			return
+		}
+		msg := fmt.Sprintf("Store error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	if m.Deleted {
+		notFound(w, r)
+		return
+	}
+	s.bumpRevision(ctx, room)
+	s.broadcast(ctx, room, m)
+	s.updatePinned(ctx, room, m)
+	s.indexMessage(ctx, room, m)
+
+	writeJSON(w, http.StatusOK, m)
+}
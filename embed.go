@@ -0,0 +1,145 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+)
+
+// embedMessages is the number of the latest messages on the embedded page.
+const embedMessages = 50
+
+const (
+	// embedHTMLTmpl is the page embedded in other sites by embed.js. The
+	// page tells the parent its height with postMessage so that the iframe
+	// fits the content.
+	embedHTMLTmpl = `<!DOCTYPE html>
+<html lang="{{.Lang}}">
+<meta charset="utf-8">
+<title>{{.Theme.Title}}</title>
+<style nonce="{{.Nonce}}">
+:root {
+  --background-color: {{.Theme.BackgroundColor}};
+  --text-color: {{.Theme.TextColor}};
+  --accent-color: {{.Theme.AccentColor}};
+}
+</style>
+<link rel="stylesheet" href="{{static "embed-page.css"}}" nonce="{{.Nonce}}">
+<meta name="csrf-token" content="{{.CSRFToken}}">
+<script src="{{static "embed-page.js"}}" nonce="{{.Nonce}}"
+  data-room="{{.Room}}"
+  data-post-path="{{.PostPath}}"
+  data-captcha-path="{{.CaptchaPath}}"
+  data-captcha-prompt="{{t .Lang "What is %s?"}}"
+  data-reload-interval="{{.ReloadInterval}}"
+  data-bot="{{t .Lang "bot"}}"
+  data-edited="{{t .Lang "(edited)"}}"
+  data-pending="{{t .Lang "Your message is waiting for approval"}}"></script>
+{{template "head" .}}
+{{if .Closed}}<p class="closed">{{t .Lang "The chat is closed. Thank you for joining!"}}</p>
+{{end -}}
+{{with .OpensIn}}<p id="countdown" class="closed" data-opens-in="{{.}}" data-format="{{t $.Lang "The chat opens in %s"}}">{{t $.Lang "The chat opens at %s" $.OpensAt}}</p>
+{{end -}}
+<div id="messages">
+{{- range .Messages}}
+<div id="message-{{.ID}}">{{if not .CreatedAt.IsZero}}<time class="time" datetime="{{.CreatedAt.Format "2006-01-02T15:04:05Z07:00"}}">{{.CreatedAt.Format "15:04:05"}}</time> {{end}}{{template "name" .}}{{if .Bot}} <span class="bot">{{t $.Lang "bot"}}</span>{{end}}{{if .Action}} <em>{{markdown .Body}}</em>{{else}}: {{markdown .Body}}{{end}}{{if .Edited}}<span class="edited"> {{t $.Lang "(edited)"}}</span>{{end}}</div>
+{{- else}}
+<div id="no-message">{{t .Lang "No Message!"}}</div>
+{{- end}}
+</div>
+<form id="post"{{if or .Closed .OpensIn}} hidden{{end}}>
+<input id="name" type="text" placeholder="{{t .Lang "Name"}}" size="10" required>
+<input id="body" type="text" placeholder="{{t .Lang "Message"}}" autocomplete="off" required>
+<button>{{t .Lang "Post"}}</button>
+</form>
+<div id="error" class="error"></div>
+<a class="open" href="{{.PagePath}}" target="_blank" rel="noopener">{{t .Lang "Open the chat"}}</a>
+`
+
+	// embedJS embeds the chat in an iframe after the script element:
+	//
+	//	<script src="https://chat.example.com/embed.js" data-room="general" async></script>
+	//
+	// data-room, data-width and data-max-height are optional. The iframe is
+	// resized by the messages from the embedded page.
+	embedJS = `(() => {
+  let script = document.currentScript;
+  let origin = new URL(script.src).origin;
+  let room = script.dataset.room || '';
+  let maxHeight = Number(script.dataset.maxHeight) || 600;
+  let iframe = document.createElement('iframe');
+  iframe.src = origin + (room ? '/rooms/' + encodeURIComponent(room) : '') + '/embed';
+  iframe.title = 'Chat';
+  iframe.style.border = '0';
+  iframe.style.width = script.dataset.width || '100%';
+  iframe.style.height = maxHeight + 'px';
+  script.parentNode.insertBefore(iframe, script.nextSibling);
+  window.addEventListener('message', e => {
+    if (e.origin !== origin || e.source !== iframe.contentWindow) {
+      return;
+    }
+    if (e.data && e.data.type === 'chatserver:resize') {
+      iframe.style.height = Math.min(Number(e.data.height), maxHeight) + 'px';
+    }
+  });
+})();
+`
+)
+
+// getEmbed handles GET /embed, the latest messages and a form to post for
+// embedding in other sites. The sites must be in frame_ancestors.
+func (s *server) getEmbed(ctx context.Context, w http.ResponseWriter, r *http.Request, room string) {
+	messages, err := s.store.Get(ctx, room)
+	if err != nil {
+		messages = s.fallback.recentMessages(room)
+	}
+	messages = visibleMessages(messages)
+	if len(messages) > embedMessages {
+		messages = messages[len(messages)-embedMessages:]
+	}
+	s.joinProfiles(ctx, messages)
+	cachePrivate(w, s.config.PageMaxAge)
+
+	closed, opensIn, opensAt := s.roomStatus(ctx, room)
+	data := map[string]interface{}{
+		"Messages":       messages,
+		"Room":           room,
+		"PostPath":       roomPath(room) + "messages",
+		"CaptchaPath":    roomPath(room) + "captcha",
+		"PagePath":       roomPath(room),
+		"Closed":         closed,
+		"OpensIn":        opensIn,
+		"OpensAt":        opensAt,
+		"CSRFToken":      s.csrfToken(ctx),
+		"ReloadInterval": int64(s.config.ReloadInterval / time.Millisecond),
+	}
+	s.renderPage(ctx, w, r, "embed", data)
+}
+
+// handleEmbedJS handles GET /embed.js, the script to embed the chat. The
+// script is served without a session so that it can be cached publicly.
+func (s *server) handleEmbedJS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		methodNotAllowed(w, r)
+		return
+	}
+	cacheImmutable(w, s.config.StaticMaxAge)
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	io.WriteString(w, embedJS)
+}
@@ -0,0 +1,84 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"strings"
+)
+
+// emojis is the map from shortcodes to emoji.
+var emojis = map[string]string{
+	"+1":               "\U0001F44D",
+	"-1":               "\U0001F44E",
+	"100":              "\U0001F4AF",
+	"bow":              "\U0001F647",
+	"clap":             "\U0001F44F",
+	"coffee":           "☕",
+	"confused":         "\U0001F615",
+	"cry":              "\U0001F622",
+	"eyes":             "\U0001F440",
+	"fire":             "\U0001F525",
+	"gopher":           "\U0001F439",
+	"grin":             "\U0001F601",
+	"heart":            "❤️",
+	"heart_eyes":       "\U0001F60D",
+	"joy":              "\U0001F602",
+	"laughing":         "\U0001F606",
+	"muscle":           "\U0001F4AA",
+	"ok_hand":          "\U0001F44C",
+	"party":            "\U0001F389",
+	"pizza":            "\U0001F355",
+	"pray":             "\U0001F64F",
+	"question":         "❓",
+	"raised_hands":     "\U0001F64C",
+	"rocket":           "\U0001F680",
+	"scream":           "\U0001F631",
+	"smile":            "\U0001F604",
+	"smiley":           "\U0001F603",
+	"sob":              "\U0001F62D",
+	"sparkles":         "✨",
+	"star":             "⭐",
+	"sunglasses":       "\U0001F60E",
+	"sushi":            "\U0001F363",
+	"sweat_smile":      "\U0001F605",
+	"tada":             "\U0001F389",
+	"thinking":         "\U0001F914",
+	"thumbsdown":       "\U0001F44E",
+	"thumbsup":         "\U0001F44D",
+	"warning":          "⚠️",
+	"wave":             "\U0001F44B",
+	"white_check_mark": "✅",
+	"wink":             "\U0001F609",
+	"x":                "❌",
+	"zap":              "⚡",
+}
+
+// emojiShortcode returns the length of the known emoji shortcode like
+// ":smile:" at the beginning of src and its emoji. emojiShortcode returns 0
+// if there is no shortcode.
+func emojiShortcode(src string) (int, string) {
+	if len(src) < 3 || src[0] != ':' {
+		return 0, ""
+	}
+	end := strings.IndexByte(src[1:], ':')
+	if end <= 0 {
+		return 0, ""
+	}
+	e, ok := emojis[src[1:1+end]]
+	if !ok {
+		return 0, ""
+	}
+	return end + 2, e
+}
@@ -0,0 +1,139 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// maxMessageTTLSeconds is the maximum TTL of a message, which is a day.
+	maxMessageTTLSeconds = 24 * 60 * 60
+
+	// expireMessagesInterval is the interval to remove the expired messages
+	// where background goroutines are available.
+	expireMessagesInterval = 10 * time.Second
+)
+
+// expiringMessages is the queue of the messages to be removed when they
+// expire. The messages are removed within a minute after they expire.
+var expiringMessages = &timeQueue{
+	name:     "expiring",
+	interval: time.Minute,
+}
+
+// expiresAt returns the time when the message expires. The zero time is
+// returned if the message never expires.
+func (m *Message) expiresAt() time.Time {
+	if m.TTLSeconds <= 0 {
+		return time.Time{}
+	}
+	return m.CreatedAt.Add(time.Duration(m.TTLSeconds) * time.Second)
+}
+
+// expired reports whether the message has expired at the time.
+func (m *Message) expired(now time.Time) bool {
+	t := m.expiresAt()
+	return !t.IsZero() && !now.Before(t)
+}
+
+// addExpiring adds the stored message with a TTL to the messages to be
+// removed. The message is hidden on read after it expires even if this
+// fails, so errors are only logged.
+func (s *server) addExpiring(ctx context.Context, room string, message Message) {
+	if err := expiringMessages.push(ctx, s.db, message.expiresAt(), queuedMessage{
+		Room: room,
+		ID:   message.ID,
+	}); err != nil {
+		s.logf(ctx, "Expire error: %v", err)
+	}
+}
+
+// expireMessages replaces the messages whose TTL has passed with their
+// tombstones, and returns the number of the removed messages.
+func (s *server) expireMessages(ctx context.Context) (int, error) {
+	n := 0
+	err := expiringMessages.process(ctx, s.db, time.Now(), func(due []queuedMessage) ([]queuedMessage, error) {
+		for i, em := range due {
+			m, err := s.store.Update(ctx, em.Room, em.ID, func(m *Message) {
+				m.tombstone()
+			})
+			if err == ErrNotFound {
+				// The message is already purged.
+				continue
+			}
+			if err != nil {
+				return due[i:], err
+			}
+			s.addTombstone(ctx, em.Room, em.ID)
+			s.bumpRevision(ctx, em.Room)
+			s.broadcast(ctx, em.Room, m)
+			s.updatePinned(ctx, em.Room, m)
+			s.indexMessage(ctx, em.Room, m)
+			n++
+		}
+		return nil, nil
+	})
+	return n, err
+}
+
+// runExpireMessages removes the expired messages periodically.
+// runExpireMessages is used where background goroutines are available.
+func (s *server) runExpireMessages(ctx context.Context) {
+	t := time.NewTicker(expireMessagesInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if _, err := s.expireMessages(ctx); err != nil {
+				s.logf(ctx, "Expire error: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ExpireResponse is the result of /tasks/expire.
+type ExpireResponse struct {
+	// Expired is the number of the removed messages.
+	Expired int `json:"expired"`
+}
+
+// handleExpire handles /tasks/expire, which removes the messages whose TTL
+// has passed. This is called by cron on App Engine, and requires the admin
+// token otherwise.
+func (s *server) handleExpire(w http.ResponseWriter, r *http.Request) {
+	if !(s.cron && r.Header.Get("X-Appengine-Cron") == "true") && !s.checkAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		methodNotAllowed(w, r)
+		return
+	}
+
+	ctx := r.Context()
+	n, err := s.expireMessages(ctx)
+	if err != nil {
+		msg := fmt.Sprintf("Expire error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	writeJSON(w, http.StatusOK, &ExpireResponse{Expired: n})
+}
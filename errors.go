@@ -0,0 +1,117 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"net/http"
+	"strings"
+)
+
+// ErrorResponse is the JSON representation of an error of the API.
+type ErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+// APIError is an error of the API.
+type APIError struct {
+	// Code is a stable machine-readable code like "not_found".
+	Code string `json:"code"`
+
+	// Message is a human-readable message. Messages can change.
+	Message string `json:"message"`
+
+	// Fields is the invalid fields for validation_failed.
+	Fields []FieldError `json:"fields,omitempty"`
+}
+
+// errorCodes is the default error codes by the status codes.
+var errorCodes = map[int]string{
+	http.StatusBadRequest:            "bad_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusConflict:              "conflict",
+	http.StatusRequestEntityTooLarge: "body_too_large",
+	http.StatusUnprocessableEntity:   "validation_failed",
+	http.StatusLocked:                "locked",
+	http.StatusTooManyRequests:       "rate_limited",
+	http.StatusInternalServerError:   "internal_error",
+	http.StatusBadGateway:            "bad_gateway",
+	http.StatusServiceUnavailable:    "unavailable",
+	http.StatusGatewayTimeout:        "timeout",
+}
+
+// errorCode returns the default error code of the status code.
+func errorCode(status int) string {
+	if code, ok := errorCodes[status]; ok {
+		return code
+	}
+	return strings.ToLower(strings.Replace(http.StatusText(status), " ", "_", -1))
+}
+
+// prefersHTML reports whether the client prefers HTML to JSON, like browsers
+// navigating to a page.
+func prefersHTML(r *http.Request) bool {
+	if apiVersion(r) > 0 {
+		return false
+	}
+	for _, t := range strings.Split(r.Header.Get("Accept"), ",") {
+		t = strings.TrimSpace(strings.SplitN(t, ";", 2)[0])
+		switch t {
+		case "text/html":
+			return true
+		case "application/json":
+			return false
+		}
+	}
+	return false
+}
+
+// writeError writes the error with the default code of the status code. See
+// writeErrorCode.
+func writeError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	writeErrorCode(w, r, status, errorCode(status), message)
+}
+
+// writeErrorCode writes the error in the JSON envelope like
+// {"error":{"code":"not_found","message":"Not Found"}}. Browsers navigating to
+// pages get the message as plain text instead. The message is translated into
+// the language of the request if it is in the catalog. Server errors caused by
+// the request timeout are written as 504 Gateway Timeout.
+func writeErrorCode(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	if status >= http.StatusInternalServerError && timedOut(r) {
+		status = http.StatusGatewayTimeout
+		code = errorCode(status)
+		message = "The server took too long to respond"
+	}
+	message = translate(requestLanguage(r), message)
+	if prefersHTML(r) {
+		http.Error(w, message, status)
+		return
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	writeJSON(w, status, &ErrorResponse{
+		Error: APIError{
+			Code:    code,
+			Message: message,
+		},
+	})
+}
+
+// notFound writes 404 Not Found.
+func notFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusNotFound, "Not Found")
+}
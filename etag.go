@@ -0,0 +1,65 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// etagOf returns a weak ETag of the values encoded in JSON. The ETag is weak
+// since the same ETag is used for the compressed responses.
+func etagOf(vs ...interface{}) (string, error) {
+	h := sha256.New()
+	e := json.NewEncoder(h)
+	for _, v := range vs {
+		if err := e.Encode(v); err != nil {
+			return "", err
+		}
+	}
+	return `W/"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`, nil
+}
+
+// etagMatches reports whether the If-None-Match header value matches the
+// ETag. Weak comparison is used as RFC 7232 requires for If-None-Match.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, t := range strings.Split(ifNoneMatch, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified sets the ETag of the values to the response, and writes 304 Not
+// Modified if the client already has the response. notModified returns true if
+// 304 is written. The response is written as usual if the ETag can't be
+// computed.
+func notModified(w http.ResponseWriter, r *http.Request, vs ...interface{}) bool {
+	etag, err := etagOf(vs...)
+	if err != nil {
+		return false
+	}
+	w.Header().Set("ETag", etag)
+	if !etagMatches(r.Header.Get("If-None-Match"), etag) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
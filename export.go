@@ -0,0 +1,148 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// exportPageSize is the number of messages read from the store at once.
+const exportPageSize = 100
+
+// exportMessages returns all the visible messages in the room posted in
+// [from, to) in the posted order. Zero from or to means no limit.
+func (s *server) exportMessages(ctx context.Context, room string, from, to time.Time) ([]Message, error) {
+	// Read pages from the latest to the oldest.
+	var pages [][]Message
+	var before int64
+	for {
+		messages, err := s.store.History(ctx, room, before, exportPageSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(messages) == 0 {
+			break
+		}
+		pages = append(pages, messages)
+		if !from.IsZero() && messages[0].CreatedAt.Before(from) {
+			break
+		}
+		if len(messages) < exportPageSize {
+			break
+		}
+		before = messages[0].ID
+	}
+
+	result := []Message{}
+	for i := len(pages) - 1; i >= 0; i-- {
+		for _, m := range visibleMessages(pages[i]) {
+			if !from.IsZero() && m.CreatedAt.Before(from) {
+				continue
+			}
+			if !to.IsZero() && !m.CreatedAt.Before(to) {
+				continue
+			}
+			result = append(result, m)
+		}
+	}
+	return result, nil
+}
+
+func parseExportTime(r *http.Request, key string) (time.Time, error) {
+	v := r.URL.Query().Get(key)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid %s: %q", key, v)
+	}
+	return t, nil
+}
+
+// handleExport handles /admin/export.
+func (s *server) handleExport(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if !isGet(r) {
+		w.Header().Set("Allow", "GET, HEAD")
+		methodNotAllowed(w, r)
+		return
+	}
+
+	q := r.URL.Query()
+	room := q.Get("room")
+	if room == "" {
+		room = defaultRoom
+	}
+	if !s.hasRoom(ctx, room) {
+		notFound(w, r)
+		return
+	}
+	format := q.Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" {
+		msg := fmt.Sprintf("Invalid format: %q", format)
+		writeError(w, r, http.StatusBadRequest, msg)
+		return
+	}
+	from, err := parseExportTime(r, "from")
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	to, err := parseExportTime(r, "to")
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	messages, err := s.exportMessages(ctx, room, from, to)
+	if err != nil {
+		msg := fmt.Sprintf("Store error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "chat-"+room+"."+format))
+	if format == "json" {
+		writeJSON(w, http.StatusOK, &MessagesResponse{
+			Messages:    messages,
+			Count:       len(messages),
+			GeneratedAt: time.Now(),
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "created_at", "name", "body", "edited", "flagged"})
+	for _, m := range messages {
+		cw.Write([]string{
+			strconv.FormatInt(m.ID, 10),
+			m.CreatedAt.Format(time.RFC3339),
+			m.Name,
+			m.Body,
+			strconv.FormatBool(m.Edited),
+			strconv.FormatBool(m.Flagged),
+		})
+	}
+	cw.Flush()
+}
@@ -0,0 +1,185 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// maxQueuedPosts is the maximum number of posts queued in a room while the
+// store is unavailable.
+const maxQueuedPosts = 100
+
+// fallback keeps the chat available in this instance while the store is
+// unavailable. The latest messages read from the store are served as stale
+// data, and posts are queued to be stored later.
+type fallback struct {
+	recent map[string][]Message
+	queued map[string][]Message
+	m      sync.Mutex
+}
+
+func newFallback() *fallback {
+	return &fallback{
+		recent: map[string][]Message{},
+		queued: map[string][]Message{},
+	}
+}
+
+func (f *fallback) setRecent(room string, messages []Message) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.recent[room] = append([]Message(nil), messages...)
+}
+
+// recentMessages returns the latest messages read from the store in the room.
+func (f *fallback) recentMessages(room string) []Message {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return append([]Message{}, f.recent[room]...)
+}
+
+// enqueue queues the post. enqueue returns false if the queue is full.
+func (f *fallback) enqueue(room string, message Message) bool {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if len(f.queued[room]) >= maxQueuedPosts {
+		return false
+	}
+	f.queued[room] = append(f.queued[room], message)
+	return true
+}
+
+// takeQueued removes and returns the queued posts in the room.
+func (f *fallback) takeQueued(room string) []Message {
+	f.m.Lock()
+	defer f.m.Unlock()
+	messages := f.queued[room]
+	delete(f.queued, room)
+	return messages
+}
+
+// takeAllQueued removes and returns the queued posts in all the rooms.
+func (f *fallback) takeAllQueued() map[string][]Message {
+	f.m.Lock()
+	defer f.m.Unlock()
+	queued := f.queued
+	f.queued = map[string][]Message{}
+	return queued
+}
+
+// requeue puts back the posts that could not be stored to the head of the
+// queue.
+func (f *fallback) requeue(room string, messages []Message) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.queued[room] = append(messages, f.queued[room]...)
+}
+
+// replayQueued stores the queued posts in the room in the posted order. The
+// rest is queued again when the store fails.
+func (s *server) replayQueued(ctx context.Context, room string) {
+	queued := s.fallback.takeQueued(room)
+	if len(queued) == 0 {
+		return
+	}
+	ids, err := s.storeQueued(ctx, room, queued)
+	if err != nil {
+		s.fallback.requeue(room, queued[len(ids):])
+	}
+}
+
+// storeQueued stores the queued posts in the room at once, and delivers them.
+// The revision of the room was already increased when the posts were
+// accepted. If an error occurs, the IDs of the posts stored so far are returned with the
+// error.
+func (s *server) storeQueued(ctx context.Context, room string, queued []Message) ([]int64, error) {
+	ids, err := appendMessages(ctx, s.store, room, queued)
+	for i, id := range ids {
+		m := queued[i]
+		m.ID = id
+		postsTotal.WithLabelValues(room).Inc()
+		s.posted(ctx, room, m)
+	}
+	if len(ids) > 0 {
+		// Trimming can wait for the next post if it fails.
+		s.store.Trim(ctx, room, s.historyLength(ctx, room))
+	}
+	return ids, err
+}
+
+// postQueue is a queue outside the instance to store posts later.
+type postQueue interface {
+	// Enqueue adds the posts in the room to the queue. The posts are sent
+	// to /tasks/posts in the posted order.
+	Enqueue(ctx context.Context, room string, messages []Message) error
+}
+
+// QueuedPosts is the JSON representation of the posts sent to /tasks/posts.
+type QueuedPosts struct {
+	Room     string    `json:"room"`
+	Messages []Message `json:"messages"`
+}
+
+// handleStop handles /_ah/stop, which App Engine requests when the instance
+// shuts down. The posts queued in the instance are handed over to the post
+// queue.
+func (s *server) handleStop(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	for room, messages := range s.fallback.takeAllQueued() {
+		if err := s.postQueue.Enqueue(ctx, room, messages); err != nil {
+			s.logf(ctx, "Post queue error: %v: %d posts in %s are lost", err, len(messages), room)
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleQueuedPosts handles POST /tasks/posts, which stores the posts from the
+// post queue. This requires the request from the queue or the admin token.
+func (s *server) handleQueuedPosts(w http.ResponseWriter, r *http.Request) {
+	if !(s.cron && r.Header.Get("X-Appengine-Queuename") != "") && !s.checkAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		methodNotAllowed(w, r)
+		return
+	}
+
+	var req QueuedPosts
+	if !decodeJSON(w, r, &req, maxAdminContentSize) {
+		return
+	}
+	ctx := r.Context()
+	if !s.hasRoom(ctx, req.Room) {
+		notFound(w, r)
+		return
+	}
+
+	ids, err := s.storeQueued(ctx, req.Room, req.Messages)
+	if err != nil {
+		// Queue the rest again instead of failing the task, so that the
+		// stored posts are not stored twice by the retry.
+		if err := s.postQueue.Enqueue(ctx, req.Room, req.Messages[len(ids):]); err != nil {
+			msg := fmt.Sprintf("Post queue error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
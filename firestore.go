@@ -0,0 +1,477 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build firestore
+
+package chatserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	firestoreRoomCollection    = "rooms"
+	firestoreMessageCollection = "messages"
+	firestoreEventCollection   = "events"
+	firestoreKVCollection      = "kv"
+
+	// firestoreBatchSize is the maximum number of writes in a batch.
+	firestoreBatchSize = 500
+
+	// firestoreEventTTL is how long the events relayed between the servers
+	// are kept. The events are removed by the TTL policy on expires_at.
+	firestoreEventTTL = time.Hour
+)
+
+// firestoreRoom is the document of a room, which counts the IDs of the
+// messages in the room.
+type firestoreRoom struct {
+	LastID int64 `firestore:"last_id"`
+}
+
+// firestoreMessage is the document of a message at
+// rooms/{room}/messages/{id}. The message is kept in JSON, and the ID and
+// the time are also kept as fields for the queries.
+type firestoreMessage struct {
+	ID        int64     `firestore:"id"`
+	CreatedAt time.Time `firestore:"created_at"`
+	Data      []byte    `firestore:"data"`
+}
+
+func newFirestoreMessage(m *Message) (*firestoreMessage, error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return &firestoreMessage{
+		ID:        m.ID,
+		CreatedAt: m.CreatedAt,
+		Data:      b,
+	}, nil
+}
+
+func (f *firestoreMessage) message() (Message, error) {
+	var m Message
+	if err := json.Unmarshal(f.Data, &m); err != nil {
+		return Message{}, err
+	}
+	return m, nil
+}
+
+// firestoreEvent is the document of a message relayed between the servers.
+// CreatedAt is set by the Firestore server so that the events are ordered
+// regardless of the clocks of the servers.
+type firestoreEvent struct {
+	Origin    string    `firestore:"origin"`
+	Room      string    `firestore:"room"`
+	Data      []byte    `firestore:"data"`
+	CreatedAt time.Time `firestore:"created_at,serverTimestamp"`
+	ExpiresAt time.Time `firestore:"expires_at"`
+}
+
+// isFirestoreNotFound reports whether err is returned for a missing
+// document.
+func isFirestoreNotFound(err error) bool {
+	return status.Code(err) == codes.NotFound
+}
+
+// firestoreStore is a Store on Cloud Firestore in Native mode. The messages
+// in a room are the documents in the subcollection of the room.
+// firestoreStore is also a Broker that listens to the events collection.
+type firestoreStore struct {
+	client *firestore.Client
+	origin string
+
+	// lastEvent is the last event seen by Subscribe, where the next
+	// Subscribe starts.
+	lastEvent  *firestore.DocumentSnapshot
+	lastEventM sync.Mutex
+}
+
+// NewFirestoreStore returns a Store that keeps messages in Cloud Firestore.
+// The returned Store also implements Broker so that multiple servers can share
+// the messages without memcache.
+func NewFirestoreStore(client *firestore.Client) Store {
+	return &firestoreStore{
+		client: client,
+		origin: newOrigin(),
+	}
+}
+
+func (s *firestoreStore) roomRef(room string) *firestore.DocumentRef {
+	return s.client.Collection(firestoreRoomCollection).Doc(room)
+}
+
+func (s *firestoreStore) messages(room string) *firestore.CollectionRef {
+	return s.roomRef(room).Collection(firestoreMessageCollection)
+}
+
+func (s *firestoreStore) messageRef(room string, id int64) *firestore.DocumentRef {
+	return s.messages(room).Doc(strconv.FormatInt(id, 10))
+}
+
+// firestoreMessages returns the messages in the documents in the same order.
+func firestoreMessages(docs []*firestore.DocumentSnapshot) ([]Message, error) {
+	messages := make([]Message, 0, len(docs))
+	for _, d := range docs {
+		var f firestoreMessage
+		if err := d.DataTo(&f); err != nil {
+			return nil, err
+		}
+		m, err := f.message()
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	return messages, nil
+}
+
+func (s *firestoreStore) Get(ctx context.Context, room string) ([]Message, error) {
+	docs, err := s.messages(room).OrderBy("id", firestore.Asc).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	return firestoreMessages(docs)
+}
+
+func (s *firestoreStore) Append(ctx context.Context, room string, message Message) (int64, error) {
+	ids, err := s.AppendMulti(ctx, room, []Message{message})
+	if err != nil {
+		return 0, err
+	}
+	return ids[0], nil
+}
+
+func (s *firestoreStore) AppendMulti(ctx context.Context, room string, messages []Message) ([]int64, error) {
+	var ids []int64
+	if err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		var r firestoreRoom
+		d, err := tx.Get(s.roomRef(room))
+		if err != nil && !isFirestoreNotFound(err) {
+			return err
+		}
+		if err == nil {
+			if err := d.DataTo(&r); err != nil {
+				return err
+			}
+		}
+		ids = make([]int64, len(messages))
+		for i, m := range messages {
+			r.LastID++
+			m.ID = r.LastID
+			f, err := newFirestoreMessage(&m)
+			if err != nil {
+				return err
+			}
+			if err := tx.Create(s.messageRef(room, m.ID), f); err != nil {
+				return err
+			}
+			ids[i] = m.ID
+		}
+		return tx.Set(s.roomRef(room), &r)
+	}); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// deleteDocs deletes the documents of the query in batches, and returns the
+// number of the deleted documents.
+func (s *firestoreStore) deleteDocs(ctx context.Context, q firestore.Query) (int, error) {
+	n := 0
+	for {
+		docs, err := q.Limit(firestoreBatchSize).Documents(ctx).GetAll()
+		if err != nil {
+			return n, err
+		}
+		if len(docs) == 0 {
+			return n, nil
+		}
+		b := s.client.Batch()
+		for _, d := range docs {
+			b.Delete(d.Ref)
+		}
+		if _, err := b.Commit(ctx); err != nil {
+			return n, err
+		}
+		n += len(docs)
+		if len(docs) < firestoreBatchSize {
+			return n, nil
+		}
+	}
+}
+
+// Trim does nothing. Firestore keeps the whole history for paging, search and
+// export, and old messages are removed by Purge and Remove.
+func (s *firestoreStore) Trim(ctx context.Context, room string, n int) error {
+	return nil
+}
+
+func (s *firestoreStore) History(ctx context.Context, room string, before int64, limit int) ([]Message, error) {
+	q := s.messages(room).Query
+	if before > 0 {
+		q = q.Where("id", "<", before)
+	}
+	docs, err := q.OrderBy("id", firestore.Desc).Limit(limit).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	messages, err := firestoreMessages(docs)
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+func (s *firestoreStore) Purge(ctx context.Context, room string, before time.Time) (int, error) {
+	return s.deleteDocs(ctx, s.messages(room).Where("created_at", "<", before))
+}
+
+func (s *firestoreStore) Remove(ctx context.Context, room string, ids []int64) (int, error) {
+	n := 0
+	for n < len(ids) {
+		end := n + firestoreBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		b := s.client.Batch()
+		for _, id := range ids[n:end] {
+			b.Delete(s.messageRef(room, id))
+		}
+		if _, err := b.Commit(ctx); err != nil {
+			return n, err
+		}
+		n = end
+	}
+	return n, nil
+}
+
+func (s *firestoreStore) Update(ctx context.Context, room string, id int64, f func(*Message)) (Message, error) {
+	var m Message
+	ref := s.messageRef(room, id)
+	if err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		d, err := tx.Get(ref)
+		if err != nil {
+			if isFirestoreNotFound(err) {
+				return ErrNotFound
+			}
+			return err
+		}
+		var fm firestoreMessage
+		if err := d.DataTo(&fm); err != nil {
+			return err
+		}
+		m, err = fm.message()
+		if err != nil {
+			return err
+		}
+		f(&m)
+		updated, err := newFirestoreMessage(&m)
+		if err != nil {
+			return err
+		}
+		return tx.Set(ref, updated)
+	}); err != nil {
+		return Message{}, err
+	}
+	return m, nil
+}
+
+func (s *firestoreStore) Publish(ctx context.Context, room string, message Message) error {
+	b, err := json.Marshal(&message)
+	if err != nil {
+		return err
+	}
+	_, _, err = s.client.Collection(firestoreEventCollection).Add(ctx, &firestoreEvent{
+		Origin:    s.origin,
+		Room:      room,
+		Data:      b,
+		ExpiresAt: time.Now().Add(firestoreEventTTL),
+	})
+	return err
+}
+
+// Subscribe listens to the events in the order of the time on the Firestore
+// server, after the last event seen by the previous call. The first call
+// starts after the latest event. The events published while the listener is
+// reconnecting are delivered until they expire.
+func (s *firestoreStore) Subscribe(ctx context.Context, f func(room string, message Message)) error {
+	events := s.client.Collection(firestoreEventCollection)
+
+	s.lastEventM.Lock()
+	last := s.lastEvent
+	s.lastEventM.Unlock()
+	if last == nil {
+		docs, err := events.OrderBy("created_at", firestore.Desc).Limit(1).Documents(ctx).GetAll()
+		if err != nil {
+			return err
+		}
+		if len(docs) > 0 {
+			last = docs[0]
+		}
+	}
+
+	q := events.OrderBy("created_at", firestore.Asc)
+	if last != nil {
+		q = q.StartAfter(last)
+	}
+	it := q.Snapshots(ctx)
+	defer it.Stop()
+	for {
+		snap, err := it.Next()
+		if err != nil {
+			return err
+		}
+		for _, c := range snap.Changes {
+			if c.Kind != firestore.DocumentAdded {
+				continue
+			}
+			s.lastEventM.Lock()
+			s.lastEvent = c.Doc
+			s.lastEventM.Unlock()
+
+			var e firestoreEvent
+			if err := c.Doc.DataTo(&e); err != nil {
+				return err
+			}
+			if e.Origin == s.origin {
+				continue
+			}
+			var m Message
+			if err := json.Unmarshal(e.Data, &m); err != nil {
+				return err
+			}
+			f(e.Room, m)
+		}
+	}
+}
+
+// firestoreKVItem is the document of a value in the kv collection. Values are
+// stored as JSON.
+type firestoreKVItem struct {
+	Data      []byte    `firestore:"data"`
+	ExpiresAt time.Time `firestore:"expires_at,omitempty"`
+}
+
+func (i *firestoreKVItem) expired() bool {
+	return !i.ExpiresAt.IsZero() && !time.Now().Before(i.ExpiresAt)
+}
+
+// firestoreKV is a KV on Cloud Firestore in Native mode. The expired values
+// are ignored on read, and removed by the TTL policy on expires_at if it is
+// configured.
+type firestoreKV struct {
+	client *firestore.Client
+}
+
+// NewFirestoreKV returns a KV that keeps values in Cloud Firestore.
+func NewFirestoreKV(client *firestore.Client) KV {
+	return &firestoreKV{
+		client: client,
+	}
+}
+
+// ref returns the document of the key. Keys can contain slashes, which
+// are not allowed in document IDs, so the keys are escaped.
+func (kv *firestoreKV) ref(key string) *firestore.DocumentRef {
+	return kv.client.Collection(firestoreKVCollection).Doc(url.PathEscape(key))
+}
+
+func newFirestoreKVItem(v interface{}, expiration time.Duration) (*firestoreKVItem, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	item := &firestoreKVItem{
+		Data: b,
+	}
+	if expiration > 0 {
+		item.ExpiresAt = time.Now().Add(expiration)
+	}
+	return item, nil
+}
+
+// load loads the value in the document into v.
+func (kv *firestoreKV) load(d *firestore.DocumentSnapshot, v interface{}) error {
+	var item firestoreKVItem
+	if err := d.DataTo(&item); err != nil {
+		return err
+	}
+	if item.expired() {
+		return ErrNotFound
+	}
+	return json.Unmarshal(item.Data, v)
+}
+
+func (kv *firestoreKV) Get(ctx context.Context, key string, v interface{}) error {
+	d, err := kv.ref(key).Get(ctx)
+	if err != nil {
+		if isFirestoreNotFound(err) {
+			return ErrNotFound
+		}
+		return err
+	}
+	return kv.load(d, v)
+}
+
+func (kv *firestoreKV) Set(ctx context.Context, key string, v interface{}, expiration time.Duration) error {
+	item, err := newFirestoreKVItem(v, expiration)
+	if err != nil {
+		return err
+	}
+	_, err = kv.ref(key).Set(ctx, item)
+	return err
+}
+
+func (kv *firestoreKV) Update(ctx context.Context, key string, v interface{}, expiration time.Duration, f func() error) error {
+	ref := kv.ref(key)
+	return kv.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		resetValue(v)
+		d, err := tx.Get(ref)
+		if err != nil && !isFirestoreNotFound(err) {
+			return err
+		}
+		if err == nil {
+			if err := kv.load(d, v); err != nil && err != ErrNotFound {
+				return err
+			}
+		}
+		if err := f(); err != nil {
+			return err
+		}
+		item, err := newFirestoreKVItem(v, expiration)
+		if err != nil {
+			return err
+		}
+		return tx.Set(ref, item)
+	})
+}
+
+func (kv *firestoreKV) Delete(ctx context.Context, key string) error {
+	_, err := kv.ref(key).Delete(ctx)
+	return err
+}
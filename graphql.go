@@ -0,0 +1,717 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/graph-gophers/graphql-go"
+	"golang.org/x/net/websocket"
+)
+
+const graphQLSchema = `
+schema {
+	query: Query
+	mutation: Mutation
+	subscription: Subscription
+}
+
+type Query {
+	# The latest messages in the room, or the older ones before the ID.
+	messages(room: String, before: ID, limit: Int): MessageList!
+	rooms: [String!]!
+	# The messages whose bodies contain all the words in the query.
+	search(room: String, query: String!, before: ID, limit: Int): SearchResults!
+}
+
+type Mutation {
+	postMessage(room: String, name: String!, body: String!): PostMessagePayload!
+}
+
+type Subscription {
+	# The new messages in the room. A changed message, like an edited or a
+	# deleted one, is sent again with the same ID.
+	messageAdded(room: String): Message!
+}
+
+scalar Time
+
+type Message {
+	id: ID!
+	name: String!
+	body: String!
+	createdAt: Time!
+	deleted: Boolean!
+	edited: Boolean!
+	flagged: Boolean!
+	sessionId: String
+	mentions: [String!]!
+	pinned: Boolean!
+	poll: Poll
+	action: Boolean!
+	bot: Boolean!
+	source: String
+	preview: LinkPreview
+}
+
+type Poll {
+	options: [PollOption!]!
+}
+
+type PollOption {
+	text: String!
+	votes: Int!
+}
+
+type LinkPreview {
+	url: String!
+	title: String!
+	description: String
+	image: String
+}
+
+type MessageList {
+	messages: [Message!]!
+	pinned: [Message!]!
+	# The ID to get the older messages with, or null if there are none.
+	nextBefore: ID
+	revision: String!
+	stale: Boolean!
+}
+
+type SearchResults {
+	results: [SearchResult!]!
+	nextBefore: ID
+}
+
+type SearchResult {
+	message: Message!
+	highlight: String!
+}
+
+type PostMessagePayload {
+	message: Message!
+	# The token to edit the message, or null if the message is queued.
+	editToken: String
+	queued: Boolean!
+}
+`
+
+// maxGraphQLContentSize is the maximum size of a GraphQL request body, which
+// is larger than max_content_size for the query and the variables.
+const maxGraphQLContentSize = 64 << 10
+
+// graphQLWSProtocol is the WebSocket subprotocol of GraphQL subscriptions.
+// See https://github.com/enisdenjo/graphql-ws/blob/master/PROTOCOL.md.
+const graphQLWSProtocol = "graphql-transport-ws"
+
+// graphQLHeaders is the headers of a GraphQL request passed to the HTTP API.
+var graphQLHeaders = []string{"Accept-Language", "Authorization", "Cookie", "Idempotency-Key", "If-Match", "Origin", csrfHeader, "X-Request-Id"}
+
+// graphQLRequestKey is the context key of the HTTP request of a GraphQL
+// request.
+type graphQLRequestKey struct{}
+
+// graphQLRequest is a GraphQL request in JSON.
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// graphQLService serves the GraphQL API at /graphql, and is the root resolver
+// of the schema. Like the gRPC API, queries and mutations are served by the
+// HTTP API under /v1 so that the requests are checked in the same way.
+type graphQLService struct {
+	server  *server
+	handler http.Handler
+	schema  *graphql.Schema
+}
+
+func newGraphQLService(s *server) *graphQLService {
+	g := &graphQLService{server: s}
+	g.schema = graphql.MustParseSchema(graphQLSchema, g)
+	return g
+}
+
+// graphQLError is an error response of the HTTP API. The code is in the
+// extensions of the GraphQL error.
+type graphQLError struct {
+	status int
+	err    APIError
+}
+
+func newGraphQLError(status int) *graphQLError {
+	return &graphQLError{
+		status: status,
+		err: APIError{
+			Code:    errorCodes[status],
+			Message: http.StatusText(status),
+		},
+	}
+}
+
+func (e *graphQLError) Error() string {
+	return e.err.Message
+}
+
+// Extensions implements the interface of the errors with extensions in
+// github.com/graph-gophers/graphql-go.
+func (e *graphQLError) Extensions() map[string]interface{} {
+	ext := map[string]interface{}{
+		"code":   e.err.Code,
+		"status": e.status,
+	}
+	if len(e.err.Fields) > 0 {
+		ext["fields"] = e.err.Fields
+	}
+	return ext
+}
+
+// serverContext returns the context to read the server's states like the
+// rooms on behalf of the GraphQL request in ctx.
+func (g *graphQLService) serverContext(ctx context.Context) context.Context {
+	if orig, ok := ctx.Value(graphQLRequestKey{}).(*http.Request); ok {
+		return orig.Context()
+	}
+	return ctx
+}
+
+// call sends the request to the HTTP API on behalf of the GraphQL request in
+// ctx, and decodes the JSON response into v. An error response is returned as
+// a *graphQLError.
+func (g *graphQLService) call(ctx context.Context, method, path string, req, v interface{}) error {
+	orig, ok := ctx.Value(graphQLRequestKey{}).(*http.Request)
+	if !ok {
+		return errors.New("chatserver: no GraphQL request")
+	}
+	var body bytes.Buffer
+	if req != nil {
+		if err := json.NewEncoder(&body).Encode(req); err != nil {
+			return err
+		}
+	}
+	r, err := http.NewRequest(method, path, &body)
+	if err != nil {
+		return err
+	}
+	r = r.WithContext(ctx)
+	r.Header.Set("Accept", mediaJSON)
+	if req != nil {
+		r.Header.Set("Content-Type", mediaJSON)
+	}
+	for _, h := range graphQLHeaders {
+		if v := orig.Header.Get(h); v != "" {
+			r.Header.Set(h, v)
+		}
+	}
+	r.RemoteAddr = orig.RemoteAddr
+
+	w := &bufferedResponse{header: http.Header{}}
+	g.handler.ServeHTTP(w, r)
+	if w.status >= 400 {
+		gerr := newGraphQLError(w.status)
+		var res ErrorResponse
+		if err := json.Unmarshal(w.body.Bytes(), &res); err == nil {
+			gerr.err = res.Error
+		}
+		return gerr
+	}
+	return json.Unmarshal(w.body.Bytes(), v)
+}
+
+func graphQLRoom(room *string) string {
+	if room == nil {
+		return defaultRoom
+	}
+	return roomOf(*room)
+}
+
+func graphQLPage(q url.Values, before *graphql.ID, limit *int32) url.Values {
+	if before != nil {
+		q.Set("before", string(*before))
+	}
+	if limit != nil {
+		q.Set("limit", strconv.Itoa(int(*limit)))
+	}
+	return q
+}
+
+func graphQLNextBefore(next string) *graphql.ID {
+	before := nextBefore(next)
+	if before == 0 {
+		return nil
+	}
+	id := graphql.ID(strconv.FormatInt(before, 10))
+	return &id
+}
+
+func (g *graphQLService) Messages(ctx context.Context, args struct {
+	Room   *string
+	Before *graphql.ID
+	Limit  *int32
+}) (*graphQLMessageList, error) {
+	q := graphQLPage(url.Values{}, args.Before, args.Limit)
+	path := "/v1" + roomPath(graphQLRoom(args.Room)) + "api/messages"
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	var res MessagesResponse
+	if err := g.call(ctx, http.MethodGet, path, nil, &res); err != nil {
+		return nil, err
+	}
+	return &graphQLMessageList{res}, nil
+}
+
+func (g *graphQLService) Rooms(ctx context.Context) []string {
+	return g.server.listedRooms(g.serverContext(ctx))
+}
+
+func (g *graphQLService) Search(ctx context.Context, args struct {
+	Room   *string
+	Query  string
+	Before *graphql.ID
+	Limit  *int32
+}) (*graphQLSearchResults, error) {
+	q := graphQLPage(url.Values{"q": {args.Query}}, args.Before, args.Limit)
+	path := "/v1" + roomPath(graphQLRoom(args.Room)) + "search?" + q.Encode()
+	var res SearchResponse
+	if err := g.call(ctx, http.MethodGet, path, nil, &res); err != nil {
+		return nil, err
+	}
+	return &graphQLSearchResults{res}, nil
+}
+
+func (g *graphQLService) PostMessage(ctx context.Context, args struct {
+	Room *string
+	Name string
+	Body string
+}) (*graphQLPostMessagePayload, error) {
+	var res PostResponse
+	if err := g.call(ctx, http.MethodPost, "/v1"+roomPath(graphQLRoom(args.Room))+"messages", &Message{
+		Name: args.Name,
+		Body: args.Body,
+	}, &res); err != nil {
+		return nil, err
+	}
+	return &graphQLPostMessagePayload{res}, nil
+}
+
+func (g *graphQLService) MessageAdded(ctx context.Context, args struct {
+	Room *string
+}) (<-chan *graphQLMessage, error) {
+	room := graphQLRoom(args.Room)
+	if !g.server.hasRoom(g.serverContext(ctx), room) {
+		return nil, newGraphQLError(http.StatusNotFound)
+	}
+
+	ch := g.server.hub.subscribe(room)
+	c := make(chan *graphQLMessage)
+	go func() {
+		defer close(c)
+		defer g.server.hub.unsubscribe(room, ch)
+		for {
+			select {
+			case m := <-ch:
+				if m.Typing {
+					continue
+				}
+				select {
+				case c <- &graphQLMessage{m}:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return c, nil
+}
+
+type graphQLMessage struct {
+	m Message
+}
+
+func (m *graphQLMessage) ID() graphql.ID {
+	return graphql.ID(strconv.FormatInt(m.m.ID, 10))
+}
+
+func (m *graphQLMessage) Name() string {
+	return m.m.Name
+}
+
+func (m *graphQLMessage) Body() string {
+	return m.m.Body
+}
+
+func (m *graphQLMessage) CreatedAt() graphql.Time {
+	return graphql.Time{Time: m.m.CreatedAt}
+}
+
+func (m *graphQLMessage) Deleted() bool {
+	return m.m.Deleted
+}
+
+func (m *graphQLMessage) Edited() bool {
+	return m.m.Edited
+}
+
+func (m *graphQLMessage) Flagged() bool {
+	return m.m.Flagged
+}
+
+func (m *graphQLMessage) SessionID() *string {
+	return optionalString(m.m.SessionID)
+}
+
+func (m *graphQLMessage) Mentions() []string {
+	if m.m.Mentions == nil {
+		return []string{}
+	}
+	return m.m.Mentions
+}
+
+func (m *graphQLMessage) Pinned() bool {
+	return m.m.Pinned
+}
+
+func (m *graphQLMessage) Poll() *graphQLPoll {
+	if m.m.Poll == nil {
+		return nil
+	}
+	return &graphQLPoll{*m.m.Poll}
+}
+
+func (m *graphQLMessage) Action() bool {
+	return m.m.Action
+}
+
+func (m *graphQLMessage) Bot() bool {
+	return m.m.Bot
+}
+
+func (m *graphQLMessage) Source() *string {
+	return optionalString(m.m.Source)
+}
+
+func (m *graphQLMessage) Preview() *graphQLLinkPreview {
+	if m.m.Preview == nil {
+		return nil
+	}
+	return &graphQLLinkPreview{*m.m.Preview}
+}
+
+func graphQLMessages(messages []Message) []*graphQLMessage {
+	ms := make([]*graphQLMessage, len(messages))
+	for i, m := range messages {
+		ms[i] = &graphQLMessage{m}
+	}
+	return ms
+}
+
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+type graphQLPoll struct {
+	p Poll
+}
+
+func (p *graphQLPoll) Options() []*graphQLPollOption {
+	options := make([]*graphQLPollOption, len(p.p.Options))
+	for i, o := range p.p.Options {
+		options[i] = &graphQLPollOption{o}
+	}
+	return options
+}
+
+type graphQLPollOption struct {
+	o PollOption
+}
+
+func (o *graphQLPollOption) Text() string {
+	return o.o.Text
+}
+
+func (o *graphQLPollOption) Votes() int32 {
+	return int32(o.o.Votes)
+}
+
+type graphQLLinkPreview struct {
+	p LinkPreview
+}
+
+func (p *graphQLLinkPreview) URL() string {
+	return p.p.URL
+}
+
+func (p *graphQLLinkPreview) Title() string {
+	return p.p.Title
+}
+
+func (p *graphQLLinkPreview) Description() *string {
+	return optionalString(p.p.Description)
+}
+
+func (p *graphQLLinkPreview) Image() *string {
+	return optionalString(p.p.Image)
+}
+
+type graphQLMessageList struct {
+	res MessagesResponse
+}
+
+func (l *graphQLMessageList) Messages() []*graphQLMessage {
+	return graphQLMessages(l.res.Messages)
+}
+
+func (l *graphQLMessageList) Pinned() []*graphQLMessage {
+	return graphQLMessages(l.res.Pinned)
+}
+
+func (l *graphQLMessageList) NextBefore() *graphql.ID {
+	return graphQLNextBefore(l.res.Next)
+}
+
+func (l *graphQLMessageList) Revision() string {
+	return strconv.FormatInt(l.res.Revision, 10)
+}
+
+func (l *graphQLMessageList) Stale() bool {
+	return l.res.Stale
+}
+
+type graphQLSearchResults struct {
+	res SearchResponse
+}
+
+func (r *graphQLSearchResults) Results() []*graphQLSearchResult {
+	rs := make([]*graphQLSearchResult, len(r.res.Results))
+	for i, result := range r.res.Results {
+		rs[i] = &graphQLSearchResult{result}
+	}
+	return rs
+}
+
+func (r *graphQLSearchResults) NextBefore() *graphql.ID {
+	return graphQLNextBefore(r.res.Next)
+}
+
+type graphQLSearchResult struct {
+	r SearchResult
+}
+
+func (r *graphQLSearchResult) Message() *graphQLMessage {
+	return &graphQLMessage{r.r.Message}
+}
+
+func (r *graphQLSearchResult) Highlight() string {
+	return r.r.Highlight
+}
+
+type graphQLPostMessagePayload struct {
+	res PostResponse
+}
+
+func (p *graphQLPostMessagePayload) Message() *graphQLMessage {
+	return &graphQLMessage{p.res.Message}
+}
+
+func (p *graphQLPostMessagePayload) EditToken() *string {
+	return optionalString(p.res.EditToken)
+}
+
+func (p *graphQLPostMessagePayload) Queued() bool {
+	return p.res.Queued
+}
+
+// ServeHTTP handles /graphql. Queries and mutations are sent with GET or POST,
+// and subscriptions are sent over WebSocket.
+func (g *graphQLService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if g.server.handleCORS(w, r) {
+		return
+	}
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		websocket.Server{
+			Handshake: handshakeGraphQL,
+			Handler:   g.serveWebSocket,
+		}.ServeHTTP(w, r)
+		return
+	}
+
+	var req graphQLRequest
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		q := r.URL.Query()
+		req.Query = q.Get("query")
+		req.OperationName = q.Get("operationName")
+		if v := q.Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				writeError(w, r, http.StatusBadRequest, "Invalid variables")
+				return
+			}
+		}
+	case http.MethodPost:
+		if !decodeJSON(w, r, &req, maxGraphQLContentSize) {
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		methodNotAllowed(w, r)
+		return
+	}
+	if req.Query == "" {
+		writeError(w, r, http.StatusBadRequest, "Missing query")
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), graphQLRequestKey{}, r)
+	writeJSON(w, http.StatusOK, g.schema.Exec(ctx, req.Query, req.OperationName, req.Variables))
+}
+
+// handshakeGraphQL accepts WebSocket connections with graphQLWSProtocol.
+func handshakeGraphQL(config *websocket.Config, r *http.Request) error {
+	for _, p := range config.Protocol {
+		if p == graphQLWSProtocol {
+			config.Protocol = []string{p}
+			return nil
+		}
+	}
+	return websocket.ErrBadWebSocketProtocol
+}
+
+// graphQLWSMessage is a message of graphQLWSProtocol.
+type graphQLWSMessage struct {
+	ID      string      `json:"id,omitempty"`
+	Type    string      `json:"type"`
+	Payload interface{} `json:"payload,omitempty"`
+}
+
+// serveWebSocket runs the operations sent over WebSocket, and sends their
+// results until the client completes them. The connection is closed on
+// protocol errors.
+func (g *graphQLService) serveWebSocket(ws *websocket.Conn) {
+	if !g.server.beginStream() {
+		return
+	}
+	defer g.server.endStream()
+
+	r := ws.Request()
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(context.WithValue(r.Context(), graphQLRequestKey{}, r))
+	defer cancel()
+
+	// Closing the connection stops receiving the operations on shutdown.
+	go func() {
+		select {
+		case <-g.server.draining:
+			ws.Close()
+		case <-ctx.Done():
+		}
+	}()
+
+	var mu sync.Mutex
+	ops := map[string]context.CancelFunc{}
+	acked := false
+	for {
+		var m struct {
+			ID      string          `json:"id"`
+			Type    string          `json:"type"`
+			Payload json.RawMessage `json:"payload"`
+		}
+		if err := websocket.JSON.Receive(ws, &m); err != nil {
+			return
+		}
+		switch m.Type {
+		case "connection_init":
+			if acked {
+				return
+			}
+			acked = true
+			websocket.JSON.Send(ws, &graphQLWSMessage{Type: "connection_ack"})
+
+		case "ping":
+			websocket.JSON.Send(ws, &graphQLWSMessage{Type: "pong"})
+
+		case "pong":
+
+		case "subscribe":
+			var req graphQLRequest
+			if !acked || m.ID == "" || json.Unmarshal(m.Payload, &req) != nil {
+				return
+			}
+			mu.Lock()
+			_, running := ops[m.ID]
+			opCtx, opCancel := context.WithCancel(ctx)
+			if !running {
+				ops[m.ID] = opCancel
+			}
+			mu.Unlock()
+			if running {
+				opCancel()
+				return
+			}
+
+			c, err := g.schema.Subscribe(opCtx, req.Query, req.OperationName, req.Variables)
+			if err != nil {
+				opCancel()
+				return
+			}
+			wg.Add(1)
+			go func(id string) {
+				defer wg.Done()
+				for res := range c {
+					if websocket.JSON.Send(ws, &graphQLWSMessage{ID: id, Type: "next", Payload: res}) != nil {
+						ws.Close()
+					}
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				// The operation completed by the client is not completed
+				// again.
+				if _, ok := ops[id]; !ok {
+					return
+				}
+				delete(ops, id)
+				opCancel()
+				websocket.JSON.Send(ws, &graphQLWSMessage{ID: id, Type: "complete"})
+			}(m.ID)
+
+		case "complete":
+			mu.Lock()
+			if cancel, ok := ops[m.ID]; ok {
+				cancel()
+				delete(ops, m.ID)
+			}
+			mu.Unlock()
+
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/golangtokyo/chatserver/chatpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// grpcHeaders is the gRPC metadata passed to the HTTP API as the headers.
+var grpcHeaders = []string{"Authorization", "Idempotency-Key", "If-Match", "X-Request-Id"}
+
+// grpcCodes is the gRPC codes by the HTTP status codes.
+var grpcCodes = map[int]codes.Code{
+	http.StatusBadRequest:            codes.InvalidArgument,
+	http.StatusUnauthorized:          codes.Unauthenticated,
+	http.StatusForbidden:             codes.PermissionDenied,
+	http.StatusNotFound:              codes.NotFound,
+	http.StatusConflict:              codes.Aborted,
+	http.StatusRequestEntityTooLarge: codes.InvalidArgument,
+	http.StatusUnprocessableEntity:   codes.InvalidArgument,
+	http.StatusLocked:                codes.FailedPrecondition,
+	http.StatusTooManyRequests:       codes.ResourceExhausted,
+	http.StatusServiceUnavailable:    codes.Unavailable,
+}
+
+// NewGRPCHandler is like NewHandler, and also returns a gRPC server of the
+// chatpb.Chat service sharing the chat with the handler.
+func NewGRPCHandler(ctx context.Context, store Store, kv KV, config Config) (http.Handler, *grpc.Server) {
+	s := newServer(store, kv, config)
+	s.start(ctx)
+	h := s.handler()
+	return h, newGRPCServer(s, h)
+}
+
+// newGRPCServer returns a gRPC server of the chatpb.Chat service serving the
+// calls with h.
+func newGRPCServer(s *server, h http.Handler) *grpc.Server {
+	g := grpc.NewServer()
+	chatpb.RegisterChatServer(g, &grpcService{
+		server:  s,
+		handler: h,
+	})
+	return g
+}
+
+// grpcService is the chatpb.Chat service. Unary calls are served by the HTTP
+// API under /v1 so that the requests are checked in the same way, like rate
+// limits, bans and the word filter.
+type grpcService struct {
+	chatpb.UnimplementedChatServer
+
+	server  *server
+	handler http.Handler
+}
+
+// bufferedResponse is an http.ResponseWriter keeping the response in memory.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedResponse) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedResponse) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *bufferedResponse) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(b)
+}
+
+// call sends the request to the HTTP API, and decodes the JSON response into
+// v. An error response is returned as a gRPC status.
+func (g *grpcService) call(ctx context.Context, method, path string, req, v interface{}) error {
+	var body bytes.Buffer
+	if req != nil {
+		if err := json.NewEncoder(&body).Encode(req); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+	r, err := http.NewRequest(method, path, &body)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	r = r.WithContext(ctx)
+	r.Header.Set("Accept", "application/json")
+	if req != nil {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for _, h := range grpcHeaders {
+			if vs := md.Get(h); len(vs) > 0 {
+				r.Header.Set(h, vs[0])
+			}
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String()
+	}
+
+	w := &bufferedResponse{header: http.Header{}}
+	g.handler.ServeHTTP(w, r)
+	if w.status >= 400 {
+		return responseStatus(w)
+	}
+	if err := json.Unmarshal(w.body.Bytes(), v); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
+
+// responseStatus returns the gRPC status of the error response.
+func responseStatus(w *bufferedResponse) error {
+	code, ok := grpcCodes[w.status]
+	if !ok {
+		code = codes.Internal
+	}
+	var res ErrorResponse
+	if err := json.Unmarshal(w.body.Bytes(), &res); err != nil {
+		return status.Error(code, http.StatusText(w.status))
+	}
+	msg := res.Error.Message
+	if len(res.Error.Fields) > 0 {
+		var fields []string
+		for _, f := range res.Error.Fields {
+			fields = append(fields, f.Field+": "+f.Message)
+		}
+		msg += ": " + strings.Join(fields, ", ")
+	}
+	return status.Error(code, msg)
+}
+
+func roomOf(room string) string {
+	if room == "" {
+		return defaultRoom
+	}
+	return room
+}
+
+func (g *grpcService) PostMessage(ctx context.Context, req *chatpb.PostMessageRequest) (*chatpb.PostMessageResponse, error) {
+	var res PostResponse
+	if err := g.call(ctx, http.MethodPost, "/v1"+roomPath(roomOf(req.Room))+"messages", &Message{
+		Name: req.Name,
+		Body: req.Body,
+	}, &res); err != nil {
+		return nil, err
+	}
+	return res.toProto().(*chatpb.PostMessageResponse), nil
+}
+
+func (g *grpcService) ListMessages(ctx context.Context, req *chatpb.ListMessagesRequest) (*chatpb.ListMessagesResponse, error) {
+	q := url.Values{}
+	if req.Before > 0 {
+		q.Set("before", strconv.FormatInt(req.Before, 10))
+	}
+	if req.Limit > 0 {
+		q.Set("limit", strconv.Itoa(int(req.Limit)))
+	}
+	path := "/v1" + roomPath(roomOf(req.Room)) + "api/messages"
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	var res MessagesResponse
+	if err := g.call(ctx, http.MethodGet, path, nil, &res); err != nil {
+		return nil, err
+	}
+	return res.toProto().(*chatpb.ListMessagesResponse), nil
+}
+
+func (g *grpcService) StreamMessages(req *chatpb.StreamMessagesRequest, stream chatpb.Chat_StreamMessagesServer) error {
+	room := roomOf(req.Room)
+	if !g.server.hasRoom(stream.Context(), room) {
+		return status.Error(codes.NotFound, "Not Found")
+	}
+
+	if !g.server.beginStream() {
+		return status.Error(codes.Unavailable, "Service Unavailable")
+	}
+	defer g.server.endStream()
+
+	ch := g.server.hub.subscribe(room)
+	defer g.server.hub.unsubscribe(room, ch)
+
+	for {
+		select {
+		case m := <-ch:
+			if err := stream.Send(messageToProto(&m)); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		case <-g.server.draining:
+			// The client reconnects to another instance.
+			return status.Error(codes.Unavailable, "Service Unavailable")
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// readyTimeout is the timeout of each dependency check in /readyz.
+const readyTimeout = 2 * time.Second
+
+type checkResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// HealthResponse is the response of /healthz and /readyz.
+type HealthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks,omitempty"`
+}
+
+// handleHealthz reports that the process is alive.
+func (s *server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, &HealthResponse{
+		Status: "ok",
+	})
+}
+
+// handleReadyz reports whether the dependencies are reachable. The cache and
+// the database are memcache and datastore on App Engine. A key not found is
+// not an error here.
+func (s *server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	checks := map[string]func(ctx context.Context) error{
+		"cache": func(ctx context.Context) error {
+			var v struct{}
+			if err := s.cache.Get(ctx, "readyz", &v); err != nil && err != ErrNotFound {
+				return err
+			}
+			return nil
+		},
+		"db": func(ctx context.Context) error {
+			var v struct{}
+			if err := s.db.Get(ctx, "readyz", &v); err != nil && err != ErrNotFound {
+				return err
+			}
+			return nil
+		},
+		"store": func(ctx context.Context) error {
+			_, err := s.store.Get(ctx, defaultRoom)
+			return err
+		},
+	}
+
+	res := &HealthResponse{
+		Status: "ok",
+		Checks: map[string]checkResult{},
+	}
+	code := http.StatusOK
+	for name, check := range checks {
+		cctx, cancel := context.WithTimeout(ctx, readyTimeout)
+		err := check(cctx)
+		cancel()
+		if err != nil {
+			res.Checks[name] = checkResult{Status: "error", Error: err.Error()}
+			res.Status = "degraded"
+			code = http.StatusServiceUnavailable
+			continue
+		}
+		res.Checks[name] = checkResult{Status: "ok"}
+	}
+	writeJSON(w, code, res)
+}
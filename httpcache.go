@@ -0,0 +1,49 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+func setExpires(w http.ResponseWriter, t time.Time) {
+	w.Header().Set("Expires", t.UTC().Format(http.TimeFormat))
+}
+
+// cachePrivate lets only the browser cache the response for maxAge. The
+// response must be revalidated if maxAge is 0.
+func cachePrivate(w http.ResponseWriter, maxAge time.Duration) {
+	if maxAge <= 0 {
+		w.Header().Set("Cache-Control", "private, no-cache")
+	} else {
+		w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int64(maxAge/time.Second)))
+	}
+	setExpires(w, time.Now().Add(maxAge))
+}
+
+// cacheImmutable lets browsers and proxies cache the response for maxAge
+// without revalidation.
+func cacheImmutable(w http.ResponseWriter, maxAge time.Duration) {
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d, immutable", int64(maxAge/time.Second)))
+	setExpires(w, time.Now().Add(maxAge))
+}
+
+// noStore forbids caching the response anywhere.
+func noStore(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", "no-store")
+	setExpires(w, time.Unix(0, 0))
+}
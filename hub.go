@@ -0,0 +1,90 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+// subscriberBufferSize is the number of messages a subscriber can hold before
+// it starts to miss messages.
+const subscriberBufferSize = 16
+
+type subscription struct {
+	room string
+	ch   chan Message
+}
+
+type roomMessage struct {
+	room    string
+	message Message
+}
+
+// hub delivers posted messages to the subscribers of the room in this
+// instance.
+type hub struct {
+	subscribeCh   chan subscription
+	unsubscribeCh chan subscription
+	broadcastCh   chan roomMessage
+}
+
+func newHub() *hub {
+	h := &hub{
+		subscribeCh:   make(chan subscription),
+		unsubscribeCh: make(chan subscription),
+		broadcastCh:   make(chan roomMessage),
+	}
+	go h.run()
+	return h
+}
+
+func (h *hub) run() {
+	subscribers := map[string]map[chan Message]struct{}{}
+	for {
+		select {
+		case s := <-h.subscribeCh:
+			if _, ok := subscribers[s.room]; !ok {
+				subscribers[s.room] = map[chan Message]struct{}{}
+			}
+			subscribers[s.room][s.ch] = struct{}{}
+		case s := <-h.unsubscribeCh:
+			delete(subscribers[s.room], s.ch)
+			if len(subscribers[s.room]) == 0 {
+				delete(subscribers, s.room)
+			}
+			close(s.ch)
+		case m := <-h.broadcastCh:
+			for ch := range subscribers[m.room] {
+				select {
+				case ch <- m.message:
+				default:
+					// The subscriber is too slow. Drop the message.
+				}
+			}
+		}
+	}
+}
+
+// subscribe returns a channel to receive messages in the room. The channel
+// must be passed to unsubscribe when it is no longer used.
+func (h *hub) subscribe(room string) chan Message {
+	ch := make(chan Message, subscriberBufferSize)
+	h.subscribeCh <- subscription{room: room, ch: ch}
+	return ch
+}
+
+func (h *hub) unsubscribe(room string, ch chan Message) {
+	h.unsubscribeCh <- subscription{room: room, ch: ch}
+}
+
+func (h *hub) broadcast(room string, message Message) {
+	h.broadcastCh <- roomMessage{room: room, message: message}
+}
@@ -0,0 +1,201 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/text/language"
+)
+
+const (
+	// langParam is the query parameter to choose the language of the UI,
+	// like ?lang=ja.
+	langParam = "lang"
+
+	// langCookieName is the cookie to keep the language chosen by langParam.
+	langCookieName = "lang"
+
+	langCookieMaxAge = 365 * 24 * time.Hour
+)
+
+// languages is the supported languages. The first one is the default.
+var languages = []language.Tag{
+	language.English,
+	language.Japanese,
+}
+
+var languageMatcher = language.NewMatcher(languages)
+
+// catalogs is the translations of the UI and the error messages by language.
+// The keys are the English messages, which are shown as they are when a
+// translation is missing, so English needs no catalog. Keys with verbs like
+// %d are formats.
+var catalogs = map[string]map[string]string{
+	"ja": {
+		// The pages.
+		"Login":                 "ログイン",
+		"Logout":                "ログアウト",
+		"people online":         "人がオンライン",
+		"%d unread messages":    "未読メッセージ %d 件",
+		"Unread messages above": "ここまで未読",
+		"The server is having trouble. The messages might be out of date.": "サーバーに問題が発生しています。メッセージが最新ではない可能性があります。",
+		"(edited)":        "(編集済み)",
+		"Report":          "通報",
+		"Reported":        "通報済み",
+		"No Message!":     "メッセージはありません",
+		"Message removed": "メッセージは削除されました",
+		"Older messages":  "以前のメッセージ",
+		"Name":            "名前",
+		"Message":         "メッセージ",
+		"Post":            "投稿",
+		"Open the chat":   "チャットを開く",
+		"What is %s?":     "%s は?",
+		"%s is typing…":   "%s が入力中…",
+		"%s are typing…":  "%s が入力中…",
+
+		// The dashboard.
+		"Dashboard":                            "ダッシュボード",
+		"Messages per minute":                  "1 分あたりのメッセージ",
+		"messages per minute":                  "件/分",
+		"Active sessions":                      "アクティブなセッション",
+		"Server errors in the last 10 minutes": "直近 10 分のサーバーエラー",
+		"Rooms":                                "ルーム",
+		"Clear room":                           "ルームを空にする",
+		"Remove all the messages in %s?":       "%s のメッセージをすべて削除しますか?",
+		"Pin":                                  "ピン留め",
+		"Delete":                               "削除",
+		"Recent reports":                       "最近の通報",
+		"hidden":                               "非表示",
+		"Dismiss":                              "却下",
+		"No reports":                           "通報はありません",
+		"Bans":                                 "投稿禁止",
+		"permanent":                            "無期限",
+		"Lift":                                 "解除",
+		"No bans":                              "投稿禁止はありません",
+		"locked":                               "ロック中",
+		"archived":                             "アーカイブ済み",
+		"pending":                              "開始前",
+		"The chat opens in %s":                 "チャット開始まで %s",
+		"The chat opens at %s":                 "チャットは %s に始まります",
+		"The chat is closed. Thank you for joining!": "チャットは終了しました。ご参加ありがとうございました!",
+
+		// The errors.
+		"Not Found":                   "見つかりません",
+		"Method Not Allowed":          "このメソッドは使えません",
+		"Unauthorized":                "認証が必要です",
+		"Forbidden":                   "許可されていません",
+		"Too Many Requests":           "リクエストが多すぎます。しばらく待ってからやり直してください",
+		"Service Unavailable":         "サービスを利用できません",
+		"Invalid CSRF token":          "CSRF トークンが無効です。ページを再読み込みしてください",
+		"Login is required":           "ログインが必要です",
+		"You are banned from posting": "投稿が禁止されています",
+		"The chat is closed":          "チャットは終了しました",
+		"The room is archived":        "このルームはアーカイブされています",
+		"The rooms in the configuration can't be deleted":        "設定ファイルのルームは削除できません",
+		"The server took too long to respond":                    "サーバーの応答に時間がかかりすぎました",
+		"Room %q already exists":                                 "ルーム %q はすでにあります",
+		"Only admins and bots can schedule messages":             "メッセージを予約できるのは管理者とボットだけです",
+		"Too many messages are scheduled":                        "予約されたメッセージが多すぎます",
+		"Too many messages are waiting for approval":             "承認待ちのメッセージが多すぎます",
+		"Your message is waiting for approval":                   "メッセージは承認待ちです",
+		"Answer the challenge at /captcha before posting":        "投稿する前に /captcha の問題に答えてください",
+		"The name is registered by another user":                 "この名前は他のユーザーが登録しています",
+		"Register a name or sign in to use direct messages":      "ダイレクトメッセージを使うには名前を登録するかログインしてください",
+		"The edit token is required":                             "編集トークンが必要です",
+		"The edit token is invalid or expired":                   "編集トークンが無効か期限切れです",
+		"The messages have been changed":                         "メッセージが変更されています",
+		"Idempotency-Key is already used for another request":    "Idempotency-Key は別のリクエストで使われています",
+		"A request with the same Idempotency-Key is in progress": "同じ Idempotency-Key のリクエストを処理中です",
+		"Idempotency-Key must be at most %d bytes":               "Idempotency-Key は %d バイト以内にしてください",
+		"Request body is too big (must be up to %d bytes)":       "リクエストが大きすぎます (%d バイトまで)",
+		"At most %d messages can be pinned":                      "ピン留めできるメッセージは %d 件までです",
+		"Too many words in q (must be up to %d)":                 "検索語が多すぎます (%d 語まで)",
+		"Missing q":                                              "検索語を指定してください",
+		"name is required":                                       "名前を指定してください",
+		"Invalid option: %d":                                     "無効な選択肢です: %d",
+
+		// The validation errors of the fields.
+		"Some fields are invalid":                  "入力内容に誤りがあります",
+		"must be valid UTF-8":                      "UTF-8 で入力してください",
+		"must not be empty":                        "入力してください",
+		"must be at most %d characters but %d":     "%[1]d 文字以内にしてください (現在 %[2]d 文字)",
+		"must be at most %d images but %d":         "画像は %[1]d 枚以内にしてください (現在 %[2]d 枚)",
+		"image %q is not found":                    "画像 %q が見つかりません",
+		"must not contain banned words":            "禁止されている言葉が含まれています",
+		"must have %d to %d options":               "選択肢は %d 個から %d 個にしてください",
+		"usage: %s":                                "使い方: %s",
+		"must not be yourself":                     "自分自身は指定できません",
+		"is expired":                               "期限が切れています",
+		"is wrong":                                 "正しくありません",
+		"must be at most %d bytes":                 "%d バイト以内にしてください",
+		"must be an http or https URL":             "http または https の URL を指定してください",
+		"must consist of letters, digits, - and _": "英数字、- と _ で指定してください",
+		"must be open, locked or archived":         "open、locked、archived のいずれかを指定してください",
+		"opens_at or closes_at is required":        "opens_at か closes_at を指定してください",
+		"must be in the future":                    "未来の時刻にしてください",
+		"must be within %d days":                   "%d 日以内にしてください",
+		"must be after opens_at":                   "opens_at より後にしてください",
+		"must be from 0 to %d":                     "0 から %d までにしてください",
+		"must not be negative":                     "0 以上にしてください",
+	},
+}
+
+// requestLanguage returns the language of the UI for the request, like "ja".
+// The language is chosen by langParam, the cookie and then Accept-Language.
+func requestLanguage(r *http.Request) string {
+	var prefs []string
+	if v := r.URL.Query().Get(langParam); v != "" {
+		prefs = append(prefs, v)
+	}
+	if c, err := r.Cookie(langCookieName); err == nil {
+		prefs = append(prefs, c.Value)
+	}
+	prefs = append(prefs, r.Header.Get("Accept-Language"))
+	tag, _ := language.MatchStrings(languageMatcher, prefs...)
+	base, _ := tag.Base()
+	return base.String()
+}
+
+// setLanguage keeps the language chosen by langParam in the cookie, so that
+// the following pages and API calls are in the same language.
+func setLanguage(w http.ResponseWriter, r *http.Request, lang string) {
+	if r.URL.Query().Get(langParam) == "" {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     langCookieName,
+		Value:    lang,
+		Path:     "/",
+		MaxAge:   int(langCookieMaxAge / time.Second),
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+	})
+}
+
+// translate returns the message translated into the language. If args are
+// given, the key is a format and the translation is formatted with them.
+func translate(lang string, key string, args ...interface{}) string {
+	format, ok := catalogs[lang][key]
+	if !ok {
+		format = key
+	}
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
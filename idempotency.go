@@ -0,0 +1,162 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// idempotencyKeyExpiration is how long the result of a request with an
+	// Idempotency-Key header is kept for retries.
+	idempotencyKeyExpiration = 24 * time.Hour
+
+	maxIdempotencyKeyLength = 255
+)
+
+var (
+	errIdempotencyKeyInUse  = errors.New("chatserver: the idempotency key is in use")
+	errIdempotencyKeyReused = errors.New("chatserver: the idempotency key is used for another request")
+)
+
+// idempotentResult is the stored result of a request with an Idempotency-Key
+// header. Status is zero while the request is in progress. The response is
+// kept as is since it might not be JSON.
+type idempotentResult struct {
+	Hash        []byte `json:"hash"`
+	Status      int    `json:"status"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        []byte `json:"body,omitempty"`
+}
+
+// idempotencyKey returns the KV key for the Idempotency-Key header. Keys are
+// scoped to the session, or to the client IP address for requests without a
+// session cookie.
+func (s *server) idempotencyKey(ctx context.Context, r *http.Request, room, key string) string {
+	scope := "ip:" + clientIP(r)
+	if s.isCookieAuthenticated(r) {
+		scope = "session:" + sessionID(ctx)
+	}
+	return "idempotency:" + room + ":" + scope + ":" + key
+}
+
+// recordingWriter records the status code and the body of the response.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// idempotent calls f unless the request has an Idempotency-Key header that
+// was already used. The successful result of f is stored, and a retried
+// request gets the original response instead of calling f again. v is the
+// decoded request, which must be the same for the same key.
+func (s *server) idempotent(ctx context.Context, w http.ResponseWriter, r *http.Request, room string, v interface{}, f func(w http.ResponseWriter)) {
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		f(w)
+		return
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		msg := translate(requestLanguage(r), "Idempotency-Key must be at most %d bytes", maxIdempotencyKeyLength)
+		writeError(w, r, http.StatusBadRequest, msg)
+		return
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		msg := fmt.Sprintf("Idempotency error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	h := sha256.Sum256(b)
+	hash := h[:]
+
+	k := s.idempotencyKey(ctx, r, room, key)
+	var result idempotentResult
+	if err := s.db.Update(ctx, k, &result, idempotencyKeyExpiration, func() error {
+		if result.Hash != nil {
+			if !bytes.Equal(result.Hash, hash) {
+				return errIdempotencyKeyReused
+			}
+			if result.Status == 0 {
+				return errIdempotencyKeyInUse
+			}
+			return nil
+		}
+		result.Hash = hash
+		return nil
+	}); err != nil {
+		switch err {
+		case errIdempotencyKeyReused:
+			msg := "Idempotency-Key is already used for another request"
+			writeErrorCode(w, r, http.StatusUnprocessableEntity, "idempotency_key_reused", msg)
+		case errIdempotencyKeyInUse:
+			msg := "A request with the same Idempotency-Key is in progress"
+			writeErrorCode(w, r, http.StatusConflict, "idempotency_key_in_use", msg)
+		default:
+			msg := fmt.Sprintf("Idempotency error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+		}
+		return
+	}
+	if result.Status != 0 {
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.Header().Set("Content-Type", result.ContentType)
+		w.WriteHeader(result.Status)
+		w.Write(result.Body)
+		return
+	}
+
+	rw := &recordingWriter{ResponseWriter: w}
+	f(rw)
+
+	// Only successful results are kept, so that a failed request can be
+	// retried with the same key.
+	if rw.status < 200 || rw.status >= 300 {
+		if err := s.db.Delete(ctx, k); err != nil {
+			s.logf(ctx, "Idempotency error: %v", err)
+		}
+		return
+	}
+	result.Status = rw.status
+	result.ContentType = rw.Header().Get("Content-Type")
+	result.Body = rw.body.Bytes()
+	if err := s.db.Set(ctx, k, &result, idempotencyKeyExpiration); err != nil {
+		s.logf(ctx, "Idempotency error: %v", err)
+	}
+}
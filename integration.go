@@ -0,0 +1,101 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// integrationFlushInterval is the interval to flush the integrations where
+// background goroutines are available.
+const integrationFlushInterval = time.Second
+
+// errQueued is returned by storeMessage if the store is unavailable and the
+// message is queued to be stored later.
+var errQueued = errors.New("chatserver: the message is queued")
+
+// storeMessage stores the new message in the room, and delivers it to the
+// clients and the integrations. The ID of the message is set when it is
+// stored. The revision of the room is increased even if the message is
+// queued, since the post is accepted.
+func (s *server) storeMessage(ctx context.Context, room string, message *Message) error {
+	// Store the queued posts first to keep the posted order.
+	s.replayQueued(ctx, room)
+
+	id, err := s.batcher.append(ctx, s, room, *message)
+	if err != nil {
+		if s.fallback.enqueue(room, *message) {
+			s.bumpRevision(ctx, room)
+			return errQueued
+		}
+		return err
+	}
+	message.ID = id
+	postsTotal.WithLabelValues(room).Inc()
+	s.bumpRevision(ctx, room)
+	s.posted(ctx, room, *message)
+	return nil
+}
+
+// posted delivers the newly stored message to the clients and the
+// integrations. The revision of the room is increased by the caller when the
+// post is accepted, which can be before the message is stored.
+func (s *server) posted(ctx context.Context, room string, message Message) {
+	s.broadcast(ctx, room, message)
+	s.indexMessage(ctx, room, message)
+	if s.slack != nil && message.Source != sourceSlack {
+		s.slack.enqueue(room, message)
+	}
+	s.enqueueWebhooks(ctx, room, message)
+	if message.TTLSeconds > 0 {
+		s.addExpiring(ctx, room, message)
+	}
+}
+
+// flushIntegrations sends the pending messages to Slack and the webhooks.
+func (s *server) flushIntegrations(ctx context.Context) {
+	if s.slack != nil {
+		if err := s.slack.flush(ctx); err != nil {
+			s.logf(ctx, "Slack error: %v", err)
+		}
+	}
+	s.flushWebhooks(ctx)
+}
+
+// withIntegrations flushes the integrations at the end of each request.
+func (s *server) withIntegrations(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r)
+		s.flushIntegrations(r.Context())
+	})
+}
+
+// runIntegrations flushes the integrations periodically. runIntegrations is
+// used where background goroutines are available.
+func (s *server) runIntegrations(ctx context.Context) {
+	t := time.NewTicker(integrationFlushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			s.flushIntegrations(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
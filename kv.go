@@ -0,0 +1,131 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned when a key is not found in a KV.
+var ErrNotFound = errors.New("chatserver: not found")
+
+// KV is a key-value storage of small JSON-encodable values other than
+// messages, like rate limit states and settings.
+type KV interface {
+	// Get loads the value for the key into v. Get returns ErrNotFound if the
+	// key doesn't exist or is expired.
+	Get(ctx context.Context, key string, v interface{}) error
+
+	// Set stores v for the key. The value expires after the expiration if it
+	// is positive.
+	Set(ctx context.Context, key string, v interface{}, expiration time.Duration) error
+
+	// Update loads the value for the key into v, calls f and stores v
+	// atomically. v is a pointer and is set to the zero value if the key
+	// doesn't exist. If f returns an error, Update returns the error without
+	// storing v. f might be called more than once.
+	Update(ctx context.Context, key string, v interface{}, expiration time.Duration, f func() error) error
+
+	// Delete deletes the value for the key. Delete doesn't return an error
+	// if the key doesn't exist.
+	Delete(ctx context.Context, key string) error
+}
+
+// resetValue sets the value that the pointer v points to to the zero value.
+func resetValue(v interface{}) {
+	rv := reflect.ValueOf(v).Elem()
+	rv.Set(reflect.Zero(rv.Type()))
+}
+
+type memoryKVItem struct {
+	value   []byte
+	expires time.Time
+}
+
+type memoryKV struct {
+	items map[string]memoryKVItem
+	m     sync.Mutex
+}
+
+// NewMemoryKV returns a KV that keeps values in the process memory.
+func NewMemoryKV() KV {
+	return &memoryKV{
+		items: map[string]memoryKVItem{},
+	}
+}
+
+func (kv *memoryKV) get(key string, v interface{}) error {
+	item, ok := kv.items[key]
+	if !ok {
+		return ErrNotFound
+	}
+	if !item.expires.IsZero() && !time.Now().Before(item.expires) {
+		delete(kv.items, key)
+		return ErrNotFound
+	}
+	return json.Unmarshal(item.value, v)
+}
+
+func (kv *memoryKV) set(key string, v interface{}, expiration time.Duration) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	item := memoryKVItem{
+		value: b,
+	}
+	if expiration > 0 {
+		item.expires = time.Now().Add(expiration)
+	}
+	kv.items[key] = item
+	return nil
+}
+
+func (kv *memoryKV) Get(ctx context.Context, key string, v interface{}) error {
+	kv.m.Lock()
+	defer kv.m.Unlock()
+	return kv.get(key, v)
+}
+
+func (kv *memoryKV) Set(ctx context.Context, key string, v interface{}, expiration time.Duration) error {
+	kv.m.Lock()
+	defer kv.m.Unlock()
+	return kv.set(key, v, expiration)
+}
+
+func (kv *memoryKV) Update(ctx context.Context, key string, v interface{}, expiration time.Duration, f func() error) error {
+	kv.m.Lock()
+	defer kv.m.Unlock()
+	resetValue(v)
+	if err := kv.get(key, v); err != nil && err != ErrNotFound {
+		return err
+	}
+	if err := f(); err != nil {
+		return err
+	}
+	return kv.set(key, v, expiration)
+}
+
+func (kv *memoryKV) Delete(ctx context.Context, key string) error {
+	kv.m.Lock()
+	defer kv.m.Unlock()
+	delete(kv.items, key)
+	return nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// requestLog is a structured log entry of a request.
+type requestLog struct {
+	Method    string  `json:"method"`
+	Path      string  `json:"path"`
+	Status    int     `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	ClientIP  string  `json:"client_ip"`
+	RequestID string  `json:"request_id"`
+}
+
+// statusRecorder records the status code of the response. Flush and Hijack are
+// passed through for streaming and WebSocket.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("chatserver: hijacking is not supported")
+	}
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
+
+func newRequestID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// withRequestLog returns a handler that logs each request served by h as JSON,
+// and records the latency in the metrics and the server errors for the
+// dashboard.
+// The request ID is taken from the X-Request-Id header, or generated if it is
+// not given, and is also returned in the X-Request-Id header.
+func (s *server) withRequestLog(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get("X-Request-Id")
+		if id == "" {
+			// The request is served without an ID if generating one fails.
+			id, _ = newRequestID()
+		}
+		w.Header().Set("X-Request-Id", id)
+
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		latency := time.Since(start)
+		requestDuration.WithLabelValues(r.Method, strconv.Itoa(rec.status)).Observe(latency.Seconds())
+		ctx := r.Context()
+		if rec.status >= http.StatusInternalServerError {
+			if err := s.recordServerError(ctx); err != nil {
+				s.logf(ctx, "stats error: %v", err)
+			}
+		}
+
+		b, err := json.Marshal(&requestLog{
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Status:    rec.status,
+			LatencyMS: float64(latency) / float64(time.Millisecond),
+			ClientIP:  clientIP(r),
+			RequestID: id,
+		})
+		if err != nil {
+			return
+		}
+		s.logf(ctx, "%s", b)
+	})
+}
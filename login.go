@@ -0,0 +1,64 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"google.golang.org/appengine/v2/user"
+)
+
+// userName returns the name of the signed-in user, or an empty string if the
+// user is not signed in. The name is the local part of the email address.
+// Google accounts are available only on App Engine.
+func (s *server) userName(ctx context.Context) string {
+	if !s.accounts {
+		return ""
+	}
+	u := user.Current(ctx)
+	if u == nil {
+		return ""
+	}
+	return strings.SplitN(u.Email, "@", 2)[0]
+}
+
+// roomPath returns the path of the messages page of the room.
+func roomPath(room string) string {
+	if room == defaultRoom {
+		return "/"
+	}
+	return "/rooms/" + room + "/"
+}
+
+// redirectToLogin redirects to the Google sign-in page for login and the
+// sign-out page for logout. The user comes back to the room after that.
+func redirectToLogin(ctx context.Context, w http.ResponseWriter, r *http.Request, room string, login bool) {
+	var u string
+	var err error
+	if login {
+		u, err = user.LoginURL(ctx, roomPath(room))
+	} else {
+		u, err = user.LogoutURL(ctx, roomPath(room))
+	}
+	if err != nil {
+		msg := fmt.Sprintf("Users API error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	http.Redirect(w, r, u, http.StatusFound)
+}
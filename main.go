@@ -15,192 +15,890 @@
 package chatserver
 
 import (
-	"encoding/json"
+	"bytes"
+	"context"
 	"fmt"
 	"html/template"
-	"io"
-	"io/ioutil"
+	"log"
 	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
 
-	"golang.org/x/net/context" // Use this until Go 1.9's type alias is available
-	"google.golang.org/appengine"
-	"google.golang.org/appengine/memcache"
+	"golang.org/x/net/websocket"
 )
 
-const (
-	messagesKey           = "messages"
-	maxContentSizeInBytes = 256
-)
+const messagesKey = "messages"
 
 type Message struct {
+	// ID is assigned by the store when the message is posted.
+	ID int64 `json:"id"`
+
 	Name string `json:"name"`
 	Body string `json:"body"`
+
+	// CreatedAt is set by the server when the message is posted.
+	CreatedAt time.Time `json:"created_at"`
+
+	// Deleted is true if the message is deleted by a moderator. Deleted
+	// messages are not shown.
+	Deleted bool `json:"deleted,omitempty"`
+
+	// Hidden is true if the message is hidden after reports. Hidden messages
+	// are not shown until a moderator dismisses the reports.
+	Hidden bool `json:"hidden,omitempty"`
+
+	// Edited is true if the message is edited by the poster.
+	Edited bool `json:"edited"`
+
+	// Flagged is true if the message contains banned words and needs
+	// moderators' attention.
+	Flagged bool `json:"flagged,omitempty"`
+
+	// SessionID is the ID of the poster's session. The ID can be public since
+	// session cookies are signed.
+	SessionID string `json:"session_id,omitempty"`
+
+	// Mentions is the names mentioned like @name in the body.
+	Mentions []string `json:"mentions,omitempty"`
+
+	// Attachments is the images attached to the message. The images are
+	// uploaded by POST /attachments before the message is posted.
+	Attachments []Attachment `json:"attachments,omitempty"`
+
+	// Pinned is true if the message is pinned by a moderator. Pinned is set
+	// when the messages are read, and is not stored in the message.
+	Pinned bool `json:"pinned,omitempty"`
+
+	// Poll is the options and the results if the message is a poll. The
+	// body is the question.
+	Poll *Poll `json:"poll,omitempty"`
+
+	// Action is true if the message is an action posted by /me, like
+	// "* name waves".
+	Action bool `json:"action,omitempty"`
+
+	// Bot is true if the message is posted by a bot with an API key.
+	Bot bool `json:"bot,omitempty"`
+
+	// Source is where the message is posted from, like "slack". Source is
+	// empty for messages posted to this server directly.
+	Source string `json:"source,omitempty"`
+
+	// Preview is the preview of the first URL in the body.
+	Preview *LinkPreview `json:"preview,omitempty"`
+
+	// DeliverAt is the time to post the message in the request of an admin
+	// or a bot. The message is held until the time, and is posted with
+	// DeliverAt cleared.
+	DeliverAt *time.Time `json:"deliver_at,omitempty"`
+
+	// TTLSeconds is how long the message is shown after it is posted, like
+	// a temporary Wi-Fi password. The message is removed after that. The
+	// message is kept if this is 0.
+	TTLSeconds int `json:"ttl_seconds,omitempty"`
+
+	// Typing is true if the message is not posted but tells that the user is
+	// typing. Typing messages are only sent to realtime clients and are never
+	// stored.
+	Typing bool `json:"typing,omitempty"`
+
+	// Profile is the profile of the poster. Profiles are not stored with the
+	// messages but are joined when the messages are shown, so that changes
+	// of a profile are shown in the past messages.
+	Profile *Profile `json:"profile,omitempty"`
 }
 
 const (
 	messagesHTMLTmpl = `<!DOCTYPE html>
-<title>Chat Server - golang.tokyo #13</title>
-<style>
-body {
-  font-family: Sans-Serif;
-}
-.name {
-  font-weight: bold;
+<html lang="{{.Lang}}">
+<title>{{.Theme.Title}}</title>
+<link rel="icon" href="{{static "favicon.png"}}">
+<style nonce="{{.Nonce}}">
+:root {
+  --background-color: {{.Theme.BackgroundColor}};
+  --text-color: {{.Theme.TextColor}};
+  --accent-color: {{.Theme.AccentColor}};
 }
 </style>
-<script>
-window.onload = () => {
-  setTimeout(() => {
-    location.reload();
-  }, 5000);
-};
-</script>
-{{range .Messages -}}
-<div><span class="name">{{.Name}}</span>: {{.Body}}</div>
-{{else}}
-No Message!
+<link rel="stylesheet" href="{{static "messages.css"}}" nonce="{{.Nonce}}">
+<meta name="csrf-token" content="{{.CSRFToken}}">
+<script src="{{static "messages.js"}}" nonce="{{.Nonce}}"
+  data-room="{{.Room}}"
+  data-presence-path="{{.PresencePath}}"
+  data-presence-interval="{{.PresenceInterval}}"
+  data-polls-path="{{.PollsPath}}"
+  data-messages-path="{{.MessagesPath}}"
+  data-read-cursor-path="{{.ReadCursorPath}}"
+  data-reload-interval="{{.ReloadInterval}}"
+  data-typing-ttl="{{.TypingTTL}}"
+  data-typing-one="{{t .Lang "%s is typing…"}}"
+  data-typing-many="{{t .Lang "%s are typing…"}}"
+  data-bot="{{t .Lang "bot"}}"
+  data-edited="{{t .Lang "(edited)"}}"
+  data-removed="{{t .Lang "Message removed"}}"
+  data-report="{{t .Lang "Report"}}"
+  data-reported="{{t .Lang "Reported"}}"></script>
+{{template "head" .}}
+{{template "header" .}}
+{{- if .Accounts -}}
+<p>
+{{- if .User}}
+<span class="name">{{.User}}</span> <a href="{{.LogoutPath}}">{{t $.Lang "Logout"}}</a>
+{{- else}}
+<a href="{{.LoginPath}}">{{t .Lang "Login"}}</a>
 {{- end}}
-`
+</p>
+{{end -}}
+{{if gt (len .Rooms) 1 -}}
+<nav>
+{{- range .Rooms}}
+<a href="/rooms/{{.}}/"{{if eq . $.Room}} class="current-room"{{end}}>{{.}}</a>
+{{- end}}
+</nav>
+{{end -}}
+{{with .Online}}<p class="online"><span id="online-count">{{.}}</span> {{t $.Lang "people online"}}</p>
+{{end -}}
+{{with .Unread}}<p class="online"><a href="#last-read">{{t $.Lang "%d unread messages" .}}</a></p>
+{{end -}}
+{{with .Pinned}}<div id="pinned">
+{{- range .}}
+<div class="pinned-message"><span class="name">{{.Name}}</span>: {{markdown .Body}}</div>
+{{- end}}
+</div>
+{{end -}}
+{{if .Closed}}<p class="closed">{{t .Lang "The chat is closed. Thank you for joining!"}}</p>
+{{end -}}
+{{with .OpensIn}}<p id="countdown" class="closed" data-opens-in="{{.}}" data-format="{{t $.Lang "The chat opens in %s"}}">{{t $.Lang "The chat opens at %s" $.OpensAt}}</p>
+{{end -}}
+{{if .Stale}}<p class="warning">{{t .Lang "The server is having trouble. The messages might be out of date."}}</p>
+{{end -}}
+<div id="messages">
+{{- range .Messages}}
+{{if eq .ID $.Marker}}<div id="last-read" class="last-read">{{t $.Lang "Unread messages above"}}</div>
+{{end -}}
+{{if .Deleted -}}
+<div id="message-{{.ID}}" class="removed">{{t $.Lang "Message removed"}}</div>
+{{- else -}}
+<div id="message-{{.ID}}">{{if not .CreatedAt.IsZero}}<time class="time" datetime="{{.CreatedAt.Format "2006-01-02T15:04:05Z07:00"}}">{{.CreatedAt.Format "15:04:05"}}</time> {{end}}{{template "name" .}}{{if .Bot}} <span class="bot">{{t $.Lang "bot"}}</span>{{end}}{{if .Action}} <em>{{markdown .Body}}</em>{{else}}: {{markdown .Body}}{{end}}{{$id := .ID}}{{with .Poll}}
+<div class="poll">{{range $i, $o := .Options}}<button class="poll-option" data-id="{{$id}}" data-option="{{$i}}">{{$o.Text}} <span class="votes">{{$o.Votes}}</span></button>{{end}}</div>{{end}}{{if .Edited}}<span class="edited"> {{t $.Lang "(edited)"}}</span>{{end}} <button class="report" data-id="{{.ID}}">{{t $.Lang "Report"}}</button>{{range .Attachments}} <a href="{{.URL}}"><img class="attachment" src="{{.ThumbnailURL}}" alt=""></a>{{end}}{{with .Preview}}
+<a class="preview" href="{{.URL}}" rel="noopener noreferrer" target="_blank">{{with .Image}}<img src="{{.}}" alt="">{{end}}<strong>{{.Title}}</strong>{{with .Description}}<br>{{.}}{{end}}</a>{{end}}</div>
+{{- end}}
+{{- else}}
+<div id="no-message">{{t .Lang "No Message!"}}</div>
+{{- end}}
+</div>
+<p id="typing" class="online"></p>
+{{with .Next}}<a href="{{.}}">{{t $.Lang "Older messages"}}</a>
+{{end -}}
+{{template "footer" .}}`
 
 	devForm = `<!DOCTYPE html>
-<script>
-window.addEventListener('load', _ => {
-  document.getElementById('submit-button').addEventListener('click', _ => {
-    let name = document.getElementById('name').value;
-    let body = document.getElementById('body').value;
-    fetch('/messages', {
-      method: 'POST',
-      body:   JSON.stringify({'name': name, 'body': body}),
-    }).then(response => {
-      console.log('status:', response.status);
-      return response.text();
-    });
-  });
-});
-</script>
+<meta name="csrf-token" content="{{.CSRFToken}}">
+<script src="{{static "dev.js"}}" nonce="{{.Nonce}}"></script>
+Room: <input id="room" type="text">
 Name: <input id="name" type="text">
 Body: <input id="body" type="text">
+Images: <input id="images" type="file" accept="image/png,image/jpeg,image/gif" multiple>
 <button id="submit-button">Submit</button>
+<div id="emoji-suggestions"></div>
 `
 )
 
-var (
-	messagesHTML = template.Must(template.New("messages").Parse(messagesHTMLTmpl))
+var devHTML = template.Must(template.New("dev").Funcs(templateFuncs).Parse(devForm))
+
+type server struct {
+	store     Store
+	cache     KV
+	db        KV
+	hub       *hub
+	fallback  *fallback
+	batcher   *postBatcher
+	broker    Broker
+	traces    *cloudTraceExporter
+	config    Config
+	rateLimit RateLimit
+
+	// botRateLimit is the rate limit of each bot.
+	botRateLimit RateLimit
+
+	// adminToken is the bearer token for moderators.
+	adminToken string
+
+	// loginRequired is true if posting requires a Google account.
+	loginRequired bool
+
+	sessionSecret []byte
+
+	// logf writes a log for the request context.
+	logf func(ctx context.Context, format string, args ...interface{})
+
+	// slack forwards posted messages to Slack if it is not nil.
+	slack *slackForwarder
+
+	// webhooks holds the deliveries to the outgoing webhooks.
+	webhooks *webhookDispatcher
+
+	// slackToken is the token to verify messages from Slack. Messages from
+	// Slack are not accepted if slackToken is empty.
+	slackToken string
+
+	// httpClient returns the client to fetch pages given by users, like
+	// link previews.
+	httpClient func(ctx context.Context) *http.Client
+
+	// accounts is true if Google accounts are available via the Users API.
+	accounts bool
+
+	// dev is true if the debug form is served at /dev.
+	dev bool
+
+	// index is the full-text index of the messages. The store is scanned
+	// to search if this is nil.
+	index messageIndex
+
+	// router routes the requests in a room.
+	router *router
+
+	// cron is true if the X-Appengine-Cron and X-Appengine-Queuename headers
+	// can be trusted. App Engine removes the headers from external requests.
+	cron bool
+
+	// pipeline stores the posts asynchronously if it is not nil.
+	pipeline postPipeline
+
+	// postQueue takes over the posts queued in this instance when the
+	// instance shuts down. The queued posts are lost if this is nil.
+	postQueue postQueue
+
+	// templates caches the templates of the pages.
+	templates templateCache
+
+	// spamScorers scores the posts to stop spam.
+	spamScorers []spamScorer
+
+	// scheduler wakes the server up to deliver the scheduled messages. The
+	// messages are delivered by runScheduledMessages or cron if this is nil.
+	scheduler messageScheduler
+
+	// draining is closed when Run starts shutting down, so that the
+	// streaming requests finish. This is nil where Run is not used.
+	draining chan struct{}
+	drained  bool
+
+	// streams is the hijacked connections to be waited for on shutdown.
+	streams  sync.WaitGroup
+	streamsM sync.Mutex
+
+	// loops is the background loops started by start.
+	loops sync.WaitGroup
+}
+
+// getDev handles GET /dev, which is the debug form.
+func (s *server) getDev(ctx context.Context, w http.ResponseWriter, r *http.Request, room string) {
+	nonce, err := randomNonce()
+	if err != nil {
+		msg := fmt.Sprintf("Nonce error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	noStore(w)
+	s.setPageSecurity(w, nonce)
+	var buf bytes.Buffer
+	if err := devHTML.Execute(&buf, map[string]interface{}{
+		"CSRFToken": s.csrfToken(ctx),
+		"Nonce":     nonce,
+	}); err != nil {
+		s.writeTemplateError(ctx, w, r, err)
+		return
+	}
+	writeHTML(w, r, http.StatusOK, &buf)
+}
+
+// getEmoji handles GET /emoji.
+func (s *server) getEmoji(ctx context.Context, w http.ResponseWriter, r *http.Request, room string) {
+	cacheImmutable(w, s.config.StaticMaxAge)
+	writeJSON(w, http.StatusOK, emojis)
+}
+
+// Formats of listMessages.
+const (
+	formatNegotiate = ""
+	formatJSON      = "json"
+	formatHTML      = "html"
 )
 
-func getMessages(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	switch r.URL.Path {
-	case "/dev":
-		if appengine.IsDevAppServer() {
-			w.Header().Set("Content-Type", "text/html; charset=utf-8")
-			io.WriteString(w, devForm)
-			return
+// listMessages handles GET /messages. The messages are in JSON or HTML by the
+// format, or by the Accept header if the format is formatNegotiate.
+func (s *server) listMessages(ctx context.Context, w http.ResponseWriter, r *http.Request, room, format string) {
+	ctx, span := startSpan(ctx, "listMessages")
+	defer span.End()
+
+	historyLength := s.historyLength(ctx, room)
+	before, limit, paged, err := parsePage(r, historyLength)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.replayQueued(ctx, room)
+
+	// The revision is read before the messages so that it is never newer
+	// than the messages.
+	rev, err := s.revision(ctx, room)
+	if err != nil {
+		s.logf(ctx, "revision error: %v", err)
+	}
+
+	var messages []Message
+	if paged {
+		messages, err = s.store.History(ctx, room, before, limit)
+	} else {
+		messages, err = s.store.Get(ctx, room)
+		// The cache can have more messages until the next post trims them.
+		if len(messages) > historyLength {
+			messages = messages[len(messages)-historyLength:]
 		}
+	}
 
-	case "/", "/messages", "/messages.html":
-		messages := []Message{}
-		if _, err := memcache.JSON.Get(ctx, messagesKey, &messages); err != nil {
-			if err != memcache.ErrCacheMiss {
-				msg := fmt.Sprintf("Memcache error: %v", err)
-				http.Error(w, msg, http.StatusInternalServerError)
-				return
-			}
+	// If the store is unavailable, serve the latest messages read in
+	// this instance instead.
+	stale := false
+	if err != nil {
+		messages = s.fallback.recentMessages(room)
+		if paged {
+			messages = historyOf(messages, before, limit)
+		}
+		stale = true
+	} else if !paged {
+		s.fallback.setRecent(room, messages)
+	}
+
+	readsTotal.WithLabelValues(room).Inc()
+
+	next := nextPageURL(r, messages, limit)
+	if next != "" {
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", next))
+	}
+	messages = shownMessages(messages)
+	s.joinProfiles(ctx, messages)
+	cachePrivate(w, s.config.PageMaxAge)
+	w.Header().Add("Vary", "Accept")
+
+	// Pinned messages are not essential, so the messages are shown
+	// without them on errors.
+	pinned, err := s.pinnedMessages(ctx, room)
+	if err != nil {
+		s.logf(ctx, "pin error: %v", err)
+	}
+	markPinned(messages, pinned)
+
+	if format == formatJSON || apiVersion(r) > 0 || format != formatHTML && wantsJSON(r) {
+		res := &MessagesResponse{
+			Messages: messages,
+			Count:    len(messages),
+			Next:     next,
+			Pinned:   pinned,
+			Stale:    stale,
+			Revision: rev,
 		}
+		// The ETag doesn't depend on GeneratedAt, but on the media type.
+		if notModified(w, r, responseMediaType(r), res) {
+			return
+		}
+		res.GeneratedAt = time.Now()
+		if r.Method == http.MethodHead {
+			writeHead(w, func(w http.ResponseWriter) {
+				writeBody(w, r, http.StatusOK, res)
+			})
+			return
+		}
+		writeBody(w, r, http.StatusOK, res)
+		return
+	}
 
-		// Reverse
-		messagesToShow := make([]Message, len(messages))
-		for i, m := range messages {
-			messagesToShow[len(messages)-i-1] = m
+	// Mark where the session left off. The read cursor is not essential,
+	// so the page is shown without it on errors.
+	var marker int64
+	unread := 0
+	if !paged {
+		cursor, err := s.readCursor(ctx, room)
+		if err != nil {
+			s.logf(ctx, "read cursor error: %v", err)
 		}
+		marker = readMarker(messages, cursor)
+		if marker != 0 {
+			unread = len(newerMessages(messages, cursor))
+		}
+	}
 
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		messagesHTML.Execute(w, map[string]interface{}{
-			"Messages": messagesToShow,
-		})
+	// Reverse
+	messagesToShow := make([]Message, len(messages))
+	for i, m := range messages {
+		messagesToShow[len(messages)-i-1] = m
+	}
+
+	// Viewing the page is also a heartbeat, but HEAD is not since it
+	// might be a health check. Presence is not essential, so the page is
+	// shown without it on errors.
+	var online int
+	if r.Method == http.MethodHead {
+		online, err = s.presence(ctx, room)
+	} else {
+		online, err = s.touchPresence(ctx, room, sessionID(ctx))
+	}
+	if err != nil {
+		s.logf(ctx, "presence error: %v", err)
+	}
+
+	closed, opensIn, opensAt := s.roomStatus(ctx, room)
+	data := map[string]interface{}{
+		"Messages": messagesToShow,
+		"Pinned":   pinned,
+		"Room":     room,
+		"Rooms":    s.listedRooms(ctx),
+		"Next":     next,
+		"Stale":    stale,
+		"Online":   online,
+		"Marker":   marker,
+		"Unread":   unread,
+		"Closed":   closed,
+		"OpensIn":  opensIn,
+		"OpensAt":  opensAt,
+
+		"ReloadInterval":   int64(s.config.ReloadInterval / time.Millisecond),
+		"PresencePath":     roomPath(room) + "presence",
+		"PresenceInterval": int64(presenceInterval / time.Millisecond),
+		"TypingTTL":        int64(typingTTL / time.Millisecond),
+		"ReadCursorPath":   roomPath(room) + "read-cursor",
+		"CSRFToken":        s.csrfToken(ctx),
+		"PollsPath":        roomPath(room) + "polls/",
+		"MessagesPath":     roomPath(room) + "messages/",
+
+		"Accounts":   s.accounts,
+		"User":       s.userName(ctx),
+		"LoginPath":  roomPath(room) + "login",
+		"LogoutPath": roomPath(room) + "logout",
+	}
+
+	s.renderPage(ctx, w, r, "messages", data)
+}
+
+// postMessage handles POST /messages.
+func (s *server) postMessage(ctx context.Context, w http.ResponseWriter, r *http.Request, room string) {
+	ctx, span := startSpan(ctx, "postMessage")
+	defer span.End()
+
+	message := Message{}
+	if !decodeBody(w, r, &message, int64(s.config.MaxContentSize)) {
+		return
+	}
+	message.Deleted = false
+	message.Hidden = false
+	message.Edited = false
+	message.Flagged = false
+	message.Mentions = nil
+	message.Preview = nil
+	message.Source = ""
+	message.Bot = false
+	message.Action = false
+	message.Typing = false
+	message.Poll = nil
+	message.Pinned = false
+	message.SessionID = ""
+	message.Profile = nil
+	if message.DeliverAt != nil && !s.isAdmin(r) {
+		msg := "Only admins and bots can schedule messages"
+		writeError(w, r, http.StatusForbidden, msg)
 		return
 	}
 
-	http.NotFound(w, r)
+	// A retried request is checked before the rate limit so that retries
+	// don't use up the poster's rate. The session is not a part of the
+	// request since a client without cookies gets a new session every time.
+	s.idempotent(ctx, w, r, room, &message, func(w http.ResponseWriter) {
+		message.SessionID = sessionID(ctx)
+		if !s.checkRateLimit(ctx, w, r) {
+			return
+		}
+		s.publishMessage(ctx, w, r, room, message)
+	})
 }
 
-func postMessages(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	if r.URL.Path != "/messages" {
-		http.NotFound(w, r)
+// publishMessage checks, stores and delivers the message posted by a user, and
+// writes the response.
+func (s *server) publishMessage(ctx context.Context, w http.ResponseWriter, r *http.Request, room string, message Message) {
+	if !s.checkRoomOpen(ctx, w, r, room) {
+		return
+	}
+	// The name of a signed-in user is always the account's name.
+	if name := s.userName(ctx); name != "" {
+		message.Name = name
+	} else if s.loginRequired {
+		msg := "Login is required"
+		writeError(w, r, http.StatusUnauthorized, msg)
+		return
+	}
+	if !s.checkCaptcha(ctx, w, r) {
 		return
 	}
 
-	reqBody, err := ioutil.ReadAll(r.Body)
+	// A message without a name is posted with the name in the profile.
+	if strings.TrimSpace(message.Name) == "" {
+		p, err := s.currentProfile(ctx)
+		if err != nil {
+			msg := fmt.Sprintf("Profile error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		if p != nil {
+			message.Name = p.Name
+		}
+	}
+
+	// The body of a poll is the question, which is not a command.
+	if message.Poll == nil {
+		if err := s.runCommand(ctx, room, &message); err != nil {
+			if verr, ok := err.(*ValidationError); ok {
+				writeValidationError(w, r, verr)
+				return
+			}
+			msg := fmt.Sprintf("Command error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+	}
+	if err := message.Validate(&s.config); err != nil {
+		writeValidationError(w, r, err)
+		return
+	}
+	if err := s.attachImages(ctx, &message); err != nil {
+		if _, ok := err.(*ValidationError); ok {
+			writeValidationError(w, r, err)
+			return
+		}
+		msg := fmt.Sprintf("Attachment error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+
+	// Only the session that registered the name can post with it. Signed-in
+	// users always post with the account's name.
+	if s.userName(ctx) == "" {
+		if err := s.checkName(ctx, message.SessionID, message.Name); err != nil {
+			if err == errNameTaken {
+				writeNameTaken(w, r, http.StatusForbidden)
+				return
+			}
+			msg := fmt.Sprintf("Name error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+	}
+
+	banned, err := s.isBanned(ctx, &poster{
+		sessionID: message.SessionID,
+		ip:        clientIP(r),
+		name:      message.Name,
+	})
 	if err != nil {
-		msg := fmt.Sprintf("Could not read the request body: %v", err)
-		http.Error(w, msg, http.StatusBadRequest)
+		msg := fmt.Sprintf("Ban error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	if banned {
+		msg := "You are banned from posting"
+		writeErrorCode(w, r, http.StatusForbidden, "banned", msg)
 		return
 	}
 
-	if len(reqBody) > maxContentSizeInBytes {
-		msg := "Request body is too big"
-		http.Error(w, msg, http.StatusBadRequest)
+	filter, err := s.wordFilter(ctx)
+	if err != nil {
+		msg := fmt.Sprintf("Word filter error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	if !filter.apply(&message) || !filter.applyPoll(&message) {
+		writeValidationError(w, r, &ValidationError{
+			Errors: []FieldError{{Field: "body", Message: "must not contain banned words"}},
+		})
+		return
+	}
+	if !s.checkSpam(ctx, w, r, room, &message) {
 		return
 	}
+	message.Mentions = parseMentions(message.Body)
+	message.Preview = s.linkPreview(ctx, message.Body)
+	message.CreatedAt = time.Now()
 
-	message := Message{}
-	if err := json.Unmarshal(reqBody, &message); err != nil {
-		msg := fmt.Sprintf("Unmarshal JSON error: %v", err)
-		http.Error(w, msg, http.StatusBadRequest)
+	// Announcements are posted at the scheduled time.
+	if message.DeliverAt != nil {
+		s.scheduleMessage(ctx, w, r, room, message)
 		return
 	}
 
-	var messages []Message
-	item, err := memcache.JSON.Get(ctx, messagesKey, &messages)
-	if err != nil {
-		if err != memcache.ErrCacheMiss {
-			msg := fmt.Sprintf("Memcache error: %v", err)
-			http.Error(w, msg, http.StatusInternalServerError)
+	// In the moderation mode, only the trusted posters' messages are shown
+	// at once.
+	if s.config.Moderation {
+		trusted, err := s.isTrusted(ctx, message.SessionID, message.Name)
+		if err != nil {
+			msg := fmt.Sprintf("Moderation error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
 			return
 		}
-		item := &memcache.Item{
-			Key:    messagesKey,
-			Object: []Message{message},
+		if !trusted {
+			s.holdMessage(ctx, w, r, room, message)
+			return
 		}
-		if err := memcache.JSON.Set(ctx, item); err != nil {
-			msg := fmt.Sprintf("Memcache error: %v", err)
-			http.Error(w, msg, http.StatusInternalServerError)
+	}
+
+	ctx, ok := s.checkRevision(ctx, w, r, room)
+	if !ok {
+		return
+	}
+	defer s.endRevision(ctx)
+	if s.pipeline != nil {
+		err := s.pipeline.Accept(ctx, room, message)
+		if err == nil {
+			// The revision is increased on accepting the post, and
+			// not when it is stored, so that another change based
+			// on the same revision fails in the meantime.
+			s.bumpRevision(ctx, room)
+			writeBody(w, r, http.StatusAccepted, &PostResponse{
+				Message: message,
+				Queued:  true,
+			})
+			return
+		}
+		// The post is stored now if the pipeline is unavailable.
+		s.logf(ctx, "Pipeline error: %v", err)
+	}
+	if err := s.storeMessage(ctx, room, &message); err != nil {
+		if err == errQueued {
+			writeBody(w, r, http.StatusAccepted, &PostResponse{
+				Message: message,
+				Queued:  true,
+			})
 			return
 		}
-		w.WriteHeader(http.StatusCreated)
+		msg := fmt.Sprintf("Could not store the request body: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
 		return
 	}
 
-	messages = append(messages, message)
-	const maxMessageNum = 50
-	if len(messages) > maxMessageNum {
-		messages = messages[len(messages)-maxMessageNum:]
+	token, err := s.issueEditToken(ctx, room, message.ID)
+	if err != nil {
+		msg := fmt.Sprintf("Edit token error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
 	}
-	item.Object = messages
+	writeBody(w, r, http.StatusCreated, &PostResponse{
+		Message:   message,
+		EditToken: token,
+	})
+}
 
-	if err := memcache.JSON.CompareAndSwap(ctx, item); err != nil {
-		msg := fmt.Sprintf("Could not store the request body: %v", err)
-		http.Error(w, msg, http.StatusBadRequest)
+func (s *server) handleSnippets(w http.ResponseWriter, r *http.Request) {
+	if s.handleCORS(w, r) {
+		return
+	}
+
+	// The route is resolved first so that unknown paths and methods get
+	// 404 and 405 without a session or the CSRF check.
+	ctx := r.Context()
+	h, p, ok := s.router.lookup(ctx, s, w, r)
+	if !ok {
 		return
 	}
 
-	w.WriteHeader(http.StatusCreated)
+	ctx, err := s.withSession(ctx, w, r)
+	if err != nil {
+		msg := fmt.Sprintf("Session error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	if !s.checkCSRF(ctx, w, r) {
+		return
+	}
+
+	h(ctx, w, r, p)
+}
+
+// routes returns the router of the paths in a room.
+func (s *server) routes() *router {
+	rt := &router{}
+	if s.dev {
+		rt.handle(http.MethodGet, "/dev", inRoom(s.getDev))
+	}
+	rt.handle(http.MethodGet, "/emoji", inRoom(s.getEmoji))
+	rt.handle(http.MethodGet, "/embed", inRoom(s.getEmbed))
+	if s.accounts {
+		rt.handle(http.MethodGet, "/login", inRoom(func(ctx context.Context, w http.ResponseWriter, r *http.Request, room string) {
+			redirectToLogin(ctx, w, r, room, true)
+		}))
+		rt.handle(http.MethodGet, "/logout", inRoom(func(ctx context.Context, w http.ResponseWriter, r *http.Request, room string) {
+			redirectToLogin(ctx, w, r, room, false)
+		}))
+	}
+
+	list := func(format string) routeHandler {
+		return inRoom(func(ctx context.Context, w http.ResponseWriter, r *http.Request, room string) {
+			s.listMessages(ctx, w, r, room, format)
+		})
+	}
+	rt.handle(http.MethodGet, "/", list(formatNegotiate))
+	rt.handle(http.MethodGet, "/messages", list(formatNegotiate))
+	rt.handle(http.MethodPost, "/messages", inRoom(s.postMessage))
+	rt.handle(http.MethodGet, "/messages.html", list(formatHTML))
+	rt.handle(http.MethodGet, "/api/messages", list(formatJSON))
+	rt.handle(http.MethodPost, "/api/messages", inRoom(s.postBotMessage))
+	rt.handle(http.MethodGet, "/messages/stream", inRoom(func(ctx context.Context, w http.ResponseWriter, r *http.Request, room string) {
+		s.streamMessages(w, r, room)
+	}))
+	rt.handle(http.MethodGet, "/messages/poll", inRoom(s.pollMessages))
+	rt.handle(http.MethodPatch, "/messages/{id}", withID(s.editMessage))
+	rt.handle(http.MethodDelete, "/messages/{id}", withID(s.deleteMessage))
+	rt.handle(http.MethodPut, "/messages/{id}/pin", withID(s.pinMessage))
+	rt.handle(http.MethodDelete, "/messages/{id}/pin", withID(s.unpinMessage))
+	rt.handle(http.MethodPost, "/messages/{id}/report", withID(s.reportMessage))
+	rt.handle(http.MethodGet, "/pins", inRoom(s.getPins))
+	rt.handle(http.MethodGet, "/search", inRoom(s.handleSearch))
+	rt.handle(http.MethodGet, "/mentions", inRoom(s.getMentions))
+	rt.handle(http.MethodGet, "/presence", inRoom(s.handlePresence))
+	rt.handle(http.MethodPost, "/presence", inRoom(s.handlePresence))
+	rt.handle(http.MethodGet, "/read-cursor", inRoom(s.handleReadCursor))
+	rt.handle(http.MethodPut, "/read-cursor", inRoom(s.handleReadCursor))
+	rt.handle(http.MethodPost, "/typing", inRoom(s.postTyping))
+	rt.handle(http.MethodPost, "/names", inRoom(s.postName))
+	rt.handle(http.MethodGet, "/captcha", inRoom(s.handleCaptcha))
+	rt.handle(http.MethodPost, "/captcha", inRoom(s.handleCaptcha))
+	rt.handle(http.MethodGet, "/profile", inRoom(s.handleProfile))
+	rt.handle(http.MethodPut, "/profile", inRoom(s.handleProfile))
+	rt.handle(http.MethodGet, "/dm/{user}", withUser(s.listDirectMessages))
+	rt.handle(http.MethodPost, "/dm/{user}", withUser(s.postDirectMessage))
+	rt.handle(http.MethodPost, "/attachments", inRoom(func(ctx context.Context, w http.ResponseWriter, r *http.Request, room string) {
+		s.postAttachment(ctx, w, r)
+	}))
+	rt.handle(http.MethodPost, "/polls", inRoom(s.postPoll))
+	rt.handle(http.MethodPost, "/polls/{id}/votes", withID(s.votePoll))
+	rt.handle(http.MethodPost, "/integrations/slack", inRoom(s.postFromSlack))
+	return rt
+}
+
+// handler returns the handler serving all the endpoints.
+func (s *server) handler() http.Handler {
+	s.router = s.routes()
+	graphQL := newGraphQLService(s)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handleSnippets)
+	mux.Handle("/ws", websocket.Handler(s.handleWebSocket))
+	mux.Handle("/graphql", graphQL)
+	mux.HandleFunc("/openapi.json", s.handleOpenAPI)
+	mux.HandleFunc("/embed.js", s.handleEmbedJS)
+	mux.HandleFunc("/static/", s.handleStatic)
+	mux.HandleFunc("/favicon.ico", s.handleFavicon)
+	mux.HandleFunc("/avatar/", s.handleAvatar)
+	mux.HandleFunc("/admin", s.handleAdmin)
+	mux.HandleFunc("/admin/", s.handleAdmin)
+	mux.HandleFunc("/images/", s.handleImage)
+	mux.HandleFunc("/tasks/purge", s.handlePurge)
+	mux.HandleFunc("/tasks/scheduled", s.handleDeliverScheduled)
+	mux.HandleFunc("/tasks/expire", s.handleExpire)
+	if s.postQueue != nil {
+		mux.HandleFunc("/_ah/stop", s.handleStop)
+		mux.HandleFunc("/tasks/posts", s.handleQueuedPosts)
+	}
+	if s.pipeline != nil {
+		mux.HandleFunc("/tasks/posts/drain", s.handleDrainPosts)
+	}
+	mux.Handle("/metrics", metricsHandler())
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/readyz", s.handleReadyz)
+	h := s.withRequestLog(withCompression(s.withSecurityHeaders(s.withTracing(s.withIntegrations(s.withTimeouts(withAPIVersions(mux)))))))
+	graphQL.handler = h
+	return h
 }
 
-func handleSnippets(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+// NewHandler returns a handler serving the chat outside App Engine. Messages
+// are stored in store, and other states like rate limits and bans are stored
+// in kv. If store also implements Broker, posted messages are relayed to the
+// other servers sharing the store. The background loops, like the one posting
+// the scheduled messages, run until ctx is done.
+func NewHandler(ctx context.Context, store Store, kv KV, config Config) http.Handler {
+	s := newServer(store, kv, config)
+	s.start(ctx)
+	return s.handler()
+}
+
+// newServer returns a server outside App Engine. See NewHandler.
+func newServer(store Store, kv KV, config Config) *server {
+	s := &server{
+		store:     store,
+		cache:     kv,
+		db:        kv,
+		hub:       newHub(),
+		fallback:  newFallback(),
+		batcher:   newPostBatcher(),
+		webhooks:  &webhookDispatcher{},
+		config:    config,
+		rateLimit: rateLimitFromEnv("RATE_LIMIT", defaultRateLimit),
+
+		botRateLimit: rateLimitFromEnv("BOT_RATE_LIMIT", defaultBotRateLimit),
 
-	ctx := appengine.NewContext(r)
-	switch r.Method {
-	case http.MethodHead, http.MethodGet:
-		getMessages(ctx, w, r)
-	case http.MethodPost:
-		postMessages(ctx, w, r)
-	default:
-		s := http.StatusMethodNotAllowed
-		http.Error(w, http.StatusText(s), s)
+		adminToken:    os.Getenv("ADMIN_TOKEN"),
+		sessionSecret: sessionSecretFromEnv(),
+
+		logf: func(ctx context.Context, format string, args ...interface{}) {
+			log.Printf(format, args...)
+		},
+		httpClient: func(ctx context.Context) *http.Client {
+			return publicClient
+		},
+		slackToken:  os.Getenv("SLACK_TOKEN"),
+		spamScorers: defaultSpamScorers,
+		draining:    make(chan struct{}),
+	}
+	if webhook := os.Getenv("SLACK_WEBHOOK_URL"); webhook != "" {
+		s.slack = &slackForwarder{
+			url: webhook,
+			client: func(ctx context.Context) *http.Client {
+				return http.DefaultClient
+			},
+		}
 	}
+	if config.TraceProject != "" {
+		token := &metadataToken{}
+		s.enableTracing(&cloudTraceExporter{
+			project: config.TraceProject,
+			token:   token.get,
+			client: func(ctx context.Context) *http.Client {
+				return http.DefaultClient
+			},
+		})
+	}
+	if b, ok := store.(Broker); ok {
+		s.broker = b
+	}
+	return s
 }
 
-func init() {
-	http.HandleFunc("/", handleSnippets)
+// start starts the background loops of the server outside App Engine. The
+// loops return when ctx is done, and s.loops waits for them.
+func (s *server) start(ctx context.Context) {
+	loops := []func(ctx context.Context){
+		s.runIntegrations,
+		s.runScheduledMessages,
+		s.runExpireMessages,
+	}
+	if s.broker != nil {
+		loops = append(loops, s.relay)
+	}
+	for _, f := range loops {
+		s.loops.Add(1)
+		go func(f func(ctx context.Context)) {
+			defer s.loops.Done()
+			f(ctx)
+		}(f)
+	}
 }
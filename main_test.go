@@ -0,0 +1,408 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/golangtokyo/chatserver"
+)
+
+const testAdminToken = "admin-token"
+
+func newTestServer(t *testing.T, config chatserver.Config) *httptest.Server {
+	t.Helper()
+	t.Setenv("ADMIN_TOKEN", testAdminToken)
+	ctx, cancel := context.WithCancel(context.Background())
+	srv := httptest.NewServer(chatserver.NewHandler(ctx, chatserver.NewMemoryStore(), chatserver.NewMemoryKV(), config))
+	t.Cleanup(func() {
+		srv.Close()
+		cancel()
+	})
+	return srv
+}
+
+func do(t *testing.T, req *http.Request) (*http.Response, []byte) {
+	t.Helper()
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, body
+}
+
+func post(t *testing.T, srv *httptest.Server, body string, header http.Header) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/messages", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	return do(t, req)
+}
+
+func postMessage(t *testing.T, srv *httptest.Server, name, body string) chatserver.Message {
+	t.Helper()
+	b, err := json.Marshal(&chatserver.Message{Name: name, Body: body})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, resBody := post(t, srv, string(b), nil)
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("POST /messages: status: got %d, want %d: %s", res.StatusCode, http.StatusCreated, resBody)
+	}
+	var m chatserver.Message
+	if err := json.Unmarshal(resBody, &m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func getMessages(t *testing.T, srv *httptest.Server, query string) chatserver.MessagesResponse {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/api/messages"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, body := do(t, req)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("GET /api/messages%s: status: got %d, want %d: %s", query, res.StatusCode, http.StatusOK, body)
+	}
+	var r chatserver.MessagesResponse
+	if err := json.Unmarshal(body, &r); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func errorCode(t *testing.T, body []byte) string {
+	t.Helper()
+	var r chatserver.ErrorResponse
+	if err := json.Unmarshal(body, &r); err != nil {
+		t.Fatalf("%v: %s", err, body)
+	}
+	return r.Error.Code
+}
+
+func ids(messages []chatserver.Message) []int64 {
+	var r []int64
+	for _, m := range messages {
+		r = append(r, m.ID)
+	}
+	return r
+}
+
+func TestPostAndGet(t *testing.T) {
+	srv := newTestServer(t, chatserver.DefaultConfig())
+
+	m := postMessage(t, srv, "gopher", "Hello")
+	if m.ID == 0 {
+		t.Errorf("ID: got 0, want non-zero")
+	}
+	if m.Name != "gopher" || m.Body != "Hello" {
+		t.Errorf("posted message: got %q: %q, want %q: %q", m.Name, m.Body, "gopher", "Hello")
+	}
+
+	r := getMessages(t, srv, "")
+	if len(r.Messages) != 1 {
+		t.Fatalf("len(messages): got %d, want 1", len(r.Messages))
+	}
+	if got := r.Messages[0]; got.ID != m.ID || got.Name != "gopher" || got.Body != "Hello" {
+		t.Errorf("message: got %d %q: %q, want %d %q: %q", got.ID, got.Name, got.Body, m.ID, "gopher", "Hello")
+	}
+	if r.Revision != 1 {
+		t.Errorf("revision: got %d, want 1", r.Revision)
+	}
+}
+
+func TestTrimAtHistoryLength(t *testing.T) {
+	config := chatserver.DefaultConfig()
+	config.HistoryLength = 3
+	srv := newTestServer(t, config)
+
+	for i := 0; i < 5; i++ {
+		postMessage(t, srv, "gopher", fmt.Sprintf("Message %d", i))
+	}
+	r := getMessages(t, srv, "")
+	if got, want := fmt.Sprint(ids(r.Messages)), "[3 4 5]"; got != want {
+		t.Errorf("IDs: got %s, want %s", got, want)
+	}
+	if r.Next == "" {
+		t.Errorf("next: got empty, want the older page")
+	}
+	// The memory store keeps only the latest messages.
+	r = getMessages(t, srv, "?before=3")
+	if len(r.Messages) != 0 {
+		t.Errorf("IDs before 3: got %v, want none", ids(r.Messages))
+	}
+}
+
+func TestBefore(t *testing.T) {
+	srv := newTestServer(t, chatserver.DefaultConfig())
+
+	for i := 0; i < 5; i++ {
+		postMessage(t, srv, "gopher", fmt.Sprintf("Message %d", i))
+	}
+	r := getMessages(t, srv, "?before=5&limit=2")
+	if got, want := fmt.Sprint(ids(r.Messages)), "[3 4]"; got != want {
+		t.Errorf("IDs: got %s, want %s", got, want)
+	}
+	if got, want := r.Next, "/api/messages?before=3&limit=2"; got != want {
+		t.Errorf("next: got %q, want %q", got, want)
+	}
+	r = getMessages(t, srv, "?before=3&limit=2")
+	if got, want := fmt.Sprint(ids(r.Messages)), "[1 2]"; got != want {
+		t.Errorf("IDs: got %s, want %s", got, want)
+	}
+}
+
+func TestConcurrentPosts(t *testing.T) {
+	const (
+		posters = 10
+		posts   = 10
+	)
+	t.Setenv("RATE_LIMIT_BURST", fmt.Sprint(posters*posts))
+	config := chatserver.DefaultConfig()
+	config.HistoryLength = posters * posts
+	srv := newTestServer(t, config)
+
+	// The posts at the same time are appended together by the batcher.
+	var wg sync.WaitGroup
+	idsCh := make(chan int64, posters*posts)
+	errCh := make(chan error, posters*posts)
+	for i := 0; i < posters; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < posts; j++ {
+				body := fmt.Sprintf(`{"name":"gopher%d","body":"Message %d"}`, i, j)
+				res, err := http.Post(srv.URL+"/messages", "application/json", strings.NewReader(body))
+				if err != nil {
+					errCh <- err
+					continue
+				}
+				var m chatserver.Message
+				err = json.NewDecoder(res.Body).Decode(&m)
+				res.Body.Close()
+				if err != nil {
+					errCh <- err
+					continue
+				}
+				if res.StatusCode != http.StatusCreated {
+					errCh <- fmt.Errorf("status: got %d, want %d", res.StatusCode, http.StatusCreated)
+					continue
+				}
+				idsCh <- m.ID
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(idsCh)
+	close(errCh)
+	for err := range errCh {
+		t.Error(err)
+	}
+
+	var posted []int64
+	for id := range idsCh {
+		posted = append(posted, id)
+	}
+	sort.Slice(posted, func(i, j int) bool { return posted[i] < posted[j] })
+	for i, id := range posted {
+		if i > 0 && id == posted[i-1] {
+			t.Errorf("ID %d is assigned to more than one message", id)
+		}
+	}
+
+	r := getMessages(t, srv, fmt.Sprintf("?limit=%d", posters*posts))
+	if got, want := len(r.Messages), posters*posts; got != want {
+		t.Fatalf("len(messages): got %d, want %d", got, want)
+	}
+	if got, want := fmt.Sprint(ids(r.Messages)), fmt.Sprint(posted); got != want {
+		t.Errorf("IDs: got %s, want %s", got, want)
+	}
+	for i, m := range r.Messages {
+		if i > 0 && m.ID <= r.Messages[i-1].ID {
+			t.Errorf("IDs are not increasing: %d after %d", m.ID, r.Messages[i-1].ID)
+		}
+	}
+	if got, want := r.Revision, int64(posters*posts); got != want {
+		t.Errorf("revision: got %d, want %d", got, want)
+	}
+}
+
+func TestIfMatch(t *testing.T) {
+	srv := newTestServer(t, chatserver.DefaultConfig())
+
+	postMessage(t, srv, "gopher", "Hello")
+	rev := getMessages(t, srv, "").Revision
+
+	ifMatch := http.Header{"If-Match": {fmt.Sprintf(`"%d"`, rev)}}
+	res, body := post(t, srv, `{"name":"gopher","body":"First"}`, ifMatch)
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("status: got %d, want %d: %s", res.StatusCode, http.StatusCreated, body)
+	}
+	if got, want := getMessages(t, srv, "").Revision, rev+1; got != want {
+		t.Errorf("revision: got %d, want %d", got, want)
+	}
+
+	// The second change based on the same revision fails.
+	res, body = post(t, srv, `{"name":"gopher","body":"Second"}`, ifMatch)
+	if res.StatusCode != http.StatusConflict {
+		t.Fatalf("status: got %d, want %d: %s", res.StatusCode, http.StatusConflict, body)
+	}
+	var conflict chatserver.RevisionConflictError
+	if err := json.Unmarshal(body, &conflict); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := conflict.Revision, rev+1; got != want {
+		t.Errorf("revision in the conflict: got %d, want %d", got, want)
+	}
+	r := getMessages(t, srv, "")
+	if got, want := len(r.Messages), 2; got != want {
+		t.Errorf("len(messages): got %d, want %d", got, want)
+	}
+	if got, want := r.Revision, rev+1; got != want {
+		t.Errorf("revision: got %d, want %d", got, want)
+	}
+
+	// A change that fails after the revision is checked doesn't change the
+	// revision.
+	req, err := http.NewRequest(http.MethodDelete, srv.URL+"/messages/100", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	req.Header.Set("If-Match", fmt.Sprintf(`"%d"`, rev+1))
+	res, body = do(t, req)
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("status: got %d, want %d: %s", res.StatusCode, http.StatusNotFound, body)
+	}
+	if got, want := getMessages(t, srv, "").Revision, rev+1; got != want {
+		t.Errorf("revision after a failure: got %d, want %d", got, want)
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	srv := newTestServer(t, chatserver.DefaultConfig())
+
+	req, err := http.NewRequest(http.MethodPut, srv.URL+"/messages", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, body := do(t, req)
+	if res.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("status: got %d, want %d: %s", res.StatusCode, http.StatusMethodNotAllowed, body)
+	}
+	if got, want := res.Header.Get("Allow"), "GET, HEAD, POST"; got != want {
+		t.Errorf("Allow: got %q, want %q", got, want)
+	}
+	if got, want := errorCode(t, body), "method_not_allowed"; got != want {
+		t.Errorf("code: got %q, want %q", got, want)
+	}
+}
+
+var csrfTokenRe = regexp.MustCompile(`<meta name="csrf-token" content="([^"]*)">`)
+
+func TestCSRF(t *testing.T) {
+	srv := newTestServer(t, chatserver.DefaultConfig())
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/messages", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "text/html")
+	res, body := do(t, req)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status: got %d, want %d: %s", res.StatusCode, http.StatusOK, body)
+	}
+	var cookie *http.Cookie
+	for _, c := range res.Cookies() {
+		if c.Name == "session" {
+			cookie = c
+		}
+	}
+	if cookie == nil {
+		t.Fatal("no session cookie")
+	}
+	match := csrfTokenRe.FindSubmatch(body)
+	if match == nil {
+		t.Fatal("no CSRF token in the page")
+	}
+	token := string(match[1])
+
+	for _, tc := range []struct {
+		token  string
+		status int
+	}{
+		{"", http.StatusForbidden},
+		{"invalid", http.StatusForbidden},
+		{token, http.StatusCreated},
+	} {
+		header := http.Header{"Cookie": {cookie.String()}}
+		if tc.token != "" {
+			header.Set("X-CSRF-Token", tc.token)
+		}
+		res, body := post(t, srv, `{"name":"gopher","body":"Hello"}`, header)
+		if res.StatusCode != tc.status {
+			t.Errorf("token %q: status: got %d, want %d: %s", tc.token, res.StatusCode, tc.status, body)
+			continue
+		}
+		if tc.status != http.StatusForbidden {
+			continue
+		}
+		if got, want := errorCode(t, body), "invalid_csrf_token"; got != want {
+			t.Errorf("token %q: code: got %q, want %q", tc.token, got, want)
+		}
+	}
+	if got, want := len(getMessages(t, srv, "").Messages), 1; got != want {
+		t.Errorf("len(messages): got %d, want %d", got, want)
+	}
+}
+
+func TestBodyTooLarge(t *testing.T) {
+	config := chatserver.DefaultConfig()
+	config.MaxContentSize = 64
+	srv := newTestServer(t, config)
+
+	res, body := post(t, srv, `{"name":"gopher","body":"`+strings.Repeat("a", 100)+`"}`, nil)
+	if res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status: got %d, want %d: %s", res.StatusCode, http.StatusRequestEntityTooLarge, body)
+	}
+	if got, want := errorCode(t, body), "body_too_large"; got != want {
+		t.Errorf("code: got %q, want %q", got, want)
+	}
+	if got := len(getMessages(t, srv, "").Messages); got != 0 {
+		t.Errorf("len(messages): got %d, want 0", got)
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"bytes"
+	"html"
+	"html/template"
+	"net/url"
+	"strings"
+	"unicode"
+)
+
+// renderMarkdown renders a limited subset of Markdown: `code`, **bold**,
+// *italic* and [text](url) links. _italic_ is not supported since
+// snake_case identifiers are common in chats about Go. Bare URLs are also
+// rendered as links, emoji shortcodes like :smile: are replaced with
+// emoji, and mentions like @name are highlighted. All the other text is
+// escaped, and only http and https links are allowed.
+func renderMarkdown(src string) template.HTML {
+	var buf bytes.Buffer
+	writeMarkdown(&buf, src, false)
+	return template.HTML(buf.String())
+}
+
+// bareURLLen returns the length of the http or https URL at the beginning of
+// src, or 0 if src doesn't start with a URL. Trailing punctuation is not
+// considered a part of the URL.
+func bareURLLen(src string) int {
+	if !strings.HasPrefix(src, "http://") && !strings.HasPrefix(src, "https://") {
+		return 0
+	}
+	n := strings.IndexFunc(src, func(r rune) bool {
+		return unicode.IsSpace(r) || strings.ContainsRune(`<>"`, r)
+	})
+	if n < 0 {
+		n = len(src)
+	}
+	n = len(strings.TrimRight(src[:n], ".,:;!?)'"))
+	if n <= len("https://") {
+		return 0
+	}
+	return n
+}
+
+// nextSpecial returns the index of the next character that might start a
+// markup after the first character.
+func nextSpecial(src string) int {
+	n := len(src)
+	if i := strings.IndexAny(src[1:], "`*[:@"); i >= 0 {
+		n = i + 1
+	}
+	if i := strings.Index(src[1:], "http"); i >= 0 && i+1 < n {
+		n = i + 1
+	}
+	return n
+}
+
+// safeURL returns the URL if its scheme is http or https.
+func safeURL(rawurl string) (string, bool) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", false
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", false
+	}
+	return u.String(), true
+}
+
+func writeLinkStart(buf *bytes.Buffer, href string) {
+	buf.WriteString(`<a href="`)
+	buf.WriteString(html.EscapeString(href))
+	buf.WriteString(`" rel="noopener noreferrer" target="_blank">`)
+}
+
+// writeMarkdown writes the rendered src. inLink is true when src is a link
+// text, where links are not allowed.
+func writeMarkdown(buf *bytes.Buffer, src string, inLink bool) {
+	for len(src) > 0 {
+		switch {
+		case src[0] == '`':
+			if end := strings.IndexByte(src[1:], '`'); end > 0 {
+				buf.WriteString("<code>")
+				buf.WriteString(html.EscapeString(src[1 : 1+end]))
+				buf.WriteString("</code>")
+				src = src[end+2:]
+				continue
+			}
+		case strings.HasPrefix(src, "**"):
+			if end := strings.Index(src[2:], "**"); end > 0 {
+				buf.WriteString("<strong>")
+				writeMarkdown(buf, src[2:2+end], inLink)
+				buf.WriteString("</strong>")
+				src = src[end+4:]
+				continue
+			}
+		case src[0] == '*':
+			if end := strings.IndexByte(src[1:], '*'); end > 0 {
+				buf.WriteString("<em>")
+				writeMarkdown(buf, src[1:1+end], inLink)
+				buf.WriteString("</em>")
+				src = src[end+2:]
+				continue
+			}
+		case src[0] == '[' && !inLink:
+			if mid := strings.Index(src, "]("); mid > 1 {
+				if end := strings.IndexByte(src[mid+2:], ')'); end > 0 {
+					if href, ok := safeURL(src[mid+2 : mid+2+end]); ok {
+						writeLinkStart(buf, href)
+						writeMarkdown(buf, src[1:mid], true)
+						buf.WriteString(`</a>`)
+						src = src[mid+2+end+1:]
+						continue
+					}
+				}
+			}
+		case src[0] == '@':
+			if n := mentionLen(src); n > 0 && canStartMention(buf.String()) {
+				buf.WriteString(`<span class="mention">`)
+				buf.WriteString(html.EscapeString(src[:n]))
+				buf.WriteString(`</span>`)
+				src = src[n:]
+				continue
+			}
+		case src[0] == ':':
+			if n, e := emojiShortcode(src); n > 0 {
+				buf.WriteString(e)
+				src = src[n:]
+				continue
+			}
+		case src[0] == 'h' && !inLink:
+			if n := bareURLLen(src); n > 0 {
+				if href, ok := safeURL(src[:n]); ok {
+					writeLinkStart(buf, href)
+					buf.WriteString(html.EscapeString(src[:n]))
+					buf.WriteString(`</a>`)
+					src = src[n:]
+					continue
+				}
+			}
+		}
+
+		// Write the text until the next special character. The first
+		// character is always written so that the loop proceeds.
+		n := nextSpecial(src)
+		buf.WriteString(html.EscapeString(src[:n]))
+		src = src[n:]
+	}
+}
@@ -0,0 +1,457 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/appengine/v2/memcache"
+)
+
+// memcacheStore is a Store on memcache. The messages might be evicted at any time.
+// IDs continue from the last cached message, so they restart when all the
+// messages are evicted.
+//
+// The messages in a room can be spread over shards, which are memcache keys
+// chosen by the message IDs, so that concurrent posts rarely update the same
+// key. Reads fetch all the shards and merge them. Shards are only for caching
+// messages whose IDs are assigned by another store, and Append requires a
+// single shard.
+type memcacheStore struct {
+	key string
+
+	// shards is the number of the shards of a room. 0 means 1.
+	shards int
+}
+
+// itemKey returns the memcache key for the room. The default room uses the key
+// as it is for compatibility.
+func (s *memcacheStore) itemKey(room string) string {
+	if room == defaultRoom {
+		return s.key
+	}
+	return s.key + ":" + room
+}
+
+func (s *memcacheStore) numShards() int {
+	if s.shards < 1 {
+		return 1
+	}
+	return s.shards
+}
+
+// shardKey returns the memcache key of the shard in the room. A single shard
+// uses the key of the room.
+func (s *memcacheStore) shardKey(room string, shard int) string {
+	if s.numShards() == 1 {
+		return s.itemKey(room)
+	}
+	return s.itemKey(room) + ":" + strconv.Itoa(shard)
+}
+
+// shardOf returns the shard of the message ID.
+func (s *memcacheStore) shardOf(id int64) int {
+	return int(id % int64(s.numShards()))
+}
+
+// shardLimit returns the number of the messages to keep in a shard so that the
+// shards have the latest n messages. IDs are consecutive, so the messages are
+// spread evenly.
+func (s *memcacheStore) shardLimit(n int) int {
+	return (n + s.numShards() - 1) / s.numShards()
+}
+
+func (s *memcacheStore) get(ctx context.Context, room string) ([]Message, bool, error) {
+	if s.numShards() == 1 {
+		messages := []Message{}
+		if _, err := memcacheGet(ctx, s.itemKey(room), &messages); err != nil {
+			if err == memcache.ErrCacheMiss {
+				return nil, false, nil
+			}
+			return nil, false, err
+		}
+		return messages, true, nil
+	}
+
+	keys := make([]string, s.numShards())
+	for i := range keys {
+		keys[i] = s.shardKey(room, i)
+	}
+	items, err := memcacheGetMulti(ctx, keys)
+	if err != nil {
+		return nil, false, err
+	}
+	// The messages are incomplete if any shard is evicted.
+	if len(items) < len(keys) {
+		return nil, false, nil
+	}
+	messages := []Message{}
+	for _, k := range keys {
+		var shard []Message
+		if err := json.Unmarshal(items[k].Value, &shard); err != nil {
+			return nil, false, err
+		}
+		messages = append(messages, shard...)
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].ID < messages[j].ID
+	})
+	return messages, true, nil
+}
+
+func (s *memcacheStore) set(ctx context.Context, room string, messages []Message) error {
+	shards := make([][]Message, s.numShards())
+	for i := range shards {
+		shards[i] = []Message{}
+	}
+	for _, m := range messages {
+		i := s.shardOf(m.ID)
+		shards[i] = append(shards[i], m)
+	}
+	items := make([]*memcache.Item, len(shards))
+	for i, shard := range shards {
+		items[i] = &memcache.Item{
+			Key:    s.shardKey(room, i),
+			Object: shard,
+		}
+	}
+	if len(items) == 1 {
+		return memcacheSet(ctx, items[0])
+	}
+	return memcacheSetMulti(ctx, items)
+}
+
+// memcacheGet and the other functions below call the memcache API in a span
+// within the backend timeout, and count the errors in the metrics.
+func memcacheGet(ctx context.Context, key string, v interface{}) (*memcache.Item, error) {
+	ctx, cancel := backendContext(ctx)
+	defer cancel()
+	ctx, span := startSpan(ctx, "memcache.Get")
+	item, err := memcache.JSON.Get(ctx, key, v)
+	endMemcacheSpan(span, err)
+	return item, err
+}
+
+func memcacheGetMulti(ctx context.Context, keys []string) (map[string]*memcache.Item, error) {
+	ctx, cancel := backendContext(ctx)
+	defer cancel()
+	ctx, span := startSpan(ctx, "memcache.GetMulti")
+	items, err := memcache.GetMulti(ctx, keys)
+	endMemcacheSpan(span, err)
+	return items, err
+}
+
+func memcacheSet(ctx context.Context, item *memcache.Item) error {
+	ctx, cancel := backendContext(ctx)
+	defer cancel()
+	ctx, span := startSpan(ctx, "memcache.Set")
+	err := memcache.JSON.Set(ctx, item)
+	endMemcacheSpan(span, err)
+	return err
+}
+
+func memcacheSetMulti(ctx context.Context, items []*memcache.Item) error {
+	ctx, cancel := backendContext(ctx)
+	defer cancel()
+	ctx, span := startSpan(ctx, "memcache.SetMulti")
+	err := memcache.JSON.SetMulti(ctx, items)
+	endMemcacheSpan(span, err)
+	return err
+}
+
+func memcacheAdd(ctx context.Context, item *memcache.Item) error {
+	ctx, cancel := backendContext(ctx)
+	defer cancel()
+	ctx, span := startSpan(ctx, "memcache.Add")
+	err := memcache.JSON.Add(ctx, item)
+	endMemcacheSpan(span, err)
+	return err
+}
+
+func memcacheCompareAndSwap(ctx context.Context, item *memcache.Item) error {
+	ctx, cancel := backendContext(ctx)
+	defer cancel()
+	ctx, span := startSpan(ctx, "memcache.CompareAndSwap")
+	err := memcache.JSON.CompareAndSwap(ctx, item)
+	endMemcacheSpan(span, err)
+	return err
+}
+
+func memcacheDelete(ctx context.Context, key string) error {
+	ctx, cancel := backendContext(ctx)
+	defer cancel()
+	ctx, span := startSpan(ctx, "memcache.Delete")
+	err := memcache.Delete(ctx, key)
+	endMemcacheSpan(span, err)
+	return err
+}
+
+// endMemcacheSpan ends the span of a memcache call. A cache miss is not an
+// error.
+func endMemcacheSpan(span trace.Span, err error) {
+	countMemcacheError(err)
+	if err == memcache.ErrCacheMiss {
+		err = nil
+	}
+	endSpan(span, err)
+}
+
+const (
+	maxCASRetries  = 5
+	casBackoffBase = 10 * time.Millisecond
+)
+
+// casBackoff returns the duration to wait before the i-th retry.
+// The duration grows exponentially with full jitter.
+func casBackoff(i int) time.Duration {
+	return time.Duration(rand.Int63n(int64(casBackoffBase << uint(i))))
+}
+
+// waitCASBackoff waits before the i-th retry. waitCASBackoff returns
+// ctx.Err() if ctx is done in the meantime, so that a canceled request stops
+// retrying.
+func waitCASBackoff(ctx context.Context, i int) error {
+	t := time.NewTimer(casBackoff(i))
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// update applies f to the cached messages in every shard of the room. See
+// updateShard.
+func (s *memcacheStore) update(ctx context.Context, room string, f func([]Message) []Message, add bool) error {
+	for i := 0; i < s.numShards(); i++ {
+		if err := s.updateShard(ctx, room, i, f, add); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateShard applies f to the cached messages in the shard. updateShard does
+// nothing when the messages are not cached unless add is true. updateShard
+// retries when another request updates the shard at the same time.
+func (s *memcacheStore) updateShard(ctx context.Context, room string, shard int, f func([]Message) []Message, add bool) error {
+	var err error
+	for i := 0; i < maxCASRetries; i++ {
+		if i > 0 {
+			if err := waitCASBackoff(ctx, i); err != nil {
+				return err
+			}
+		}
+		err = s.tryUpdate(ctx, s.shardKey(room, shard), f, add)
+		if err != memcache.ErrCASConflict && err != memcache.ErrNotStored {
+			return err
+		}
+		casConflictsTotal.WithLabelValues("memcache").Inc()
+	}
+	return err
+}
+
+func (s *memcacheStore) tryUpdate(ctx context.Context, key string, f func([]Message) []Message, add bool) error {
+	var messages []Message
+	item, err := memcacheGet(ctx, key, &messages)
+	if err != nil {
+		if err != memcache.ErrCacheMiss {
+			return err
+		}
+		if !add {
+			return nil
+		}
+		item := &memcache.Item{
+			Key:    key,
+			Object: f(nil),
+		}
+		return memcacheAdd(ctx, item)
+	}
+	item.Object = f(messages)
+	return memcacheCompareAndSwap(ctx, item)
+}
+
+// appendIfCached appends the message to its shard if the messages are cached,
+// and trims the shard so that the room keeps the latest n messages. Only the
+// shard of the message is updated.
+func (s *memcacheStore) appendIfCached(ctx context.Context, room string, message Message, n int) error {
+	limit := s.shardLimit(n)
+	return s.updateShard(ctx, room, s.shardOf(message.ID), func(messages []Message) []Message {
+		messages = append(messages, message)
+		if len(messages) > limit {
+			messages = messages[len(messages)-limit:]
+		}
+		return messages
+	}, false)
+}
+
+// appendMultiIfCached is like appendIfCached, and each shard is updated once
+// for all the messages.
+func (s *memcacheStore) appendMultiIfCached(ctx context.Context, room string, messages []Message, n int) error {
+	shards := map[int][]Message{}
+	for _, m := range messages {
+		i := s.shardOf(m.ID)
+		shards[i] = append(shards[i], m)
+	}
+	limit := s.shardLimit(n)
+	for i, ms := range shards {
+		ms := ms
+		if err := s.updateShard(ctx, room, i, func(messages []Message) []Message {
+			messages = append(messages, ms...)
+			if len(messages) > limit {
+				messages = messages[len(messages)-limit:]
+			}
+			return messages
+		}, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memcacheStore) Get(ctx context.Context, room string) ([]Message, error) {
+	messages, ok, err := s.get(ctx, room)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return []Message{}, nil
+	}
+	return messages, nil
+}
+
+func (s *memcacheStore) Append(ctx context.Context, room string, message Message) (int64, error) {
+	if err := s.update(ctx, room, func(messages []Message) []Message {
+		message.ID = 1
+		if len(messages) > 0 {
+			message.ID = messages[len(messages)-1].ID + 1
+		}
+		return append(messages, message)
+	}, true); err != nil {
+		return 0, err
+	}
+	return message.ID, nil
+}
+
+func (s *memcacheStore) History(ctx context.Context, room string, before int64, limit int) ([]Message, error) {
+	messages, err := s.Get(ctx, room)
+	if err != nil {
+		return nil, err
+	}
+	return historyOf(messages, before, limit), nil
+}
+
+func (s *memcacheStore) Trim(ctx context.Context, room string, n int) error {
+	limit := s.shardLimit(n)
+	return s.update(ctx, room, func(messages []Message) []Message {
+		if len(messages) > limit {
+			messages = messages[len(messages)-limit:]
+		}
+		return messages
+	}, false)
+}
+
+func (s *memcacheStore) Update(ctx context.Context, room string, id int64, f func(*Message)) (Message, error) {
+	var m Message
+	found := false
+	if err := s.updateShard(ctx, room, s.shardOf(id), func(messages []Message) []Message {
+		m, found = updateMessage(messages, id, f)
+		return messages
+	}, false); err != nil {
+		return Message{}, err
+	}
+	if !found {
+		return Message{}, ErrNotFound
+	}
+	return m, nil
+}
+
+// memcacheKV is a KV on memcache. The values might be evicted at any time.
+type memcacheKV struct{}
+
+func (memcacheKV) Get(ctx context.Context, key string, v interface{}) error {
+	if _, err := memcacheGet(ctx, key, v); err != nil {
+		if err == memcache.ErrCacheMiss {
+			return ErrNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (memcacheKV) Set(ctx context.Context, key string, v interface{}, expiration time.Duration) error {
+	item := &memcache.Item{
+		Key:        key,
+		Object:     v,
+		Expiration: expiration,
+	}
+	return memcacheSet(ctx, item)
+}
+
+func (kv memcacheKV) Update(ctx context.Context, key string, v interface{}, expiration time.Duration, f func() error) error {
+	var err error
+	for i := 0; i < maxCASRetries; i++ {
+		if i > 0 {
+			if err := waitCASBackoff(ctx, i); err != nil {
+				return err
+			}
+		}
+		err = kv.tryUpdate(ctx, key, v, expiration, f)
+		if err != memcache.ErrCASConflict && err != memcache.ErrNotStored {
+			return err
+		}
+		casConflictsTotal.WithLabelValues("memcache").Inc()
+	}
+	return err
+}
+
+func (memcacheKV) tryUpdate(ctx context.Context, key string, v interface{}, expiration time.Duration, f func() error) error {
+	resetValue(v)
+	item, err := memcacheGet(ctx, key, v)
+	if err != nil {
+		if err != memcache.ErrCacheMiss {
+			return err
+		}
+		if err := f(); err != nil {
+			return err
+		}
+		item := &memcache.Item{
+			Key:        key,
+			Object:     v,
+			Expiration: expiration,
+		}
+		return memcacheAdd(ctx, item)
+	}
+	if err := f(); err != nil {
+		return err
+	}
+	item.Object = v
+	item.Expiration = expiration
+	return memcacheCompareAndSwap(ctx, item)
+}
+
+func (memcacheKV) Delete(ctx context.Context, key string) error {
+	if err := memcacheDelete(ctx, key); err != nil && err != memcache.ErrCacheMiss {
+		return err
+	}
+	return nil
+}
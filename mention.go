@@ -0,0 +1,123 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// isMentionRune reports whether r can be a part of a mentioned name.
+func isMentionRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' || r == '.'
+}
+
+// mentionLen returns the length of the mention like @name at the beginning of
+// src, or 0 if src doesn't start with a mention. Trailing dots are not
+// considered a part of the name.
+func mentionLen(src string) int {
+	if !strings.HasPrefix(src, "@") {
+		return 0
+	}
+	n := strings.IndexFunc(src[1:], func(r rune) bool {
+		return !isMentionRune(r)
+	})
+	if n < 0 {
+		n = len(src) - 1
+	}
+	n = len(strings.TrimRight(src[1:1+n], "."))
+	if n == 0 {
+		return 0
+	}
+	return 1 + n
+}
+
+// canStartMention reports whether a mention can start after prev. This
+// excludes email addresses like gopher@example.com.
+func canStartMention(prev string) bool {
+	if prev == "" {
+		return true
+	}
+	r, _ := utf8.DecodeLastRuneInString(prev)
+	return !isMentionRune(r)
+}
+
+// parseMentions returns the names mentioned in the body without duplicates.
+func parseMentions(body string) []string {
+	var names []string
+	for i := 0; i < len(body); i++ {
+		if body[i] != '@' || !canStartMention(body[:i]) {
+			continue
+		}
+		n := mentionLen(body[i:])
+		if n == 0 {
+			continue
+		}
+		name := body[i+1 : i+n]
+		if !containsFold(names, name) {
+			names = append(names, name)
+		}
+		i += n - 1
+	}
+	return names
+}
+
+func containsFold(strs []string, str string) bool {
+	for _, s := range strs {
+		if strings.EqualFold(s, str) {
+			return true
+		}
+	}
+	return false
+}
+
+// mentioning returns the messages that mention the name. Names are compared
+// case-insensitively.
+func mentioning(messages []Message, name string) []Message {
+	result := []Message{}
+	for _, m := range messages {
+		if containsFold(m.Mentions, name) {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+// getMentions handles GET /mentions?name={name}. The latest messages in the
+// room are searched.
+func (s *server) getMentions(ctx context.Context, w http.ResponseWriter, r *http.Request, room string) {
+	name := strings.TrimPrefix(r.URL.Query().Get("name"), "@")
+	if name == "" {
+		writeError(w, r, http.StatusBadRequest, "name is required")
+		return
+	}
+	messages, err := s.store.Get(ctx, room)
+	if err != nil {
+		msg := fmt.Sprintf("Store error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	messages = mentioning(visibleMessages(messages), name)
+	writeJSON(w, http.StatusOK, &MessagesResponse{
+		Messages:    messages,
+		Count:       len(messages),
+		GeneratedAt: time.Now(),
+	})
+}
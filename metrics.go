@@ -0,0 +1,88 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/appengine/v2/memcache"
+)
+
+var (
+	postsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "chatserver_posts_total",
+		Help: "The number of posted messages.",
+	}, []string{"room"})
+
+	readsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "chatserver_reads_total",
+		Help: "The number of reads of the messages.",
+	}, []string{"room"})
+
+	memcacheErrorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "chatserver_memcache_errors_total",
+		Help: "The number of memcache errors other than cache misses and CAS conflicts.",
+	})
+
+	casConflictsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "chatserver_cas_conflicts_total",
+		Help: "The number of conflicts of optimistic updates.",
+	}, []string{"backend"})
+
+	postBatchSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "chatserver_post_batch_size",
+		Help:    "The number of posts stored at once.",
+		Buckets: []float64{1, 2, 5, 10, 20, 50, 100},
+	})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "chatserver_request_duration_seconds",
+		Help:    "The latency of the requests.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "code"})
+)
+
+// metricsRegistry has only the metrics of this package and the Go runtime.
+// The process metrics are not included since /proc is not available on App
+// Engine.
+var metricsRegistry = prometheus.NewRegistry()
+
+func init() {
+	metricsRegistry.MustRegister(
+		postsTotal,
+		readsTotal,
+		memcacheErrorsTotal,
+		casConflictsTotal,
+		postBatchSize,
+		requestDuration,
+		prometheus.NewGoCollector(),
+	)
+}
+
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// countMemcacheError counts err as a memcache error unless it is a cache miss
+// or a CAS conflict.
+func countMemcacheError(err error) {
+	switch err {
+	case nil, memcache.ErrCacheMiss, memcache.ErrCASConflict, memcache.ErrNotStored:
+	default:
+		memcacheErrorsTotal.Inc()
+	}
+}
@@ -0,0 +1,271 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	moderationQueueKey = "moderation:queue"
+	trustedNamesKey    = "moderation:trusted"
+
+	// maxPendingMessages is the maximum number of posts waiting for approval.
+	maxPendingMessages = 500
+)
+
+var errModerationQueueFull = errors.New("chatserver: the moderation queue is full")
+
+// PendingMessage is a post waiting for the approval of a moderator.
+type PendingMessage struct {
+	ID      string  `json:"id"`
+	Room    string  `json:"room"`
+	Message Message `json:"message"`
+
+	// IP is the address of the poster to ban.
+	IP string `json:"ip"`
+}
+
+// TrustedNames is the names that can post without approval in the moderation
+// mode.
+type TrustedNames struct {
+	Names []string `json:"names"`
+}
+
+func (s *server) trustedNames(ctx context.Context) (*TrustedNames, error) {
+	var t TrustedNames
+	if err := s.db.Get(ctx, trustedNamesKey, &t); err != nil && err != ErrNotFound {
+		return nil, err
+	}
+	if t.Names == nil {
+		t.Names = []string{}
+	}
+	return &t, nil
+}
+
+// isTrusted reports whether the poster can post without approval. The name
+// must be in the trusted names, and must be the account's name or registered
+// by the session so that no one else can post with it.
+func (s *server) isTrusted(ctx context.Context, sessionID, name string) (bool, error) {
+	t, err := s.trustedNames(ctx)
+	if err != nil {
+		return false, err
+	}
+	found := false
+	for _, n := range t.Names {
+		if normalizeName(n) == normalizeName(name) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false, nil
+	}
+	if s.userName(ctx) != "" {
+		return true, nil
+	}
+	var e nameClaimEntry
+	if err := s.db.Get(ctx, nameKey(name), &e); err != nil {
+		if err == ErrNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return e.SessionID == sessionID, nil
+}
+
+// holdMessage adds the post to the moderation queue, and writes 202 Accepted
+// with "pending":true.
+func (s *server) holdMessage(ctx context.Context, w http.ResponseWriter, r *http.Request, room string, message Message) {
+	id, err := newID()
+	if err != nil {
+		msg := fmt.Sprintf("Moderation error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	p := PendingMessage{
+		ID:      id,
+		Room:    room,
+		Message: message,
+		IP:      clientIP(r),
+	}
+	var queue []PendingMessage
+	if err := s.db.Update(ctx, moderationQueueKey, &queue, 0, func() error {
+		if len(queue) >= maxPendingMessages {
+			return errModerationQueueFull
+		}
+		queue = append(queue, p)
+		return nil
+	}); err != nil {
+		if err == errModerationQueueFull {
+			msg := "Too many messages are waiting for approval"
+			writeError(w, r, http.StatusServiceUnavailable, msg)
+			return
+		}
+		msg := fmt.Sprintf("Moderation error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	writeBody(w, r, http.StatusAccepted, &PostResponse{
+		Message: message,
+		Pending: true,
+	})
+}
+
+// takePending removes the post from the moderation queue and returns it.
+func (s *server) takePending(ctx context.Context, id string) (*PendingMessage, error) {
+	var queue []PendingMessage
+	var taken *PendingMessage
+	if err := s.db.Update(ctx, moderationQueueKey, &queue, 0, func() error {
+		for i := range queue {
+			if queue[i].ID != id {
+				continue
+			}
+			p := queue[i]
+			taken = &p
+			queue = append(queue[:i], queue[i+1:]...)
+			return nil
+		}
+		return ErrNotFound
+	}); err != nil {
+		return nil, err
+	}
+	return taken, nil
+}
+
+// handleModerationQueue handles /admin/queue, /admin/queue/{id} and
+// /admin/queue/{id}/approve.
+func (s *server) handleModerationQueue(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/queue"), "/")
+	id := strings.TrimSuffix(rest, "/approve")
+	approve := id != rest
+
+	switch {
+	case rest == "" && isGet(r):
+		var queue []PendingMessage
+		if err := s.db.Get(ctx, moderationQueueKey, &queue); err != nil && err != ErrNotFound {
+			msg := fmt.Sprintf("Moderation error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		if queue == nil {
+			queue = []PendingMessage{}
+		}
+		writeJSON(w, http.StatusOK, queue)
+
+	case id != "" && approve && r.Method == http.MethodPost:
+		p, err := s.takePending(ctx, id)
+		if err != nil {
+			if err == ErrNotFound {
+				notFound(w, r)
+				return
+			}
+			msg := fmt.Sprintf("Moderation error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		// The message is shown as posted at the approval to keep the order
+		// of the messages.
+		s.audit(ctx, r, "queue.approve", p.Room, p.ID, p, nil)
+		m := p.Message
+		m.CreatedAt = time.Now()
+		if err := s.storeMessage(ctx, p.Room, &m); err != nil {
+			if err == errQueued {
+				writeJSON(w, http.StatusAccepted, &PostResponse{
+					Message: m,
+					Queued:  true,
+				})
+				return
+			}
+			msg := fmt.Sprintf("Could not store the message: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		writeJSON(w, http.StatusCreated, &m)
+
+	case id != "" && !approve && r.Method == http.MethodDelete:
+		p, err := s.takePending(ctx, id)
+		if err != nil {
+			if err == ErrNotFound {
+				notFound(w, r)
+				return
+			}
+			msg := fmt.Sprintf("Moderation error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		s.audit(ctx, r, "queue.reject", p.Room, p.ID, p, nil)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		switch {
+		case rest == "":
+			w.Header().Set("Allow", "GET, HEAD")
+		case approve:
+			w.Header().Set("Allow", "POST")
+		default:
+			w.Header().Set("Allow", "DELETE")
+		}
+		methodNotAllowed(w, r)
+	}
+}
+
+// handleTrustedNames handles GET and PUT /admin/trusted, the names that can
+// post without approval.
+func (s *server) handleTrustedNames(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		t, err := s.trustedNames(ctx)
+		if err != nil {
+			msg := fmt.Sprintf("Moderation error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		writeJSON(w, http.StatusOK, t)
+	case http.MethodPut:
+		var t TrustedNames
+		if !decodeJSON(w, r, &t, maxAdminContentSize) {
+			return
+		}
+		names := []string{}
+		for _, n := range t.Names {
+			if n = strings.TrimSpace(n); n != "" {
+				names = append(names, n)
+			}
+		}
+		t.Names = names
+		prev, err := s.trustedNames(ctx)
+		if err != nil {
+			msg := fmt.Sprintf("Moderation error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		if err := s.db.Set(ctx, trustedNamesKey, &t, 0); err != nil {
+			msg := fmt.Sprintf("Moderation error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		s.audit(ctx, r, "trusted.update", "", "", prev, &t)
+		writeJSON(w, http.StatusOK, &t)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT")
+		methodNotAllowed(w, r)
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	// nameClaimTTL is how long a registered name is kept after it is
+	// registered or used last.
+	nameClaimTTL = 30 * 24 * time.Hour
+
+	// nameClaimRenewInterval is the interval to extend the registration of a
+	// name when the owner posts.
+	nameClaimRenewInterval = 24 * time.Hour
+)
+
+var errNameTaken = errors.New("chatserver: the name is registered by another session")
+
+// NameClaim is a display name registered by a session.
+type NameClaim struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// ExpiresAt is when the registration expires unless the name is used.
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// nameClaimEntry is the stored NameClaim.
+type nameClaimEntry struct {
+	Name      string    `json:"name"`
+	SessionID string    `json:"session_id"`
+	CreatedAt time.Time `json:"created_at"`
+	RenewedAt time.Time `json:"renewed_at"`
+}
+
+// NameRequest is the request body of POST /names.
+type NameRequest struct {
+	Name string `json:"name"`
+}
+
+// normalizeName returns the name to compare. Names are compared
+// case-insensitively after NFKC normalization, so that full-width letters
+// don't look like another registered name.
+func normalizeName(name string) string {
+	return strings.ToLower(norm.NFKC.String(name))
+}
+
+// nameKey returns the key of the registration of the name.
+func nameKey(name string) string {
+	return "name:" + normalizeName(name)
+}
+
+func sessionNameKey(sessionID string) string {
+	return "session-name:" + sessionID
+}
+
+// claimName registers the name to the session. If the session has another
+// name, the name is released. claimName returns errNameTaken if another
+// session has the name.
+func (s *server) claimName(ctx context.Context, sessionID, name string) (*nameClaimEntry, error) {
+	now := time.Now()
+	var e nameClaimEntry
+	if err := s.db.Update(ctx, nameKey(name), &e, nameClaimTTL, func() error {
+		if e.SessionID != "" && e.SessionID != sessionID {
+			return errNameTaken
+		}
+		if e.SessionID == "" {
+			e.CreatedAt = now
+		}
+		e.Name = name
+		e.SessionID = sessionID
+		e.RenewedAt = now
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	var old string
+	if err := s.db.Get(ctx, sessionNameKey(sessionID), &old); err != nil && err != ErrNotFound {
+		return nil, err
+	}
+	if err := s.db.Set(ctx, sessionNameKey(sessionID), name, nameClaimTTL); err != nil {
+		return nil, err
+	}
+	if old != "" && nameKey(old) != nameKey(name) {
+		if err := s.releaseName(ctx, sessionID, old); err != nil {
+			return nil, err
+		}
+	}
+	return &e, nil
+}
+
+// releaseName removes the registration of the name if the session has it.
+func (s *server) releaseName(ctx context.Context, sessionID, name string) error {
+	var e nameClaimEntry
+	if err := s.db.Get(ctx, nameKey(name), &e); err != nil {
+		if err == ErrNotFound {
+			return nil
+		}
+		return err
+	}
+	if e.SessionID != sessionID {
+		return nil
+	}
+	return s.db.Delete(ctx, nameKey(name))
+}
+
+// checkName returns errNameTaken if the name is registered by another
+// session. The registration is extended when the owner uses the name.
+func (s *server) checkName(ctx context.Context, sessionID, name string) error {
+	var e nameClaimEntry
+	if err := s.db.Get(ctx, nameKey(name), &e); err != nil {
+		if err == ErrNotFound {
+			return nil
+		}
+		return err
+	}
+	if e.SessionID != sessionID {
+		return errNameTaken
+	}
+	if time.Since(e.RenewedAt) >= nameClaimRenewInterval {
+		e.RenewedAt = time.Now()
+		if err := s.db.Set(ctx, nameKey(name), &e, nameClaimTTL); err != nil {
+			// The registration is still valid for a while.
+			s.logf(ctx, "Name error: %v", err)
+		}
+		if err := s.db.Set(ctx, sessionNameKey(sessionID), e.Name, nameClaimTTL); err != nil {
+			s.logf(ctx, "Name error: %v", err)
+		}
+	}
+	return nil
+}
+
+// writeNameTaken writes the error for a name registered by another session.
+func writeNameTaken(w http.ResponseWriter, r *http.Request, status int) {
+	msg := "The name is registered by another user"
+	writeErrorCode(w, r, status, "name_taken", msg)
+}
+
+// postName handles POST /names to register the display name of the session.
+// Only the session can post with the registered name.
+func (s *server) postName(ctx context.Context, w http.ResponseWriter, r *http.Request, room string) {
+	var req NameRequest
+	if !decodeJSON(w, r, &req, int64(s.config.MaxContentSize)) {
+		return
+	}
+	if f := validateField("name", &req.Name, s.config.MaxNameLength); f != nil {
+		writeValidationError(w, r, &ValidationError{
+			Errors: []FieldError{*f},
+		})
+		return
+	}
+
+	sid := sessionID(ctx)
+	banned, err := s.isBanned(ctx, &poster{
+		sessionID: sid,
+		ip:        clientIP(r),
+		name:      req.Name,
+	})
+	if err != nil {
+		msg := fmt.Sprintf("Ban error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	if banned {
+		msg := "You are banned from posting"
+		writeErrorCode(w, r, http.StatusForbidden, "banned", msg)
+		return
+	}
+
+	filter, err := s.wordFilter(ctx)
+	if err != nil {
+		msg := fmt.Sprintf("Word filter error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	m := Message{Name: req.Name}
+	if !filter.apply(&m) || m.Name != req.Name {
+		writeValidationError(w, r, &ValidationError{
+			Errors: []FieldError{{Field: "name", Message: "must not contain banned words"}},
+		})
+		return
+	}
+
+	e, err := s.claimName(ctx, sid, req.Name)
+	if err != nil {
+		if err == errNameTaken {
+			writeNameTaken(w, r, http.StatusConflict)
+			return
+		}
+		msg := fmt.Sprintf("Name error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	writeJSON(w, http.StatusCreated, &NameClaim{
+		Name:      e.Name,
+		CreatedAt: e.CreatedAt,
+		ExpiresAt: e.RenewedAt.Add(nameClaimTTL),
+	})
+}
@@ -0,0 +1,526 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// openAPIParam is a parameter of an operation. The type of value is the
+// type of the parameter.
+type openAPIParam struct {
+	name        string
+	in          string
+	description string
+	value       interface{}
+	required    bool
+}
+
+// openAPIOperation documents an operation of the HTTP API. The request and
+// the response bodies are described by the zero values of their Go types, so
+// that the document follows the JSON representations used by the handlers.
+type openAPIOperation struct {
+	summary     string
+	description string
+	params      []openAPIParam
+
+	// auth is true if the operation requires a bearer token.
+	auth bool
+
+	request interface{}
+
+	// responses is the response bodies by the status codes. A nil body
+	// means that the response has no body.
+	responses map[int]interface{}
+}
+
+var (
+	pageParams = []openAPIParam{
+		{name: "before", in: "query", description: "Only the messages older than the ID", value: int64(0)},
+		{name: "limit", in: "query", description: "The maximum number of the messages", value: 0},
+	}
+	idempotencyKeyParam = openAPIParam{name: "Idempotency-Key", in: "header", description: "A unique key to retry the request safely", value: ""}
+	ifMatchParam        = openAPIParam{name: "If-Match", in: "header", description: "The revision of the messages that the change is based on", value: ""}
+	idParam             = openAPIParam{name: "id", in: "path", description: "The message ID", value: int64(0), required: true}
+	userParam           = openAPIParam{name: "user", in: "path", description: "The name of the other user", value: "", required: true}
+)
+
+// apiOperations is the operations of the message API by the methods and the
+// path patterns of the routes. Routes without operations, like the HTML
+// pages, are not in the OpenAPI document.
+var apiOperations = map[string]openAPIOperation{
+	"GET /api/messages": {
+		summary: "List the latest messages, or the older ones before the ID",
+		params:  pageParams,
+		responses: map[int]interface{}{
+			http.StatusOK:          MessagesResponse{},
+			http.StatusNotModified: nil,
+		},
+	},
+	"POST /messages": {
+		summary:     "Post a message",
+		description: "Only name and body are used. The body can also be in Protocol Buffers or MessagePack.",
+		params:      []openAPIParam{idempotencyKeyParam, ifMatchParam},
+		request:     Message{},
+		responses: map[int]interface{}{
+			http.StatusCreated:             PostResponse{},
+			http.StatusAccepted:            PostResponse{},
+			http.StatusForbidden:           ErrorResponse{},
+			http.StatusUnprocessableEntity: validationErrorJSON{},
+		},
+	},
+	"POST /api/messages": {
+		summary:     "Post a message as the bot of the API key",
+		description: "Only body is used.",
+		auth:        true,
+		request:     Message{},
+		responses: map[int]interface{}{
+			http.StatusCreated:             PostResponse{},
+			http.StatusAccepted:            PostResponse{},
+			http.StatusUnprocessableEntity: validationErrorJSON{},
+		},
+	},
+	"GET /messages/poll": {
+		summary: "Wait for the messages newer than the ID",
+		params: []openAPIParam{
+			{name: "since", in: "query", description: "The ID of the latest message that the client has", value: int64(0)},
+		},
+		responses: map[int]interface{}{
+			http.StatusOK: MessagesResponse{},
+		},
+	},
+	"PATCH /messages/{id}": {
+		summary:     "Edit a message with the edit token",
+		description: "The message can be edited only for a while after it is posted.",
+		params:      []openAPIParam{idParam, ifMatchParam},
+		auth:        true,
+		request:     EditRequest{},
+		responses: map[int]interface{}{
+			http.StatusOK:                  Message{},
+			http.StatusUnprocessableEntity: validationErrorJSON{},
+		},
+	},
+	"DELETE /messages/{id}": {
+		summary: "Delete a message with the admin token",
+		params:  []openAPIParam{idParam, ifMatchParam},
+		auth:    true,
+		responses: map[int]interface{}{
+			http.StatusNoContent: nil,
+		},
+	},
+	"PUT /messages/{id}/pin": {
+		summary: "Pin a message with the admin token",
+		params:  []openAPIParam{idParam, ifMatchParam},
+		auth:    true,
+		responses: map[int]interface{}{
+			http.StatusOK: Message{},
+			// too_many_pins or revision_conflict
+			http.StatusConflict: ErrorResponse{},
+		},
+	},
+	"DELETE /messages/{id}/pin": {
+		summary: "Unpin a message with the admin token",
+		params:  []openAPIParam{idParam, ifMatchParam},
+		auth:    true,
+		responses: map[int]interface{}{
+			http.StatusNoContent: nil,
+		},
+	},
+	"POST /messages/{id}/report": {
+		summary:     "Report an abusive message",
+		description: "A client can report a message once. The message is hidden after report_threshold reports from different clients.",
+		params:      []openAPIParam{idParam},
+		request:     ReportRequest{},
+		responses: map[int]interface{}{
+			http.StatusNoContent:           nil,
+			http.StatusUnprocessableEntity: validationErrorJSON{},
+		},
+	},
+	"GET /pins": {
+		summary: "List the pinned messages",
+		responses: map[int]interface{}{
+			http.StatusOK: MessagesResponse{},
+		},
+	},
+	"GET /search": {
+		summary: "Search the messages containing all the words",
+		params: append([]openAPIParam{
+			{name: "q", in: "query", description: "The words to search", value: "", required: true},
+		}, pageParams...),
+		responses: map[int]interface{}{
+			http.StatusOK: SearchResponse{},
+		},
+	},
+	"GET /mentions": {
+		summary: "List the messages mentioning the name",
+		params: []openAPIParam{
+			{name: "name", in: "query", description: "The mentioned name with or without @", value: "", required: true},
+		},
+		responses: map[int]interface{}{
+			http.StatusOK: MessagesResponse{},
+		},
+	},
+	"GET /presence": {
+		summary: "Count the viewers in the room",
+		responses: map[int]interface{}{
+			http.StatusOK: PresenceResponse{},
+		},
+	},
+	"POST /presence": {
+		summary: "Mark the session as a viewer, and count the viewers in the room",
+		responses: map[int]interface{}{
+			http.StatusOK: PresenceResponse{},
+		},
+	},
+	"GET /read-cursor": {
+		summary: "Get the last read message of the session",
+		responses: map[int]interface{}{
+			http.StatusOK: ReadCursor{},
+		},
+	},
+	"PUT /read-cursor": {
+		summary: "Move the read cursor of the session",
+		request: ReadCursorRequest{},
+		responses: map[int]interface{}{
+			http.StatusOK: ReadCursor{},
+		},
+	},
+	"POST /typing": {
+		summary: "Tell the others that the poster is typing",
+		request: TypingRequest{},
+		responses: map[int]interface{}{
+			http.StatusNoContent:           nil,
+			http.StatusUnprocessableEntity: validationErrorJSON{},
+		},
+	},
+	"POST /names": {
+		summary:     "Register the display name of the session",
+		description: "Other sessions can't post with the registered name. Registering another name releases the current one.",
+		request:     NameRequest{},
+		responses: map[int]interface{}{
+			http.StatusCreated:             NameClaim{},
+			http.StatusConflict:            ErrorResponse{},
+			http.StatusUnprocessableEntity: validationErrorJSON{},
+		},
+	},
+	"GET /captcha": {
+		summary: "Get a challenge to answer before posting",
+		responses: map[int]interface{}{
+			http.StatusOK: Captcha{},
+		},
+	},
+	"POST /captcha": {
+		summary:     "Answer the challenge",
+		description: "The session can post after answering a challenge. Each challenge can be answered once.",
+		request:     CaptchaAnswer{},
+		responses: map[int]interface{}{
+			http.StatusNoContent:           nil,
+			http.StatusUnprocessableEntity: validationErrorJSON{},
+		},
+	},
+	"GET /profile": {
+		summary: "Get the profile of the session",
+		responses: map[int]interface{}{
+			http.StatusOK: Profile{},
+		},
+	},
+	"PUT /profile": {
+		summary:     "Update the profile of the session",
+		description: "The avatar and the link are shown with the messages of the session. The name is used to post without a name.",
+		request:     Profile{},
+		responses: map[int]interface{}{
+			http.StatusOK:                  Profile{},
+			http.StatusConflict:            ErrorResponse{},
+			http.StatusUnprocessableEntity: validationErrorJSON{},
+		},
+	},
+	"GET /dm/{user}": {
+		summary:     "List the direct messages with the user",
+		description: "The user of the request is the signed-in user or the name registered with POST /names.",
+		params:      []openAPIParam{userParam},
+		responses: map[int]interface{}{
+			http.StatusOK:        DirectMessagesResponse{},
+			http.StatusForbidden: ErrorResponse{},
+		},
+	},
+	"POST /dm/{user}": {
+		summary:     "Send a direct message to the user",
+		description: "Only the sender and the recipient can read the message.",
+		params:      []openAPIParam{userParam},
+		request:     DirectMessageRequest{},
+		responses: map[int]interface{}{
+			http.StatusCreated:             DirectMessage{},
+			http.StatusForbidden:           ErrorResponse{},
+			http.StatusUnprocessableEntity: validationErrorJSON{},
+		},
+	},
+	"POST /polls": {
+		summary: "Post a poll",
+		params:  []openAPIParam{ifMatchParam},
+		request: PollRequest{},
+		responses: map[int]interface{}{
+			http.StatusCreated:             PostResponse{},
+			http.StatusAccepted:            PostResponse{},
+			http.StatusUnprocessableEntity: validationErrorJSON{},
+		},
+	},
+	"POST /polls/{id}/votes": {
+		summary: "Vote for an option of a poll",
+		params:  []openAPIParam{idParam, ifMatchParam},
+		request: VoteRequest{},
+		responses: map[int]interface{}{
+			http.StatusOK: Message{},
+		},
+	},
+	"GET /emoji": {
+		summary: "List the emoji shortcodes",
+		responses: map[int]interface{}{
+			http.StatusOK: emojis,
+		},
+	},
+}
+
+// openAPISchemaNames is the schema names of the unexported types.
+var openAPISchemaNames = map[reflect.Type]string{
+	reflect.TypeOf(validationErrorJSON{}):  "ValidationError",
+	reflect.TypeOf(revisionConflictJSON{}): "RevisionConflictError",
+}
+
+// openAPISchemas builds the schemas of the Go types from their JSON
+// representations. Named struct types are in the components.
+type openAPISchemas map[string]interface{}
+
+func (s openAPISchemas) of(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return s.of(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": s.of(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": s.of(t.Elem())}
+	case reflect.Struct:
+		if t == reflect.TypeOf(time.Time{}) {
+			return map[string]interface{}{"type": "string", "format": "date-time"}
+		}
+		name, ok := openAPISchemaNames[t]
+		if !ok {
+			name = t.Name()
+		}
+		if name == "" {
+			return s.object(t)
+		}
+		if _, ok := s[name]; !ok {
+			// Register the name first for recursive types.
+			s[name] = nil
+			s[name] = s.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	// Any JSON value.
+	return map[string]interface{}{}
+}
+
+func (s openAPISchemas) object(t reflect.Type) map[string]interface{} {
+	props := map[string]interface{}{}
+	var required []string
+	s.addFields(t, props, &required)
+	schema := map[string]interface{}{
+		"type":       "object",
+		"properties": props,
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// addFields adds the fields of the struct type in the same way as
+// encoding/json. The fields of embedded structs without names are promoted.
+func (s openAPISchemas) addFields(t reflect.Type, props map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		opts := strings.Split(tag, ",")
+		if f.Anonymous && opts[0] == "" && f.Type.Kind() == reflect.Struct {
+			s.addFields(f.Type, props, required)
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		name := opts[0]
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = s.of(f.Type)
+		omitempty := false
+		for _, o := range opts[1:] {
+			if o == "omitempty" {
+				omitempty = true
+			}
+		}
+		if !omitempty {
+			*required = append(*required, name)
+		}
+	}
+}
+
+func (s openAPISchemas) content(v interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		mediaJSON: map[string]interface{}{
+			"schema": s.of(reflect.TypeOf(v)),
+		},
+	}
+}
+
+func (s openAPISchemas) operation(op openAPIOperation) map[string]interface{} {
+	o := map[string]interface{}{
+		"summary": op.summary,
+	}
+	if op.description != "" {
+		o["description"] = op.description
+	}
+
+	var params []interface{}
+	ifMatch := false
+	for _, p := range op.params {
+		param := map[string]interface{}{
+			"name":        p.name,
+			"in":          p.in,
+			"description": p.description,
+			"schema":      s.of(reflect.TypeOf(p.value)),
+		}
+		if p.required {
+			param["required"] = true
+		}
+		params = append(params, param)
+		if p.name == ifMatchParam.name {
+			ifMatch = true
+		}
+	}
+	if len(params) > 0 {
+		o["parameters"] = params
+	}
+	if op.auth {
+		o["security"] = []interface{}{map[string]interface{}{"bearer": []string{}}}
+	}
+	if op.request != nil {
+		o["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  s.content(op.request),
+		}
+	}
+
+	responses := map[string]interface{}{}
+	add := func(status int, v interface{}) {
+		res := map[string]interface{}{
+			"description": http.StatusText(status),
+		}
+		if v != nil {
+			res["content"] = s.content(v)
+		}
+		responses[fmt.Sprint(status)] = res
+	}
+	for status, v := range op.responses {
+		add(status, v)
+	}
+	if _, ok := op.responses[http.StatusConflict]; ifMatch && !ok {
+		add(http.StatusConflict, revisionConflictJSON{})
+	}
+	responses["default"] = map[string]interface{}{
+		"description": "Error",
+		"content":     s.content(ErrorResponse{}),
+	}
+	o["responses"] = responses
+	return o
+}
+
+// openAPI returns the OpenAPI 3 document of the message API served by the
+// routes.
+func (s *server) openAPI() map[string]interface{} {
+	schemas := openAPISchemas{}
+	paths := map[string]interface{}{}
+	for _, rt := range s.router.routes {
+		path := "/" + strings.Join(rt.segments, "/")
+		for method := range rt.handlers {
+			op, ok := apiOperations[method+" "+path]
+			if !ok {
+				continue
+			}
+			item, ok := paths[path].(map[string]interface{})
+			if !ok {
+				item = map[string]interface{}{}
+				paths[path] = item
+			}
+			item[strings.ToLower(method)] = schemas.operation(op)
+		}
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "Chat Server",
+			"version":     fmt.Sprint(latestAPIVersion),
+			"description": "The messages are in the room general. Each path is also available under /rooms/{room} for the other rooms.",
+		},
+		"servers": []interface{}{
+			map[string]interface{}{"url": fmt.Sprintf("/v%d", latestAPIVersion)},
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearer": map[string]interface{}{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "The edit token, the API key of a bot, or the admin token",
+				},
+			},
+		},
+	}
+}
+
+// handleOpenAPI handles GET /openapi.json.
+func (s *server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if s.handleCORS(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		methodNotAllowed(w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.openAPI())
+}
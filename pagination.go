@@ -0,0 +1,64 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+const maxPageSize = 100
+
+// parsePage parses the before and limit query parameters. limit is
+// defaultLimit if it is not given. paged is false if neither parameter is
+// given.
+func parsePage(r *http.Request, defaultLimit int) (before int64, limit int, paged bool, err error) {
+	q := r.URL.Query()
+	limit = defaultLimit
+	if v := q.Get("before"); v != "" {
+		before, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || before <= 0 {
+			return 0, 0, false, fmt.Errorf("invalid before: %q", v)
+		}
+		paged = true
+	}
+	if v := q.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > maxPageSize {
+			return 0, 0, false, fmt.Errorf("invalid limit: %q (must be 1 to %d)", v, maxPageSize)
+		}
+		paged = true
+	}
+	return before, limit, paged, nil
+}
+
+// nextPageURL returns the URL of the page of the messages older than messages,
+// or an empty string if there are no older messages.
+func nextPageURL(r *http.Request, messages []Message, limit int) string {
+	// IDs start with 1.
+	if len(messages) == 0 || messages[0].ID <= 1 {
+		return ""
+	}
+	u := url.URL{
+		Path: versionPrefix(r) + r.URL.Path,
+	}
+	q := r.URL.Query()
+	q.Set("before", strconv.FormatInt(messages[0].ID, 10))
+	q.Set("limit", strconv.Itoa(limit))
+	u.RawQuery = q.Encode()
+	return u.String()
+}
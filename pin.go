@@ -0,0 +1,192 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxPinnedMessages is the maximum number of pinned messages in a room.
+const maxPinnedMessages = 10
+
+var (
+	errTooManyPins = errors.New("chatserver: too many pinned messages")
+	errNotPinned   = errors.New("chatserver: the message is not pinned")
+)
+
+func pinsKey(room string) string {
+	return "pins:" + room
+}
+
+// pinnedMessages returns the copies of the pinned messages in the room.
+// Pinned messages are copied so that they are kept after trimmed.
+func (s *server) pinnedMessages(ctx context.Context, room string) ([]Message, error) {
+	var pinned []Message
+	if err := s.db.Get(ctx, pinsKey(room), &pinned); err != nil && err != ErrNotFound {
+		return nil, err
+	}
+	return pinned, nil
+}
+
+// markPinned sets Pinned of the messages that are pinned.
+func markPinned(messages []Message, pinned []Message) {
+	ids := map[int64]struct{}{}
+	for _, m := range pinned {
+		ids[m.ID] = struct{}{}
+	}
+	for i := range messages {
+		if _, ok := ids[messages[i].ID]; ok {
+			messages[i].Pinned = true
+		}
+	}
+}
+
+// updatePinned updates the copy of the message if it is pinned, after it is
+// edited or deleted. Deleted messages are unpinned.
+func (s *server) updatePinned(ctx context.Context, room string, m Message) {
+	var pinned []Message
+	if err := s.db.Update(ctx, pinsKey(room), &pinned, 0, func() error {
+		for i := range pinned {
+			if pinned[i].ID != m.ID {
+				continue
+			}
+			if m.Deleted {
+				pinned = append(pinned[:i], pinned[i+1:]...)
+				return nil
+			}
+			pinned[i] = m
+			pinned[i].Pinned = true
+			return nil
+		}
+		return errNotPinned
+	}); err != nil && err != errNotPinned {
+		s.logf(ctx, "Pin error: %v", err)
+	}
+}
+
+// pinMessage handles PUT /messages/{id}/pin, which pins the message. This
+// requires the admin token.
+func (s *server) pinMessage(ctx context.Context, w http.ResponseWriter, r *http.Request, room string, id int64) {
+	if !s.checkAdmin(w, r) {
+		return
+	}
+	ctx, ok := s.checkRevision(ctx, w, r, room)
+	if !ok {
+		return
+	}
+	defer s.endRevision(ctx)
+
+	m, err := s.findMessage(ctx, room, id)
+	if err != nil && err != ErrNotFound {
+		msg := fmt.Sprintf("Store error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	if err == ErrNotFound || m.Deleted || m.Hidden {
+		notFound(w, r)
+		return
+	}
+	m.Pinned = true
+
+	var pinned []Message
+	if err := s.db.Update(ctx, pinsKey(room), &pinned, 0, func() error {
+		for _, p := range pinned {
+			if p.ID == id {
+				return nil
+			}
+		}
+		if len(pinned) >= maxPinnedMessages {
+			return errTooManyPins
+		}
+		pinned = append(pinned, m)
+		return nil
+	}); err != nil {
+		if err == errTooManyPins {
+			msg := translate(requestLanguage(r), "At most %d messages can be pinned", maxPinnedMessages)
+			writeErrorCode(w, r, http.StatusConflict, "too_many_pins", msg)
+			return
+		}
+		msg := fmt.Sprintf("Pin error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	s.bumpRevision(ctx, room)
+	s.broadcast(ctx, room, m)
+	s.audit(ctx, r, "message.pin", room, strconv.FormatInt(id, 10), nil, &m)
+	writeJSON(w, http.StatusOK, m)
+}
+
+// unpinMessage handles DELETE /messages/{id}/pin, which unpins the message.
+// This requires the admin token.
+func (s *server) unpinMessage(ctx context.Context, w http.ResponseWriter, r *http.Request, room string, id int64) {
+	if !s.checkAdmin(w, r) {
+		return
+	}
+	ctx, ok := s.checkRevision(ctx, w, r, room)
+	if !ok {
+		return
+	}
+	defer s.endRevision(ctx)
+
+	var pinned []Message
+	var unpinned Message
+	if err := s.db.Update(ctx, pinsKey(room), &pinned, 0, func() error {
+		for i, p := range pinned {
+			if p.ID == id {
+				unpinned = p
+				pinned = append(pinned[:i], pinned[i+1:]...)
+				return nil
+			}
+		}
+		return ErrNotFound
+	}); err != nil {
+		if err == ErrNotFound {
+			notFound(w, r)
+			return
+		}
+		msg := fmt.Sprintf("Pin error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	s.bumpRevision(ctx, room)
+	if m, err := s.findMessage(ctx, room, id); err == nil {
+		s.broadcast(ctx, room, m)
+	}
+	s.audit(ctx, r, "message.unpin", room, strconv.FormatInt(id, 10), &unpinned, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getPins handles GET /pins, which returns the pinned messages.
+func (s *server) getPins(ctx context.Context, w http.ResponseWriter, r *http.Request, room string) {
+	pinned, err := s.pinnedMessages(ctx, room)
+	if err != nil {
+		msg := fmt.Sprintf("Pin error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	if pinned == nil {
+		pinned = []Message{}
+	}
+	writeJSON(w, http.StatusOK, &MessagesResponse{
+		Messages:    pinned,
+		Count:       len(pinned),
+		GeneratedAt: time.Now(),
+	})
+}
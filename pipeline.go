@@ -0,0 +1,114 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// postPipeline stores accepted posts asynchronously. Accepted posts are stored
+// by /tasks/posts/drain in the posted order.
+type postPipeline interface {
+	// Accept adds the post to the room, and schedules /tasks/posts/drain
+	// for the room.
+	Accept(ctx context.Context, room string, message Message) error
+
+	// Lease returns the oldest accepted posts in the room up to n. Leased
+	// posts are not returned again until they are released or the lease
+	// expires.
+	Lease(ctx context.Context, room string, n int) ([]leasedPost, error)
+
+	// Done removes the stored posts.
+	Done(ctx context.Context, posts []leasedPost) error
+
+	// Release makes the posts available to lease again.
+	Release(ctx context.Context, posts []leasedPost) error
+}
+
+// leasedPost is a post leased from a postPipeline.
+type leasedPost struct {
+	message Message
+
+	// lease identifies the lease in the pipeline.
+	lease interface{}
+}
+
+// DrainRequest is the JSON representation of a request to
+// /tasks/posts/drain.
+type DrainRequest struct {
+	Room string `json:"room"`
+}
+
+// handleDrainPosts handles POST /tasks/posts/drain, which stores the accepted
+// posts in the room. This requires the request from the queue or the admin
+// token.
+func (s *server) handleDrainPosts(w http.ResponseWriter, r *http.Request) {
+	if !(s.cron && r.Header.Get("X-Appengine-Queuename") != "") && !s.checkAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		methodNotAllowed(w, r)
+		return
+	}
+
+	var req DrainRequest
+	if !decodeJSON(w, r, &req, maxAdminContentSize) {
+		return
+	}
+	ctx := r.Context()
+	if !s.hasRoom(ctx, req.Room) {
+		notFound(w, r)
+		return
+	}
+
+	posts, err := s.pipeline.Lease(ctx, req.Room, maxPostBatch)
+	if err != nil {
+		msg := fmt.Sprintf("Pipeline error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	if len(posts) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	// The queue doesn't keep the order strictly.
+	sort.SliceStable(posts, func(i, j int) bool {
+		return posts[i].message.CreatedAt.Before(posts[j].message.CreatedAt)
+	})
+
+	messages := make([]Message, len(posts))
+	for i, p := range posts {
+		messages[i] = p.message
+	}
+	ids, err := s.storeQueued(ctx, req.Room, messages)
+	if err := s.pipeline.Done(ctx, posts[:len(ids)]); err != nil {
+		s.logf(ctx, "Pipeline error: %v", err)
+	}
+	if err != nil {
+		// Release the rest at once so that the retry stores them before
+		// newer posts.
+		if err := s.pipeline.Release(ctx, posts[len(ids):]); err != nil {
+			s.logf(ctx, "Pipeline error: %v", err)
+		}
+		msg := fmt.Sprintf("Store error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,136 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// memoryPipeline is a postPipeline keeping the accepted posts in memory.
+type memoryPipeline struct {
+	posts map[string][]Message
+	m     sync.Mutex
+}
+
+func (p *memoryPipeline) Accept(ctx context.Context, room string, message Message) error {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.posts == nil {
+		p.posts = map[string][]Message{}
+	}
+	p.posts[room] = append(p.posts[room], message)
+	return nil
+}
+
+func (p *memoryPipeline) Lease(ctx context.Context, room string, n int) ([]leasedPost, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	messages := p.posts[room]
+	if len(messages) > n {
+		messages = messages[:n]
+	}
+	p.posts[room] = p.posts[room][len(messages):]
+	posts := make([]leasedPost, len(messages))
+	for i, m := range messages {
+		posts[i] = leasedPost{message: m, lease: room}
+	}
+	return posts, nil
+}
+
+func (p *memoryPipeline) Done(ctx context.Context, posts []leasedPost) error {
+	return nil
+}
+
+func (p *memoryPipeline) Release(ctx context.Context, posts []leasedPost) error {
+	p.m.Lock()
+	defer p.m.Unlock()
+	for i := len(posts) - 1; i >= 0; i-- {
+		room := posts[i].lease.(string)
+		p.posts[room] = append([]Message{posts[i].message}, p.posts[room]...)
+	}
+	return nil
+}
+
+func TestIfMatchWithPipeline(t *testing.T) {
+	const adminToken = "admin-token"
+	t.Setenv("ADMIN_TOKEN", adminToken)
+	s := newServer(NewMemoryStore(), NewMemoryKV(), DefaultConfig())
+	s.pipeline = &memoryPipeline{}
+	srv := httptest.NewServer(s.handler())
+	defer srv.Close()
+
+	request := func(method, path, body string, header http.Header) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+	messages := func() MessagesResponse {
+		t.Helper()
+		res, err := http.Get(srv.URL + "/api/messages")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var r MessagesResponse
+		if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	ifMatch := http.Header{"If-Match": {`"0"`}}
+	if got, want := request(http.MethodPost, "/messages", `{"name":"gopher","body":"First"}`, ifMatch).StatusCode, http.StatusAccepted; got != want {
+		t.Fatalf("status: got %d, want %d", got, want)
+	}
+	// The accepted post is not stored yet, but the revision is already
+	// increased.
+	if got, want := messages().Revision, int64(1); got != want {
+		t.Errorf("revision: got %d, want %d", got, want)
+	}
+	if got, want := request(http.MethodPost, "/messages", `{"name":"gopher","body":"Second"}`, ifMatch).StatusCode, http.StatusConflict; got != want {
+		t.Errorf("status of the second post: got %d, want %d", got, want)
+	}
+
+	admin := http.Header{"Authorization": {"Bearer " + adminToken}}
+	if got, want := request(http.MethodPost, "/tasks/posts/drain", `{"room":"general"}`, admin).StatusCode, http.StatusNoContent; got != want {
+		t.Fatalf("status of the drain: got %d, want %d", got, want)
+	}
+	r := messages()
+	if got, want := len(r.Messages), 1; got != want {
+		t.Errorf("len(messages): got %d, want %d", got, want)
+	}
+	// Storing the accepted post doesn't increase the revision again.
+	if got, want := r.Revision, int64(1); got != want {
+		t.Errorf("revision after the drain: got %d, want %d", got, want)
+	}
+}
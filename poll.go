@@ -0,0 +1,90 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// pollTimeout is the maximum duration to wait for new messages.
+const pollTimeout = 30 * time.Second
+
+// newerMessages returns the visible messages whose IDs are greater than since.
+func newerMessages(messages []Message, since int64) []Message {
+	result := []Message{}
+	for _, m := range visibleMessages(messages) {
+		if m.ID > since {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+// pollMessages returns the messages newer than the since query parameter. If
+// there are no such messages, pollMessages waits for a new message up to
+// pollTimeout.
+func (s *server) pollMessages(ctx context.Context, w http.ResponseWriter, r *http.Request, room string) {
+	var since int64
+	if v := r.URL.Query().Get("since"); v != "" {
+		var err error
+		since, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || since < 0 {
+			msg := fmt.Sprintf("Invalid since: %q", v)
+			writeError(w, r, http.StatusBadRequest, msg)
+			return
+		}
+	}
+
+	// Subscribe before reading the store not to miss messages posted in
+	// between.
+	ch := s.hub.subscribe(room)
+	defer s.hub.unsubscribe(room, ch)
+
+	messages, err := s.store.Get(ctx, room)
+	if err != nil {
+		msg := fmt.Sprintf("Store error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	messages = newerMessages(messages, since)
+
+	t := time.NewTimer(pollTimeout)
+	defer t.Stop()
+
+loop:
+	for len(messages) == 0 {
+		select {
+		case m := <-ch:
+			// Edited or deleted old messages are also broadcast.
+			messages = newerMessages([]Message{m}, since)
+		case <-t.C:
+			break loop
+		case <-s.draining:
+			break loop
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, &MessagesResponse{
+		Messages:    messages,
+		Count:       len(messages),
+		GeneratedAt: time.Now(),
+	})
+}
@@ -0,0 +1,214 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	minPollOptions = 2
+	maxPollOptions = 10
+
+	maxPollOptionLength = 50
+)
+
+// PollRequest is the JSON representation of a request to post a poll.
+type PollRequest struct {
+	Name     string   `json:"name"`
+	Question string   `json:"question"`
+	Options  []string `json:"options"`
+}
+
+// VoteRequest is the JSON representation of a vote. Option is the index of
+// the option.
+type VoteRequest struct {
+	Option int `json:"option"`
+}
+
+// Poll is an audience poll in a message.
+type Poll struct {
+	Options []PollOption `json:"options"`
+}
+
+// PollOption is an option of a poll with the number of votes.
+type PollOption struct {
+	Text  string `json:"text"`
+	Votes int    `json:"votes"`
+}
+
+// newPoll returns a poll with the options. If the options are invalid,
+// newPoll returns a *ValidationError.
+func newPoll(options []string) (*Poll, error) {
+	if len(options) < minPollOptions || len(options) > maxPollOptions {
+		return nil, &ValidationError{
+			Errors: []FieldError{newFieldError("options", "must have %d to %d options", minPollOptions, maxPollOptions)},
+		}
+	}
+	p := &Poll{}
+	for _, o := range options {
+		if f := validateField("options", &o, maxPollOptionLength); f != nil {
+			return nil, &ValidationError{
+				Errors: []FieldError{*f},
+			}
+		}
+		p.Options = append(p.Options, PollOption{Text: o})
+	}
+	return p, nil
+}
+
+// applyPoll applies the filter to the options of the poll in the message.
+func (f *WordFilter) applyPoll(message *Message) bool {
+	if message.Poll == nil {
+		return true
+	}
+	for i := range message.Poll.Options {
+		o := Message{Body: message.Poll.Options[i].Text}
+		if !f.apply(&o) {
+			return false
+		}
+		message.Poll.Options[i].Text = o.Body
+		if o.Flagged {
+			message.Flagged = true
+		}
+	}
+	return true
+}
+
+func pollVotesKey(room string, id int64) string {
+	return "pollvotes:" + room + ":" + strconv.FormatInt(id, 10)
+}
+
+// postPoll handles POST /polls, which posts a poll as a message.
+func (s *server) postPoll(ctx context.Context, w http.ResponseWriter, r *http.Request, room string) {
+	if !s.checkRateLimit(ctx, w, r) {
+		return
+	}
+
+	var req PollRequest
+	if !decodeJSON(w, r, &req, int64(s.config.MaxContentSize)) {
+		return
+	}
+	poll, err := newPoll(req.Options)
+	if err != nil {
+		writeValidationError(w, r, err)
+		return
+	}
+
+	s.publishMessage(ctx, w, r, room, Message{
+		Name:      req.Name,
+		Body:      req.Question,
+		Poll:      poll,
+		SessionID: sessionID(ctx),
+	})
+}
+
+// votePoll handles POST /polls/{id}/votes. Each session has one vote, and
+// voting again changes the vote.
+func (s *server) votePoll(ctx context.Context, w http.ResponseWriter, r *http.Request, room string, id int64) {
+	if !s.checkRoomOpen(ctx, w, r, room) {
+		return
+	}
+	var req VoteRequest
+	if !decodeJSON(w, r, &req, int64(s.config.MaxContentSize)) {
+		return
+	}
+
+	poll, err := s.findMessage(ctx, room, id)
+	if err != nil && err != ErrNotFound {
+		msg := fmt.Sprintf("Store error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	if err == ErrNotFound || poll.Deleted || poll.Poll == nil {
+		notFound(w, r)
+		return
+	}
+	n := len(poll.Poll.Options)
+	if req.Option < 0 || req.Option >= n {
+		msg := translate(requestLanguage(r), "Invalid option: %d", req.Option)
+		writeError(w, r, http.StatusBadRequest, msg)
+		return
+	}
+	ctx, ok := s.checkRevision(ctx, w, r, room)
+	if !ok {
+		return
+	}
+	defer s.endRevision(ctx)
+
+	var votes map[string]int
+	if err := s.db.Update(ctx, pollVotesKey(room, id), &votes, 0, func() error {
+		if votes == nil {
+			votes = map[string]int{}
+		}
+		votes[sessionID(ctx)] = req.Option
+		return nil
+	}); err != nil {
+		msg := fmt.Sprintf("Poll error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+
+	// The results are counted from all the votes every time, so that results
+	// overwritten by a concurrent vote are fixed by the next vote.
+	counts := make([]int, n)
+	for _, o := range votes {
+		if o >= 0 && o < n {
+			counts[o]++
+		}
+	}
+	m, err := s.store.Update(ctx, room, id, func(m *Message) {
+		if m.Poll == nil || len(m.Poll.Options) != n {
+			return
+		}
+		for i := range m.Poll.Options {
+			m.Poll.Options[i].Votes = counts[i]
+		}
+	})
+	if err != nil {
+		if err == ErrNotFound {
+			notFound(w, r)
+			return
+		}
+		msg := fmt.Sprintf("Store error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	s.bumpRevision(ctx, room)
+	s.broadcast(ctx, room, m)
+
+	writeJSON(w, http.StatusOK, m)
+}
+
+func init() {
+	registerCommand("poll", CommandFunc(func(ctx context.Context, s *server, room string, message *Message, args string) error {
+		const usage = "/poll <question> | <option> | <option>..."
+		parts := strings.Split(args, "|")
+		if len(parts) < 1+minPollOptions {
+			return commandUsage(usage)
+		}
+		poll, err := newPoll(parts[1:])
+		if err != nil {
+			return err
+		}
+		message.Body = strings.TrimSpace(parts[0])
+		message.Poll = poll
+		return nil
+	}))
+}
@@ -0,0 +1,57 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"database/sql"
+)
+
+// postgres is the dialect of PostgreSQL.
+var postgres = &sqlDialect{
+	migrations: []string{
+		`CREATE TABLE rooms (
+			room TEXT PRIMARY KEY,
+			last_id BIGINT NOT NULL
+		)`,
+		`CREATE TABLE messages (
+			room TEXT NOT NULL,
+			id BIGINT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL,
+			data JSONB NOT NULL,
+			PRIMARY KEY (room, id)
+		)`,
+		`CREATE INDEX messages_room_created_at ON messages (room, created_at)`,
+		`CREATE TABLE kv (
+			key TEXT PRIMARY KEY,
+			data JSONB,
+			expires_at TIMESTAMPTZ
+		)`,
+	},
+	forUpdate: " FOR UPDATE",
+}
+
+// NewPostgresStore returns a Store that keeps messages in PostgreSQL, like
+// Cloud SQL for PostgreSQL. All the messages are kept until they are purged,
+// so that the history can be paged and exported. The schema is migrated to
+// the latest one.
+func NewPostgresStore(db *sql.DB) (Store, error) {
+	return newSQLStore(db, postgres)
+}
+
+// NewPostgresKV returns a KV that keeps values in PostgreSQL. The schema is
+// migrated to the latest one.
+func NewPostgresKV(db *sql.DB) (KV, error) {
+	return newSQLKV(db, postgres)
+}
@@ -0,0 +1,111 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// presenceTTL is the duration while a viewer is regarded as online
+	// after the last heartbeat.
+	presenceTTL = time.Minute
+
+	// presenceInterval is the interval of heartbeats from browsers.
+	presenceInterval = 30 * time.Second
+)
+
+// PresenceResponse is the JSON representation of the viewers of a room.
+type PresenceResponse struct {
+	Room  string `json:"room"`
+	Count int    `json:"count"`
+}
+
+func presenceKey(room string) string {
+	return "presence:" + room
+}
+
+// onlineCount returns the number of the viewers seen within presenceTTL.
+func onlineCount(seen map[string]time.Time, now time.Time) int {
+	n := 0
+	for _, t := range seen {
+		if now.Sub(t) < presenceTTL {
+			n++
+		}
+	}
+	return n
+}
+
+// touchPresence records that the session is viewing the room, and returns the
+// number of the viewers.
+func (s *server) touchPresence(ctx context.Context, room, id string) (int, error) {
+	var seen map[string]time.Time
+	now := time.Now()
+	if err := s.cache.Update(ctx, presenceKey(room), &seen, presenceTTL, func() error {
+		if seen == nil {
+			seen = map[string]time.Time{}
+		}
+		for k, t := range seen {
+			if now.Sub(t) >= presenceTTL {
+				delete(seen, k)
+			}
+		}
+		seen[id] = now
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	return len(seen), nil
+}
+
+// presence returns the number of the viewers of the room.
+func (s *server) presence(ctx context.Context, room string) (int, error) {
+	var seen map[string]time.Time
+	if err := s.cache.Get(ctx, presenceKey(room), &seen); err != nil {
+		if err == ErrNotFound {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return onlineCount(seen, time.Now()), nil
+}
+
+// handlePresence handles GET and POST /presence. POST is a heartbeat from the
+// viewer.
+func (s *server) handlePresence(ctx context.Context, w http.ResponseWriter, r *http.Request, room string) {
+	var n int
+	var err error
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		n, err = s.presence(ctx, room)
+	case http.MethodPost:
+		n, err = s.touchPresence(ctx, room, sessionID(ctx))
+	default:
+		methodNotAllowed(w, r)
+		return
+	}
+	if err != nil {
+		msg := fmt.Sprintf("Presence error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	writeJSON(w, http.StatusOK, &PresenceResponse{
+		Room:  room,
+		Count: n,
+	})
+}
@@ -0,0 +1,292 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const (
+	// previewTimeout is the maximum duration to fetch a page for a preview.
+	previewTimeout = 3 * time.Second
+
+	// previewExpiration is the duration to cache a preview.
+	previewExpiration = 24 * time.Hour
+
+	// maxPreviewPageSize is the maximum number of bytes read from a page.
+	maxPreviewPageSize = 512 * 1024
+
+	maxPreviewTitleLength       = 100
+	maxPreviewDescriptionLength = 200
+)
+
+// LinkPreview is a summary of the page at the first URL in a message.
+type LinkPreview struct {
+	URL         string `json:"url"`
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Image       string `json:"image,omitempty"`
+}
+
+// firstURL returns the first http or https URL in the body.
+func firstURL(body string) (string, bool) {
+	for i := strings.Index(body, "http"); i >= 0; {
+		if n := bareURLLen(body[i:]); n > 0 {
+			if u, ok := safeURL(body[i : i+n]); ok {
+				return u, true
+			}
+		}
+		j := strings.Index(body[i+1:], "http")
+		if j < 0 {
+			break
+		}
+		i += j + 1
+	}
+	return "", false
+}
+
+// truncate returns the first maxLength characters of str.
+func truncate(str string, maxLength int) string {
+	str = strings.Join(strings.Fields(str), " ")
+	if utf8.RuneCountInString(str) <= maxLength {
+		return str
+	}
+	return string([]rune(str)[:maxLength-1]) + "…"
+}
+
+// parsePreview extracts the title, the description and the image from the
+// head of the HTML page at the URL.
+func parsePreview(r io.Reader, pageURL *url.URL) *LinkPreview {
+	var title, ogTitle, description, ogDescription, image string
+	z := html.NewTokenizer(r)
+loop:
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			break loop
+		case html.StartTagToken, html.SelfClosingTagToken:
+			t := z.Token()
+			switch t.DataAtom {
+			case atom.Body:
+				break loop
+			case atom.Title:
+				if title == "" && z.Next() == html.TextToken {
+					title = string(z.Text())
+				}
+			case atom.Meta:
+				var key, content string
+				for _, a := range t.Attr {
+					switch a.Key {
+					case "property", "name":
+						key = strings.ToLower(a.Val)
+					case "content":
+						content = a.Val
+					}
+				}
+				// The first tag wins.
+				switch {
+				case key == "og:title" && ogTitle == "":
+					ogTitle = content
+				case key == "og:description" && ogDescription == "":
+					ogDescription = content
+				case key == "description" && description == "":
+					description = content
+				case key == "og:image" && image == "":
+					image = content
+				}
+			}
+		case html.EndTagToken:
+			if z.Token().DataAtom == atom.Head {
+				break loop
+			}
+		}
+	}
+
+	if ogTitle != "" {
+		title = ogTitle
+	}
+	if ogDescription != "" {
+		description = ogDescription
+	}
+	title = truncate(title, maxPreviewTitleLength)
+	if title == "" {
+		return nil
+	}
+	p := &LinkPreview{
+		URL:         pageURL.String(),
+		Title:       title,
+		Description: truncate(description, maxPreviewDescriptionLength),
+	}
+	if u, err := pageURL.Parse(image); err == nil && image != "" {
+		if img, ok := safeURL(u.String()); ok {
+			p.Image = img
+		}
+	}
+	return p
+}
+
+// fetchPreview fetches the page at the URL and returns its preview. If the
+// page is not HTML or has no title, fetchPreview returns nil.
+func (s *server) fetchPreview(ctx context.Context, rawurl string) (*LinkPreview, error) {
+	ctx, cancel := context.WithTimeout(ctx, previewTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodGet, rawurl, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/html")
+	res, err := s.httpClient(ctx).Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("chatserver: fetching %s failed with status %d", rawurl, res.StatusCode)
+	}
+	if t, _, err := mime.ParseMediaType(res.Header.Get("Content-Type")); err != nil || t != "text/html" {
+		return nil, nil
+	}
+	// Redirects are followed, so use the final URL.
+	return parsePreview(io.LimitReader(res.Body, maxPreviewPageSize), res.Request.URL), nil
+}
+
+func previewKey(rawurl string) string {
+	h := sha256.Sum256([]byte(rawurl))
+	return "preview:" + hex.EncodeToString(h[:])
+}
+
+// linkPreview returns the preview of the first URL in the body, or nil if
+// there is no URL or the preview is not available. Previews are not
+// essential, so errors are only logged.
+func (s *server) linkPreview(ctx context.Context, body string) *LinkPreview {
+	rawurl, ok := firstURL(body)
+	if !ok {
+		return nil
+	}
+
+	ctx, span := startSpan(ctx, "linkPreview")
+	defer span.End()
+
+	// A page without a preview is cached as an empty preview not to fetch
+	// it again.
+	var p LinkPreview
+	if err := s.cache.Get(ctx, previewKey(rawurl), &p); err == nil {
+		if p.Title == "" {
+			return nil
+		}
+		return &p
+	} else if err != ErrNotFound {
+		s.logf(ctx, "link preview error: %v", err)
+	}
+
+	fetched, err := s.fetchPreview(ctx, rawurl)
+	if err != nil {
+		s.logf(ctx, "link preview error: %v", err)
+		return nil
+	}
+	if fetched != nil {
+		p = *fetched
+	}
+	if err := s.cache.Set(ctx, previewKey(rawurl), &p, previewExpiration); err != nil {
+		s.logf(ctx, "link preview error: %v", err)
+	}
+	return fetched
+}
+
+var errPrivateAddress = errors.New("chatserver: connecting to a private address is not allowed")
+
+var privateNetworks []*net.IPNet
+
+func init() {
+	for _, cidr := range []string{
+		"0.0.0.0/8",
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"127.0.0.0/8",
+		"169.254.0.0/16",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"::1/128",
+		"fc00::/7",
+		"fe80::/10",
+	} {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		privateNetworks = append(privateNetworks, n)
+	}
+}
+
+func isPrivateIP(ip net.IP) bool {
+	if ip.IsUnspecified() {
+		return true
+	}
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialPublic connects to the address only if it is a public address, so that
+// users can't make the server fetch internal pages like the metadata server.
+func dialPublic(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if isPrivateIP(ip.IP) {
+			return nil, errPrivateAddress
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("chatserver: no addresses for %s", host)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, network, net.JoinHostPort(ips[0].IP.String(), port))
+}
+
+// publicClient is the client to fetch pages given by users outside App
+// Engine.
+var publicClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext:         dialPublic,
+		TLSHandshakeTimeout: previewTimeout,
+	},
+}
@@ -0,0 +1,238 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// maxProfileURLLength is the maximum length of the URLs in a profile.
+	maxProfileURLLength = 2048
+
+	// profileCacheTTL is how long the profiles are cached to show the
+	// messages. Changes of a profile are shown in other instances after
+	// this.
+	profileCacheTTL = time.Minute
+)
+
+// Profile is the profile of a poster shown with the messages.
+type Profile struct {
+	// Name is the name to post with when a message has no name.
+	Name string `json:"name,omitempty"`
+
+	// AvatarURL is the URL of the avatar image.
+	AvatarURL string `json:"avatar_url,omitempty"`
+
+	// Link is the URL of the page of the poster like a blog.
+	Link string `json:"link,omitempty"`
+}
+
+func (p *Profile) empty() bool {
+	return *p == Profile{}
+}
+
+// validateProfileURL returns a *FieldError if the URL is not an absolute HTTP
+// URL.
+func validateProfileURL(field string, rawurl string) *FieldError {
+	if len(rawurl) > maxProfileURLLength {
+		f := newFieldError(field, "must be at most %d bytes", maxProfileURLLength)
+		return &f
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		f := newFieldError(field, "must be an http or https URL")
+		return &f
+	}
+	return nil
+}
+
+// validate sanitizes the profile and returns a *ValidationError if the profile
+// is invalid. All the fields are optional.
+func (p *Profile) validate(config *Config) error {
+	var errs []FieldError
+	p.Name = strings.TrimSpace(p.Name)
+	if p.Name != "" {
+		if f := validateField("name", &p.Name, config.MaxNameLength); f != nil {
+			errs = append(errs, *f)
+		}
+	}
+	p.AvatarURL = strings.TrimSpace(p.AvatarURL)
+	if p.AvatarURL != "" {
+		if f := validateProfileURL("avatar_url", p.AvatarURL); f != nil {
+			errs = append(errs, *f)
+		}
+	}
+	p.Link = strings.TrimSpace(p.Link)
+	if p.Link != "" {
+		if f := validateProfileURL("link", p.Link); f != nil {
+			errs = append(errs, *f)
+		}
+	}
+	if len(errs) > 0 {
+		return &ValidationError{Errors: errs}
+	}
+	return nil
+}
+
+// sessionProfileKey returns the key of the profile of the session. The
+// messages are joined with the profiles by the session IDs.
+func sessionProfileKey(sessionID string) string {
+	return "profile:session:" + sessionID
+}
+
+// accountProfileKey returns the key of the profile of the signed-in user,
+// which is copied to the new sessions of the user.
+func accountProfileKey(userName string) string {
+	return "profile:user:" + userName
+}
+
+// sessionProfile returns the profile of the session, or nil if the session
+// has no profile. The profiles are cached for profileCacheTTL.
+func (s *server) sessionProfile(ctx context.Context, sessionID string) (*Profile, error) {
+	var p Profile
+	key := sessionProfileKey(sessionID)
+	if err := s.cache.Get(ctx, key, &p); err == nil {
+		if p.empty() {
+			return nil, nil
+		}
+		return &p, nil
+	}
+	if err := s.db.Get(ctx, key, &p); err != nil && err != ErrNotFound {
+		return nil, err
+	}
+	// An empty profile is also cached so that the sessions without profiles
+	// are not looked up again.
+	if err := s.cache.Set(ctx, key, &p, profileCacheTTL); err != nil {
+		s.logf(ctx, "Profile error: %v", err)
+	}
+	if p.empty() {
+		return nil, nil
+	}
+	return &p, nil
+}
+
+// currentProfile returns the profile of the request. A signed-in user gets
+// the profile of the account in a new session.
+func (s *server) currentProfile(ctx context.Context) (*Profile, error) {
+	p, err := s.sessionProfile(ctx, sessionID(ctx))
+	if err != nil || p != nil {
+		return p, err
+	}
+	name := s.userName(ctx)
+	if name == "" {
+		return nil, nil
+	}
+	var ap Profile
+	if err := s.db.Get(ctx, accountProfileKey(name), &ap); err != nil {
+		if err == ErrNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if err := s.setProfile(ctx, &ap); err != nil {
+		return nil, err
+	}
+	return &ap, nil
+}
+
+// setProfile stores the profile of the request.
+func (s *server) setProfile(ctx context.Context, p *Profile) error {
+	key := sessionProfileKey(sessionID(ctx))
+	if err := s.db.Set(ctx, key, p, 0); err != nil {
+		return err
+	}
+	if err := s.cache.Set(ctx, key, p, profileCacheTTL); err != nil {
+		s.logf(ctx, "Profile error: %v", err)
+	}
+	if name := s.userName(ctx); name != "" {
+		if err := s.db.Set(ctx, accountProfileKey(name), p, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// joinProfiles sets the profiles of the posters to the messages. Profiles are
+// not essential, so the messages are shown without them on errors.
+func (s *server) joinProfiles(ctx context.Context, messages []Message) {
+	profiles := map[string]*Profile{}
+	for i := range messages {
+		m := &messages[i]
+		if m.SessionID == "" || m.Bot {
+			continue
+		}
+		p, ok := profiles[m.SessionID]
+		if !ok {
+			var err error
+			p, err = s.sessionProfile(ctx, m.SessionID)
+			if err != nil {
+				s.logf(ctx, "Profile error: %v", err)
+			}
+			profiles[m.SessionID] = p
+		}
+		m.Profile = p
+	}
+}
+
+// handleProfile handles GET and PUT /profile, the profile of the session.
+func (s *server) handleProfile(ctx context.Context, w http.ResponseWriter, r *http.Request, room string) {
+	noStore(w)
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		p, err := s.currentProfile(ctx)
+		if err != nil {
+			msg := fmt.Sprintf("Profile error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		if p == nil {
+			p = &Profile{}
+		}
+		writeJSON(w, http.StatusOK, p)
+	case http.MethodPut:
+		var p Profile
+		if !decodeJSON(w, r, &p, int64(s.config.MaxContentSize)) {
+			return
+		}
+		if err := p.validate(&s.config); err != nil {
+			writeValidationError(w, r, err)
+			return
+		}
+		// The name to post with must not be registered by another session.
+		if p.Name != "" {
+			if err := s.checkName(ctx, sessionID(ctx), p.Name); err != nil {
+				if err == errNameTaken {
+					writeNameTaken(w, r, http.StatusConflict)
+					return
+				}
+				msg := fmt.Sprintf("Name error: %v", err)
+				writeError(w, r, http.StatusInternalServerError, msg)
+				return
+			}
+		}
+		if err := s.setProfile(ctx, &p); err != nil {
+			msg := fmt.Sprintf("Profile error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		writeJSON(w, http.StatusOK, &p)
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/urlfetch"
+)
+
+const (
+	pubsubEndpoint = "https://pubsub.googleapis.com/v1/"
+	pubsubScope    = "https://www.googleapis.com/auth/pubsub"
+
+	// pubsubPullTimeout is the duration to wait for messages in a pull.
+	pubsubPullTimeout = 30 * time.Second
+
+	// pubsubSubscriptionTTL is the duration after which the subscription of
+	// a stopped instance is deleted.
+	pubsubSubscriptionTTL = 24 * time.Hour
+)
+
+// pubsubBroker is a Broker on Cloud Pub/Sub. Each instance has its own
+// subscription to the topic so that all the instances receive the messages.
+type pubsubBroker struct {
+	topicID string
+}
+
+func (b *pubsubBroker) topic(ctx context.Context) string {
+	return "projects/" + appengine.AppID(ctx) + "/topics/" + b.topicID
+}
+
+func (b *pubsubBroker) subscription(ctx context.Context) string {
+	return "projects/" + appengine.AppID(ctx) + "/subscriptions/" + b.topicID + "-" + appengine.InstanceID()
+}
+
+type pubsubError struct {
+	status int
+	body   string
+}
+
+func (e *pubsubError) Error() string {
+	return fmt.Sprintf("chatserver: Pub/Sub API error: %d %s", e.status, e.body)
+}
+
+// call calls the Pub/Sub API and decodes the response into resp if resp is
+// not nil.
+func (b *pubsubBroker) call(ctx context.Context, method, path string, req, resp interface{}) error {
+	token, _, err := appengine.AccessToken(ctx, pubsubScope)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	r, err := http.NewRequest(method, pubsubEndpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Authorization", "Bearer "+token)
+	r.Header.Set("Content-Type", "application/json")
+
+	res, err := urlfetch.Client(ctx).Do(r)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(res.Body)
+		return &pubsubError{
+			status: res.StatusCode,
+			body:   string(b),
+		}
+	}
+	if resp == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(resp)
+}
+
+type pubsubMessage struct {
+	Data       []byte            `json:"data"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+type pubsubPublishRequest struct {
+	Messages []pubsubMessage `json:"messages"`
+}
+
+type pubsubPullRequest struct {
+	MaxMessages int `json:"maxMessages"`
+}
+
+type pubsubPullResponse struct {
+	ReceivedMessages []struct {
+		AckID   string        `json:"ackId"`
+		Message pubsubMessage `json:"message"`
+	} `json:"receivedMessages"`
+}
+
+type pubsubAckRequest struct {
+	AckIDs []string `json:"ackIds"`
+}
+
+type pubsubData struct {
+	Room    string  `json:"room"`
+	Message Message `json:"message"`
+}
+
+func (b *pubsubBroker) Publish(ctx context.Context, room string, message Message) error {
+	data, err := json.Marshal(&pubsubData{
+		Room:    room,
+		Message: message,
+	})
+	if err != nil {
+		return err
+	}
+	req := &pubsubPublishRequest{
+		Messages: []pubsubMessage{
+			{
+				Data: data,
+				Attributes: map[string]string{
+					"origin": appengine.InstanceID(),
+				},
+			},
+		},
+	}
+	return b.call(ctx, http.MethodPost, b.topic(ctx)+":publish", req, nil)
+}
+
+// createSubscription creates the subscription of this instance if it doesn't
+// exist.
+func (b *pubsubBroker) createSubscription(ctx context.Context) error {
+	req := map[string]interface{}{
+		"topic": b.topic(ctx),
+		"expirationPolicy": map[string]string{
+			"ttl": fmt.Sprintf("%ds", int(pubsubSubscriptionTTL/time.Second)),
+		},
+	}
+	err := b.call(ctx, http.MethodPut, b.subscription(ctx), req, nil)
+	if e, ok := err.(*pubsubError); ok && e.status == http.StatusConflict {
+		return nil
+	}
+	return err
+}
+
+func (b *pubsubBroker) Subscribe(ctx context.Context, f func(room string, message Message)) error {
+	if err := b.createSubscription(ctx); err != nil {
+		return err
+	}
+	for {
+		var resp pubsubPullResponse
+		pctx, cancel := context.WithTimeout(ctx, pubsubPullTimeout)
+		err := b.call(pctx, http.MethodPost, b.subscription(ctx)+":pull", &pubsubPullRequest{
+			MaxMessages: 100,
+		}, &resp)
+		timedOut := pctx.Err() == context.DeadlineExceeded
+		cancel()
+		if err != nil {
+			if timedOut {
+				continue
+			}
+			return err
+		}
+		if len(resp.ReceivedMessages) == 0 {
+			continue
+		}
+
+		ack := &pubsubAckRequest{}
+		for _, m := range resp.ReceivedMessages {
+			ack.AckIDs = append(ack.AckIDs, m.AckID)
+			if m.Message.Attributes["origin"] == appengine.InstanceID() {
+				continue
+			}
+			var d pubsubData
+			if err := json.Unmarshal(m.Message.Data, &d); err != nil {
+				continue
+			}
+			f(d.Room, d.Message)
+		}
+		if err := b.call(ctx, http.MethodPost, b.subscription(ctx)+":acknowledge", ack, nil); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// RateLimit is a token bucket limit of posting per client.
+type RateLimit struct {
+	// Burst is the number of messages a client can post at once.
+	Burst int
+
+	// Interval is the interval to get one more token.
+	Interval time.Duration
+}
+
+var defaultRateLimit = RateLimit{
+	Burst:    5,
+	Interval: 3 * time.Second,
+}
+
+// defaultBotRateLimit is the limit of bots, which post more often than humans.
+var defaultBotRateLimit = RateLimit{
+	Burst:    20,
+	Interval: time.Second,
+}
+
+// rateLimitFromEnv returns the rate limit. The default limit l can be
+// overwritten by {prefix}_BURST and {prefix}_INTERVAL (e.g. "3s")
+// environment variables.
+func rateLimitFromEnv(prefix string, l RateLimit) RateLimit {
+	if v, err := strconv.Atoi(os.Getenv(prefix + "_BURST")); err == nil && v > 0 {
+		l.Burst = v
+	}
+	if v, err := time.ParseDuration(os.Getenv(prefix + "_INTERVAL")); err == nil && v > 0 {
+		l.Interval = v
+	}
+	return l
+}
+
+type tokenBucket struct {
+	Tokens    float64   `json:"tokens"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+var errRateLimited = errors.New("chatserver: rate limited")
+
+// takeToken takes a token from the client's bucket with the limit. If there is
+// no token, takeToken returns the duration to wait for the next token.
+func (s *server) takeToken(ctx context.Context, client string, l RateLimit) (time.Duration, error) {
+	var b tokenBucket
+	var wait time.Duration
+	key := "ratelimit:" + client
+	// The bucket is full again after this duration, so it is no longer needed.
+	exp := time.Duration(l.Burst) * l.Interval
+	err := s.cache.Update(ctx, key, &b, exp, func() error {
+		now := time.Now()
+		if b.UpdatedAt.IsZero() {
+			b.Tokens = float64(l.Burst)
+		} else {
+			b.Tokens += float64(now.Sub(b.UpdatedAt)) / float64(l.Interval)
+			b.Tokens = math.Min(b.Tokens, float64(l.Burst))
+		}
+		b.UpdatedAt = now
+		if b.Tokens < 1 {
+			wait = time.Duration((1 - b.Tokens) * float64(l.Interval))
+			return errRateLimited
+		}
+		b.Tokens--
+		return nil
+	})
+	if err == errRateLimited {
+		return wait, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
+// clientIP returns the IP address of the client.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// App Engine sets RemoteAddr without the port.
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// checkRateLimit reports whether the client can post now. Both the client IP
+// address and the session are limited. If the client can't post, checkRateLimit
+// writes an error response.
+func (s *server) checkRateLimit(ctx context.Context, w http.ResponseWriter, r *http.Request) bool {
+	clients := []string{"ip:" + clientIP(r)}
+	if id := sessionID(ctx); id != "" {
+		clients = append(clients, "session:"+id)
+	}
+	var wait time.Duration
+	for _, c := range clients {
+		d, err := s.takeToken(ctx, c, s.rateLimit)
+		if err != nil {
+			msg := fmt.Sprintf("Rate limit error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return false
+		}
+		if d > wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		writeTooManyRequests(w, r, wait)
+		return false
+	}
+	return true
+}
+
+func writeTooManyRequests(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	s := http.StatusTooManyRequests
+	writeError(w, r, s, http.StatusText(s))
+}
@@ -0,0 +1,126 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// readCursorExpiration is the duration to keep a read cursor after it is last
+// updated.
+const readCursorExpiration = 30 * 24 * time.Hour
+
+// ReadCursorRequest is the JSON representation of a request to move the read
+// cursor to the message of ID.
+type ReadCursorRequest struct {
+	ID int64 `json:"id"`
+}
+
+// ReadCursor is the JSON representation of the last read message of a
+// session.
+type ReadCursor struct {
+	Room string `json:"room"`
+
+	// ID is the ID of the last read message. ID is 0 if the session hasn't
+	// read any messages.
+	ID int64 `json:"id"`
+
+	// Unread is the number of the messages newer than ID in the latest
+	// messages.
+	Unread int `json:"unread"`
+}
+
+func readCursorKey(room, sessionID string) string {
+	return "readcursor:" + room + ":" + sessionID
+}
+
+// readCursor returns the ID of the last read message in the room.
+func (s *server) readCursor(ctx context.Context, room string) (int64, error) {
+	var id int64
+	if err := s.db.Get(ctx, readCursorKey(room, sessionID(ctx)), &id); err != nil && err != ErrNotFound {
+		return 0, err
+	}
+	return id, nil
+}
+
+// readMarker returns the ID of the newest read message if there are unread
+// messages newer than it. messages are in the posted order.
+func readMarker(messages []Message, cursor int64) int64 {
+	if cursor == 0 {
+		return 0
+	}
+	for i := len(messages) - 1; i > 0; i-- {
+		if messages[i].ID > cursor && messages[i-1].ID <= cursor {
+			return messages[i-1].ID
+		}
+	}
+	return 0
+}
+
+// handleReadCursor handles GET and PUT /read-cursor. The cursor never moves
+// back.
+func (s *server) handleReadCursor(ctx context.Context, w http.ResponseWriter, r *http.Request, room string) {
+	var id int64
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		var err error
+		id, err = s.readCursor(ctx, room)
+		if err != nil {
+			msg := fmt.Sprintf("Read cursor error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+
+	case http.MethodPut:
+		var req ReadCursorRequest
+		if !decodeJSON(w, r, &req, int64(s.config.MaxContentSize)) {
+			return
+		}
+		if req.ID < 0 {
+			msg := fmt.Sprintf("Invalid id: %d", req.ID)
+			writeError(w, r, http.StatusBadRequest, msg)
+			return
+		}
+		if err := s.db.Update(ctx, readCursorKey(room, sessionID(ctx)), &id, readCursorExpiration, func() error {
+			if req.ID > id {
+				id = req.ID
+			}
+			return nil
+		}); err != nil {
+			msg := fmt.Sprintf("Read cursor error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+
+	default:
+		methodNotAllowed(w, r)
+		return
+	}
+
+	messages, err := s.store.Get(ctx, room)
+	if err != nil {
+		msg := fmt.Sprintf("Store error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	writeJSON(w, http.StatusOK, &ReadCursor{
+		Room:   room,
+		ID:     id,
+		Unread: len(newerMessages(messages, id)),
+	})
+}
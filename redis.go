@@ -0,0 +1,353 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// redisChannel is the Redis pub/sub channel of posted messages.
+const redisChannel = "messages"
+
+// errRedisConflict is returned when a watched key is modified during a
+// transaction.
+var errRedisConflict = errors.New("chatserver: redis transaction conflict")
+
+// redisTransaction calls f with the keys watched and executes the queued
+// commands. f must queue the commands after MULTI. redisTransaction retries
+// when another client modifies the keys at the same time.
+func redisTransaction(pool *redis.Pool, keys []interface{}, f func(c redis.Conn) error) error {
+	var err error
+	for i := 0; i < maxCASRetries; i++ {
+		if i > 0 {
+			time.Sleep(casBackoff(i))
+		}
+		err = tryRedisTransaction(pool, keys, f)
+		if err != errRedisConflict {
+			return err
+		}
+		casConflictsTotal.WithLabelValues("redis").Inc()
+	}
+	return err
+}
+
+func tryRedisTransaction(pool *redis.Pool, keys []interface{}, f func(c redis.Conn) error) error {
+	c := pool.Get()
+	defer c.Close()
+
+	if _, err := c.Do("WATCH", keys...); err != nil {
+		return err
+	}
+	if err := f(c); err != nil {
+		return err
+	}
+	r, err := c.Do("EXEC")
+	if err != nil {
+		return err
+	}
+	if r == nil {
+		return errRedisConflict
+	}
+	return nil
+}
+
+// redisStore is a Store on Redis. The messages in a room are kept in a list
+// in the newest-first order. redisStore is also a Broker on Redis pub/sub.
+type redisStore struct {
+	pool   *redis.Pool
+	origin string
+}
+
+// NewRedisStore returns a Store that keeps messages in Redis. The returned
+// Store also implements Broker so that multiple servers can share the
+// messages.
+func NewRedisStore(pool *redis.Pool) Store {
+	return &redisStore{
+		pool:   pool,
+		origin: newOrigin(),
+	}
+}
+
+func (s *redisStore) listKey(room string) string {
+	return "messages:" + room
+}
+
+func (s *redisStore) idKey(room string) string {
+	return "messageid:" + room
+}
+
+// messages returns the messages in the room in the posted order.
+func (s *redisStore) messages(c redis.Conn, room string) ([]Message, error) {
+	items, err := redis.ByteSlices(c.Do("LRANGE", s.listKey(room), 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]Message, len(items))
+	for i, item := range items {
+		if err := json.Unmarshal(item, &messages[len(items)-i-1]); err != nil {
+			return nil, err
+		}
+	}
+	return messages, nil
+}
+
+func (s *redisStore) Get(ctx context.Context, room string) ([]Message, error) {
+	c := s.pool.Get()
+	defer c.Close()
+	return s.messages(c, room)
+}
+
+func (s *redisStore) Append(ctx context.Context, room string, message Message) (int64, error) {
+	keys := []interface{}{s.idKey(room)}
+	if err := redisTransaction(s.pool, keys, func(c redis.Conn) error {
+		id, err := redis.Int64(c.Do("GET", s.idKey(room)))
+		if err != nil && err != redis.ErrNil {
+			return err
+		}
+		message.ID = id + 1
+		b, err := json.Marshal(&message)
+		if err != nil {
+			return err
+		}
+		c.Send("MULTI")
+		c.Send("SET", s.idKey(room), message.ID)
+		return c.Send("LPUSH", s.listKey(room), b)
+	}); err != nil {
+		return 0, err
+	}
+	return message.ID, nil
+}
+
+func (s *redisStore) AppendMulti(ctx context.Context, room string, messages []Message) ([]int64, error) {
+	var ids []int64
+	keys := []interface{}{s.idKey(room)}
+	if err := redisTransaction(s.pool, keys, func(c redis.Conn) error {
+		id, err := redis.Int64(c.Do("GET", s.idKey(room)))
+		if err != nil && err != redis.ErrNil {
+			return err
+		}
+		ids = make([]int64, len(messages))
+		args := []interface{}{s.listKey(room)}
+		for i, m := range messages {
+			id++
+			m.ID = id
+			b, err := json.Marshal(&m)
+			if err != nil {
+				return err
+			}
+			ids[i] = id
+			args = append(args, b)
+		}
+		c.Send("MULTI")
+		c.Send("SET", s.idKey(room), id)
+		return c.Send("LPUSH", args...)
+	}); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func (s *redisStore) Trim(ctx context.Context, room string, n int) error {
+	c := s.pool.Get()
+	defer c.Close()
+	_, err := c.Do("LTRIM", s.listKey(room), 0, n-1)
+	return err
+}
+
+func (s *redisStore) History(ctx context.Context, room string, before int64, limit int) ([]Message, error) {
+	messages, err := s.Get(ctx, room)
+	if err != nil {
+		return nil, err
+	}
+	return historyOf(messages, before, limit), nil
+}
+
+func (s *redisStore) Update(ctx context.Context, room string, id int64, f func(*Message)) (Message, error) {
+	var message Message
+	keys := []interface{}{s.listKey(room)}
+	if err := redisTransaction(s.pool, keys, func(c redis.Conn) error {
+		messages, err := s.messages(c, room)
+		if err != nil {
+			return err
+		}
+		for i := range messages {
+			if messages[i].ID != id {
+				continue
+			}
+			f(&messages[i])
+			message = messages[i]
+			b, err := json.Marshal(&message)
+			if err != nil {
+				return err
+			}
+			c.Send("MULTI")
+			return c.Send("LSET", s.listKey(room), len(messages)-i-1, b)
+		}
+		return ErrNotFound
+	}); err != nil {
+		return Message{}, err
+	}
+	return message, nil
+}
+
+type redisMessage struct {
+	Origin  string  `json:"origin"`
+	Room    string  `json:"room"`
+	Message Message `json:"message"`
+}
+
+func (s *redisStore) Publish(ctx context.Context, room string, message Message) error {
+	b, err := json.Marshal(&redisMessage{
+		Origin:  s.origin,
+		Room:    room,
+		Message: message,
+	})
+	if err != nil {
+		return err
+	}
+	c := s.pool.Get()
+	defer c.Close()
+	_, err = c.Do("PUBLISH", redisChannel, b)
+	return err
+}
+
+func (s *redisStore) Subscribe(ctx context.Context, f func(room string, message Message)) error {
+	c := s.pool.Get()
+	defer c.Close()
+
+	psc := redis.PubSubConn{Conn: c}
+	if err := psc.Subscribe(redisChannel); err != nil {
+		return err
+	}
+
+	// Receive blocks, so unsubscribe to return when ctx is done.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			psc.Unsubscribe()
+		case <-done:
+		}
+	}()
+
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Subscription:
+			if v.Count == 0 {
+				return ctx.Err()
+			}
+		case redis.Message:
+			var m redisMessage
+			if err := json.Unmarshal(v.Data, &m); err != nil {
+				return err
+			}
+			if m.Origin == s.origin {
+				continue
+			}
+			f(m.Room, m.Message)
+		case error:
+			return v
+		}
+	}
+}
+
+// redisKV is a KV on Redis. Values are stored as JSON.
+type redisKV struct {
+	pool *redis.Pool
+}
+
+// NewRedisKV returns a KV that keeps values in Redis.
+func NewRedisKV(pool *redis.Pool) KV {
+	return &redisKV{
+		pool: pool,
+	}
+}
+
+func (kv *redisKV) itemKey(key string) string {
+	return "kv:" + key
+}
+
+func (kv *redisKV) get(c redis.Conn, key string, v interface{}) error {
+	b, err := redis.Bytes(c.Do("GET", kv.itemKey(key)))
+	if err != nil {
+		if err == redis.ErrNil {
+			return ErrNotFound
+		}
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// setArgs returns the arguments of SET for the value.
+func (kv *redisKV) setArgs(key string, v interface{}, expiration time.Duration) ([]interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	args := []interface{}{kv.itemKey(key), b}
+	if expiration > 0 {
+		args = append(args, "PX", int64(expiration/time.Millisecond))
+	}
+	return args, nil
+}
+
+func (kv *redisKV) Get(ctx context.Context, key string, v interface{}) error {
+	c := kv.pool.Get()
+	defer c.Close()
+	return kv.get(c, key, v)
+}
+
+func (kv *redisKV) Set(ctx context.Context, key string, v interface{}, expiration time.Duration) error {
+	args, err := kv.setArgs(key, v, expiration)
+	if err != nil {
+		return err
+	}
+	c := kv.pool.Get()
+	defer c.Close()
+	_, err = c.Do("SET", args...)
+	return err
+}
+
+func (kv *redisKV) Update(ctx context.Context, key string, v interface{}, expiration time.Duration, f func() error) error {
+	keys := []interface{}{kv.itemKey(key)}
+	return redisTransaction(kv.pool, keys, func(c redis.Conn) error {
+		resetValue(v)
+		if err := kv.get(c, key, v); err != nil && err != ErrNotFound {
+			return err
+		}
+		if err := f(); err != nil {
+			return err
+		}
+		args, err := kv.setArgs(key, v, expiration)
+		if err != nil {
+			return err
+		}
+		c.Send("MULTI")
+		return c.Send("SET", args...)
+	})
+}
+
+func (kv *redisKV) Delete(ctx context.Context, key string) error {
+	c := kv.pool.Get()
+	defer c.Close()
+	_, err := c.Do("DEL", kv.itemKey(key))
+	return err
+}
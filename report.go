@@ -0,0 +1,253 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	reportsKey = "reports"
+
+	// maxReportedMessages is the maximum number of the reported messages
+	// kept for moderators. The oldest ones are dropped.
+	maxReportedMessages = 500
+
+	// maxReportReasonLength is the maximum number of characters of a reason.
+	maxReportReasonLength = 200
+)
+
+var errAlreadyReported = errors.New("chatserver: the message is already reported by the client")
+
+// ReportRequest is the request body of POST /messages/{id}/report. The body
+// can be empty.
+type ReportRequest struct {
+	Reason string `json:"reason"`
+}
+
+// Report is a report of a message by a client.
+type Report struct {
+	Reason    string    `json:"reason,omitempty"`
+	SessionID string    `json:"session_id"`
+	IP        string    `json:"ip"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// MessageReports is the reports of a message.
+type MessageReports struct {
+	Room    string   `json:"room"`
+	Message Message  `json:"message"`
+	Reports []Report `json:"reports"`
+
+	// Hidden is true if the message is hidden after report_threshold
+	// reports.
+	Hidden bool `json:"hidden"`
+}
+
+// reportedBy reports whether the session or the IP address has reported the
+// message. A client can report a message only once, so that a few clients
+// can't hide a message.
+func (mr *MessageReports) reportedBy(sessionID, ip string) bool {
+	for _, r := range mr.Reports {
+		if r.SessionID == sessionID || r.IP == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// reportMessage handles POST /messages/{id}/report. The message is hidden
+// when it gets report_threshold reports from different clients.
+func (s *server) reportMessage(ctx context.Context, w http.ResponseWriter, r *http.Request, room string, id int64) {
+	var req ReportRequest
+	if r.ContentLength != 0 {
+		if !decodeJSON(w, r, &req, int64(s.config.MaxContentSize)) {
+			return
+		}
+	}
+	if req.Reason != "" {
+		if f := validateField("reason", &req.Reason, maxReportReasonLength); f != nil {
+			writeValidationError(w, r, &ValidationError{
+				Errors: []FieldError{*f},
+			})
+			return
+		}
+	}
+	if !s.checkRateLimit(ctx, w, r) {
+		return
+	}
+
+	m, err := s.findMessage(ctx, room, id)
+	if err != nil && err != ErrNotFound {
+		msg := fmt.Sprintf("Store error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	if err == ErrNotFound || m.Deleted || m.Hidden {
+		notFound(w, r)
+		return
+	}
+
+	report := Report{
+		Reason:    req.Reason,
+		SessionID: sessionID(ctx),
+		IP:        clientIP(r),
+		CreatedAt: time.Now(),
+	}
+	hide := false
+	var all []MessageReports
+	if err := s.db.Update(ctx, reportsKey, &all, 0, func() error {
+		var mr *MessageReports
+		for i := range all {
+			if all[i].Room == room && all[i].Message.ID == id {
+				mr = &all[i]
+				break
+			}
+		}
+		if mr == nil {
+			all = append(all, MessageReports{Room: room})
+			if len(all) > maxReportedMessages {
+				all = all[len(all)-maxReportedMessages:]
+			}
+			mr = &all[len(all)-1]
+		}
+		if mr.reportedBy(report.SessionID, report.IP) {
+			return errAlreadyReported
+		}
+		mr.Message = m
+		mr.Reports = append(mr.Reports, report)
+		if n := s.config.ReportThreshold; n > 0 && len(mr.Reports) >= n && !mr.Hidden {
+			mr.Hidden = true
+			hide = true
+		}
+		return nil
+	}); err != nil {
+		// Reporting again is not an error.
+		if err == errAlreadyReported {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		msg := fmt.Sprintf("Report error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	if hide {
+		s.setHidden(ctx, room, id, true)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setHidden hides or shows the message, and delivers the change to the
+// clients.
+func (s *server) setHidden(ctx context.Context, room string, id int64, hidden bool) {
+	m, err := s.store.Update(ctx, room, id, func(m *Message) {
+		m.Hidden = hidden
+	})
+	if err != nil {
+		if err != ErrNotFound {
+			s.logf(ctx, "Report error: %v", err)
+		}
+		return
+	}
+	s.bumpRevision(ctx, room)
+	s.broadcast(ctx, room, m)
+}
+
+// removeReports removes the reports of the message and returns them.
+func (s *server) removeReports(ctx context.Context, room string, id int64) (*MessageReports, error) {
+	var all []MessageReports
+	var removed *MessageReports
+	if err := s.db.Update(ctx, reportsKey, &all, 0, func() error {
+		for i := range all {
+			if all[i].Room == room && all[i].Message.ID == id {
+				mr := all[i]
+				removed = &mr
+				all = append(all[:i], all[i+1:]...)
+				return nil
+			}
+		}
+		return ErrNotFound
+	}); err != nil {
+		return nil, err
+	}
+	return removed, nil
+}
+
+// handleReports handles /admin/reports and /admin/reports/{room}/{id}.
+func (s *server) handleReports(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/reports"), "/")
+
+	switch {
+	case rest == "" && isGet(r):
+		var all []MessageReports
+		if err := s.db.Get(ctx, reportsKey, &all); err != nil && err != ErrNotFound {
+			msg := fmt.Sprintf("Report error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		if all == nil {
+			all = []MessageReports{}
+		}
+		// The most reported messages come first.
+		sort.SliceStable(all, func(i, j int) bool {
+			return len(all[i].Reports) > len(all[j].Reports)
+		})
+		writeJSON(w, http.StatusOK, all)
+
+	case rest != "" && r.Method == http.MethodDelete:
+		// Dismissing the reports shows the hidden message again.
+		i := strings.LastIndex(rest, "/")
+		if i < 0 {
+			notFound(w, r)
+			return
+		}
+		room := rest[:i]
+		id, err := strconv.ParseInt(rest[i+1:], 10, 64)
+		if err != nil || id <= 0 {
+			notFound(w, r)
+			return
+		}
+		mr, err := s.removeReports(ctx, room, id)
+		if err != nil {
+			if err == ErrNotFound {
+				notFound(w, r)
+				return
+			}
+			msg := fmt.Sprintf("Report error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		if mr.Hidden {
+			s.setHidden(ctx, room, id, false)
+		}
+		s.audit(ctx, r, "report.dismiss", room, strconv.FormatInt(id, 10), mr, nil)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		if rest == "" {
+			w.Header().Set("Allow", "GET, HEAD")
+		} else {
+			w.Header().Set("Allow", "DELETE")
+		}
+		methodNotAllowed(w, r)
+	}
+}
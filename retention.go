@@ -0,0 +1,184 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// RoomRetention is the request body of PUT /admin/rooms/{room}/retention.
+type RoomRetention struct {
+	MaxMessages   int   `json:"max_messages"`
+	MaxAgeSeconds int64 `json:"max_age_seconds"`
+}
+
+// historyLength returns the number of the latest messages kept in the room.
+func (s *server) historyLength(ctx context.Context, name string) int {
+	if n := s.room(ctx, name).MaxMessages; n > 0 && n < s.config.HistoryLength {
+		return n
+	}
+	return s.config.HistoryLength
+}
+
+// purgeBefore returns the time before which the messages in the room are
+// removed by /tasks/purge, or the zero time if no messages are removed.
+func (s *server) purgeBefore(ctx context.Context, room Room, now time.Time) (time.Time, error) {
+	var before time.Time
+	retention := s.config.Retention
+	if room.MaxAgeSeconds > 0 {
+		retention = time.Duration(room.MaxAgeSeconds) * time.Second
+	}
+	if retention > 0 {
+		before = now.Add(-retention)
+	}
+	if room.MaxMessages > 0 {
+		latest, err := s.store.History(ctx, room.Name, 0, room.MaxMessages)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if len(latest) == room.MaxMessages && latest[0].CreatedAt.After(before) {
+			before = latest[0].CreatedAt
+		}
+	}
+	return before, nil
+}
+
+// PurgeResponse is the result of /tasks/purge.
+type PurgeResponse struct {
+	// Purged is the number of the removed messages.
+	Purged int `json:"purged"`
+
+	// Before is the time before which the messages were removed by the
+	// retention period in the configuration.
+	Before time.Time `json:"before,omitempty"`
+
+	// Tombstones is the number of the removed tombstones of the deleted
+	// messages.
+	Tombstones int `json:"tombstones,omitempty"`
+}
+
+// handlePurge handles /tasks/purge, which removes the messages older than the
+// retention period, the messages over max_messages of each room and the old
+// tombstones. This is called by cron on App Engine, and requires the admin
+// token otherwise.
+func (s *server) handlePurge(w http.ResponseWriter, r *http.Request) {
+	if !(s.cron && r.Header.Get("X-Appengine-Cron") == "true") && !s.checkAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		methodNotAllowed(w, r)
+		return
+	}
+
+	ctx := r.Context()
+	res := &PurgeResponse{}
+	n, err := s.purgeTombstones(ctx)
+	res.Tombstones = n
+	if err != nil {
+		msg := fmt.Sprintf("Purge error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	p, ok := s.store.(purger)
+	if !ok {
+		writeJSON(w, http.StatusOK, res)
+		return
+	}
+
+	now := time.Now()
+	if s.config.Retention > 0 {
+		res.Before = now.Add(-s.config.Retention)
+	}
+	rooms, err := s.rooms(ctx)
+	if err != nil {
+		s.logf(ctx, "Room error: %v", err)
+	}
+	for _, room := range rooms {
+		before, err := s.purgeBefore(ctx, room, now)
+		if err != nil {
+			msg := fmt.Sprintf("Purge error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		if before.IsZero() {
+			continue
+		}
+		n, err := p.Purge(ctx, room.Name, before)
+		res.Purged += n
+		if err != nil {
+			msg := fmt.Sprintf("Purge error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		if n > 0 {
+			s.bumpRevision(ctx, room.Name)
+			s.logf(ctx, "purged %d messages in %s posted before %v", n, room.Name, before)
+		}
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// handleRoomRetention handles PUT and DELETE /admin/rooms/{room}/retention,
+// which set and remove the retention of the room.
+func (s *server) handleRoomRetention(ctx context.Context, w http.ResponseWriter, r *http.Request, name string) {
+	var retention RoomRetention
+	switch r.Method {
+	case http.MethodPut:
+		if !decodeJSON(w, r, &retention, maxAdminContentSize) {
+			return
+		}
+		var errs []FieldError
+		if retention.MaxMessages < 0 || retention.MaxMessages > s.config.HistoryLength {
+			errs = append(errs, newFieldError("max_messages", "must be from 0 to %d", s.config.HistoryLength))
+		}
+		if retention.MaxAgeSeconds < 0 {
+			errs = append(errs, newFieldError("max_age_seconds", "must not be negative"))
+		}
+		if len(errs) > 0 {
+			writeValidationError(w, r, &ValidationError{Errors: errs})
+			return
+		}
+	case http.MethodDelete:
+	default:
+		w.Header().Set("Allow", "DELETE, PUT")
+		methodNotAllowed(w, r)
+		return
+	}
+
+	prev, room, err := s.updateRoom(ctx, name, func(room *Room) {
+		room.MaxMessages = retention.MaxMessages
+		room.MaxAgeSeconds = retention.MaxAgeSeconds
+	})
+	if err != nil {
+		if err == ErrNotFound {
+			notFound(w, r)
+			return
+		}
+		msg := fmt.Sprintf("Room error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	// The cache is trimmed now so that the page shows the new length.
+	if err := s.store.Trim(ctx, name, s.historyLength(ctx, name)); err != nil {
+		s.logf(ctx, "Trim error: %v", err)
+	}
+	s.bumpRevision(ctx, name)
+	s.audit(ctx, r, "room.retention", room.Name, "", &prev, &room)
+	writeJSON(w, http.StatusOK, &room)
+}
@@ -0,0 +1,202 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var errRevisionConflict = errors.New("chatserver: the revision doesn't match")
+
+// RevisionConflictError is the error when If-Match doesn't match the current
+// revision of the room.
+type RevisionConflictError struct {
+	// Revision is the current revision of the room.
+	Revision int64
+
+	// lang is the language of the message in JSON.
+	lang string
+}
+
+// revisionConflictJSON is the JSON representation of RevisionConflictError.
+type revisionConflictJSON struct {
+	Error    APIError `json:"error"`
+	Revision int64    `json:"revision"`
+}
+
+// MarshalJSON encodes the error in the same envelope as the other errors with
+// the current revision.
+func (e *RevisionConflictError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&revisionConflictJSON{
+		Error: APIError{
+			Code:    "revision_conflict",
+			Message: translate(e.lang, "The messages have been changed"),
+		},
+		Revision: e.Revision,
+	})
+}
+
+func (e *RevisionConflictError) Error() string {
+	return fmt.Sprintf("chatserver: the current revision is %d", e.Revision)
+}
+
+func revisionKey(room string) string {
+	return "revision:" + room
+}
+
+// revisionChangeKey is the context key of the *revisionChange of the request.
+type revisionChangeKey struct{}
+
+// revisionChange is the revision of a room increased by checkRevision before
+// the change is made.
+type revisionChange struct {
+	room string
+	rev  int64
+
+	// made is true if the change is made and the revision is kept.
+	made bool
+	m    sync.Mutex
+}
+
+// takeRevisionChange reports whether the revision of the room was already
+// increased by checkRevision for the change of the request, and marks the
+// change as made.
+func takeRevisionChange(ctx context.Context, room string) bool {
+	c, ok := ctx.Value(revisionChangeKey{}).(*revisionChange)
+	if !ok || c.room != room {
+		return false
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.made {
+		return false
+	}
+	c.made = true
+	return true
+}
+
+// revision returns the revision of the messages in the room. The revision
+// increases whenever a message is posted, edited, deleted, pinned, unpinned,
+// voted on or purged.
+func (s *server) revision(ctx context.Context, room string) (int64, error) {
+	var rev int64
+	if err := s.db.Get(ctx, revisionKey(room), &rev); err != nil && err != ErrNotFound {
+		return 0, err
+	}
+	return rev, nil
+}
+
+// bumpRevision increases the revision of the room after the messages are
+// changed. If checkRevision already increased it for the change, the revision
+// is kept as it is.
+func (s *server) bumpRevision(ctx context.Context, room string) {
+	if takeRevisionChange(ctx, room) {
+		return
+	}
+	var rev int64
+	if err := s.db.Update(ctx, revisionKey(room), &rev, 0, func() error {
+		rev++
+		return nil
+	}); err != nil {
+		s.logf(ctx, "Revision error: %v", err)
+	}
+}
+
+// revisionMatches reports whether the If-Match header value matches the
+// revision. The revisions can be quoted like entity tags.
+func revisionMatches(ifMatch string, rev int64) bool {
+	for _, t := range strings.Split(ifMatch, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" {
+			return true
+		}
+		t = strings.Trim(strings.TrimPrefix(t, "W/"), `"`)
+		if n, err := strconv.ParseInt(t, 10, 64); err == nil && n == rev {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRevision reports whether the change to the room can be made, and
+// returns the context to make the change with. If the request has an If-Match
+// header, the revision is compared with it and is increased at once, so that
+// only one of the concurrent changes based on the same revision succeeds.
+// bumpRevision with the returned context doesn't increase it again, and
+// endRevision must be called to undo the increase if the change is not made.
+// If the revision doesn't match, checkRevision writes 409 Conflict with the
+// current revision.
+func (s *server) checkRevision(ctx context.Context, w http.ResponseWriter, r *http.Request, room string) (context.Context, bool) {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		return ctx, true
+	}
+	var rev int64
+	if err := s.db.Update(ctx, revisionKey(room), &rev, 0, func() error {
+		if !revisionMatches(ifMatch, rev) {
+			return errRevisionConflict
+		}
+		rev++
+		return nil
+	}); err != nil {
+		if err == errRevisionConflict {
+			writeJSON(w, http.StatusConflict, &RevisionConflictError{
+				Revision: rev,
+				lang:     requestLanguage(r),
+			})
+			return ctx, false
+		}
+		msg := fmt.Sprintf("Revision error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return ctx, false
+	}
+	return context.WithValue(ctx, revisionChangeKey{}, &revisionChange{
+		room: room,
+		rev:  rev,
+	}), true
+}
+
+// endRevision undoes the increase of the revision by checkRevision if the
+// change was not made, like when the message is not found or the store
+// fails. The revision is kept if another change has increased it since.
+func (s *server) endRevision(ctx context.Context) {
+	c, ok := ctx.Value(revisionChangeKey{}).(*revisionChange)
+	if !ok {
+		return
+	}
+	c.m.Lock()
+	made := c.made
+	c.made = true
+	c.m.Unlock()
+	if made {
+		return
+	}
+	var rev int64
+	if err := s.db.Update(ctx, revisionKey(c.room), &rev, 0, func() error {
+		if rev == c.rev {
+			rev--
+		}
+		return nil
+	}); err != nil {
+		s.logf(ctx, "Revision error: %v", err)
+	}
+}
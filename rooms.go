@@ -0,0 +1,545 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultRoom is the room for the paths without the /rooms/{room} prefix.
+const defaultRoom = "general"
+
+const (
+	roomsKey = "rooms"
+
+	// maxRoomNameLength is the maximum number of bytes of a created room's
+	// name.
+	maxRoomNameLength = 64
+)
+
+var errRoomExists = errors.New("chatserver: the room already exists")
+
+// roomNamePattern is the names of the created rooms, which are in the paths.
+var roomNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// RoomState is the state of a room.
+type RoomState string
+
+const (
+	// RoomOpen is the state of the rooms where anyone can post.
+	RoomOpen RoomState = "open"
+
+	// RoomLocked is the state of the read-only rooms, like after an event
+	// ends. The page shows that the chat is closed.
+	RoomLocked RoomState = "locked"
+
+	// RoomArchived is the state of the read-only rooms that are not listed.
+	RoomArchived RoomState = "archived"
+
+	// RoomPending is the state of the open rooms before the schedule. It
+	// can't be set by the admin API.
+	RoomPending RoomState = "pending"
+)
+
+// Room is a chat room. The rooms in the configuration always exist, and the
+// other rooms are created by the admin API.
+type Room struct {
+	Name  string    `json:"name"`
+	State RoomState `json:"state"`
+
+	// Config is true if the room is in the configuration. Such rooms can be
+	// locked and archived but not deleted.
+	Config bool `json:"config"`
+
+	// OpensAt and ClosesAt are the schedule of the open room. The room is
+	// pending before OpensAt and is locked after ClosesAt. Zero is no limit.
+	OpensAt  time.Time `json:"opens_at,omitempty"`
+	ClosesAt time.Time `json:"closes_at,omitempty"`
+
+	// MaxMessages is the number of the latest messages kept in the room,
+	// which is up to history_length in the configuration. The older
+	// messages are also removed from the archive by /tasks/purge.
+	// history_length is used and the archive keeps all the messages if this
+	// is 0.
+	MaxMessages int `json:"max_messages,omitempty"`
+
+	// MaxAgeSeconds is how long messages are kept in the room. retention in
+	// the configuration is used if this is 0.
+	MaxAgeSeconds int64 `json:"max_age_seconds,omitempty"`
+
+	CreatedAt time.Time `json:"created_at,omitempty"`
+	UpdatedAt time.Time `json:"updated_at,omitempty"`
+}
+
+// RoomSchedule is the request body of PUT /admin/rooms/{room}/schedule.
+type RoomSchedule struct {
+	OpensAt  time.Time `json:"opens_at"`
+	ClosesAt time.Time `json:"closes_at"`
+}
+
+// stateAt returns the state of the room at the time with the schedule.
+func (r *Room) stateAt(now time.Time) RoomState {
+	if r.State != RoomOpen {
+		return r.State
+	}
+	if !r.OpensAt.IsZero() && now.Before(r.OpensAt) {
+		return RoomPending
+	}
+	if !r.ClosesAt.IsZero() && !now.Before(r.ClosesAt) {
+		return RoomLocked
+	}
+	return RoomOpen
+}
+
+// RoomRequest is the request body of POST /admin/rooms and PATCH
+// /admin/rooms/{room}.
+type RoomRequest struct {
+	Name  string    `json:"name"`
+	State RoomState `json:"state"`
+}
+
+func (state RoomState) valid() bool {
+	switch state {
+	case RoomOpen, RoomLocked, RoomArchived:
+		return true
+	}
+	return false
+}
+
+// normalizeRooms returns the rooms with the default room first. Empty and
+// duplicated names are removed.
+func normalizeRooms(names []string) []string {
+	rooms := []string{defaultRoom}
+	for _, r := range names {
+		r = strings.TrimSpace(r)
+		if r == "" || contains(rooms, r) {
+			continue
+		}
+		rooms = append(rooms, r)
+	}
+	return rooms
+}
+
+func contains(strs []string, str string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
+
+// findRoom returns the index of the room of the name, or -1 if not found.
+func findRoom(rooms []Room, name string) int {
+	for i, r := range rooms {
+		if r.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// mergeRooms returns the rooms in the configuration with the stored states,
+// and then the created rooms in the created order.
+func mergeRooms(names []string, stored []Room) []Room {
+	rooms := make([]Room, 0, len(names)+len(stored))
+	for _, name := range names {
+		room := Room{Name: name, State: RoomOpen, Config: true}
+		if i := findRoom(stored, name); i >= 0 {
+			room.State = stored[i].State
+			room.OpensAt = stored[i].OpensAt
+			room.ClosesAt = stored[i].ClosesAt
+			room.MaxMessages = stored[i].MaxMessages
+			room.MaxAgeSeconds = stored[i].MaxAgeSeconds
+			room.UpdatedAt = stored[i].UpdatedAt
+		}
+		rooms = append(rooms, room)
+	}
+	for _, r := range stored {
+		if !contains(names, r.Name) {
+			rooms = append(rooms, r)
+		}
+	}
+	return rooms
+}
+
+// rooms returns all the rooms. On errors, the rooms in the configuration are
+// returned with the error so that the chat keeps working.
+func (s *server) rooms(ctx context.Context) ([]Room, error) {
+	var stored []Room
+	if err := s.db.Get(ctx, roomsKey, &stored); err != nil && err != ErrNotFound {
+		return mergeRooms(s.config.Rooms, nil), err
+	}
+	return mergeRooms(s.config.Rooms, stored), nil
+}
+
+// listedRooms returns the names of the rooms shown in the navigation, which
+// are the rooms not archived.
+func (s *server) listedRooms(ctx context.Context) []string {
+	rooms, err := s.rooms(ctx)
+	if err != nil {
+		s.logf(ctx, "Room error: %v", err)
+	}
+	names := make([]string, 0, len(rooms))
+	for _, r := range rooms {
+		if r.State != RoomArchived {
+			names = append(names, r.Name)
+		}
+	}
+	return names
+}
+
+// roomNames returns the names of all the rooms.
+func (s *server) roomNames(ctx context.Context) []string {
+	rooms, err := s.rooms(ctx)
+	if err != nil {
+		s.logf(ctx, "Room error: %v", err)
+	}
+	names := make([]string, len(rooms))
+	for i, r := range rooms {
+		names[i] = r.Name
+	}
+	return names
+}
+
+// hasRoom reports whether the room exists. The rooms in the configuration
+// are found without reading the store.
+func (s *server) hasRoom(ctx context.Context, room string) bool {
+	if contains(s.config.Rooms, room) {
+		return true
+	}
+	rooms, err := s.rooms(ctx)
+	if err != nil {
+		s.logf(ctx, "Room error: %v", err)
+	}
+	return findRoom(rooms, room) >= 0
+}
+
+// room returns the room of the name. The room is regarded as open on errors.
+func (s *server) room(ctx context.Context, name string) Room {
+	rooms, err := s.rooms(ctx)
+	if err != nil {
+		s.logf(ctx, "Room error: %v", err)
+	}
+	if i := findRoom(rooms, name); i >= 0 {
+		return rooms[i]
+	}
+	return Room{Name: name, State: RoomOpen}
+}
+
+// roomStatus returns the status of the room for the pages: whether the room
+// is closed, and the seconds until the pending room opens and the time it
+// opens.
+func (s *server) roomStatus(ctx context.Context, name string) (bool, int64, string) {
+	room := s.room(ctx, name)
+	now := time.Now()
+	switch room.stateAt(now) {
+	case RoomLocked, RoomArchived:
+		return true, 0, ""
+	case RoomPending:
+		opensIn := int64(math.Ceil(room.OpensAt.Sub(now).Seconds()))
+		return false, opensIn, room.OpensAt.Format(time.RFC3339)
+	}
+	return false, 0, ""
+}
+
+// checkRoomOpen reports whether the room accepts posts now. If not,
+// checkRoomOpen writes 423 Locked.
+func (s *server) checkRoomOpen(ctx context.Context, w http.ResponseWriter, r *http.Request, name string) bool {
+	room := s.room(ctx, name)
+	now := time.Now()
+	switch room.stateAt(now) {
+	case RoomPending:
+		wait := room.OpensAt.Sub(now)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		msg := translate(requestLanguage(r), "The chat opens at %s", room.OpensAt.Format(time.RFC3339))
+		writeErrorCode(w, r, http.StatusLocked, "room_not_open", msg)
+		return false
+	case RoomLocked:
+		msg := "The chat is closed"
+		writeErrorCode(w, r, http.StatusLocked, "room_locked", msg)
+		return false
+	case RoomArchived:
+		msg := "The room is archived"
+		writeErrorCode(w, r, http.StatusLocked, "room_archived", msg)
+		return false
+	}
+	return true
+}
+
+// updateRoom updates the room of the name with f, and returns the room before
+// and after the update. The rooms in the configuration are also stored when
+// they are updated.
+func (s *server) updateRoom(ctx context.Context, name string, f func(room *Room)) (Room, Room, error) {
+	var prev, room Room
+	var stored []Room
+	if err := s.db.Update(ctx, roomsKey, &stored, 0, func() error {
+		rooms := mergeRooms(s.config.Rooms, stored)
+		i := findRoom(rooms, name)
+		if i < 0 {
+			return ErrNotFound
+		}
+		prev = rooms[i]
+		room = prev
+		f(&room)
+		room.UpdatedAt = time.Now()
+		if j := findRoom(stored, name); j >= 0 {
+			stored[j] = room
+		} else {
+			stored = append(stored, room)
+		}
+		return nil
+	}); err != nil {
+		return Room{}, Room{}, err
+	}
+	return prev, room, nil
+}
+
+// handleRooms handles /admin/rooms, /admin/rooms/{room},
+// /admin/rooms/{room}/messages, /admin/rooms/{room}/schedule and
+// /admin/rooms/{room}/retention.
+func (s *server) handleRooms(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/rooms"), "/")
+	if i := strings.Index(rest, "/"); i >= 0 {
+		room, sub := rest[:i], rest[i+1:]
+		if !s.hasRoom(ctx, room) {
+			notFound(w, r)
+			return
+		}
+		switch sub {
+		case "messages":
+			if r.Method != http.MethodDelete {
+				w.Header().Set("Allow", "DELETE")
+				methodNotAllowed(w, r)
+				return
+			}
+			s.clearRoom(ctx, w, r, room)
+		case "schedule":
+			s.handleRoomSchedule(ctx, w, r, room)
+		case "retention":
+			s.handleRoomRetention(ctx, w, r, room)
+		default:
+			notFound(w, r)
+		}
+		return
+	}
+
+	switch {
+	case rest == "" && isGet(r):
+		rooms, err := s.rooms(ctx)
+		if err != nil {
+			msg := fmt.Sprintf("Room error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		writeJSON(w, http.StatusOK, rooms)
+
+	case rest == "" && r.Method == http.MethodPost:
+		var req RoomRequest
+		if !decodeJSON(w, r, &req, maxAdminContentSize) {
+			return
+		}
+		if req.State == "" {
+			req.State = RoomOpen
+		}
+		var errs []FieldError
+		if !roomNamePattern.MatchString(req.Name) {
+			errs = append(errs, newFieldError("name", "must consist of letters, digits, - and _"))
+		} else if len(req.Name) > maxRoomNameLength {
+			errs = append(errs, newFieldError("name", "must be at most %d bytes", maxRoomNameLength))
+		}
+		if !req.State.valid() {
+			errs = append(errs, newFieldError("state", "must be open, locked or archived"))
+		}
+		if len(errs) > 0 {
+			writeValidationError(w, r, &ValidationError{Errors: errs})
+			return
+		}
+
+		now := time.Now()
+		room := Room{
+			Name:      req.Name,
+			State:     req.State,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		var stored []Room
+		if err := s.db.Update(ctx, roomsKey, &stored, 0, func() error {
+			if contains(s.config.Rooms, room.Name) || findRoom(stored, room.Name) >= 0 {
+				return errRoomExists
+			}
+			stored = append(stored, room)
+			return nil
+		}); err != nil {
+			if err == errRoomExists {
+				msg := translate(requestLanguage(r), "Room %q already exists", room.Name)
+				writeErrorCode(w, r, http.StatusConflict, "room_exists", msg)
+				return
+			}
+			msg := fmt.Sprintf("Room error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		s.audit(ctx, r, "room.create", room.Name, "", nil, &room)
+		writeJSON(w, http.StatusCreated, &room)
+
+	case rest != "" && r.Method == http.MethodPatch:
+		var req RoomRequest
+		if !decodeJSON(w, r, &req, maxAdminContentSize) {
+			return
+		}
+		if !req.State.valid() {
+			writeValidationError(w, r, &ValidationError{
+				Errors: []FieldError{newFieldError("state", "must be open, locked or archived")},
+			})
+			return
+		}
+		if !s.hasRoom(ctx, rest) {
+			notFound(w, r)
+			return
+		}
+
+		prev, room, err := s.updateRoom(ctx, rest, func(room *Room) {
+			room.State = req.State
+		})
+		if err != nil {
+			if err == ErrNotFound {
+				notFound(w, r)
+				return
+			}
+			msg := fmt.Sprintf("Room error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		s.audit(ctx, r, "room.update", room.Name, "", &prev, &room)
+		writeJSON(w, http.StatusOK, &room)
+
+	case rest != "" && r.Method == http.MethodDelete:
+		if contains(s.config.Rooms, rest) {
+			msg := "The rooms in the configuration can't be deleted"
+			writeErrorCode(w, r, http.StatusConflict, "room_in_config", msg)
+			return
+		}
+		var prev Room
+		var stored []Room
+		if err := s.db.Update(ctx, roomsKey, &stored, 0, func() error {
+			i := findRoom(stored, rest)
+			if i < 0 {
+				return ErrNotFound
+			}
+			prev = stored[i]
+			stored = append(stored[:i], stored[i+1:]...)
+			return nil
+		}); err != nil {
+			if err == ErrNotFound {
+				notFound(w, r)
+				return
+			}
+			msg := fmt.Sprintf("Room error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		// The messages are removed so that a new room of the same name
+		// starts empty.
+		if p, ok := s.store.(purger); ok {
+			if _, err := p.Purge(ctx, rest, time.Now()); err != nil {
+				s.logf(ctx, "Purge error: %v", err)
+			}
+		}
+		s.audit(ctx, r, "room.delete", rest, "", &prev, nil)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		if rest == "" {
+			w.Header().Set("Allow", "GET, HEAD, POST")
+		} else {
+			w.Header().Set("Allow", "DELETE, PATCH")
+		}
+		methodNotAllowed(w, r)
+	}
+}
+
+// handleRoomSchedule handles PUT and DELETE /admin/rooms/{room}/schedule,
+// which set and remove the window to post in the room.
+func (s *server) handleRoomSchedule(ctx context.Context, w http.ResponseWriter, r *http.Request, name string) {
+	var schedule RoomSchedule
+	switch r.Method {
+	case http.MethodPut:
+		if !decodeJSON(w, r, &schedule, maxAdminContentSize) {
+			return
+		}
+		if schedule.OpensAt.IsZero() && schedule.ClosesAt.IsZero() {
+			writeValidationError(w, r, &ValidationError{
+				Errors: []FieldError{newFieldError("opens_at", "opens_at or closes_at is required")},
+			})
+			return
+		}
+		if !schedule.OpensAt.IsZero() && !schedule.ClosesAt.IsZero() && !schedule.ClosesAt.After(schedule.OpensAt) {
+			writeValidationError(w, r, &ValidationError{
+				Errors: []FieldError{newFieldError("closes_at", "must be after opens_at")},
+			})
+			return
+		}
+	case http.MethodDelete:
+	default:
+		w.Header().Set("Allow", "DELETE, PUT")
+		methodNotAllowed(w, r)
+		return
+	}
+
+	prev, room, err := s.updateRoom(ctx, name, func(room *Room) {
+		room.OpensAt = schedule.OpensAt
+		room.ClosesAt = schedule.ClosesAt
+	})
+	if err != nil {
+		if err == ErrNotFound {
+			notFound(w, r)
+			return
+		}
+		msg := fmt.Sprintf("Room error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	s.audit(ctx, r, "room.schedule", room.Name, "", &prev, &room)
+	writeJSON(w, http.StatusOK, &room)
+}
+
+// splitRoom splits the path into the room and the path in the room.
+// For example, "/rooms/foo/messages" is split into "foo" and "/messages".
+// splitRoom returns false if the room doesn't exist.
+func (s *server) splitRoom(ctx context.Context, path string) (string, string, bool) {
+	const prefix = "/rooms/"
+	if !strings.HasPrefix(path, prefix) {
+		return defaultRoom, path, true
+	}
+	path = path[len(prefix):]
+	i := strings.Index(path, "/")
+	if i < 0 {
+		return "", "", false
+	}
+	room := path[:i]
+	if !s.hasRoom(ctx, room) {
+		return "", "", false
+	}
+	return room, path[i:], true
+}
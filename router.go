@@ -0,0 +1,170 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// routeParams is the parameters of a request matched to a route.
+type routeParams struct {
+	// room is the room in the /rooms/{room} prefix, or the default room.
+	room string
+
+	// vars is the values of the {name} segments in the pattern.
+	vars map[string]string
+}
+
+// routeHandler handles a request matched to a route.
+type routeHandler func(ctx context.Context, w http.ResponseWriter, r *http.Request, p routeParams)
+
+type route struct {
+	segments []string
+	handlers map[string]routeHandler
+}
+
+// router routes the requests in a room by the method and the path pattern
+// like "/messages/{id}/pin". The paths are also available under
+// /rooms/{room}.
+type router struct {
+	routes []*route
+}
+
+func splitPath(path string) []string {
+	return strings.Split(strings.TrimPrefix(path, "/"), "/")
+}
+
+// handle registers the handler for the method and the pattern. A {name}
+// segment matches any non-empty segment. The routes are matched in the
+// registered order.
+func (rt *router) handle(method, pattern string, h routeHandler) {
+	segments := splitPath(pattern)
+	for _, r := range rt.routes {
+		if strings.Join(r.segments, "/") == strings.Join(segments, "/") {
+			if _, ok := r.handlers[method]; ok {
+				panic("chatserver: duplicated route: " + method + " " + pattern)
+			}
+			r.handlers[method] = h
+			return
+		}
+	}
+	rt.routes = append(rt.routes, &route{
+		segments: segments,
+		handlers: map[string]routeHandler{method: h},
+	})
+}
+
+func (r *route) match(segments []string) (map[string]string, bool) {
+	if len(segments) != len(r.segments) {
+		return nil, false
+	}
+	vars := map[string]string{}
+	for i, s := range r.segments {
+		if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+			if segments[i] == "" {
+				return nil, false
+			}
+			vars[s[1:len(s)-1]] = segments[i]
+			continue
+		}
+		if s != segments[i] {
+			return nil, false
+		}
+	}
+	return vars, true
+}
+
+// allowed returns the methods of the route.
+func (r *route) allowed() []string {
+	var methods []string
+	for m := range r.handlers {
+		methods = append(methods, m)
+	}
+	if _, ok := r.handlers[http.MethodGet]; ok {
+		if _, ok := r.handlers[http.MethodHead]; !ok {
+			methods = append(methods, http.MethodHead)
+		}
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// lookup returns the handler of the route matching the request and its
+// parameters. If no route matches, lookup responds 404 Not Found. If the route
+// doesn't have the method, lookup responds 405 Method Not Allowed with the
+// Allow header. HEAD is handled by the GET handler unless the route has its
+// own.
+func (rt *router) lookup(ctx context.Context, s *server, w http.ResponseWriter, r *http.Request) (routeHandler, routeParams, bool) {
+	room, path, ok := s.splitRoom(ctx, r.URL.Path)
+	if !ok {
+		notFound(w, r)
+		return nil, routeParams{}, false
+	}
+	segments := splitPath(path)
+	for _, route := range rt.routes {
+		vars, ok := route.match(segments)
+		if !ok {
+			continue
+		}
+		h, ok := route.handlers[r.Method]
+		if !ok && r.Method == http.MethodHead {
+			h, ok = route.handlers[http.MethodGet]
+		}
+		if !ok {
+			w.Header().Set("Allow", strings.Join(route.allowed(), ", "))
+			methodNotAllowed(w, r)
+			return nil, routeParams{}, false
+		}
+		return h, routeParams{room: room, vars: vars}, true
+	}
+	notFound(w, r)
+	return nil, routeParams{}, false
+}
+
+// isGet reports whether the request is GET or HEAD, which is handled as GET.
+func isGet(r *http.Request) bool {
+	return r.Method == http.MethodGet || r.Method == http.MethodHead
+}
+
+// inRoom adapts a handler that takes the room.
+func inRoom(f func(ctx context.Context, w http.ResponseWriter, r *http.Request, room string)) routeHandler {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request, p routeParams) {
+		f(ctx, w, r, p.room)
+	}
+}
+
+// withID adapts a handler that takes the room and the positive integer {id}.
+func withID(f func(ctx context.Context, w http.ResponseWriter, r *http.Request, room string, id int64)) routeHandler {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request, p routeParams) {
+		id, err := strconv.ParseInt(p.vars["id"], 10, 64)
+		if err != nil || id <= 0 {
+			notFound(w, r)
+			return
+		}
+		f(ctx, w, r, p.room, id)
+	}
+}
+
+// withUser adapts a handler that takes the {user} segment. The handler doesn't
+// take the room since the users are not in a room.
+func withUser(f func(ctx context.Context, w http.ResponseWriter, r *http.Request, user string)) routeHandler {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request, p routeParams) {
+		f(ctx, w, r, p.vars["user"])
+	}
+}
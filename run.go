@@ -0,0 +1,201 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"google.golang.org/grpc"
+)
+
+// Run serves the chat on config.Addr until ctx is done or the process
+// receives SIGTERM or SIGINT, like on Cloud Run and Kubernetes. Messages are
+// stored in config.Store and config.KV, or in memory if they are nil. The
+// gRPC API is also served on config.GRPCAddr if it is not empty.
+//
+// On shutdown, Run stops accepting connections, closes WebSocket,
+// /messages/stream and gRPC streaming connections so that the clients
+// reconnect to another instance, and waits for the other requests up to
+// config.ShutdownTimeout.
+// Then the posts queued while the store was unavailable are stored, and the
+// pending deliveries to Slack and the webhooks are sent. Run returns nil
+// after the graceful shutdown.
+func Run(ctx context.Context, config Config) error {
+	store, kv := config.Store, config.KV
+	if store == nil {
+		store = NewMemoryStore()
+	}
+	if kv == nil {
+		kv = NewMemoryKV()
+	}
+	s := newServer(store, kv, config)
+
+	// The background loops run until the pending writes are flushed.
+	lctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		s.loops.Wait()
+	}()
+	s.start(lctx)
+
+	h := s.handler()
+	srv := &http.Server{
+		Addr:    config.Addr,
+		Handler: h,
+	}
+	l, err := net.Listen("tcp", config.Addr)
+	if err != nil {
+		return err
+	}
+	var g *grpc.Server
+	var gl net.Listener
+	if config.GRPCAddr != "" {
+		gl, err = net.Listen("tcp", config.GRPCAddr)
+		if err != nil {
+			l.Close()
+			return err
+		}
+		g = newGRPCServer(s, h)
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	errCh := make(chan error, 2)
+	go func() {
+		log.Printf("Listening on %s", config.Addr)
+		errCh <- srv.Serve(l)
+	}()
+	if g != nil {
+		go func() {
+			log.Printf("Serving gRPC on %s", config.GRPCAddr)
+			errCh <- g.Serve(gl)
+		}()
+	}
+	select {
+	case err := <-errCh:
+		srv.Close()
+		if g != nil {
+			g.Stop()
+		}
+		return err
+	case <-ctx.Done():
+	}
+	stop()
+
+	log.Printf("Shutting down")
+	sctx := context.Background()
+	if config.ShutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		sctx, cancel = context.WithTimeout(sctx, config.ShutdownTimeout)
+		defer cancel()
+	}
+	return s.shutdown(sctx, srv, g)
+}
+
+// stopGRPC stops g gracefully, or closes the connections when ctx is done.
+func stopGRPC(ctx context.Context, g *grpc.Server) {
+	done := make(chan struct{})
+	go func() {
+		g.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		g.Stop()
+	}
+}
+
+// shutdown stops srv and g gracefully, and then flushes the pending writes. g
+// can be nil.
+func (s *server) shutdown(ctx context.Context, srv *http.Server, g *grpc.Server) error {
+	s.drain()
+	gdone := make(chan struct{})
+	go func() {
+		if g != nil {
+			stopGRPC(ctx, g)
+		}
+		close(gdone)
+	}()
+	err := srv.Shutdown(ctx)
+	<-gdone
+
+	// WebSocket connections are hijacked and gRPC is served separately, so
+	// srv doesn't wait for them.
+	done := make(chan struct{})
+	go func() {
+		s.streams.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+
+	// The pending writes are flushed even after the timeout since they are
+	// lost otherwise.
+	s.flushPending(context.Background())
+	return err
+}
+
+// drain tells the streaming requests to finish.
+func (s *server) drain() {
+	s.streamsM.Lock()
+	defer s.streamsM.Unlock()
+	if s.drained {
+		return
+	}
+	s.drained = true
+	close(s.draining)
+}
+
+// beginStream registers a hijacked connection like WebSocket, or a gRPC
+// stream, to be waited for on shutdown. beginStream returns false if the server is shutting down.
+// endStream must be called when the connection is closed.
+func (s *server) beginStream() bool {
+	s.streamsM.Lock()
+	defer s.streamsM.Unlock()
+	if s.drained {
+		return false
+	}
+	s.streams.Add(1)
+	return true
+}
+
+func (s *server) endStream() {
+	s.streams.Done()
+}
+
+// flushPending stores the posts queued in this instance, and sends the
+// pending deliveries to the integrations.
+func (s *server) flushPending(ctx context.Context) {
+	for room, messages := range s.fallback.takeAllQueued() {
+		ids, err := s.storeQueued(ctx, room, messages)
+		if err != nil {
+			s.logf(ctx, "Store error: %v: %d posts in %s are lost", err, len(messages)-len(ids), room)
+		}
+	}
+	s.flushIntegrations(ctx)
+}
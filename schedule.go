@@ -0,0 +1,285 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	scheduledMessagesKey = "scheduled"
+
+	// maxScheduledMessages is the maximum number of the messages waiting to
+	// be delivered.
+	maxScheduledMessages = 500
+
+	// maxScheduleAhead is how far in the future a message can be scheduled.
+	maxScheduleAhead = 30 * 24 * time.Hour
+
+	// scheduledMessagesInterval is the interval to deliver the scheduled
+	// messages where background goroutines are available.
+	scheduledMessagesInterval = time.Second
+)
+
+var errScheduledMessagesFull = errors.New("chatserver: too many messages are scheduled")
+
+// ScheduledMessage is a message to be posted at the time.
+type ScheduledMessage struct {
+	ID        string    `json:"id"`
+	Room      string    `json:"room"`
+	Message   Message   `json:"message"`
+	DeliverAt time.Time `json:"deliver_at"`
+}
+
+// messageScheduler wakes the server up to deliver the scheduled messages.
+type messageScheduler interface {
+	// Schedule requests /tasks/scheduled at the time.
+	Schedule(ctx context.Context, at time.Time) error
+}
+
+// scheduleMessage adds the message to the scheduled messages, and writes 202
+// Accepted with "scheduled":true. The message is checked like the other posts
+// when it is scheduled.
+func (s *server) scheduleMessage(ctx context.Context, w http.ResponseWriter, r *http.Request, room string, message Message) {
+	deliverAt := *message.DeliverAt
+	now := time.Now()
+	if !deliverAt.After(now) {
+		writeValidationError(w, r, &ValidationError{
+			Errors: []FieldError{newFieldError("deliver_at", "must be in the future")},
+		})
+		return
+	}
+	if deliverAt.Sub(now) > maxScheduleAhead {
+		writeValidationError(w, r, &ValidationError{
+			Errors: []FieldError{newFieldError("deliver_at", "must be within %d days", int(maxScheduleAhead/(24*time.Hour)))},
+		})
+		return
+	}
+
+	id, err := newID()
+	if err != nil {
+		msg := fmt.Sprintf("Schedule error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	sm := ScheduledMessage{
+		ID:        id,
+		Room:      room,
+		Message:   message,
+		DeliverAt: deliverAt,
+	}
+	var queue []ScheduledMessage
+	if err := s.db.Update(ctx, scheduledMessagesKey, &queue, 0, func() error {
+		if len(queue) >= maxScheduledMessages {
+			return errScheduledMessagesFull
+		}
+		queue = append(queue, sm)
+		return nil
+	}); err != nil {
+		if err == errScheduledMessagesFull {
+			msg := "Too many messages are scheduled"
+			writeError(w, r, http.StatusServiceUnavailable, msg)
+			return
+		}
+		msg := fmt.Sprintf("Schedule error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	// The sweep by cron delivers the message a little late if this fails.
+	if s.scheduler != nil {
+		if err := s.scheduler.Schedule(ctx, deliverAt); err != nil {
+			s.logf(ctx, "Schedule error: %v", err)
+		}
+	}
+	writeBody(w, r, http.StatusAccepted, &PostResponse{
+		Message:     message,
+		Scheduled:   true,
+		ScheduledID: id,
+	})
+}
+
+// deliverScheduledMessages posts the scheduled messages whose time has come,
+// and returns the number of the posted messages. The messages are taken from
+// the queue atomically, so each message is posted once even if some servers
+// deliver at the same time.
+func (s *server) deliverScheduledMessages(ctx context.Context) (int, error) {
+	now := time.Now()
+	var queue []ScheduledMessage
+	if err := s.db.Get(ctx, scheduledMessagesKey, &queue); err != nil {
+		if err == ErrNotFound {
+			return 0, nil
+		}
+		return 0, err
+	}
+	found := false
+	for _, sm := range queue {
+		if !sm.DeliverAt.After(now) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return 0, nil
+	}
+
+	var due []ScheduledMessage
+	if err := s.db.Update(ctx, scheduledMessagesKey, &queue, 0, func() error {
+		due = nil
+		var rest []ScheduledMessage
+		for _, sm := range queue {
+			if sm.DeliverAt.After(now) {
+				rest = append(rest, sm)
+				continue
+			}
+			due = append(due, sm)
+		}
+		queue = rest
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	sort.SliceStable(due, func(i, j int) bool {
+		return due[i].DeliverAt.Before(due[j].DeliverAt)
+	})
+
+	n := 0
+	for i, sm := range due {
+		m := sm.Message
+		m.DeliverAt = nil
+		m.CreatedAt = time.Now()
+		if err := s.storeMessage(ctx, sm.Room, &m); err != nil && err != errQueued {
+			// Put the rest back to try again.
+			if err := s.db.Update(ctx, scheduledMessagesKey, &queue, 0, func() error {
+				queue = append(queue, due[i:]...)
+				return nil
+			}); err != nil {
+				s.logf(ctx, "Schedule error: %v", err)
+			}
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// runScheduledMessages delivers the scheduled messages periodically.
+// runScheduledMessages is used where background goroutines are available.
+func (s *server) runScheduledMessages(ctx context.Context) {
+	t := time.NewTicker(scheduledMessagesInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if _, err := s.deliverScheduledMessages(ctx); err != nil {
+				s.logf(ctx, "Schedule error: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// handleDeliverScheduled handles /tasks/scheduled, which posts the scheduled
+// messages whose time has come. This is called by Task Queue at the time and
+// by cron on App Engine, and requires the admin token otherwise.
+func (s *server) handleDeliverScheduled(w http.ResponseWriter, r *http.Request) {
+	fromAppEngine := r.Header.Get("X-Appengine-Cron") == "true" || r.Header.Get("X-Appengine-Queuename") != ""
+	if !(s.cron && fromAppEngine) && !s.checkAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		methodNotAllowed(w, r)
+		return
+	}
+
+	ctx := r.Context()
+	n, err := s.deliverScheduledMessages(ctx)
+	if err != nil {
+		msg := fmt.Sprintf("Schedule error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	writeJSON(w, http.StatusOK, &DeliverResponse{Delivered: n})
+}
+
+// DeliverResponse is the result of /tasks/scheduled.
+type DeliverResponse struct {
+	// Delivered is the number of the posted messages.
+	Delivered int `json:"delivered"`
+}
+
+// handleScheduledMessages handles /admin/scheduled and
+// /admin/scheduled/{id}.
+func (s *server) handleScheduledMessages(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/scheduled"), "/")
+
+	switch {
+	case id == "" && isGet(r):
+		var queue []ScheduledMessage
+		if err := s.db.Get(ctx, scheduledMessagesKey, &queue); err != nil && err != ErrNotFound {
+			msg := fmt.Sprintf("Schedule error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		if queue == nil {
+			queue = []ScheduledMessage{}
+		}
+		sort.SliceStable(queue, func(i, j int) bool {
+			return queue[i].DeliverAt.Before(queue[j].DeliverAt)
+		})
+		writeJSON(w, http.StatusOK, queue)
+
+	case id != "" && r.Method == http.MethodDelete:
+		var queue []ScheduledMessage
+		var canceled *ScheduledMessage
+		if err := s.db.Update(ctx, scheduledMessagesKey, &queue, 0, func() error {
+			for i := range queue {
+				if queue[i].ID != id {
+					continue
+				}
+				sm := queue[i]
+				canceled = &sm
+				queue = append(queue[:i], queue[i+1:]...)
+				return nil
+			}
+			return ErrNotFound
+		}); err != nil {
+			if err == ErrNotFound {
+				notFound(w, r)
+				return
+			}
+			msg := fmt.Sprintf("Schedule error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		s.audit(ctx, r, "scheduled.delete", canceled.Room, id, canceled, nil)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		if id == "" {
+			w.Header().Set("Allow", "GET, HEAD")
+		} else {
+			w.Header().Set("Allow", "DELETE")
+		}
+		methodNotAllowed(w, r)
+	}
+}
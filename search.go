@@ -0,0 +1,251 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// defaultSearchLimit is the number of the search results in a page by
+	// default.
+	defaultSearchLimit = 20
+
+	// maxSearchTerms is the maximum number of the words in a search query.
+	maxSearchTerms = 10
+)
+
+// messageIndex is a full-text index of the messages.
+type messageIndex interface {
+	// Put adds or replaces the message in the room to the index.
+	Put(ctx context.Context, room string, message Message) error
+
+	// Delete removes the message of the ID in the room from the index.
+	Delete(ctx context.Context, room string, id int64) error
+
+	// Search returns the IDs of at most limit messages in the room that
+	// match all the terms and are posted before the message of the ID, from
+	// the latest. If before is 0, Search searches all the messages.
+	Search(ctx context.Context, room string, terms []string, before int64, limit int) ([]int64, error)
+}
+
+// SearchResult is a message matching the search query.
+type SearchResult struct {
+	Message Message `json:"message"`
+
+	// Highlight is the HTML of the body where the matching words are in
+	// <mark> elements.
+	Highlight string `json:"highlight"`
+}
+
+// SearchResponse is the JSON representation of the search results.
+type SearchResponse struct {
+	Query string `json:"query"`
+
+	// Results are in the posted order.
+	Results     []SearchResult `json:"results"`
+	Count       int            `json:"count"`
+	GeneratedAt time.Time      `json:"generated_at"`
+
+	// Next is the URL of the older results. Next is empty if there are no
+	// older results.
+	Next string `json:"next,omitempty"`
+}
+
+// searchTerms splits the query into lowercase words. Duplicated words are
+// removed.
+func searchTerms(query string) []string {
+	var terms []string
+	for _, t := range strings.Fields(strings.ToLower(query)) {
+		if !contains(terms, t) {
+			terms = append(terms, t)
+		}
+	}
+	return terms
+}
+
+// matchesTerms reports whether the body contains all the terms regardless of
+// the case.
+func matchesTerms(body string, terms []string) bool {
+	body = strings.ToLower(body)
+	for _, t := range terms {
+		if !strings.Contains(body, t) {
+			return false
+		}
+	}
+	return true
+}
+
+// highlight returns the escaped body where the terms are in <mark> elements.
+func highlight(body string, terms []string) string {
+	var buf bytes.Buffer
+	for len(body) > 0 {
+		n := 0
+		for _, t := range terms {
+			if len(t) > n && len(t) <= len(body) && strings.EqualFold(body[:len(t)], t) {
+				n = len(t)
+			}
+		}
+		if n > 0 {
+			buf.WriteString("<mark>")
+			buf.WriteString(html.EscapeString(body[:n]))
+			buf.WriteString("</mark>")
+			body = body[n:]
+			continue
+		}
+		_, size := utf8.DecodeRuneInString(body)
+		buf.WriteString(html.EscapeString(body[:size]))
+		body = body[size:]
+	}
+	return buf.String()
+}
+
+// indexMessage updates the search index for the posted, edited or deleted
+// message. Search is not essential, so errors are only logged.
+func (s *server) indexMessage(ctx context.Context, room string, message Message) {
+	if s.index == nil {
+		return
+	}
+	var err error
+	if message.Deleted {
+		err = s.index.Delete(ctx, room, message.ID)
+	} else {
+		err = s.index.Put(ctx, room, message)
+	}
+	if err != nil {
+		s.logf(ctx, "Search index error: %v", err)
+	}
+}
+
+// searchMessages returns at most limit visible messages in the room that
+// match all the terms and are posted before the message of the ID, in the
+// posted order. more is true if there might be older matching messages.
+func (s *server) searchMessages(ctx context.Context, room string, terms []string, before int64, limit int) (messages []Message, more bool, err error) {
+	if s.index != nil {
+		return s.searchIndex(ctx, room, terms, before, limit)
+	}
+
+	// Without an index, read the store from the latest.
+	var result []Message
+	for len(result) < limit {
+		page, err := s.store.History(ctx, room, before, exportPageSize)
+		if err != nil {
+			return nil, false, err
+		}
+		for i := len(page) - 1; i >= 0 && len(result) < limit; i-- {
+			m := page[i]
+			if m.Deleted || m.Hidden || m.Typing || m.expired(time.Now()) || !matchesTerms(m.Body, terms) {
+				continue
+			}
+			result = append(result, m)
+		}
+		if len(page) < exportPageSize {
+			break
+		}
+		before = page[0].ID
+	}
+	reverseMessages(result)
+	return result, len(result) == limit, nil
+}
+
+func (s *server) searchIndex(ctx context.Context, room string, terms []string, before int64, limit int) ([]Message, bool, error) {
+	ids, err := s.index.Search(ctx, room, terms, before, limit)
+	if err != nil {
+		return nil, false, err
+	}
+	var result []Message
+	for _, id := range ids {
+		m, err := s.findMessage(ctx, room, id)
+		if err != nil && err != ErrNotFound {
+			return nil, false, err
+		}
+		// Purged messages are removed from the index lazily.
+		if err == ErrNotFound || m.Deleted {
+			if err := s.index.Delete(ctx, room, id); err != nil {
+				s.logf(ctx, "Search index error: %v", err)
+			}
+			continue
+		}
+		if m.Hidden || m.expired(time.Now()) {
+			continue
+		}
+		result = append(result, m)
+	}
+	reverseMessages(result)
+	return result, len(ids) == limit, nil
+}
+
+func reverseMessages(messages []Message) {
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+}
+
+// handleSearch handles GET /search?q={query}. The results are paged with the
+// before and limit query parameters in the same way as /api/messages.
+func (s *server) handleSearch(ctx context.Context, w http.ResponseWriter, r *http.Request, room string) {
+	query := r.URL.Query().Get("q")
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		writeError(w, r, http.StatusBadRequest, "Missing q")
+		return
+	}
+	if len(terms) > maxSearchTerms {
+		msg := translate(requestLanguage(r), "Too many words in q (must be up to %d)", maxSearchTerms)
+		writeError(w, r, http.StatusBadRequest, msg)
+		return
+	}
+	before, limit, _, err := parsePage(r, defaultSearchLimit)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	messages, more, err := s.searchMessages(ctx, room, terms, before, limit)
+	if err != nil {
+		msg := fmt.Sprintf("Search error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+
+	results := make([]SearchResult, len(messages))
+	for i, m := range messages {
+		results[i] = SearchResult{
+			Message:   m,
+			Highlight: highlight(m.Body, terms),
+		}
+	}
+	next := ""
+	if more {
+		next = nextPageURL(r, messages, limit)
+	}
+	if next != "" {
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", next))
+	}
+	writeJSON(w, http.StatusOK, &SearchResponse{
+		Query:       query,
+		Results:     results,
+		Count:       len(results),
+		GeneratedAt: time.Now(),
+		Next:        next,
+	})
+}
@@ -0,0 +1,116 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine/v2/search"
+)
+
+// messageDocument is a message in the Search API index.
+type messageDocument struct {
+	Room     search.Atom
+	ID       float64
+	Body     string
+	PostedAt time.Time
+}
+
+// searchAPIIndex is a messageIndex on the App Engine Search API. Words match
+// as whole words, not as substrings.
+type searchAPIIndex struct {
+	name string
+}
+
+// documentID returns the document ID of the message. Document IDs must be
+// printable ASCII.
+func documentID(room string, id int64) string {
+	return url.QueryEscape(room) + "/" + strconv.FormatInt(id, 10)
+}
+
+// quoteSearch quotes the string in the Search API query syntax.
+func quoteSearch(str string) string {
+	str = strings.Replace(str, `\`, `\\`, -1)
+	str = strings.Replace(str, `"`, `\"`, -1)
+	return `"` + str + `"`
+}
+
+func (x searchAPIIndex) Put(ctx context.Context, room string, message Message) error {
+	idx, err := search.Open(x.name)
+	if err != nil {
+		return err
+	}
+	_, err = idx.Put(ctx, documentID(room, message.ID), &messageDocument{
+		Room:     search.Atom(room),
+		ID:       float64(message.ID),
+		Body:     message.Body,
+		PostedAt: message.CreatedAt,
+	})
+	return err
+}
+
+func (x searchAPIIndex) Delete(ctx context.Context, room string, id int64) error {
+	idx, err := search.Open(x.name)
+	if err != nil {
+		return err
+	}
+	return idx.Delete(ctx, documentID(room, id))
+}
+
+func (x searchAPIIndex) Search(ctx context.Context, room string, terms []string, before int64, limit int) ([]int64, error) {
+	idx, err := search.Open(x.name)
+	if err != nil {
+		return nil, err
+	}
+
+	query := []string{"Room:" + quoteSearch(room)}
+	if before > 0 {
+		query = append(query, "ID < "+strconv.FormatInt(before, 10))
+	}
+	for _, t := range terms {
+		query = append(query, "Body:"+quoteSearch(t))
+	}
+	it := idx.Search(ctx, strings.Join(query, " AND "), &search.SearchOptions{
+		Limit:   limit,
+		IDsOnly: true,
+		Sort: &search.SortOptions{
+			// From the latest.
+			Expressions: []search.SortExpression{
+				{Expr: "ID", Default: 0.0},
+			},
+		},
+	})
+
+	var ids []int64
+	for {
+		docID, err := it.Next(nil)
+		if err == search.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		id, err := strconv.ParseInt(docID[strings.LastIndex(docID, "/")+1:], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
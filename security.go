@@ -0,0 +1,95 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// apiCSP is the Content-Security-Policy of the responses other than the HTML
+// pages. They are never rendered as documents.
+const apiCSP = "default-src 'none'; frame-ancestors 'none'"
+
+// withSecurityHeaders returns a handler that sets the security headers to the
+// responses of h. The HTML pages override the Content-Security-Policy with
+// setPageSecurity.
+func (s *server) withSecurityHeaders(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := w.Header()
+		header.Set("X-Content-Type-Options", "nosniff")
+		if s.config.ReferrerPolicy != "" {
+			header.Set("Referrer-Policy", s.config.ReferrerPolicy)
+		}
+		header.Set("Content-Security-Policy", apiCSP)
+		header.Set("X-Frame-Options", "DENY")
+		h.ServeHTTP(w, r)
+	})
+}
+
+// setPageSecurity sets the Content-Security-Policy of an HTML page. Only the
+// inline scripts and styles with the nonce run, and the page can be embedded
+// in the origins in frame_ancestors.
+func (s *server) setPageSecurity(w http.ResponseWriter, nonce string) {
+	frameAncestors := "'none'"
+	if len(s.config.FrameAncestors) > 0 {
+		frameAncestors = strings.Join(s.config.FrameAncestors, " ")
+		// X-Frame-Options can't allow multiple origins.
+		w.Header().Del("X-Frame-Options")
+	}
+	csp := []string{
+		"default-src 'none'",
+		"script-src 'nonce-" + nonce + "'",
+		"style-src 'nonce-" + nonce + "'",
+		// Link previews show images on other sites.
+		"img-src http: https: data:",
+		"connect-src 'self' ws: wss:",
+		"base-uri 'none'",
+		"form-action 'self'",
+		"frame-ancestors " + frameAncestors,
+	}
+	w.Header().Set("Content-Security-Policy", strings.Join(csp, "; "))
+}
+
+// randomNonce returns a new CSP nonce.
+func randomNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// contentNonce returns the CSP nonce of a page rendered from the values. The
+// nonce is the same while the page is the same, so that a page revalidated
+// with 304 Not Modified keeps working with the new Content-Security-Policy.
+// The nonce can't be guessed without the session secret.
+func (s *server) contentNonce(vs ...interface{}) (string, error) {
+	h := hmac.New(sha256.New, s.sessionSecret)
+	io.WriteString(h, "nonce:")
+	e := json.NewEncoder(h)
+	for _, v := range vs {
+		if err := e.Encode(v); err != nil {
+			return "", err
+		}
+	}
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)[:16]), nil
+}
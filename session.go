@@ -0,0 +1,100 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	sessionCookieName = "session"
+	sessionMaxAge     = 365 * 24 * time.Hour
+)
+
+type sessionContextKey struct{}
+
+// sessionSecretFromEnv returns the secret to sign session cookies. The secret
+// is the SESSION_SECRET environment variable. If it is not set, a random
+// secret is used, and the sessions are valid only in this instance.
+func sessionSecretFromEnv() []byte {
+	if s := os.Getenv("SESSION_SECRET"); s != "" {
+		return []byte(s)
+	}
+	b := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func (s *server) signSession(id string) string {
+	h := hmac.New(sha256.New, s.sessionSecret)
+	io.WriteString(h, id)
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// verifySession returns the session ID in the cookie value, or false if the
+// value is not signed correctly.
+func (s *server) verifySession(value string) (string, bool) {
+	i := strings.LastIndex(value, ".")
+	if i < 0 {
+		return "", false
+	}
+	id, sig := value[:i], value[i+1:]
+	if id == "" || !hmac.Equal([]byte(sig), []byte(s.signSession(id))) {
+		return "", false
+	}
+	return id, true
+}
+
+// withSession returns a context with the session ID in the cookie. If the
+// request doesn't have a valid session cookie, a new session is started.
+func (s *server) withSession(ctx context.Context, w http.ResponseWriter, r *http.Request) (context.Context, error) {
+	if c, err := r.Cookie(sessionCookieName); err == nil {
+		if id, ok := s.verifySession(c.Value); ok {
+			return context.WithValue(ctx, sessionContextKey{}, id), nil
+		}
+	}
+
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return nil, err
+	}
+	id := base64.RawURLEncoding.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    id + "." + s.signSession(id),
+		Path:     "/",
+		MaxAge:   int(sessionMaxAge / time.Second),
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+	})
+	return context.WithValue(ctx, sessionContextKey{}, id), nil
+}
+
+// sessionID returns the session ID of the request.
+func sessionID(ctx context.Context) string {
+	id, _ := ctx.Value(sessionContextKey{}).(string)
+	return id
+}
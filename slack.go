@@ -0,0 +1,251 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sourceSlack is the source of messages posted from Slack.
+const sourceSlack = "slack"
+
+const (
+	// slackBatchInterval is the minimum interval of posts to the Slack
+	// webhook. Messages posted in between are sent together.
+	slackBatchInterval = 2 * time.Second
+
+	// slackMaxBackoff is the maximum duration to wait before retrying after
+	// failures.
+	slackMaxBackoff = time.Minute
+
+	// maxPendingSlackMessages is the maximum number of messages waiting to
+	// be sent. The oldest messages are dropped when it is exceeded.
+	maxPendingSlackMessages = 1000
+
+	slackTimeout = 5 * time.Second
+)
+
+// slackForwarder forwards posted messages to a Slack incoming webhook.
+type slackForwarder struct {
+	url    string
+	client func(ctx context.Context) *http.Client
+
+	pending   []string
+	nextFlush time.Time
+	backoff   time.Duration
+	m         sync.Mutex
+}
+
+// slackEscape escapes the characters that have special meanings in Slack.
+func slackEscape(str string) string {
+	str = strings.Replace(str, "&", "&amp;", -1)
+	str = strings.Replace(str, "<", "&lt;", -1)
+	str = strings.Replace(str, ">", "&gt;", -1)
+	return str
+}
+
+func (f *slackForwarder) enqueue(room string, message Message) {
+	line := fmt.Sprintf("*%s* [%s]: %s", slackEscape(message.Name), slackEscape(room), slackEscape(message.Body))
+	if message.Action {
+		line = fmt.Sprintf("_%s %s_ [%s]", slackEscape(message.Name), slackEscape(message.Body), slackEscape(room))
+	}
+
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.pending = append(f.pending, line)
+	if n := len(f.pending) - maxPendingSlackMessages; n > 0 {
+		f.pending = f.pending[n:]
+	}
+}
+
+// flush sends the pending messages if slackBatchInterval or the backoff has
+// passed since the last post. If sending fails, the messages are retried
+// later.
+func (f *slackForwarder) flush(ctx context.Context) error {
+	f.m.Lock()
+	if len(f.pending) == 0 || time.Now().Before(f.nextFlush) {
+		f.m.Unlock()
+		return nil
+	}
+	lines := f.pending
+	f.pending = nil
+	// Prevent other requests from flushing while sending.
+	f.nextFlush = time.Now().Add(slackTimeout)
+	f.m.Unlock()
+
+	retryAfter, err := f.post(ctx, strings.Join(lines, "\n"))
+
+	f.m.Lock()
+	defer f.m.Unlock()
+	if err != nil {
+		f.pending = append(lines, f.pending...)
+		if n := len(f.pending) - maxPendingSlackMessages; n > 0 {
+			f.pending = f.pending[n:]
+		}
+		if f.backoff == 0 {
+			f.backoff = time.Second
+		} else {
+			f.backoff *= 2
+		}
+		if f.backoff > slackMaxBackoff {
+			f.backoff = slackMaxBackoff
+		}
+		if retryAfter < f.backoff {
+			retryAfter = f.backoff
+		}
+		f.nextFlush = time.Now().Add(retryAfter)
+		return err
+	}
+	f.backoff = 0
+	f.nextFlush = time.Now().Add(slackBatchInterval)
+	return nil
+}
+
+// post posts the text to the webhook. If Slack asks to wait, post returns the
+// duration to wait with the error.
+func (f *slackForwarder) post(ctx context.Context, text string) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, slackTimeout)
+	defer cancel()
+
+	b, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest(http.MethodPost, f.url, bytes.NewReader(b))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := f.client(ctx).Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		var retryAfter time.Duration
+		if sec, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil {
+			retryAfter = time.Duration(sec) * time.Second
+		}
+		return retryAfter, fmt.Errorf("chatserver: Slack webhook failed with status %d: %s", res.StatusCode, body)
+	}
+	return 0, nil
+}
+
+// slackLink matches links like <https://example.com|text> and user mentions
+// like <@U012AB3CD> in Slack messages.
+var slackLink = regexp.MustCompile(`<([^<>|]+)(\|[^<>]*)?>`)
+
+// slackToPlain converts a Slack message to a plain text.
+func slackToPlain(text string) string {
+	text = slackLink.ReplaceAllString(text, "$1")
+	return html.UnescapeString(text)
+}
+
+// postFromSlack handles /integrations/slack, which receives messages from a
+// Slack outgoing webhook, and posts them to the room.
+func (s *server) postFromSlack(ctx context.Context, w http.ResponseWriter, r *http.Request, room string) {
+	if s.slackToken == "" {
+		notFound(w, r)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, int64(s.config.MaxContentSize))
+	if err := r.ParseForm(); err != nil {
+		if err.Error() == errBodyTooLarge {
+			code := http.StatusRequestEntityTooLarge
+			writeError(w, r, code, http.StatusText(code))
+			return
+		}
+		msg := fmt.Sprintf("Parse form error: %v", err)
+		writeError(w, r, http.StatusBadRequest, msg)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.PostForm.Get("token")), []byte(s.slackToken)) != 1 {
+		code := http.StatusForbidden
+		writeError(w, r, code, http.StatusText(code))
+		return
+	}
+
+	// Ignore messages from bots including the messages forwarded from this
+	// server.
+	if r.PostForm.Get("bot_id") != "" || r.PostForm.Get("user_name") == "slackbot" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if !s.checkRoomOpen(ctx, w, r, room) {
+		return
+	}
+
+	message := Message{
+		Name:   r.PostForm.Get("user_name"),
+		Body:   slackToPlain(r.PostForm.Get("text")),
+		Source: sourceSlack,
+	}
+	if err := message.Validate(&s.config); err != nil {
+		writeValidationError(w, r, err)
+		return
+	}
+
+	banned, err := s.isBanned(ctx, &poster{name: message.Name})
+	if err != nil {
+		msg := fmt.Sprintf("Ban error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	if banned {
+		msg := "You are banned from posting"
+		writeErrorCode(w, r, http.StatusForbidden, "banned", msg)
+		return
+	}
+
+	filter, err := s.wordFilter(ctx)
+	if err != nil {
+		msg := fmt.Sprintf("Word filter error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	if !filter.apply(&message) {
+		writeValidationError(w, r, &ValidationError{
+			Errors: []FieldError{{Field: "body", Message: "must not contain banned words"}},
+		})
+		return
+	}
+	message.Mentions = parseMentions(message.Body)
+	message.Preview = s.linkPreview(ctx, message.Body)
+	message.CreatedAt = time.Now()
+
+	if err := s.storeMessage(ctx, room, &message); err != nil && err != errQueued {
+		msg := fmt.Sprintf("Store error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,350 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	spamScoresKey = "spam:scores"
+
+	// spamHistoryTTL is how long the posts of a session are remembered to
+	// score the next posts.
+	spamHistoryTTL = 10 * time.Minute
+
+	// maxSpamHistory is the maximum number of the remembered posts of a
+	// session.
+	maxSpamHistory = 50
+
+	// maxSpamScores is the number of the latest scored posts kept for admins.
+	maxSpamScores = 200
+
+	// shadowBanTTL is how long a shadow-banned session's posts are dropped.
+	shadowBanTTL = 24 * time.Hour
+)
+
+// spamPost is a post to score with the recent posts of the poster.
+type spamPost struct {
+	room string
+	name string
+	body string
+	now  time.Time
+
+	// history is the recent posts of the session in the posted order.
+	history []spamRecord
+}
+
+// spamRecord is a post remembered to score the next posts of the session.
+type spamRecord struct {
+	Hash string    `json:"hash"`
+	Time time.Time `json:"time"`
+}
+
+// spamScorer scores a post. A post is more suspicious with a higher score,
+// and the scores of the scorers are added up. reason explains a positive
+// score to admins.
+type spamScorer interface {
+	score(p *spamPost) (score float64, reason string)
+}
+
+// defaultSpamScorers is the scorers used by the server.
+var defaultSpamScorers = []spamScorer{
+	duplicateScorer{},
+	linkScorer{},
+	velocityScorer{},
+}
+
+// spamHash returns the hash of the body to detect duplicates. Spaces and cases
+// are ignored.
+func spamHash(body string) string {
+	b := strings.ToLower(strings.Join(strings.Fields(body), " "))
+	h := sha256.Sum256([]byte(b))
+	return hex.EncodeToString(h[:8])
+}
+
+// duplicateScorer scores a post with the same body as the recent posts.
+type duplicateScorer struct{}
+
+func (duplicateScorer) score(p *spamPost) (float64, string) {
+	hash := spamHash(p.body)
+	n := 0
+	for _, r := range p.history {
+		if r.Hash == hash {
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, ""
+	}
+	return 0.6 * float64(n), fmt.Sprintf("duplicate of %d recent posts", n)
+}
+
+// linkScorer scores a post with many links. One link is usual.
+type linkScorer struct{}
+
+func countURLs(body string) int {
+	n := 0
+	for i := 0; i < len(body); {
+		j := strings.Index(body[i:], "http")
+		if j < 0 {
+			break
+		}
+		i += j
+		if l := bareURLLen(body[i:]); l > 0 {
+			n++
+			i += l
+			continue
+		}
+		i++
+	}
+	return n
+}
+
+func (linkScorer) score(p *spamPost) (float64, string) {
+	n := countURLs(p.body)
+	if n <= 1 {
+		return 0, ""
+	}
+	return 0.4 * float64(n-1), fmt.Sprintf("%d links", n)
+}
+
+// velocityScorer scores a post from a session posting fast. The rate limit
+// stops bursts, and this catches steady flooding.
+type velocityScorer struct{}
+
+func (velocityScorer) score(p *spamPost) (float64, string) {
+	const (
+		window  = time.Minute
+		allowed = 5
+	)
+	n := 0
+	for _, r := range p.history {
+		if p.now.Sub(r.Time) < window {
+			n++
+		}
+	}
+	if n < allowed {
+		return 0, ""
+	}
+	return 0.3 * float64(n-allowed+1), fmt.Sprintf("%d posts in a minute", n+1)
+}
+
+// SpamScore is the score of a suspicious post shown to admins.
+type SpamScore struct {
+	Time      time.Time `json:"time"`
+	Room      string    `json:"room"`
+	SessionID string    `json:"session_id"`
+	IP        string    `json:"ip"`
+	Name      string    `json:"name"`
+	Body      string    `json:"body"`
+	Score     float64   `json:"score"`
+	Reasons   []string  `json:"reasons"`
+
+	// Action is "throttle" or "shadow_ban" if the post is stopped.
+	Action string `json:"action,omitempty"`
+}
+
+func spamHistoryKey(sessionID string) string {
+	return "spam:history:" + sessionID
+}
+
+func shadowBanKey(sessionID string) string {
+	return "spam:shadowban:" + sessionID
+}
+
+// isShadowBanned reports whether the session is shadow-banned.
+func (s *server) isShadowBanned(ctx context.Context, sessionID string) (bool, error) {
+	var until time.Time
+	if err := s.db.Get(ctx, shadowBanKey(sessionID), &until); err != nil {
+		if err == ErrNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return time.Now().Before(until), nil
+}
+
+// scoreSpam scores the post and remembers it for the next posts of the
+// session.
+func (s *server) scoreSpam(ctx context.Context, room string, message *Message) (float64, []string) {
+	p := spamPost{
+		room: room,
+		name: message.Name,
+		body: message.Body,
+		now:  time.Now(),
+	}
+	var history []spamRecord
+	if err := s.cache.Update(ctx, spamHistoryKey(message.SessionID), &history, spamHistoryTTL, func() error {
+		p.history = append([]spamRecord(nil), history...)
+		history = append(history, spamRecord{Hash: spamHash(message.Body), Time: p.now})
+		if len(history) > maxSpamHistory {
+			history = history[len(history)-maxSpamHistory:]
+		}
+		return nil
+	}); err != nil {
+		// Spam detection is not essential, and the post is scored without
+		// the history.
+		s.logf(ctx, "Spam error: %v", err)
+	}
+
+	var total float64
+	var reasons []string
+	for _, sc := range s.spamScorers {
+		score, reason := sc.score(&p)
+		if score <= 0 {
+			continue
+		}
+		total += score
+		reasons = append(reasons, reason)
+	}
+	return total, reasons
+}
+
+// recordSpamScore keeps the score of the post for admins.
+func (s *server) recordSpamScore(ctx context.Context, score SpamScore) {
+	var scores []SpamScore
+	if err := s.db.Update(ctx, spamScoresKey, &scores, 0, func() error {
+		scores = append(scores, score)
+		if len(scores) > maxSpamScores {
+			scores = scores[len(scores)-maxSpamScores:]
+		}
+		return nil
+	}); err != nil {
+		s.logf(ctx, "Spam error: %v", err)
+	}
+}
+
+// checkSpam reports whether the post can be stored. A post scoring
+// spam_throttle_score or more is rejected with 429 Too Many Requests, and
+// spam_shadow_ban_score or more shadow-bans the session. The posts of a
+// shadow-banned session look accepted to the poster but are dropped. If the
+// post can't be stored, checkSpam writes the response.
+func (s *server) checkSpam(ctx context.Context, w http.ResponseWriter, r *http.Request, room string, message *Message) bool {
+	if s.config.SpamThrottleScore <= 0 && s.config.SpamShadowBanScore <= 0 {
+		return true
+	}
+	banned, err := s.isShadowBanned(ctx, message.SessionID)
+	if err != nil {
+		msg := fmt.Sprintf("Spam error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return false
+	}
+	if banned {
+		writeShadowBanned(w, r, message)
+		return false
+	}
+
+	score, reasons := s.scoreSpam(ctx, room, message)
+	if score <= 0 {
+		return true
+	}
+	sc := SpamScore{
+		Time:      time.Now(),
+		Room:      room,
+		SessionID: message.SessionID,
+		IP:        clientIP(r),
+		Name:      message.Name,
+		Body:      message.Body,
+		Score:     score,
+		Reasons:   reasons,
+	}
+	switch {
+	case s.config.SpamShadowBanScore > 0 && score >= s.config.SpamShadowBanScore:
+		sc.Action = "shadow_ban"
+	case s.config.SpamThrottleScore > 0 && score >= s.config.SpamThrottleScore:
+		sc.Action = "throttle"
+	}
+	s.recordSpamScore(ctx, sc)
+
+	switch sc.Action {
+	case "shadow_ban":
+		if err := s.db.Set(ctx, shadowBanKey(message.SessionID), sc.Time.Add(shadowBanTTL), shadowBanTTL); err != nil {
+			s.logf(ctx, "Spam error: %v", err)
+		}
+		writeShadowBanned(w, r, message)
+		return false
+	case "throttle":
+		writeTooManyRequests(w, r, time.Minute)
+		return false
+	}
+	return true
+}
+
+// writeShadowBanned writes the same response as a post queued to be stored,
+// so that the poster doesn't notice the ban.
+func writeShadowBanned(w http.ResponseWriter, r *http.Request, message *Message) {
+	m := *message
+	m.CreatedAt = time.Now()
+	writeBody(w, r, http.StatusAccepted, &PostResponse{
+		Message: m,
+		Queued:  true,
+	})
+}
+
+// handleSpam handles GET /admin/spam, the latest scored posts, and
+// DELETE /admin/spam/{session}, which lifts the shadow ban of the session.
+func (s *server) handleSpam(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	sid := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/spam"), "/")
+
+	switch {
+	case sid == "" && isGet(r):
+		var scores []SpamScore
+		if err := s.db.Get(ctx, spamScoresKey, &scores); err != nil && err != ErrNotFound {
+			msg := fmt.Sprintf("Spam error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		// The newest scores come first.
+		result := make([]SpamScore, 0, len(scores))
+		for i := len(scores) - 1; i >= 0; i-- {
+			result = append(result, scores[i])
+		}
+		writeJSON(w, http.StatusOK, result)
+
+	case sid != "" && r.Method == http.MethodDelete:
+		banned, err := s.isShadowBanned(ctx, sid)
+		if err != nil {
+			msg := fmt.Sprintf("Spam error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		if !banned {
+			notFound(w, r)
+			return
+		}
+		if err := s.db.Delete(ctx, shadowBanKey(sid)); err != nil {
+			msg := fmt.Sprintf("Spam error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		s.audit(ctx, r, "shadowban.delete", "", sid, nil, nil)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		if sid == "" {
+			w.Header().Set("Allow", "GET, HEAD")
+		} else {
+			w.Header().Set("Allow", "DELETE")
+		}
+		methodNotAllowed(w, r)
+	}
+}
@@ -0,0 +1,397 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+)
+
+// sqlDialect is the differences of the SQL databases.
+type sqlDialect struct {
+	// migrations is the schema. The migrations are applied in order, and the
+	// applied ones are recorded in schema_migrations. Add new migrations to
+	// the end, and never change the applied ones.
+	migrations []string
+
+	// forUpdate is the clause to lock the selected rows in a transaction.
+	// This is empty if transactions lock the whole database.
+	forUpdate string
+}
+
+// migrate applies the migrations that are not applied yet.
+func migrate(ctx context.Context, db *sql.DB, migrations []string) error {
+	if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return err
+	}
+	for i, m := range migrations {
+		if err := runInTx(ctx, db, func(tx *sql.Tx) error {
+			var n int
+			if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM schema_migrations WHERE version = $1`, i+1).Scan(&n); err != nil {
+				return err
+			}
+			if n > 0 {
+				return nil
+			}
+			if _, err := tx.ExecContext(ctx, m); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, i+1)
+			return err
+		}); err != nil {
+			return fmt.Errorf("chatserver: migration %d failed: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+// runInTx calls f in a transaction, and commits it if f succeeds.
+func runInTx(ctx context.Context, db *sql.DB, f func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// sqlStore is a Store on an SQL database. The messages are the rows of the
+// messages table, keyed by the room and the ID, and the last ID of each room
+// is in the rooms table. The whole history is kept until it is purged.
+type sqlStore struct {
+	db *sql.DB
+
+	nextIDs    *sql.Stmt
+	insert     *sql.Stmt
+	selectAll  *sql.Stmt
+	selectPage *sql.Stmt
+	selectOne  *sql.Stmt
+	update     *sql.Stmt
+	purge      *sql.Stmt
+	remove     *sql.Stmt
+}
+
+// newSQLStore returns a Store on db. The schema is migrated to the latest one.
+func newSQLStore(db *sql.DB, d *sqlDialect) (Store, error) {
+	ctx := context.Background()
+	if err := migrate(ctx, db, d.migrations); err != nil {
+		return nil, err
+	}
+	s := &sqlStore{db: db}
+	for _, q := range []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&s.nextIDs, `INSERT INTO rooms (room, last_id) VALUES ($1, $2)
+			ON CONFLICT (room) DO UPDATE SET last_id = rooms.last_id + EXCLUDED.last_id
+			RETURNING last_id`},
+		{&s.insert, `INSERT INTO messages (room, id, created_at, data) VALUES ($1, $2, $3, $4)`},
+		{&s.selectAll, `SELECT data FROM messages WHERE room = $1 ORDER BY id`},
+		{&s.selectPage, `SELECT data FROM messages WHERE room = $1 AND id < $2 ORDER BY id DESC LIMIT $3`},
+		{&s.selectOne, `SELECT data FROM messages WHERE room = $1 AND id = $2` + d.forUpdate},
+		{&s.update, `UPDATE messages SET data = $3 WHERE room = $1 AND id = $2`},
+		{&s.purge, `DELETE FROM messages WHERE room = $1 AND created_at < $2`},
+		{&s.remove, `DELETE FROM messages WHERE room = $1 AND id = $2`},
+	} {
+		stmt, err := db.PrepareContext(ctx, q.query)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		*q.stmt = stmt
+	}
+	return s, nil
+}
+
+// Close closes the prepared statements.
+func (s *sqlStore) Close() error {
+	for _, stmt := range []*sql.Stmt{s.nextIDs, s.insert, s.selectAll, s.selectPage, s.selectOne, s.update, s.purge, s.remove} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+	return nil
+}
+
+// scanMessages returns the messages in the rows in the same order.
+func scanMessages(rows *sql.Rows) ([]Message, error) {
+	defer rows.Close()
+	var messages []Message
+	for rows.Next() {
+		var b []byte
+		if err := rows.Scan(&b); err != nil {
+			return nil, err
+		}
+		var m Message
+		if err := json.Unmarshal(b, &m); err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+func (s *sqlStore) Get(ctx context.Context, room string) ([]Message, error) {
+	rows, err := s.selectAll.QueryContext(ctx, room)
+	if err != nil {
+		return nil, err
+	}
+	return scanMessages(rows)
+}
+
+func (s *sqlStore) Append(ctx context.Context, room string, message Message) (int64, error) {
+	ids, err := s.AppendMulti(ctx, room, []Message{message})
+	if err != nil {
+		return 0, err
+	}
+	return ids[0], nil
+}
+
+func (s *sqlStore) AppendMulti(ctx context.Context, room string, messages []Message) ([]int64, error) {
+	var ids []int64
+	if err := runInTx(ctx, s.db, func(tx *sql.Tx) error {
+		var last int64
+		if err := tx.StmtContext(ctx, s.nextIDs).QueryRowContext(ctx, room, len(messages)).Scan(&last); err != nil {
+			return err
+		}
+		insert := tx.StmtContext(ctx, s.insert)
+		ids = make([]int64, len(messages))
+		for i, m := range messages {
+			m.ID = last - int64(len(messages)-i-1)
+			b, err := json.Marshal(&m)
+			if err != nil {
+				return err
+			}
+			if _, err := insert.ExecContext(ctx, room, m.ID, m.CreatedAt.UTC(), b); err != nil {
+				return err
+			}
+			ids[i] = m.ID
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// Trim does nothing. The database keeps the whole history for paging, search
+// and export, and old messages are removed by Purge and Remove.
+func (s *sqlStore) Trim(ctx context.Context, room string, n int) error {
+	return nil
+}
+
+func (s *sqlStore) History(ctx context.Context, room string, before int64, limit int) ([]Message, error) {
+	if before <= 0 {
+		before = math.MaxInt64
+	}
+	rows, err := s.selectPage.QueryContext(ctx, room, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+func (s *sqlStore) Purge(ctx context.Context, room string, before time.Time) (int, error) {
+	r, err := s.purge.ExecContext(ctx, room, before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	n, err := r.RowsAffected()
+	return int(n), err
+}
+
+func (s *sqlStore) Remove(ctx context.Context, room string, ids []int64) (int, error) {
+	n := 0
+	if err := runInTx(ctx, s.db, func(tx *sql.Tx) error {
+		n = 0
+		remove := tx.StmtContext(ctx, s.remove)
+		for _, id := range ids {
+			r, err := remove.ExecContext(ctx, room, id)
+			if err != nil {
+				return err
+			}
+			c, err := r.RowsAffected()
+			if err != nil {
+				return err
+			}
+			n += int(c)
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (s *sqlStore) Update(ctx context.Context, room string, id int64, f func(*Message)) (Message, error) {
+	var m Message
+	if err := runInTx(ctx, s.db, func(tx *sql.Tx) error {
+		var b []byte
+		if err := tx.StmtContext(ctx, s.selectOne).QueryRowContext(ctx, room, id).Scan(&b); err != nil {
+			if err == sql.ErrNoRows {
+				return ErrNotFound
+			}
+			return err
+		}
+		m = Message{}
+		if err := json.Unmarshal(b, &m); err != nil {
+			return err
+		}
+		f(&m)
+		b, err := json.Marshal(&m)
+		if err != nil {
+			return err
+		}
+		_, err = tx.StmtContext(ctx, s.update).ExecContext(ctx, room, id, b)
+		return err
+	}); err != nil {
+		return Message{}, err
+	}
+	return m, nil
+}
+
+// sqlKV is a KV on an SQL database. Values are stored as JSON in the kv
+// table. The expired values are ignored on read, and replaced on write.
+type sqlKV struct {
+	db *sql.DB
+
+	get     *sql.Stmt
+	lock    *sql.Stmt
+	reserve *sql.Stmt
+	set     *sql.Stmt
+	delete  *sql.Stmt
+}
+
+// newSQLKV returns a KV on db. The schema is migrated to the latest one.
+func newSQLKV(db *sql.DB, d *sqlDialect) (KV, error) {
+	ctx := context.Background()
+	if err := migrate(ctx, db, d.migrations); err != nil {
+		return nil, err
+	}
+	kv := &sqlKV{db: db}
+	for _, q := range []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&kv.get, `SELECT data, expires_at FROM kv WHERE key = $1 AND data IS NOT NULL`},
+		{&kv.lock, `SELECT data, expires_at FROM kv WHERE key = $1` + d.forUpdate},
+		// A row without data is inserted so that the key can be locked
+		// even if it doesn't exist.
+		{&kv.reserve, `INSERT INTO kv (key) VALUES ($1) ON CONFLICT (key) DO NOTHING`},
+		{&kv.set, `INSERT INTO kv (key, data, expires_at) VALUES ($1, $2, $3)
+			ON CONFLICT (key) DO UPDATE SET data = EXCLUDED.data, expires_at = EXCLUDED.expires_at`},
+		{&kv.delete, `DELETE FROM kv WHERE key = $1`},
+	} {
+		stmt, err := db.PrepareContext(ctx, q.query)
+		if err != nil {
+			kv.Close()
+			return nil, err
+		}
+		*q.stmt = stmt
+	}
+	return kv, nil
+}
+
+// Close closes the prepared statements.
+func (kv *sqlKV) Close() error {
+	for _, stmt := range []*sql.Stmt{kv.get, kv.lock, kv.reserve, kv.set, kv.delete} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+	return nil
+}
+
+// load loads the value of the row into v.
+func (kv *sqlKV) load(row *sql.Row, v interface{}) error {
+	var b []byte
+	var expires *time.Time
+	if err := row.Scan(&b, &expires); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrNotFound
+		}
+		return err
+	}
+	if b == nil || expires != nil && !time.Now().Before(*expires) {
+		return ErrNotFound
+	}
+	return json.Unmarshal(b, v)
+}
+
+// setArgs returns the arguments of the set statement for the value.
+func (kv *sqlKV) setArgs(key string, v interface{}, expiration time.Duration) ([]interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var expires interface{}
+	if expiration > 0 {
+		expires = time.Now().Add(expiration).UTC()
+	}
+	return []interface{}{key, b, expires}, nil
+}
+
+func (kv *sqlKV) Get(ctx context.Context, key string, v interface{}) error {
+	return kv.load(kv.get.QueryRowContext(ctx, key), v)
+}
+
+func (kv *sqlKV) Set(ctx context.Context, key string, v interface{}, expiration time.Duration) error {
+	args, err := kv.setArgs(key, v, expiration)
+	if err != nil {
+		return err
+	}
+	_, err = kv.set.ExecContext(ctx, args...)
+	return err
+}
+
+func (kv *sqlKV) Update(ctx context.Context, key string, v interface{}, expiration time.Duration, f func() error) error {
+	return runInTx(ctx, kv.db, func(tx *sql.Tx) error {
+		if _, err := tx.StmtContext(ctx, kv.reserve).ExecContext(ctx, key); err != nil {
+			return err
+		}
+		resetValue(v)
+		if err := kv.load(tx.StmtContext(ctx, kv.lock).QueryRowContext(ctx, key), v); err != nil && err != ErrNotFound {
+			return err
+		}
+		if err := f(); err != nil {
+			return err
+		}
+		args, err := kv.setArgs(key, v, expiration)
+		if err != nil {
+			return err
+		}
+		_, err = tx.StmtContext(ctx, kv.set).ExecContext(ctx, args...)
+		return err
+	})
+}
+
+func (kv *sqlKV) Delete(ctx context.Context, key string) error {
+	_, err := kv.delete.ExecContext(ctx, key)
+	return err
+}
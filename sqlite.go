@@ -0,0 +1,57 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"database/sql"
+)
+
+// sqlite is the dialect of SQLite. A transaction locks the whole database
+// when it writes, so the rows are not locked by the queries.
+var sqlite = &sqlDialect{
+	migrations: []string{
+		`CREATE TABLE rooms (
+			room TEXT PRIMARY KEY,
+			last_id INTEGER NOT NULL
+		)`,
+		`CREATE TABLE messages (
+			room TEXT NOT NULL,
+			id INTEGER NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			data BLOB NOT NULL,
+			PRIMARY KEY (room, id)
+		)`,
+		`CREATE INDEX messages_room_created_at ON messages (room, created_at)`,
+		`CREATE TABLE kv (
+			key TEXT PRIMARY KEY,
+			data BLOB,
+			expires_at TIMESTAMP
+		)`,
+	},
+}
+
+// NewSQLiteStore returns a Store that keeps messages in SQLite, for local
+// development without any servers. The schema is migrated to the latest one.
+// Limit db to one connection with SetMaxOpenConns(1) so that the
+// transactions don't fail with SQLITE_BUSY.
+func NewSQLiteStore(db *sql.DB) (Store, error) {
+	return newSQLStore(db, sqlite)
+}
+
+// NewSQLiteKV returns a KV that keeps values in SQLite. The schema is migrated
+// to the latest one.
+func NewSQLiteKV(db *sql.DB) (KV, error) {
+	return newSQLKV(db, sqlite)
+}
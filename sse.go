@@ -0,0 +1,71 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// sseHeartbeatInterval is the interval of comments sent to keep proxies from
+// closing idle connections.
+const sseHeartbeatInterval = 30 * time.Second
+
+func (s *server) streamMessages(w http.ResponseWriter, r *http.Request, room string) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		msg := "Streaming is not supported"
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+
+	ch := s.hub.subscribe(room)
+	defer s.hub.unsubscribe(room, ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+
+	t := time.NewTicker(sseHeartbeatInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case m := <-ch:
+			b, err := json.Marshal(m)
+			if err != nil {
+				return
+			}
+			event := "message"
+			if m.Typing {
+				event = "typing"
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b)
+			f.Flush()
+		case <-t.C:
+			io.WriteString(w, ": heartbeat\n\n")
+			f.Flush()
+		case <-r.Context().Done():
+			return
+		case <-s.draining:
+			// The client reconnects to another instance.
+			return
+		}
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:generate go run genstatic.go
+
+package chatserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// staticHashedMaxAge is how long the static files at the hashed paths can be
+// cached. The files at the paths never change since the path changes with
+// the content.
+const staticHashedMaxAge = 365 * 24 * time.Hour
+
+// staticFile is a file served under /static/.
+type staticFile struct {
+	name string
+	body string
+
+	// hash is the hash of the body in the path of the file.
+	hash string
+}
+
+// path returns the path of the file with the hash, like
+// /static/messages.0123456789abcdef.css.
+func (f *staticFile) path() string {
+	ext := path.Ext(f.name)
+	return "/static/" + strings.TrimSuffix(f.name, ext) + "." + f.hash + ext
+}
+
+var (
+	// staticFilesByName is the static files by the names in the static
+	// directory.
+	staticFilesByName = map[string]*staticFile{}
+
+	// staticFilesByPath is the static files by the hashed paths.
+	staticFilesByPath = map[string]*staticFile{}
+)
+
+func init() {
+	for name, body := range staticFiles {
+		h := sha256.Sum256([]byte(body))
+		f := &staticFile{
+			name: name,
+			body: body,
+			hash: hex.EncodeToString(h[:8]),
+		}
+		staticFilesByName[name] = f
+		staticFilesByPath[f.path()] = f
+	}
+}
+
+// staticPath returns the hashed path of the static file for the templates.
+func staticPath(name string) (string, error) {
+	f, ok := staticFilesByName[name]
+	if !ok {
+		return "", fmt.Errorf("chatserver: static file not found: %q", name)
+	}
+	return f.path(), nil
+}
+
+// handleStatic handles GET /static/{name}. The files at the hashed paths are
+// cached for a year, and the files at the plain names like
+// /static/messages.css are cached for static_max_age.
+func (s *server) handleStatic(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		methodNotAllowed(w, r)
+		return
+	}
+	if f, ok := staticFilesByPath[r.URL.Path]; ok {
+		s.serveStatic(w, r, f, staticHashedMaxAge)
+		return
+	}
+	if f, ok := staticFilesByName[strings.TrimPrefix(r.URL.Path, "/static/")]; ok {
+		s.serveStatic(w, r, f, s.config.StaticMaxAge)
+		return
+	}
+	notFound(w, r)
+}
+
+// handleFavicon handles GET /favicon.ico, which browsers fetch without a link
+// in the page.
+func (s *server) handleFavicon(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		methodNotAllowed(w, r)
+		return
+	}
+	s.serveStatic(w, r, staticFilesByName["favicon.png"], s.config.StaticMaxAge)
+}
+
+func (s *server) serveStatic(w http.ResponseWriter, r *http.Request, f *staticFile, maxAge time.Duration) {
+	cacheImmutable(w, maxAge)
+	w.Header().Set("ETag", `"`+f.hash+`"`)
+	if t := mime.TypeByExtension(path.Ext(f.name)); t != "" {
+		w.Header().Set("Content-Type", t)
+	}
+	http.ServeContent(w, r, f.name, time.Time{}, strings.NewReader(f.body))
+}
@@ -0,0 +1,51 @@
+(() => {
+  // The values from the server are in the data attributes of the script.
+  let config = document.currentScript.dataset;
+  window.addEventListener('load', () => {
+    let csrfToken = document.querySelector('meta[name="csrf-token"]').content;
+    let error = document.getElementById('error');
+    let busy = false;
+
+    // The quick actions call the admin API with the Basic credentials of the
+    // page, which also need the CSRF token.
+    document.addEventListener('click', e => {
+      let button = e.target.closest('button.action');
+      if (!button) {
+        return;
+      }
+      let room = button.dataset.confirm;
+      if (room && !confirm(config.confirmClear.replace('%s', room))) {
+        return;
+      }
+      busy = true;
+      button.disabled = true;
+      fetch(button.dataset.path, {
+        method:      button.dataset.method,
+        credentials: 'same-origin',
+        headers:     {'X-CSRF-Token': csrfToken},
+      }).then(r => {
+        if (r.ok) {
+          location.reload();
+          return;
+        }
+        return r.json().then(json => {
+          throw new Error(json.error.message);
+        });
+      }).catch(e => {
+        error.textContent = e.message;
+        button.disabled = false;
+        busy = false;
+      });
+    });
+
+    // Reload the page to keep the stats live.
+    let interval = Number(config.reloadInterval);
+    if (interval > 0) {
+      setInterval(() => {
+        if (!busy) {
+          location.reload();
+        }
+      }, interval);
+    }
+  });
+})();
@@ -0,0 +1,59 @@
+window.addEventListener('load', _ => {
+  let csrfToken = document.querySelector('meta[name="csrf-token"]').content;
+  let emojis = {};
+  fetch('/emoji').then(response => response.json()).then(json => {
+    emojis = json;
+  });
+  let bodyInput = document.getElementById('body');
+  let suggestions = document.getElementById('emoji-suggestions');
+  let lastTyping = 0;
+  bodyInput.addEventListener('input', _ => {
+    if (Date.now() - lastTyping >= 3000) {
+      lastTyping = Date.now();
+      let room = document.getElementById('room').value;
+      let path = room ? '/rooms/' + encodeURIComponent(room) + '/typing' : '/typing';
+      fetch(path, {
+        method:  'POST',
+        headers: {'X-CSRF-Token': csrfToken},
+        body:    JSON.stringify({'name': document.getElementById('name').value}),
+      });
+    }
+    suggestions.textContent = '';
+    let m = bodyInput.value.match(/:([a-z0-9_+-]+)$/);
+    if (!m) {
+      return;
+    }
+    for (let name of Object.keys(emojis).sort()) {
+      if (!name.startsWith(m[1])) {
+        continue;
+      }
+      let button = document.createElement('button');
+      button.textContent = emojis[name] + ' :' + name + ':';
+      button.addEventListener('click', _ => {
+        bodyInput.value = bodyInput.value.slice(0, -m[0].length) + ':' + name + ': ';
+        suggestions.textContent = '';
+        bodyInput.focus();
+      });
+      suggestions.appendChild(button);
+    }
+  });
+  document.getElementById('submit-button').addEventListener('click', _ => {
+    let room = document.getElementById('room').value;
+    let name = document.getElementById('name').value;
+    let body = document.getElementById('body').value;
+    let path = room ? '/rooms/' + encodeURIComponent(room) + '/messages' : '/messages';
+    let uploads = Array.from(document.getElementById('images').files).map(f => fetch('/attachments', {
+      method:  'POST',
+      headers: {'X-CSRF-Token': csrfToken},
+      body:    f,
+    }).then(response => response.json()));
+    Promise.all(uploads).then(attachments => fetch(path, {
+      method:  'POST',
+      headers: {'X-CSRF-Token': csrfToken},
+      body:    JSON.stringify({'name': name, 'body': body, 'attachments': attachments.map(a => ({'id': a.id}))}),
+    })).then(response => {
+      console.log('status:', response.status);
+      return response.text();
+    });
+  });
+});
@@ -0,0 +1,183 @@
+(() => {
+  // The values from the server are in the data attributes of the script.
+  let config = document.currentScript.dataset;
+  window.addEventListener('load', () => {
+    let csrfToken = document.querySelector('meta[name="csrf-token"]').content;
+    let resize = () => {
+      parent.postMessage({'type': 'chatserver:resize', 'height': document.documentElement.scrollHeight}, '*');
+    };
+    let scrollToBottom = () => {
+      window.scrollTo(0, document.documentElement.scrollHeight);
+    };
+    for (let time of document.querySelectorAll('time')) {
+      time.textContent = new Date(time.dateTime).toLocaleTimeString();
+    }
+    if (window.ResizeObserver) {
+      new ResizeObserver(resize).observe(document.body);
+    }
+    resize();
+    scrollToBottom();
+    // Count down to the opening of the room, and reload the page when it
+    // opens. The remaining time is from the server since the clocks can
+    // differ.
+    let countdown = document.getElementById('countdown');
+    if (countdown) {
+      let opensAt = Date.now() + Number(countdown.dataset.opensIn) * 1000;
+      let pad = n => (n < 10 ? '0' : '') + n;
+      let update = () => {
+        let sec = Math.ceil((opensAt - Date.now()) / 1000);
+        if (sec <= 0) {
+          location.reload();
+          return;
+        }
+        let h = Math.floor(sec / 3600);
+        let m = Math.floor(sec / 60) % 60;
+        countdown.textContent = countdown.dataset.format.replace('%s', h + ':' + pad(m) + ':' + pad(sec % 60));
+        setTimeout(update, 1000);
+      };
+      update();
+    }
+
+    let nameInput = document.getElementById('name');
+    let bodyInput = document.getElementById('body');
+    let error = document.getElementById('error');
+    try {
+      nameInput.value = localStorage.getItem('chatserver:name') || '';
+    } catch (e) {
+      // Storage might be unavailable in third-party frames.
+    }
+    let solveCaptcha = () => fetch(config.captchaPath, {
+      credentials: 'same-origin',
+    }).then(r => r.json()).then(c => {
+      let answer = prompt(config.captchaPrompt.replace('%s', c.question));
+      return fetch(config.captchaPath, {
+        method:      'POST',
+        credentials: 'same-origin',
+        headers:     {'Content-Type': 'application/json', 'X-CSRF-Token': csrfToken},
+        body:        JSON.stringify({'id': c.id, 'answer': Number(answer)}),
+      });
+    });
+    document.getElementById('post').addEventListener('submit', e => {
+      e.preventDefault();
+      try {
+        localStorage.setItem('chatserver:name', nameInput.value);
+      } catch (e) {
+      }
+      let post = () => fetch(config.postPath, {
+        method:      'POST',
+        credentials: 'same-origin',
+        headers:     {'Content-Type': 'application/json', 'X-CSRF-Token': csrfToken},
+        body:        JSON.stringify({'name': nameInput.value, 'body': bodyInput.value}),
+      });
+      post().then(r => {
+        if (r.status !== 403) {
+          return r;
+        }
+        // A new session might need to answer a challenge before posting.
+        return r.clone().json().then(json => {
+          if (json.error.code !== 'captcha_required') {
+            return r;
+          }
+          return solveCaptcha().then(post);
+        });
+      }).then(r => r.json().then(json => {
+        if (!r.ok) {
+          let msg = json.error.message;
+          if (json.error.fields) {
+            msg += ': ' + json.error.fields.map(f => f.field + ' ' + f.message).join(', ');
+          }
+          throw new Error(msg);
+        }
+        bodyInput.value = '';
+        error.textContent = json.pending ? config.pending : '';
+      })).catch(e => {
+        error.textContent = e.message;
+      }).then(resize);
+    });
+
+    if (!window.WebSocket) {
+      return;
+    }
+    let scheme = location.protocol === 'https:' ? 'wss:' : 'ws:';
+    let ws = new WebSocket(scheme + '//' + location.host + '/ws?room=' + encodeURIComponent(config.room));
+    ws.addEventListener('message', e => {
+      let m = JSON.parse(e.data);
+      if (m.typing) {
+        return;
+      }
+      let old = document.getElementById('message-' + m.id);
+      if (m.deleted || m.hidden) {
+        if (old) {
+          old.remove();
+        }
+        return;
+      }
+      let div = document.createElement('div');
+      div.id = 'message-' + m.id;
+      let time = document.createElement('time');
+      time.className = 'time';
+      time.dateTime = m.created_at;
+      time.textContent = new Date(m.created_at).toLocaleTimeString();
+      div.appendChild(time);
+      div.appendChild(document.createTextNode(' '));
+      let name = document.createElement('span');
+      name.className = 'name';
+      name.textContent = m.name;
+      let profile = m.profile || {};
+      if (profile.link) {
+        let link = document.createElement('a');
+        link.href = profile.link;
+        link.rel = 'noopener noreferrer nofollow';
+        link.target = '_blank';
+        link.textContent = m.name;
+        name.textContent = '';
+        name.appendChild(link);
+      }
+      // The poster without an avatar is shown with the identicon.
+      let avatarURL = profile.avatar_url || (m.name ? '/avatar/' + encodeURIComponent(m.name) + '.png' : '');
+      if (avatarURL) {
+        let avatar = document.createElement('img');
+        avatar.className = 'avatar';
+        avatar.src = avatarURL;
+        avatar.alt = '';
+        div.appendChild(avatar);
+        div.appendChild(document.createTextNode(' '));
+      }
+      div.appendChild(name);
+      if (m.bot) {
+        let bot = document.createElement('span');
+        bot.className = 'bot';
+        bot.textContent = config.bot;
+        div.appendChild(document.createTextNode(' '));
+        div.appendChild(bot);
+      }
+      div.appendChild(document.createTextNode(m.action ? ' ' : ': '));
+      // body_html is rendered and sanitized by the server.
+      let body = document.createElement(m.action ? 'em' : 'span');
+      body.innerHTML = m.body_html;
+      div.appendChild(body);
+      if (m.edited) {
+        let edited = document.createElement('span');
+        edited.className = 'edited';
+        edited.textContent = ' ' + config.edited;
+        div.appendChild(edited);
+      }
+      if (old) {
+        old.replaceWith(div);
+        return;
+      }
+      let noMessage = document.getElementById('no-message');
+      if (noMessage) {
+        noMessage.remove();
+      }
+      document.getElementById('messages').appendChild(div);
+      resize();
+      scrollToBottom();
+    });
+    ws.addEventListener('close', () => {
+      setTimeout(() => {
+        location.reload();
+      }, Number(config.reloadInterval));
+    });
+  });
+})();
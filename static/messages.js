@@ -0,0 +1,269 @@
+(() => {
+  // The values from the server are in the data attributes of the script.
+  let config = document.currentScript.dataset;
+  window.onload = () => {
+    let csrfToken = document.querySelector('meta[name="csrf-token"]').content;
+    for (let time of document.querySelectorAll('time')) {
+      time.textContent = new Date(time.dateTime).toLocaleTimeString();
+    }
+    // Count down to the opening of the room, and reload the page when it
+    // opens. The remaining time is from the server since the clocks can
+    // differ.
+    let countdown = document.getElementById('countdown');
+    if (countdown) {
+      let opensAt = Date.now() + Number(countdown.dataset.opensIn) * 1000;
+      let pad = n => (n < 10 ? '0' : '') + n;
+      let update = () => {
+        let sec = Math.ceil((opensAt - Date.now()) / 1000);
+        if (sec <= 0) {
+          location.reload();
+          return;
+        }
+        let h = Math.floor(sec / 3600);
+        let m = Math.floor(sec / 60) % 60;
+        countdown.textContent = countdown.dataset.format.replace('%s', h + ':' + pad(m) + ':' + pad(sec % 60));
+        setTimeout(update, 1000);
+      };
+      update();
+    }
+    setInterval(() => {
+      fetch(config.presencePath, {
+        method:      'POST',
+        credentials: 'same-origin',
+        headers:     {'X-CSRF-Token': csrfToken},
+      }).then(r => r.json()).then(p => {
+        let online = document.getElementById('online-count');
+        if (online) {
+          online.textContent = p.count;
+        }
+      });
+    }, Number(config.presenceInterval));
+    let pollElement = m => {
+      let poll = document.createElement('div');
+      poll.className = 'poll';
+      m.poll.options.forEach((o, i) => {
+        let button = document.createElement('button');
+        button.className = 'poll-option';
+        button.dataset.id = m.id;
+        button.dataset.option = i;
+        button.textContent = o.text + ' ';
+        let votes = document.createElement('span');
+        votes.className = 'votes';
+        votes.textContent = o.votes;
+        button.appendChild(votes);
+        poll.appendChild(button);
+      });
+      return poll;
+    };
+    document.addEventListener('click', e => {
+      let button = e.target.closest('.poll-option');
+      if (!button) {
+        return;
+      }
+      fetch(config.pollsPath + button.dataset.id + '/votes', {
+        method:      'POST',
+        credentials: 'same-origin',
+        headers:     {'X-CSRF-Token': csrfToken},
+        body:        JSON.stringify({'option': Number(button.dataset.option)}),
+      }).then(r => r.json()).then(m => {
+        let old = document.querySelector('#message-' + m.id + ' .poll');
+        if (old) {
+          old.replaceWith(pollElement(m));
+        }
+      });
+    });
+    document.addEventListener('click', e => {
+      let button = e.target.closest('.report');
+      if (!button || button.disabled) {
+        return;
+      }
+      button.disabled = true;
+      fetch(config.messagesPath + button.dataset.id + '/report', {
+        method:      'POST',
+        credentials: 'same-origin',
+        headers:     {'X-CSRF-Token': csrfToken},
+      }).then(r => {
+        if (r.ok) {
+          button.textContent = config.reported;
+        } else {
+          button.disabled = false;
+        }
+      });
+    });
+    let readTimer;
+    let markRead = () => {
+      clearTimeout(readTimer);
+      readTimer = setTimeout(() => {
+        let newest = document.querySelector('#messages > [id^="message-"]');
+        if (!newest) {
+          return;
+        }
+        fetch(config.readCursorPath, {
+          method:      'PUT',
+          credentials: 'same-origin',
+          headers:     {'X-CSRF-Token': csrfToken},
+          body:        JSON.stringify({'id': Number(newest.id.slice('message-'.length))}),
+        });
+      }, 1000);
+    };
+    markRead();
+    let reload = () => {
+      setTimeout(() => {
+        location.reload();
+      }, Number(config.reloadInterval));
+    };
+    if (!window.WebSocket) {
+      reload();
+      return;
+    }
+    let typingNames = new Map();
+    let timers = new Map();
+    let updateTyping = () => {
+      let names = Array.from(typingNames.values());
+      document.getElementById('typing').textContent = names.length ? (names.length === 1 ? config.typingOne : config.typingMany).replace('%s', names.join(', ')) : '';
+    };
+    let scheme = location.protocol === 'https:' ? 'wss:' : 'ws:';
+    let ws = new WebSocket(scheme + '//' + location.host + '/ws?room=' + encodeURIComponent(config.room));
+    ws.addEventListener('message', e => {
+      let m = JSON.parse(e.data);
+      clearTimeout(timers.get(m.session_id));
+      if (m.typing) {
+        typingNames.set(m.session_id, m.name);
+        timers.set(m.session_id, setTimeout(() => {
+          typingNames.delete(m.session_id);
+          updateTyping();
+        }, Number(config.typingTtl)));
+        updateTyping();
+        return;
+      }
+      if (typingNames.delete(m.session_id)) {
+        updateTyping();
+      }
+      let old = document.getElementById('message-' + m.id);
+      if (m.hidden) {
+        if (old) {
+          old.remove();
+        }
+        return;
+      }
+      if (m.deleted) {
+        if (old) {
+          old.className = 'removed';
+          old.textContent = config.removed;
+        }
+        return;
+      }
+      let time = document.createElement('time');
+      time.className = 'time';
+      time.dateTime = m.created_at;
+      time.textContent = new Date(m.created_at).toLocaleTimeString();
+      let name = document.createElement('span');
+      name.className = 'name';
+      name.textContent = m.name;
+      let profile = m.profile || {};
+      if (profile.link) {
+        let link = document.createElement('a');
+        link.href = profile.link;
+        link.rel = 'noopener noreferrer nofollow';
+        link.target = '_blank';
+        link.textContent = m.name;
+        name.textContent = '';
+        name.appendChild(link);
+      }
+      let div = document.createElement('div');
+      div.id = 'message-' + m.id;
+      div.appendChild(time);
+      div.appendChild(document.createTextNode(' '));
+      // The poster without an avatar is shown with the identicon.
+      let avatarURL = profile.avatar_url || (m.name ? '/avatar/' + encodeURIComponent(m.name) + '.png' : '');
+      if (avatarURL) {
+        let avatar = document.createElement('img');
+        avatar.className = 'avatar';
+        avatar.src = avatarURL;
+        avatar.alt = '';
+        div.appendChild(avatar);
+        div.appendChild(document.createTextNode(' '));
+      }
+      div.appendChild(name);
+      if (m.bot) {
+        let bot = document.createElement('span');
+        bot.className = 'bot';
+        bot.textContent = config.bot;
+        div.appendChild(document.createTextNode(' '));
+        div.appendChild(bot);
+      }
+      div.appendChild(document.createTextNode(m.action ? ' ' : ': '));
+      // body_html is rendered and sanitized by the server.
+      let body = document.createElement('span');
+      body.innerHTML = m.body_html;
+      if (m.action) {
+        let em = document.createElement('em');
+        em.appendChild(body);
+        div.appendChild(em);
+      } else {
+        while (body.firstChild) {
+          div.appendChild(body.firstChild);
+        }
+      }
+      if (m.edited) {
+        let edited = document.createElement('span');
+        edited.className = 'edited';
+        edited.textContent = ' ' + config.edited;
+        div.appendChild(edited);
+      }
+      let report = document.createElement('button');
+      report.className = 'report';
+      report.dataset.id = m.id;
+      report.textContent = config.report;
+      div.appendChild(document.createTextNode(' '));
+      div.appendChild(report);
+      for (let a of m.attachments || []) {
+        let link = document.createElement('a');
+        link.href = a.url;
+        let img = document.createElement('img');
+        img.className = 'attachment';
+        img.src = a.thumbnail_url;
+        img.alt = '';
+        link.appendChild(img);
+        div.appendChild(document.createTextNode(' '));
+        div.appendChild(link);
+      }
+      if (m.preview) {
+        let preview = document.createElement('a');
+        preview.className = 'preview';
+        preview.href = m.preview.url;
+        preview.rel = 'noopener noreferrer';
+        preview.target = '_blank';
+        if (m.preview.image) {
+          let img = document.createElement('img');
+          img.src = m.preview.image;
+          img.alt = '';
+          preview.appendChild(img);
+        }
+        let title = document.createElement('strong');
+        title.textContent = m.preview.title;
+        preview.appendChild(title);
+        if (m.preview.description) {
+          preview.appendChild(document.createElement('br'));
+          preview.appendChild(document.createTextNode(m.preview.description));
+        }
+        div.appendChild(preview);
+      }
+      if (m.poll) {
+        div.appendChild(pollElement(m));
+      }
+      if (old) {
+        old.replaceWith(div);
+        return;
+      }
+      let noMessage = document.getElementById('no-message');
+      if (noMessage) {
+        noMessage.remove();
+      }
+      let messages = document.getElementById('messages');
+      messages.insertBefore(div, messages.firstChild);
+      markRead();
+    });
+    ws.addEventListener('close', reload);
+  };
+})();
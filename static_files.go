@@ -0,0 +1,29 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Code generated by genstatic.go. DO NOT EDIT.
+
+package chatserver
+
+// staticFiles is the files in the static directory by name.
+var staticFiles = map[string]string{
+	"admin.css":      "body {\n  font-family: Sans-Serif;\n  margin: 8px;\n}\ntable {\n  border-collapse: collapse;\n}\nth, td {\n  border-bottom: 1px solid lightgray;\n  padding: 2px 8px;\n  text-align: left;\n  vertical-align: top;\n}\n.room ul {\n  list-style: none;\n  padding-left: 0;\n}\n.room small {\n  color: gray;\n  font-weight: normal;\n}\n.name {\n  font-weight: bold;\n}\n.action {\n  font-size: smaller;\n}\n.danger {\n  color: darkred;\n}\n.error {\n  color: darkred;\n}\n",
+	"admin.js":       "(() => {\n  // The values from the server are in the data attributes of the script.\n  let config = document.currentScript.dataset;\n  window.addEventListener('load', () => {\n    let csrfToken = document.querySelector('meta[name=\"csrf-token\"]').content;\n    let error = document.getElementById('error');\n    let busy = false;\n\n    // The quick actions call the admin API with the Basic credentials of the\n    // page, which also need the CSRF token.\n    document.addEventListener('click', e => {\n      let button = e.target.closest('button.action');\n      if (!button) {\n        return;\n      }\n      let room = button.dataset.confirm;\n      if (room && !confirm(config.confirmClear.replace('%s', room))) {\n        return;\n      }\n      busy = true;\n      button.disabled = true;\n      fetch(button.dataset.path, {\n        method:      button.dataset.method,\n        credentials: 'same-origin',\n        headers:     {'X-CSRF-Token': csrfToken},\n      }).then(r => {\n        if (r.ok) {\n          location.reload();\n          return;\n        }\n        return r.json().then(json => {\n          throw new Error(json.error.message);\n        });\n      }).catch(e => {\n        error.textContent = e.message;\n        button.disabled = false;\n        busy = false;\n      });\n    });\n\n    // Reload the page to keep the stats live.\n    let interval = Number(config.reloadInterval);\n    if (interval > 0) {\n      setInterval(() => {\n        if (!busy) {\n          location.reload();\n        }\n      }, interval);\n    }\n  });\n})();\n",
+	"dev.js":         "window.addEventListener('load', _ => {\n  let csrfToken = document.querySelector('meta[name=\"csrf-token\"]').content;\n  let emojis = {};\n  fetch('/emoji').then(response => response.json()).then(json => {\n    emojis = json;\n  });\n  let bodyInput = document.getElementById('body');\n  let suggestions = document.getElementById('emoji-suggestions');\n  let lastTyping = 0;\n  bodyInput.addEventListener('input', _ => {\n    if (Date.now() - lastTyping >= 3000) {\n      lastTyping = Date.now();\n      let room = document.getElementById('room').value;\n      let path = room ? '/rooms/' + encodeURIComponent(room) + '/typing' : '/typing';\n      fetch(path, {\n        method:  'POST',\n        headers: {'X-CSRF-Token': csrfToken},\n        body:    JSON.stringify({'name': document.getElementById('name').value}),\n      });\n    }\n    suggestions.textContent = '';\n    let m = bodyInput.value.match(/:([a-z0-9_+-]+)$/);\n    if (!m) {\n      return;\n    }\n    for (let name of Object.keys(emojis).sort()) {\n      if (!name.startsWith(m[1])) {\n        continue;\n      }\n      let button = document.createElement('button');\n      button.textContent = emojis[name] + ' :' + name + ':';\n      button.addEventListener('click', _ => {\n        bodyInput.value = bodyInput.value.slice(0, -m[0].length) + ':' + name + ': ';\n        suggestions.textContent = '';\n        bodyInput.focus();\n      });\n      suggestions.appendChild(button);\n    }\n  });\n  document.getElementById('submit-button').addEventListener('click', _ => {\n    let room = document.getElementById('room').value;\n    let name = document.getElementById('name').value;\n    let body = document.getElementById('body').value;\n    let path = room ? '/rooms/' + encodeURIComponent(room) + '/messages' : '/messages';\n    let uploads = Array.from(document.getElementById('images').files).map(f => fetch('/attachments', {\n      method:  'POST',\n      headers: {'X-CSRF-Token': csrfToken},\n      body:    f,\n    }).then(response => response.json()));\n    Promise.all(uploads).then(attachments => fetch(path, {\n      method:  'POST',\n      headers: {'X-CSRF-Token': csrfToken},\n      body:    JSON.stringify({'name': name, 'body': body, 'attachments': attachments.map(a => ({'id': a.id}))}),\n    })).then(response => {\n      console.log('status:', response.status);\n      return response.text();\n    });\n  });\n});\n",
+	"embed-page.css": "body {\n  background-color: var(--background-color);\n  color: var(--text-color);\n  font-family: Sans-Serif;\n  margin: 8px;\n}\n.name {\n  color: var(--accent-color);\n  font-weight: bold;\n}\n.name a {\n  color: inherit;\n  text-decoration: none;\n}\n.avatar {\n  border-radius: 50%;\n  height: 20px;\n  vertical-align: middle;\n  width: 20px;\n}\n.time, .edited {\n  color: gray;\n  font-size: smaller;\n}\n.bot {\n  background-color: lightgray;\n  border-radius: 3px;\n  font-size: smaller;\n  padding: 0 3px;\n}\n#post {\n  display: flex;\n  margin: 8px 0 4px;\n}\n#post input {\n  margin-right: 4px;\n}\n#body {\n  flex: 1;\n}\n.error {\n  color: darkred;\n}\n.open {\n  font-size: smaller;\n}\n.closed {\n  background-color: lightgray;\n  border-radius: 3px;\n  padding: 4px 8px;\n  text-align: center;\n}\n",
+	"embed-page.js":  "(() => {\n  // The values from the server are in the data attributes of the script.\n  let config = document.currentScript.dataset;\n  window.addEventListener('load', () => {\n    let csrfToken = document.querySelector('meta[name=\"csrf-token\"]').content;\n    let resize = () => {\n      parent.postMessage({'type': 'chatserver:resize', 'height': document.documentElement.scrollHeight}, '*');\n    };\n    let scrollToBottom = () => {\n      window.scrollTo(0, document.documentElement.scrollHeight);\n    };\n    for (let time of document.querySelectorAll('time')) {\n      time.textContent = new Date(time.dateTime).toLocaleTimeString();\n    }\n    if (window.ResizeObserver) {\n      new ResizeObserver(resize).observe(document.body);\n    }\n    resize();\n    scrollToBottom();\n    // Count down to the opening of the room, and reload the page when it\n    // opens. The remaining time is from the server since the clocks can\n    // differ.\n    let countdown = document.getElementById('countdown');\n    if (countdown) {\n      let opensAt = Date.now() + Number(countdown.dataset.opensIn) * 1000;\n      let pad = n => (n < 10 ? '0' : '') + n;\n      let update = () => {\n        let sec = Math.ceil((opensAt - Date.now()) / 1000);\n        if (sec <= 0) {\n          location.reload();\n          return;\n        }\n        let h = Math.floor(sec / 3600);\n        let m = Math.floor(sec / 60) % 60;\n        countdown.textContent = countdown.dataset.format.replace('%s', h + ':' + pad(m) + ':' + pad(sec % 60));\n        setTimeout(update, 1000);\n      };\n      update();\n    }\n\n    let nameInput = document.getElementById('name');\n    let bodyInput = document.getElementById('body');\n    let error = document.getElementById('error');\n    try {\n      nameInput.value = localStorage.getItem('chatserver:name') || '';\n    } catch (e) {\n      // Storage might be unavailable in third-party frames.\n    }\n    let solveCaptcha = () => fetch(config.captchaPath, {\n      credentials: 'same-origin',\n    }).then(r => r.json()).then(c => {\n      let answer = prompt(config.captchaPrompt.replace('%s', c.question));\n      return fetch(config.captchaPath, {\n        method:      'POST',\n        credentials: 'same-origin',\n        headers:     {'Content-Type': 'application/json', 'X-CSRF-Token': csrfToken},\n        body:        JSON.stringify({'id': c.id, 'answer': Number(answer)}),\n      });\n    });\n    document.getElementById('post').addEventListener('submit', e => {\n      e.preventDefault();\n      try {\n        localStorage.setItem('chatserver:name', nameInput.value);\n      } catch (e) {\n      }\n      let post = () => fetch(config.postPath, {\n        method:      'POST',\n        credentials: 'same-origin',\n        headers:     {'Content-Type': 'application/json', 'X-CSRF-Token': csrfToken},\n        body:        JSON.stringify({'name': nameInput.value, 'body': bodyInput.value}),\n      });\n      post().then(r => {\n        if (r.status !== 403) {\n          return r;\n        }\n        // A new session might need to answer a challenge before posting.\n        return r.clone().json().then(json => {\n          if (json.error.code !== 'captcha_required') {\n            return r;\n          }\n          return solveCaptcha().then(post);\n        });\n      }).then(r => r.json().then(json => {\n        if (!r.ok) {\n          let msg = json.error.message;\n          if (json.error.fields) {\n            msg += ': ' + json.error.fields.map(f => f.field + ' ' + f.message).join(', ');\n          }\n          throw new Error(msg);\n        }\n        bodyInput.value = '';\n        error.textContent = json.pending ? config.pending : '';\n      })).catch(e => {\n        error.textContent = e.message;\n      }).then(resize);\n    });\n\n    if (!window.WebSocket) {\n      return;\n    }\n    let scheme = location.protocol === 'https:' ? 'wss:' : 'ws:';\n    let ws = new WebSocket(scheme + '//' + location.host + '/ws?room=' + encodeURIComponent(config.room));\n    ws.addEventListener('message', e => {\n      let m = JSON.parse(e.data);\n      if (m.typing) {\n        return;\n      }\n      let old = document.getElementById('message-' + m.id);\n      if (m.deleted || m.hidden) {\n        if (old) {\n          old.remove();\n        }\n        return;\n      }\n      let div = document.createElement('div');\n      div.id = 'message-' + m.id;\n      let time = document.createElement('time');\n      time.className = 'time';\n      time.dateTime = m.created_at;\n      time.textContent = new Date(m.created_at).toLocaleTimeString();\n      div.appendChild(time);\n      div.appendChild(document.createTextNode(' '));\n      let name = document.createElement('span');\n      name.className = 'name';\n      name.textContent = m.name;\n      let profile = m.profile || {};\n      if (profile.link) {\n        let link = document.createElement('a');\n        link.href = profile.link;\n        link.rel = 'noopener noreferrer nofollow';\n        link.target = '_blank';\n        link.textContent = m.name;\n        name.textContent = '';\n        name.appendChild(link);\n      }\n      // The poster without an avatar is shown with the identicon.\n      let avatarURL = profile.avatar_url || (m.name ? '/avatar/' + encodeURIComponent(m.name) + '.png' : '');\n      if (avatarURL) {\n        let avatar = document.createElement('img');\n        avatar.className = 'avatar';\n        avatar.src = avatarURL;\n        avatar.alt = '';\n        div.appendChild(avatar);\n        div.appendChild(document.createTextNode(' '));\n      }\n      div.appendChild(name);\n      if (m.bot) {\n        let bot = document.createElement('span');\n        bot.className = 'bot';\n        bot.textContent = config.bot;\n        div.appendChild(document.createTextNode(' '));\n        div.appendChild(bot);\n      }\n      div.appendChild(document.createTextNode(m.action ? ' ' : ': '));\n      // body_html is rendered and sanitized by the server.\n      let body = document.createElement(m.action ? 'em' : 'span');\n      body.innerHTML = m.body_html;\n      div.appendChild(body);\n      if (m.edited) {\n        let edited = document.createElement('span');\n        edited.className = 'edited';\n        edited.textContent = ' ' + config.edited;\n        div.appendChild(edited);\n      }\n      if (old) {\n        old.replaceWith(div);\n        return;\n      }\n      let noMessage = document.getElementById('no-message');\n      if (noMessage) {\n        noMessage.remove();\n      }\n      document.getElementById('messages').appendChild(div);\n      resize();\n      scrollToBottom();\n    });\n    ws.addEventListener('close', () => {\n      setTimeout(() => {\n        location.reload();\n      }, Number(config.reloadInterval));\n    });\n  });\n})();\n",
+	"favicon.png":    "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00 \x00\x00\x00 \b\x06\x00\x00\x00szz\xf4\x00\x00\x00lIDATx\xdac`\x18\x05\x83\x16\xac\xbd\xf1\x9f\xaax\xc0,&\xc9!\xb4\xb6\x9c\xa0#\x06\xd4\x01\xf4\xb2\x1c\xa7#F\x1d\x80C!\fPS\x8eh\a\xa0\x03j\xc8\x11\xed\x00\\\x80\x12\xb9\xa1\xe5\x80\x01\x8f\x82A\x91\bGˁ\xe1[\x1f\f\xde\xeax\xc0\x1b$\x83\xa2IF\xac#\x06\xb4a:\xa0-\xe3\x01m\x9a\x0fh\xdf`@;'\xa3`8\x03\x00\x12~\xde87 ɑ\x00\x00\x00\x00IEND\xaeB`\x82",
+	"messages.css":   "body {\n  background-color: var(--background-color);\n  color: var(--text-color);\n  font-family: Sans-Serif;\n}\n.name {\n  color: var(--accent-color);\n  font-weight: bold;\n}\n.name a {\n  color: inherit;\n  text-decoration: none;\n}\n.avatar {\n  border-radius: 50%;\n  height: 20px;\n  vertical-align: middle;\n  width: 20px;\n}\n.logo {\n  max-height: 64px;\n}\n.time {\n  color: gray;\n}\n.current-room {\n  font-weight: bold;\n}\n.report {\n  background: none;\n  border: none;\n  color: gray;\n  cursor: pointer;\n  font-size: smaller;\n  padding: 0;\n}\n.edited {\n  color: gray;\n  font-size: smaller;\n}\n.removed {\n  color: gray;\n  font-style: italic;\n}\n.online {\n  color: gray;\n}\n.warning {\n  color: darkred;\n}\n#pinned {\n  background: var(--background-color);\n  border-bottom: 1px solid lightgray;\n  position: sticky;\n  top: 0;\n}\n.last-read {\n  border-top: 1px solid darkred;\n  color: darkred;\n  font-size: smaller;\n}\n.preview {\n  border-left: 4px solid lightgray;\n  color: inherit;\n  display: block;\n  margin: 4px 0;\n  max-width: 400px;\n  padding-left: 8px;\n  text-decoration: none;\n}\n.attachment {\n  max-height: 240px;\n  max-width: 240px;\n  vertical-align: top;\n}\n.preview img {\n  display: block;\n  max-height: 120px;\n  max-width: 100%;\n}\n.bot {\n  background-color: lightgray;\n  border-radius: 3px;\n  font-size: smaller;\n  padding: 0 3px;\n}\n.poll-option {\n  margin: 2px 4px 2px 0;\n}\n.votes {\n  color: gray;\n}\n.mention {\n  background-color: lightyellow;\n  font-weight: bold;\n}\n.closed {\n  background-color: lightgray;\n  border-radius: 3px;\n  padding: 4px 8px;\n  text-align: center;\n}\n",
+	"messages.js":    "(() => {\n  // The values from the server are in the data attributes of the script.\n  let config = document.currentScript.dataset;\n  window.onload = () => {\n    let csrfToken = document.querySelector('meta[name=\"csrf-token\"]').content;\n    for (let time of document.querySelectorAll('time')) {\n      time.textContent = new Date(time.dateTime).toLocaleTimeString();\n    }\n    // Count down to the opening of the room, and reload the page when it\n    // opens. The remaining time is from the server since the clocks can\n    // differ.\n    let countdown = document.getElementById('countdown');\n    if (countdown) {\n      let opensAt = Date.now() + Number(countdown.dataset.opensIn) * 1000;\n      let pad = n => (n < 10 ? '0' : '') + n;\n      let update = () => {\n        let sec = Math.ceil((opensAt - Date.now()) / 1000);\n        if (sec <= 0) {\n          location.reload();\n          return;\n        }\n        let h = Math.floor(sec / 3600);\n        let m = Math.floor(sec / 60) % 60;\n        countdown.textContent = countdown.dataset.format.replace('%s', h + ':' + pad(m) + ':' + pad(sec % 60));\n        setTimeout(update, 1000);\n      };\n      update();\n    }\n    setInterval(() => {\n      fetch(config.presencePath, {\n        method:      'POST',\n        credentials: 'same-origin',\n        headers:     {'X-CSRF-Token': csrfToken},\n      }).then(r => r.json()).then(p => {\n        let online = document.getElementById('online-count');\n        if (online) {\n          online.textContent = p.count;\n        }\n      });\n    }, Number(config.presenceInterval));\n    let pollElement = m => {\n      let poll = document.createElement('div');\n      poll.className = 'poll';\n      m.poll.options.forEach((o, i) => {\n        let button = document.createElement('button');\n        button.className = 'poll-option';\n        button.dataset.id = m.id;\n        button.dataset.option = i;\n        button.textContent = o.text + ' ';\n        let votes = document.createElement('span');\n        votes.className = 'votes';\n        votes.textContent = o.votes;\n        button.appendChild(votes);\n        poll.appendChild(button);\n      });\n      return poll;\n    };\n    document.addEventListener('click', e => {\n      let button = e.target.closest('.poll-option');\n      if (!button) {\n        return;\n      }\n      fetch(config.pollsPath + button.dataset.id + '/votes', {\n        method:      'POST',\n        credentials: 'same-origin',\n        headers:     {'X-CSRF-Token': csrfToken},\n        body:        JSON.stringify({'option': Number(button.dataset.option)}),\n      }).then(r => r.json()).then(m => {\n        let old = document.querySelector('#message-' + m.id + ' .poll');\n        if (old) {\n          old.replaceWith(pollElement(m));\n        }\n      });\n    });\n    document.addEventListener('click', e => {\n      let button = e.target.closest('.report');\n      if (!button || button.disabled) {\n        return;\n      }\n      button.disabled = true;\n      fetch(config.messagesPath + button.dataset.id + '/report', {\n        method:      'POST',\n        credentials: 'same-origin',\n        headers:     {'X-CSRF-Token': csrfToken},\n      }).then(r => {\n        if (r.ok) {\n          button.textContent = config.reported;\n        } else {\n          button.disabled = false;\n        }\n      });\n    });\n    let readTimer;\n    let markRead = () => {\n      clearTimeout(readTimer);\n      readTimer = setTimeout(() => {\n        let newest = document.querySelector('#messages > [id^=\"message-\"]');\n        if (!newest) {\n          return;\n        }\n        fetch(config.readCursorPath, {\n          method:      'PUT',\n          credentials: 'same-origin',\n          headers:     {'X-CSRF-Token': csrfToken},\n          body:        JSON.stringify({'id': Number(newest.id.slice('message-'.length))}),\n        });\n      }, 1000);\n    };\n    markRead();\n    let reload = () => {\n      setTimeout(() => {\n        location.reload();\n      }, Number(config.reloadInterval));\n    };\n    if (!window.WebSocket) {\n      reload();\n      return;\n    }\n    let typingNames = new Map();\n    let timers = new Map();\n    let updateTyping = () => {\n      let names = Array.from(typingNames.values());\n      document.getElementById('typing').textContent = names.length ? (names.length === 1 ? config.typingOne : config.typingMany).replace('%s', names.join(', ')) : '';\n    };\n    let scheme = location.protocol === 'https:' ? 'wss:' : 'ws:';\n    let ws = new WebSocket(scheme + '//' + location.host + '/ws?room=' + encodeURIComponent(config.room));\n    ws.addEventListener('message', e => {\n      let m = JSON.parse(e.data);\n      clearTimeout(timers.get(m.session_id));\n      if (m.typing) {\n        typingNames.set(m.session_id, m.name);\n        timers.set(m.session_id, setTimeout(() => {\n          typingNames.delete(m.session_id);\n          updateTyping();\n        }, Number(config.typingTtl)));\n        updateTyping();\n        return;\n      }\n      if (typingNames.delete(m.session_id)) {\n        updateTyping();\n      }\n      let old = document.getElementById('message-' + m.id);\n      if (m.hidden) {\n        if (old) {\n          old.remove();\n        }\n        return;\n      }\n      if (m.deleted) {\n        if (old) {\n          old.className = 'removed';\n          old.textContent = config.removed;\n        }\n        return;\n      }\n      let time = document.createElement('time');\n      time.className = 'time';\n      time.dateTime = m.created_at;\n      time.textContent = new Date(m.created_at).toLocaleTimeString();\n      let name = document.createElement('span');\n      name.className = 'name';\n      name.textContent = m.name;\n      let profile = m.profile || {};\n      if (profile.link) {\n        let link = document.createElement('a');\n        link.href = profile.link;\n        link.rel = 'noopener noreferrer nofollow';\n        link.target = '_blank';\n        link.textContent = m.name;\n        name.textContent = '';\n        name.appendChild(link);\n      }\n      let div = document.createElement('div');\n      div.id = 'message-' + m.id;\n      div.appendChild(time);\n      div.appendChild(document.createTextNode(' '));\n      // The poster without an avatar is shown with the identicon.\n      let avatarURL = profile.avatar_url || (m.name ? '/avatar/' + encodeURIComponent(m.name) + '.png' : '');\n      if (avatarURL) {\n        let avatar = document.createElement('img');\n        avatar.className = 'avatar';\n        avatar.src = avatarURL;\n        avatar.alt = '';\n        div.appendChild(avatar);\n        div.appendChild(document.createTextNode(' '));\n      }\n      div.appendChild(name);\n      if (m.bot) {\n        let bot = document.createElement('span');\n        bot.className = 'bot';\n        bot.textContent = config.bot;\n        div.appendChild(document.createTextNode(' '));\n        div.appendChild(bot);\n      }\n      div.appendChild(document.createTextNode(m.action ? ' ' : ': '));\n      // body_html is rendered and sanitized by the server.\n      let body = document.createElement('span');\n      body.innerHTML = m.body_html;\n      if (m.action) {\n        let em = document.createElement('em');\n        em.appendChild(body);\n        div.appendChild(em);\n      } else {\n        while (body.firstChild) {\n          div.appendChild(body.firstChild);\n        }\n      }\n      if (m.edited) {\n        let edited = document.createElement('span');\n        edited.className = 'edited';\n        edited.textContent = ' ' + config.edited;\n        div.appendChild(edited);\n      }\n      let report = document.createElement('button');\n      report.className = 'report';\n      report.dataset.id = m.id;\n      report.textContent = config.report;\n      div.appendChild(document.createTextNode(' '));\n      div.appendChild(report);\n      for (let a of m.attachments || []) {\n        let link = document.createElement('a');\n        link.href = a.url;\n        let img = document.createElement('img');\n        img.className = 'attachment';\n        img.src = a.thumbnail_url;\n        img.alt = '';\n        link.appendChild(img);\n        div.appendChild(document.createTextNode(' '));\n        div.appendChild(link);\n      }\n      if (m.preview) {\n        let preview = document.createElement('a');\n        preview.className = 'preview';\n        preview.href = m.preview.url;\n        preview.rel = 'noopener noreferrer';\n        preview.target = '_blank';\n        if (m.preview.image) {\n          let img = document.createElement('img');\n          img.src = m.preview.image;\n          img.alt = '';\n          preview.appendChild(img);\n        }\n        let title = document.createElement('strong');\n        title.textContent = m.preview.title;\n        preview.appendChild(title);\n        if (m.preview.description) {\n          preview.appendChild(document.createElement('br'));\n          preview.appendChild(document.createTextNode(m.preview.description));\n        }\n        div.appendChild(preview);\n      }\n      if (m.poll) {\n        div.appendChild(pollElement(m));\n      }\n      if (old) {\n        old.replaceWith(div);\n        return;\n      }\n      let noMessage = document.getElementById('no-message');\n      if (noMessage) {\n        noMessage.remove();\n      }\n      let messages = document.getElementById('messages');\n      messages.insertBefore(div, messages.firstChild);\n      markRead();\n    });\n    ws.addEventListener('close', reload);\n  };\n})();\n",
+}
@@ -0,0 +1,427 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Store is a storage of messages. Messages are stored per room.
+type Store interface {
+	// Get returns the stored messages in the room in the posted order.
+	Get(ctx context.Context, room string) ([]Message, error)
+
+	// Append adds the message to the end of the room and returns the ID
+	// assigned to it. IDs increase monotonically in the posted order in a
+	// room.
+	Append(ctx context.Context, room string, message Message) (int64, error)
+
+	// Trim removes old messages in the room so that at most n messages
+	// remain. The stores keeping the whole history, like Datastore and the
+	// databases, do nothing.
+	Trim(ctx context.Context, room string, n int) error
+
+	// History returns at most limit messages posted before the message of
+	// the ID in the room in the posted order. If before is 0, History returns
+	// the latest messages.
+	History(ctx context.Context, room string, before int64, limit int) ([]Message, error)
+
+	// Update applies f to the message of the ID in the room and returns the
+	// updated message. Update returns ErrNotFound if the message doesn't
+	// exist. f might be called more than once.
+	Update(ctx context.Context, room string, id int64, f func(*Message)) (Message, error)
+}
+
+// purger is implemented by the stores that can remove old messages by the
+// posted time.
+type purger interface {
+	// Purge removes the messages in the room posted before the time, and
+	// returns the number of the removed messages.
+	Purge(ctx context.Context, room string, before time.Time) (int, error)
+}
+
+// batchAppender is implemented by the stores that can append messages at once
+// with fewer round trips than appending them one by one.
+type batchAppender interface {
+	// AppendMulti adds the messages to the end of the room in order, and
+	// returns the IDs assigned to them.
+	AppendMulti(ctx context.Context, room string, messages []Message) ([]int64, error)
+}
+
+// appendMessages adds the messages to the end of the room in order, at once if
+// the store supports it. If an error occurs, the IDs of the messages stored so
+// far are returned with the error.
+func appendMessages(ctx context.Context, store Store, room string, messages []Message) ([]int64, error) {
+	if b, ok := store.(batchAppender); ok {
+		return b.AppendMulti(ctx, room, messages)
+	}
+	ids := make([]int64, 0, len(messages))
+	for _, m := range messages {
+		id, err := store.Append(ctx, room, m)
+		if err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// olderMessages returns the number of the leading messages posted before the
+// time.
+func olderMessages(messages []Message, before time.Time) int {
+	for i, m := range messages {
+		if !m.CreatedAt.Before(before) {
+			return i
+		}
+	}
+	return len(messages)
+}
+
+// updateMessage applies f to the message of the ID in messages. The updated
+// message is returned, or false is returned if the message is not found.
+func updateMessage(messages []Message, id int64, f func(*Message)) (Message, bool) {
+	for i := range messages {
+		if messages[i].ID == id {
+			f(&messages[i])
+			return messages[i], true
+		}
+	}
+	return Message{}, false
+}
+
+// withoutMessages returns the messages other than the ones of the IDs, and
+// the number of the removed messages.
+func withoutMessages(messages []Message, ids []int64) ([]Message, int) {
+	result := make([]Message, 0, len(messages))
+	for _, m := range messages {
+		found := false
+		for _, id := range ids {
+			if m.ID == id {
+				found = true
+				break
+			}
+		}
+		if !found {
+			result = append(result, m)
+		}
+	}
+	return result, len(messages) - len(result)
+}
+
+// visibleMessages returns the messages that are neither deleted, expired nor
+// typing events.
+func visibleMessages(messages []Message) []Message {
+	now := time.Now()
+	result := make([]Message, 0, len(messages))
+	for _, m := range messages {
+		if m.Deleted || m.Hidden || m.Typing || m.expired(now) {
+			continue
+		}
+		result = append(result, m)
+	}
+	return result
+}
+
+// historyOf returns the result of History from all the messages in the
+// posted order.
+func historyOf(messages []Message, before int64, limit int) []Message {
+	end := len(messages)
+	if before > 0 {
+		end = 0
+		for end < len(messages) && messages[end].ID < before {
+			end++
+		}
+	}
+	start := end - limit
+	if start < 0 {
+		start = 0
+	}
+	result := make([]Message, end-start)
+	copy(result, messages[start:end])
+	return result
+}
+
+type memoryRoom struct {
+	messages []Message
+	lastID   int64
+}
+
+type memoryStore struct {
+	rooms map[string]*memoryRoom
+	m     sync.Mutex
+}
+
+// NewMemoryStore returns a Store that keeps messages in the process memory.
+func NewMemoryStore() Store {
+	return &memoryStore{
+		rooms: map[string]*memoryRoom{},
+	}
+}
+
+func (s *memoryStore) room(name string) *memoryRoom {
+	r, ok := s.rooms[name]
+	if !ok {
+		r = &memoryRoom{}
+		s.rooms[name] = r
+	}
+	return r
+}
+
+func (s *memoryStore) Get(ctx context.Context, room string) ([]Message, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	r := s.room(room)
+	messages := make([]Message, len(r.messages))
+	copy(messages, r.messages)
+	return messages, nil
+}
+
+func (s *memoryStore) Append(ctx context.Context, room string, message Message) (int64, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	r := s.room(room)
+	r.lastID++
+	message.ID = r.lastID
+	r.messages = append(r.messages, message)
+	return message.ID, nil
+}
+
+func (s *memoryStore) AppendMulti(ctx context.Context, room string, messages []Message) ([]int64, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	r := s.room(room)
+	ids := make([]int64, len(messages))
+	for i, m := range messages {
+		r.lastID++
+		m.ID = r.lastID
+		r.messages = append(r.messages, m)
+		ids[i] = m.ID
+	}
+	return ids, nil
+}
+
+func (s *memoryStore) History(ctx context.Context, room string, before int64, limit int) ([]Message, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return historyOf(s.room(room).messages, before, limit), nil
+}
+
+func (s *memoryStore) Update(ctx context.Context, room string, id int64, f func(*Message)) (Message, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	m, ok := updateMessage(s.room(room).messages, id, f)
+	if !ok {
+		return Message{}, ErrNotFound
+	}
+	return m, nil
+}
+
+func (s *memoryStore) Trim(ctx context.Context, room string, n int) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	r := s.room(room)
+	if len(r.messages) > n {
+		r.messages = append([]Message(nil), r.messages[len(r.messages)-n:]...)
+	}
+	return nil
+}
+
+func (s *memoryStore) Purge(ctx context.Context, room string, before time.Time) (int, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	r := s.room(room)
+	n := olderMessages(r.messages, before)
+	r.messages = append([]Message(nil), r.messages[n:]...)
+	return n, nil
+}
+
+func (s *memoryStore) Remove(ctx context.Context, room string, ids []int64) (int, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	r := s.room(room)
+	var n int
+	r.messages, n = withoutMessages(r.messages, ids)
+	return n, nil
+}
+
+// cachedStore is a Store that reads through the memcache store. Only the
+// cache is trimmed, and the store keeps the whole history.
+//
+// Memcache errors don't fail the operations since the store has all the
+// messages. Messages are read from the store while memcache is unavailable,
+// and the rooms whose cache missed writes are refilled from the store when
+// memcache recovers.
+type cachedStore struct {
+	cache *memcacheStore
+	store Store
+
+	// limit is the number of messages read into the cache.
+	limit int
+
+	// stale is the set of the rooms whose cache missed writes.
+	stale map[string]struct{}
+	m     sync.Mutex
+}
+
+func newCachedStore(cache *memcacheStore, store Store, limit int) *cachedStore {
+	return &cachedStore{
+		cache: cache,
+		store: store,
+		limit: limit,
+		stale: map[string]struct{}{},
+	}
+}
+
+func (s *cachedStore) isStale(room string) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	_, ok := s.stale[room]
+	return ok
+}
+
+func (s *cachedStore) setStale(room string, stale bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if stale {
+		s.stale[room] = struct{}{}
+		return
+	}
+	delete(s.stale, room)
+}
+
+func (s *cachedStore) Get(ctx context.Context, room string) ([]Message, error) {
+	if !s.isStale(room) {
+		messages, ok, err := s.cache.get(ctx, room)
+		if err == nil && ok {
+			// The shards can have a few more messages than the limit.
+			if len(messages) > s.limit {
+				messages = messages[len(messages)-s.limit:]
+			}
+			return messages, nil
+		}
+		if err != nil {
+			// Memcache is unavailable. Read the store without filling the
+			// cache.
+			return s.store.History(ctx, room, 0, s.limit)
+		}
+	}
+
+	messages, err := s.store.History(ctx, room, 0, s.limit)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.cache.set(ctx, room, messages); err != nil {
+		s.setStale(room, true)
+		return messages, nil
+	}
+	s.setStale(room, false)
+	return messages, nil
+}
+
+func (s *cachedStore) Append(ctx context.Context, room string, message Message) (int64, error) {
+	id, err := s.store.Append(ctx, room, message)
+	if err != nil {
+		return 0, err
+	}
+	message.ID = id
+	// If the messages are not cached, the next read fills the cache from the store.
+	if err := s.cache.appendIfCached(ctx, room, message, s.limit); err != nil {
+		s.setStale(room, true)
+	}
+	return id, nil
+}
+
+func (s *cachedStore) AppendMulti(ctx context.Context, room string, messages []Message) ([]int64, error) {
+	ids, err := appendMessages(ctx, s.store, room, messages)
+	if len(ids) > 0 {
+		stored := make([]Message, len(ids))
+		for i, id := range ids {
+			stored[i] = messages[i]
+			stored[i].ID = id
+		}
+		if err := s.cache.appendMultiIfCached(ctx, room, stored, s.limit); err != nil {
+			s.setStale(room, true)
+		}
+	}
+	return ids, err
+}
+
+func (s *cachedStore) Trim(ctx context.Context, room string, n int) error {
+	// The cache is already trimmed to the limit when a message is appended.
+	if n >= s.limit {
+		return nil
+	}
+	if err := s.cache.Trim(ctx, room, n); err != nil {
+		s.setStale(room, true)
+	}
+	return nil
+}
+
+func (s *cachedStore) Update(ctx context.Context, room string, id int64, f func(*Message)) (Message, error) {
+	m, err := s.store.Update(ctx, room, id, f)
+	if err != nil {
+		return Message{}, err
+	}
+	if _, err := s.cache.Update(ctx, room, id, func(cached *Message) {
+		*cached = m
+	}); err != nil && err != ErrNotFound {
+		s.setStale(room, true)
+	}
+	return m, nil
+}
+
+func (s *cachedStore) Purge(ctx context.Context, room string, before time.Time) (int, error) {
+	p, ok := s.store.(purger)
+	if !ok {
+		return 0, nil
+	}
+	n, err := p.Purge(ctx, room, before)
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	if err := s.cache.update(ctx, room, func(messages []Message) []Message {
+		return messages[olderMessages(messages, before):]
+	}, false); err != nil {
+		s.setStale(room, true)
+	}
+	return n, nil
+}
+
+func (s *cachedStore) History(ctx context.Context, room string, before int64, limit int) ([]Message, error) {
+	return s.store.History(ctx, room, before, limit)
+}
+
+func (s *cachedStore) Remove(ctx context.Context, room string, ids []int64) (int, error) {
+	rm, ok := s.store.(remover)
+	if !ok {
+		return 0, nil
+	}
+	n, err := rm.Remove(ctx, room, ids)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.cache.update(ctx, room, func(messages []Message) []Message {
+		messages, _ = withoutMessages(messages, ids)
+		return messages
+	}, false); err != nil {
+		s.setStale(room, true)
+	}
+	return n, nil
+}
@@ -0,0 +1,161 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"google.golang.org/appengine/v2/taskqueue"
+)
+
+// taskQueue is a postQueue on App Engine Task Queue. The posts are sent to
+// /tasks/posts by the queue, which retries until they are stored.
+type taskQueue struct {
+	// name is the name of the queue. The default queue is used if this is
+	// empty.
+	name string
+}
+
+func (q taskQueue) Enqueue(ctx context.Context, room string, messages []Message) error {
+	b, err := json.Marshal(&QueuedPosts{
+		Room:     room,
+		Messages: messages,
+	})
+	if err != nil {
+		return err
+	}
+	t := &taskqueue.Task{
+		Path:    "/tasks/posts",
+		Payload: b,
+		Header: http.Header{
+			"Content-Type": []string{"application/json"},
+		},
+		Method: http.MethodPost,
+	}
+	_, err = taskqueue.Add(ctx, t, q.name)
+	return err
+}
+
+// taskScheduler is a messageScheduler on App Engine Task Queue. A task to
+// /tasks/scheduled is added with the time as the ETA.
+type taskScheduler struct{}
+
+func (taskScheduler) Schedule(ctx context.Context, at time.Time) error {
+	_, err := taskqueue.Add(ctx, &taskqueue.Task{
+		Path:   "/tasks/scheduled",
+		Method: http.MethodPost,
+		ETA:    at,
+	}, "")
+	return err
+}
+
+const (
+	// postsQueue is the pull queue of the accepted posts.
+	postsQueue = "posts"
+
+	// drainQueue is the push queue to drain postsQueue. The queue runs one
+	// task at a time so that the posts are stored in order.
+	drainQueue = "posts-drain"
+
+	// postLeaseSeconds is how long the posts are leased to be stored.
+	postLeaseSeconds = 60
+)
+
+// taskPipeline is a postPipeline on App Engine Task Queue. Posts are kept in
+// the pull queue postsQueue tagged with their rooms, and each post adds a task
+// to drainQueue to store them.
+type taskPipeline struct{}
+
+func (taskPipeline) Accept(ctx context.Context, room string, message Message) error {
+	b, err := json.Marshal(&message)
+	if err != nil {
+		return err
+	}
+	if _, err := taskqueue.Add(ctx, &taskqueue.Task{
+		Method:  "PULL",
+		Payload: b,
+		Tag:     room,
+	}, postsQueue); err != nil {
+		return err
+	}
+
+	b, err = json.Marshal(&DrainRequest{Room: room})
+	if err != nil {
+		return err
+	}
+	// If this fails, the post is stored by the drain for the next post.
+	if _, err := taskqueue.Add(ctx, &taskqueue.Task{
+		Path:    "/tasks/posts/drain",
+		Payload: b,
+		Header: http.Header{
+			"Content-Type": []string{"application/json"},
+		},
+		Method: http.MethodPost,
+	}, drainQueue); err != nil {
+		log.Printf("Task Queue error: %v", err)
+	}
+	return nil
+}
+
+func (taskPipeline) Lease(ctx context.Context, room string, n int) ([]leasedPost, error) {
+	tasks, err := taskqueue.LeaseByTag(ctx, n, postsQueue, postLeaseSeconds, room)
+	if err != nil {
+		return nil, err
+	}
+	var posts []leasedPost
+	var broken []*taskqueue.Task
+	for _, t := range tasks {
+		var m Message
+		if err := json.Unmarshal(t.Payload, &m); err != nil {
+			broken = append(broken, t)
+			continue
+		}
+		posts = append(posts, leasedPost{
+			message: m,
+			lease:   t,
+		})
+	}
+	// Broken posts can never be stored.
+	if len(broken) > 0 {
+		if err := taskqueue.DeleteMulti(ctx, broken, postsQueue); err != nil {
+			return nil, err
+		}
+	}
+	return posts, nil
+}
+
+func (taskPipeline) Done(ctx context.Context, posts []leasedPost) error {
+	if len(posts) == 0 {
+		return nil
+	}
+	tasks := make([]*taskqueue.Task, len(posts))
+	for i, p := range posts {
+		tasks[i] = p.lease.(*taskqueue.Task)
+	}
+	return taskqueue.DeleteMulti(ctx, tasks, postsQueue)
+}
+
+func (taskPipeline) Release(ctx context.Context, posts []leasedPost) error {
+	for _, p := range posts {
+		if err := taskqueue.ModifyLease(ctx, p.lease.(*taskqueue.Task), postsQueue, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,363 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const templatesKey = "templates"
+
+// templateExt is the extension of the template files in template_dir.
+const templateExt = ".html"
+
+const (
+	// headTmpl is the hook to add elements like styles to the head of the
+	// pages. Styles and scripts need the nonce attribute to run.
+	headTmpl = ``
+
+	// headerTmpl is shown at the top of the messages page.
+	headerTmpl = `{{with .Theme.LogoURL}}<header><img class="logo" src="{{.}}" alt="{{$.Theme.Title}}"></header>
+{{end}}`
+
+	// footerTmpl is shown at the bottom of the messages page.
+	footerTmpl = `{{with .Theme.Footer}}<footer>{{.}}</footer>
+{{end}}`
+
+	// nameTmpl shows the poster of a message with the avatar and the link in
+	// the profile. The poster without an avatar is shown with the identicon.
+	nameTmpl = `{{with avatar .}}<img class="avatar" src="{{.}}" alt=""> {{end}}<span class="name">{{with .Profile}}{{with .Link}}<a href="{{.}}" rel="noopener noreferrer nofollow" target="_blank">{{end}}{{end}}{{.Name}}{{with .Profile}}{{with .Link}}</a>{{end}}{{end}}</span>`
+)
+
+// defaultTemplates is the built-in templates by name. The pages are
+// "messages", "embed" and "admin", and the others are the parts the pages include.
+// A template in template_dir or in the store replaces the built-in one of the
+// same name, so a theme can override only the parts like "footer".
+var defaultTemplates = map[string]string{
+	"messages": messagesHTMLTmpl,
+	"embed":    embedHTMLTmpl,
+	"admin":    dashboardHTMLTmpl,
+	"head":     headTmpl,
+	"header":   headerTmpl,
+	"footer":   footerTmpl,
+	"name":     nameTmpl,
+}
+
+var templateFuncs = template.FuncMap{
+	"avatar":   avatarURL,
+	"markdown": renderMarkdown,
+	"static":   staticPath,
+	"t":        translate,
+}
+
+// pageTemplates is a parsed template set.
+type pageTemplates struct {
+	*template.Template
+
+	// version identifies the sources of the templates for the ETags of the
+	// pages.
+	version string
+}
+
+var defaultPageTemplates = mustParseTemplates(defaultTemplates)
+
+// templateNames returns the sorted names of the template sources.
+func templateNames(sources map[string]string) []string {
+	var names []string
+	for name := range sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// templatesVersion returns the version of the template sources by name.
+func templatesVersion(sources map[string]string) string {
+	h := sha256.New()
+	for _, name := range templateNames(sources) {
+		fmt.Fprintf(h, "%q:%q\n", name, sources[name])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// parseTemplates parses the template sources by name into a set.
+func parseTemplates(sources map[string]string) (*pageTemplates, error) {
+	t := template.New("").Funcs(templateFuncs)
+	for _, name := range templateNames(sources) {
+		if _, err := t.New(name).Parse(sources[name]); err != nil {
+			return nil, err
+		}
+	}
+	return &pageTemplates{
+		Template: t,
+		version:  templatesVersion(sources),
+	}, nil
+}
+
+func mustParseTemplates(sources map[string]string) *pageTemplates {
+	t, err := parseTemplates(sources)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// templateCache keeps the template files and the latest parsed set, so that
+// the templates are parsed again only when they are changed.
+type templateCache struct {
+	filesOnce sync.Once
+	files     map[string]string
+	filesErr  error
+
+	m       sync.Mutex
+	current *pageTemplates
+}
+
+// loadTemplateFiles reads the templates in the directory. The name of a
+// template is the file name without the extension.
+func loadTemplateFiles(dir string) (map[string]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+templateExt))
+	if err != nil {
+		return nil, err
+	}
+	files := map[string]string{}
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		files[strings.TrimSuffix(filepath.Base(path), templateExt)] = string(b)
+	}
+	return files, nil
+}
+
+// Templates is the templates stored by the admin API. They override the
+// built-in templates and the files in template_dir.
+type Templates struct {
+	// Templates is the template sources by name.
+	Templates map[string]string `json:"templates"`
+}
+
+func (t *Templates) validate() error {
+	for name := range t.Templates {
+		if name == "" || strings.ContainsAny(name, `/\`) {
+			return fmt.Errorf("chatserver: invalid template name: %q", name)
+		}
+	}
+	return nil
+}
+
+// storedTemplates returns the templates stored by the admin API.
+func (s *server) storedTemplates(ctx context.Context) (*Templates, error) {
+	t := &Templates{
+		Templates: map[string]string{},
+	}
+	if err := s.db.Get(ctx, templatesKey, t); err != nil && err != ErrNotFound {
+		return nil, err
+	}
+	return t, nil
+}
+
+// templateSources returns the built-in templates overridden by the files and
+// the stored ones.
+func (s *server) templateSources(stored *Templates) (map[string]string, error) {
+	c := &s.templates
+	c.filesOnce.Do(func() {
+		if s.config.TemplateDir != "" {
+			c.files, c.filesErr = loadTemplateFiles(s.config.TemplateDir)
+		}
+	})
+	if c.filesErr != nil {
+		return nil, c.filesErr
+	}
+
+	sources := map[string]string{}
+	for _, ts := range []map[string]string{defaultTemplates, c.files, stored.Templates} {
+		for name, src := range ts {
+			sources[name] = src
+		}
+	}
+	return sources, nil
+}
+
+// pageTemplates returns the current template set.
+func (s *server) pageTemplates(ctx context.Context) (*pageTemplates, error) {
+	stored, err := s.storedTemplates(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sources, err := s.templateSources(stored)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &s.templates
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.current != nil && c.current.version == templatesVersion(sources) {
+		return c.current, nil
+	}
+	t, err := parseTemplates(sources)
+	if err != nil {
+		return nil, err
+	}
+	c.current = t
+	return t, nil
+}
+
+// renderPage renders the page template of the name with the data and the
+// theme. If the customized templates are broken, the page is rendered with
+// the built-in templates so that the chat keeps working.
+func (s *server) renderPage(ctx context.Context, w http.ResponseWriter, r *http.Request, name string, data map[string]interface{}) {
+	t, err := s.pageTemplates(ctx)
+	if err != nil {
+		s.logf(ctx, "Template error: %v", err)
+		t = defaultPageTemplates
+	}
+	data["Theme"] = &s.config.Theme
+	lang := requestLanguage(r)
+	data["Lang"] = lang
+	setLanguage(w, r, lang)
+	w.Header().Add("Vary", "Accept-Language")
+	w.Header().Set("Content-Language", lang)
+
+	nonce, err := s.contentNonce(t.version, name, data)
+	if err != nil {
+		msg := fmt.Sprintf("Nonce error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	s.setPageSecurity(w, nonce)
+
+	// Browsers without WebSocket reload the pages periodically. Skip
+	// rendering the page if nothing in it has changed.
+	if notModified(w, r, t.version, name, data) {
+		return
+	}
+	data["Nonce"] = nonce
+
+	var buf bytes.Buffer
+	if err := t.ExecuteTemplate(&buf, name, data); err != nil {
+		if t == defaultPageTemplates {
+			s.writeTemplateError(ctx, w, r, err)
+			return
+		}
+		s.logf(ctx, "Template error: %v", err)
+		buf.Reset()
+		if err := defaultPageTemplates.ExecuteTemplate(&buf, name, data); err != nil {
+			s.writeTemplateError(ctx, w, r, err)
+			return
+		}
+	}
+	writeHTML(w, r, http.StatusOK, &buf)
+}
+
+// errorPage is the page shown when a page can't be rendered. The page is
+// static so that it is always shown.
+const errorPage = `<!DOCTYPE html>
+<title>Error</title>
+<p>The page could not be shown. Please reload the page later.</p>
+`
+
+// writeTemplateError logs the error of rendering a page, and writes 500
+// Internal Server Error with errorPage. Clients preferring JSON get the error
+// in JSON instead.
+func (s *server) writeTemplateError(ctx context.Context, w http.ResponseWriter, r *http.Request, err error) {
+	s.logf(ctx, "Template error: %v", err)
+	if !prefersHTML(r) {
+		msg := fmt.Sprintf("Template error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	writeHTML(w, r, http.StatusInternalServerError, bytes.NewBufferString(errorPage))
+}
+
+// writeHTML writes the rendered page in buf with the Content-Length. Only the
+// headers are written for HEAD.
+func writeHTML(w http.ResponseWriter, r *http.Request, status int, buf *bytes.Buffer) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return
+	}
+	io.Copy(w, buf)
+}
+
+// handleTemplates handles /admin/templates to get and replace the stored
+// templates.
+func (s *server) handleTemplates(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		t, err := s.storedTemplates(ctx)
+		if err != nil {
+			msg := fmt.Sprintf("Templates error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		writeJSON(w, http.StatusOK, t)
+	case http.MethodPut:
+		var t Templates
+		if !decodeJSON(w, r, &t, maxAdminContentSize) {
+			return
+		}
+		if t.Templates == nil {
+			t.Templates = map[string]string{}
+		}
+		if err := t.validate(); err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		sources, err := s.templateSources(&t)
+		if err != nil {
+			msg := fmt.Sprintf("Templates error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		if _, err := parseTemplates(sources); err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		prev, err := s.storedTemplates(ctx)
+		if err != nil {
+			msg := fmt.Sprintf("Templates error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		if err := s.db.Set(ctx, templatesKey, &t, 0); err != nil {
+			msg := fmt.Sprintf("Templates error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		s.audit(ctx, r, "templates.update", "", "", prev, &t)
+		writeJSON(w, http.StatusOK, &t)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT")
+		methodNotAllowed(w, r)
+	}
+}
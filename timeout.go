@@ -0,0 +1,68 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// backendTimeoutKey is the context key of the timeout of each backend call.
+type backendTimeoutKey struct{}
+
+// isStreaming reports whether the request keeps the connection open to
+// receive messages, like WebSocket.
+func isStreaming(r *http.Request) bool {
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return true
+	}
+	return r.URL.Path == "/ws" ||
+		strings.HasSuffix(r.URL.Path, "/messages/stream") ||
+		strings.HasSuffix(r.URL.Path, "/messages/poll")
+}
+
+// withTimeouts limits the time of the requests by RequestTimeout in the
+// config, and sets BackendTimeout in the request context. The request context
+// is also canceled when the client disconnects.
+func (s *server) withTimeouts(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if s.config.BackendTimeout > 0 {
+			ctx = context.WithValue(ctx, backendTimeoutKey{}, s.config.BackendTimeout)
+		}
+		if s.config.RequestTimeout > 0 && !isStreaming(r) {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, s.config.RequestTimeout)
+			defer cancel()
+		}
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// backendContext returns the context for a backend call limited by the
+// backend timeout in ctx.
+func backendContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if d, ok := ctx.Value(backendTimeoutKey{}).(time.Duration); ok && d > 0 {
+		return context.WithTimeout(ctx, d)
+	}
+	return context.WithCancel(ctx)
+}
+
+// timedOut reports whether the request failed since it took too long.
+func timedOut(r *http.Request) bool {
+	return r.Context().Err() == context.DeadlineExceeded
+}
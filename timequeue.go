@@ -0,0 +1,165 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// takenBucketExpiration is how long the emptied bucket of a timeQueue is
+// kept in the KV.
+const takenBucketExpiration = time.Hour
+
+// queuedMessage is a message in a timeQueue.
+type queuedMessage struct {
+	Room string `json:"room"`
+	ID   int64  `json:"id"`
+}
+
+// timeQueue is a queue of the messages to be processed at their times, kept
+// in a KV. The messages are kept in a value per bucket of the interval, like
+// "expiring:1520017200", so the number of the messages is not limited by the
+// size of a value. The value of bucketsKey is the list of the buckets that
+// might have messages, so that only the due buckets are read.
+type timeQueue struct {
+	name     string
+	interval time.Duration
+}
+
+// bucketsKey returns the key of the list of the buckets.
+func (q *timeQueue) bucketsKey() string {
+	return q.name + ":buckets"
+}
+
+// bucket returns the bucket of the time.
+func (q *timeQueue) bucket(t time.Time) int64 {
+	return t.Truncate(q.interval).Unix()
+}
+
+// bucketKey returns the key of the messages in the bucket.
+func (q *timeQueue) bucketKey(bucket int64) string {
+	return q.name + ":" + strconv.FormatInt(bucket, 10)
+}
+
+// due reports whether all the messages in the bucket are due at the time.
+func (q *timeQueue) due(bucket int64, now time.Time) bool {
+	return !now.Before(time.Unix(bucket, 0).Add(q.interval))
+}
+
+// addBucket adds the bucket to the list of the buckets.
+func (q *timeQueue) addBucket(ctx context.Context, kv KV, bucket int64) error {
+	var buckets []int64
+	return kv.Update(ctx, q.bucketsKey(), &buckets, 0, func() error {
+		i := sort.Search(len(buckets), func(i int) bool {
+			return buckets[i] >= bucket
+		})
+		if i < len(buckets) && buckets[i] == bucket {
+			return nil
+		}
+		buckets = append(buckets, 0)
+		copy(buckets[i+1:], buckets[i:])
+		buckets[i] = bucket
+		return nil
+	})
+}
+
+// removeBucket removes the bucket from the list of the buckets.
+func (q *timeQueue) removeBucket(ctx context.Context, kv KV, bucket int64) error {
+	var buckets []int64
+	return kv.Update(ctx, q.bucketsKey(), &buckets, 0, func() error {
+		for i, b := range buckets {
+			if b == bucket {
+				buckets = append(buckets[:i], buckets[i+1:]...)
+				break
+			}
+		}
+		return nil
+	})
+}
+
+// push adds the messages to be processed after the time. The bucket is listed
+// after the messages are added, since process might unlist and take the
+// bucket in the meantime. If listing fails, the error is returned, and the
+// messages are found again when another message is pushed to the bucket.
+func (q *timeQueue) push(ctx context.Context, kv KV, at time.Time, messages ...queuedMessage) error {
+	bucket := q.bucket(at)
+	var queue []queuedMessage
+	if err := kv.Update(ctx, q.bucketKey(bucket), &queue, 0, func() error {
+		queue = append(queue, messages...)
+		return nil
+	}); err != nil {
+		return err
+	}
+	return q.addBucket(ctx, kv, bucket)
+}
+
+// take removes the messages in the bucket and returns them. The emptied value
+// expires soon unless messages are added again.
+func (q *timeQueue) take(ctx context.Context, kv KV, bucket int64) ([]queuedMessage, error) {
+	var taken []queuedMessage
+	var queue []queuedMessage
+	if err := kv.Update(ctx, q.bucketKey(bucket), &queue, takenBucketExpiration, func() error {
+		taken = queue
+		queue = nil
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return taken, nil
+}
+
+// process calls f with the messages of each bucket due at the time in order.
+// If f fails, f returns the messages that are not processed yet, which are put
+// back to try again later.
+func (q *timeQueue) process(ctx context.Context, kv KV, now time.Time, f func(messages []queuedMessage) ([]queuedMessage, error)) error {
+	var buckets []int64
+	if err := kv.Get(ctx, q.bucketsKey(), &buckets); err != nil {
+		if err == ErrNotFound {
+			return nil
+		}
+		return err
+	}
+	for _, bucket := range buckets {
+		if !q.due(bucket, now) {
+			break
+		}
+		if err := q.removeBucket(ctx, kv, bucket); err != nil {
+			return err
+		}
+		messages, err := q.take(ctx, kv, bucket)
+		if err != nil {
+			if err := q.addBucket(ctx, kv, bucket); err != nil {
+				return err
+			}
+			return err
+		}
+		if len(messages) == 0 {
+			continue
+		}
+		rest, err := f(messages)
+		if err != nil {
+			if len(rest) > 0 {
+				if err := q.push(ctx, kv, time.Unix(bucket, 0), rest...); err != nil {
+					return err
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// hookedKV is a KV calling the hook before the first update of the key.
+type hookedKV struct {
+	KV
+	key  string
+	hook func()
+}
+
+func (kv *hookedKV) Update(ctx context.Context, key string, v interface{}, expiration time.Duration, f func() error) error {
+	if key == kv.key && kv.hook != nil {
+		hook := kv.hook
+		kv.hook = nil
+		hook()
+	}
+	return kv.KV.Update(ctx, key, v, expiration, f)
+}
+
+func TestTimeQueue(t *testing.T) {
+	ctx := context.Background()
+	kv := NewMemoryKV()
+	q := &timeQueue{name: "test", interval: time.Minute}
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if err := q.push(ctx, kv, now.Add(time.Duration(i)*time.Minute), queuedMessage{Room: "general", ID: int64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []int64
+	process := func(now time.Time, fail bool) error {
+		return q.process(ctx, kv, now, func(messages []queuedMessage) ([]queuedMessage, error) {
+			if fail {
+				return messages, errors.New("failed")
+			}
+			for _, m := range messages {
+				got = append(got, m.ID)
+			}
+			return nil, nil
+		})
+	}
+	if err := process(now.Add(time.Minute), true); err == nil {
+		t.Fatal("process: got nil, want an error")
+	}
+	// The failed messages are processed again.
+	if err := process(now.Add(time.Minute), false); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0] != 0 {
+		t.Errorf("processed: got %v, want [0]", got)
+	}
+	if err := process(now.Add(3*time.Minute), false); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 {
+		t.Errorf("processed: got %v, want [0 1 2]", got)
+	}
+}
+
+func TestTimeQueuePushWhileProcessing(t *testing.T) {
+	ctx := context.Background()
+	q := &timeQueue{name: "test", interval: time.Minute}
+	now := time.Now()
+	at := now.Add(-time.Hour)
+
+	mkv := NewMemoryKV()
+	if err := q.push(ctx, mkv, at, queuedMessage{Room: "general", ID: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []int64
+	process := func() {
+		if err := q.process(ctx, mkv, now, func(messages []queuedMessage) ([]queuedMessage, error) {
+			for _, m := range messages {
+				got = append(got, m.ID)
+			}
+			return nil, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The bucket is processed while the second message is being pushed to
+	// it.
+	kv := &hookedKV{
+		KV:   mkv,
+		key:  q.bucketKey(q.bucket(at)),
+		hook: process,
+	}
+	if err := q.push(ctx, kv, at, queuedMessage{Room: "general", ID: 2}); err != nil {
+		t.Fatal(err)
+	}
+	process()
+	if len(got) != 2 {
+		t.Errorf("processed: got %v, want [1 2]", got)
+	}
+}
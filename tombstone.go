@@ -0,0 +1,127 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"time"
+)
+
+// tombstoneRetention is how long the tombstones of the deleted messages are
+// kept so that the clients see the deletion.
+const tombstoneRetention = 24 * time.Hour
+
+// tombstones is the queue of the deleted messages to be removed from the
+// store after tombstoneRetention.
+var tombstones = &timeQueue{
+	name:     "tombstones",
+	interval: time.Hour,
+}
+
+// remover is implemented by the stores that can remove messages by the ID.
+type remover interface {
+	// Remove removes the messages of the IDs in the room, and returns the
+	// number of the removed messages.
+	Remove(ctx context.Context, room string, ids []int64) (int, error)
+}
+
+// tombstone marks the message as deleted and removes its content. The ID and
+// the time are kept so that the clients can find the message to remove.
+func (m *Message) tombstone() {
+	m.Deleted = true
+	m.Body = ""
+	m.Mentions = nil
+	m.Attachments = nil
+	m.Preview = nil
+	m.Poll = nil
+}
+
+// tombstoneOf returns the tombstone of the message shown in the list.
+func tombstoneOf(m Message) Message {
+	return Message{
+		ID:        m.ID,
+		CreatedAt: m.CreatedAt,
+		Deleted:   true,
+	}
+}
+
+// shownMessages returns the messages in the list. Deleted and expired
+// messages are replaced with their tombstones so that the list keeps the
+// IDs, and hidden messages and typing events are removed.
+func shownMessages(messages []Message) []Message {
+	now := time.Now()
+	result := make([]Message, 0, len(messages))
+	for _, m := range messages {
+		if m.Hidden || m.Typing {
+			continue
+		}
+		if m.Deleted || m.expired(now) {
+			m = tombstoneOf(m)
+		}
+		result = append(result, m)
+	}
+	return result
+}
+
+// addTombstone adds the deleted message to the tombstones removed by
+// /tasks/purge. The tombstone stays in the store if this fails, so errors
+// are only logged.
+func (s *server) addTombstone(ctx context.Context, room string, id int64) {
+	if err := tombstones.push(ctx, s.db, time.Now().Add(tombstoneRetention), queuedMessage{
+		Room: room,
+		ID:   id,
+	}); err != nil {
+		s.logf(ctx, "Tombstone error: %v", err)
+	}
+}
+
+// purgeTombstones removes the tombstones older than tombstoneRetention from
+// the store, and returns the number of the removed messages.
+func (s *server) purgeTombstones(ctx context.Context) (int, error) {
+	rm, ok := s.store.(remover)
+	if !ok {
+		return 0, nil
+	}
+
+	n := 0
+	err := tombstones.process(ctx, s.db, time.Now(), func(due []queuedMessage) ([]queuedMessage, error) {
+		ids := map[string][]int64{}
+		var rooms []string
+		for _, t := range due {
+			if _, ok := ids[t.Room]; !ok {
+				rooms = append(rooms, t.Room)
+			}
+			ids[t.Room] = append(ids[t.Room], t.ID)
+		}
+		for i, room := range rooms {
+			removed, err := rm.Remove(ctx, room, ids[room])
+			n += removed
+			if err != nil {
+				var rest []queuedMessage
+				for _, t := range due {
+					if contains(rooms[i:], t.Room) {
+						rest = append(rest, t)
+					}
+				}
+				return rest, err
+			}
+			if removed > 0 {
+				s.bumpRevision(ctx, room)
+			}
+		}
+		return nil, nil
+	})
+	return n, err
+}
@@ -0,0 +1,258 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName = "github.com/golangtokyo/chatserver"
+
+	cloudTraceEndpoint = "https://cloudtrace.googleapis.com/v2/"
+	cloudTraceScope    = "https://www.googleapis.com/auth/trace.append"
+
+	// traceBatchSize and traceFlushInterval control how often the finished
+	// spans are sent. The spans are sent at the end of a request when either
+	// is exceeded.
+	traceBatchSize     = 100
+	traceFlushInterval = 10 * time.Second
+
+	// maxPendingSpans is the maximum number of spans waiting to be sent.
+	// Older spans are dropped.
+	maxPendingSpans = 1000
+)
+
+// startSpan starts a span as a child of the span in ctx. Spans are not
+// recorded unless tracing is enabled.
+func startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name)
+}
+
+// endSpan records err in the span if err is not nil, and ends the span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+type cloudTraceString struct {
+	Value string `json:"value"`
+}
+
+type cloudTraceAttributes struct {
+	AttributeMap map[string]map[string]cloudTraceString `json:"attributeMap,omitempty"`
+}
+
+type cloudTraceStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// cloudTraceSpan is a span in the Cloud Trace API v2.
+type cloudTraceSpan struct {
+	Name         string               `json:"name"`
+	SpanID       string               `json:"spanId"`
+	ParentSpanID string               `json:"parentSpanId,omitempty"`
+	DisplayName  cloudTraceString     `json:"displayName"`
+	StartTime    time.Time            `json:"startTime"`
+	EndTime      time.Time            `json:"endTime"`
+	Attributes   cloudTraceAttributes `json:"attributes"`
+	Status       *cloudTraceStatus    `json:"status,omitempty"`
+}
+
+// cloudTraceExporter is an OpenTelemetry span exporter to Cloud Trace. The
+// finished spans are kept in memory and sent by flush with the context of a
+// request, since App Engine APIs are not available outside requests.
+type cloudTraceExporter struct {
+	project string
+
+	// token returns an access token for Cloud Trace.
+	token func(ctx context.Context) (string, error)
+
+	// client returns the HTTP client for the context.
+	client func(ctx context.Context) *http.Client
+
+	spans     []cloudTraceSpan
+	lastFlush time.Time
+	m         sync.Mutex
+}
+
+func (e *cloudTraceExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	e.m.Lock()
+	defer e.m.Unlock()
+	for _, s := range spans {
+		e.spans = append(e.spans, e.convert(s))
+	}
+	if len(e.spans) > maxPendingSpans {
+		e.spans = append([]cloudTraceSpan(nil), e.spans[len(e.spans)-maxPendingSpans:]...)
+	}
+	return nil
+}
+
+func (e *cloudTraceExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+func (e *cloudTraceExporter) convert(s sdktrace.ReadOnlySpan) cloudTraceSpan {
+	sc := s.SpanContext()
+	span := cloudTraceSpan{
+		Name:        fmt.Sprintf("projects/%s/traces/%s/spans/%s", e.project, sc.TraceID(), sc.SpanID()),
+		SpanID:      sc.SpanID().String(),
+		DisplayName: cloudTraceString{Value: s.Name()},
+		StartTime:   s.StartTime(),
+		EndTime:     s.EndTime(),
+	}
+	if p := s.Parent(); p.IsValid() {
+		span.ParentSpanID = p.SpanID().String()
+	}
+	if attrs := s.Attributes(); len(attrs) > 0 {
+		span.Attributes.AttributeMap = map[string]map[string]cloudTraceString{}
+		for _, a := range attrs {
+			span.Attributes.AttributeMap[string(a.Key)] = map[string]cloudTraceString{
+				"stringValue": {Value: a.Value.Emit()},
+			}
+		}
+	}
+	if st := s.Status(); st.Code == codes.Error {
+		// 2 is UNKNOWN in google.rpc.Code.
+		span.Status = &cloudTraceStatus{
+			Code:    2,
+			Message: st.Description,
+		}
+	}
+	return span
+}
+
+// flush sends the finished spans if there are enough spans or the last flush
+// is old enough.
+func (e *cloudTraceExporter) flush(ctx context.Context) error {
+	e.m.Lock()
+	if len(e.spans) == 0 || len(e.spans) < traceBatchSize && time.Since(e.lastFlush) < traceFlushInterval {
+		e.m.Unlock()
+		return nil
+	}
+	spans := e.spans
+	e.spans = nil
+	e.lastFlush = time.Now()
+	e.m.Unlock()
+
+	token, err := e.token(ctx)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"spans": spans,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, cloudTraceEndpoint+"projects/"+e.project+"/traces:batchWrite", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := e.client(ctx).Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("chatserver: Cloud Trace API error: %d %s", res.StatusCode, string(b))
+	}
+	return nil
+}
+
+// enableTracing records spans and exports them with e.
+func (s *server) enableTracing(e *cloudTraceExporter) {
+	s.traces = e
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(e)))
+}
+
+// withTracing returns a handler that starts a span for each request served by
+// h, and sends the finished spans after that.
+func (s *server) withTracing(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.traces == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		ctx, span := startSpan(r.Context(), r.Method+" "+r.URL.Path)
+		h.ServeHTTP(w, r.WithContext(ctx))
+		span.End()
+
+		if err := s.traces.flush(r.Context()); err != nil {
+			s.logf(r.Context(), "Cloud Trace error: %v", err)
+		}
+	})
+}
+
+// metadataToken is an access token from the metadata server, which is
+// available on Compute Engine, Kubernetes Engine and Cloud Run.
+type metadataToken struct {
+	token  string
+	expiry time.Time
+	m      sync.Mutex
+}
+
+func (t *metadataToken) get(ctx context.Context) (string, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if t.token != "" && time.Now().Before(t.expiry) {
+		return t.token, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("chatserver: metadata server error: %d", res.StatusCode)
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&tok); err != nil {
+		return "", err
+	}
+	t.token = tok.AccessToken
+	// Refresh the token a minute before it expires.
+	t.expiry = time.Now().Add(time.Duration(tok.ExpiresIn)*time.Second - time.Minute)
+	return t.token, nil
+}
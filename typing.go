@@ -0,0 +1,124 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// typingTTL is the duration while clients show that the user is typing
+	// after a typing event.
+	typingTTL = 5 * time.Second
+
+	// typingInterval is the minimum interval of typing events from a
+	// session. More frequent events are ignored.
+	typingInterval = 3 * time.Second
+)
+
+var errTypingThrottled = errors.New("chatserver: typing event is throttled")
+
+// TypingRequest is the JSON representation of a typing event.
+type TypingRequest struct {
+	Name string `json:"name"`
+}
+
+func typingKey(room, sessionID string) string {
+	return "typing:" + room + ":" + sessionID
+}
+
+// postTyping broadcasts that the poster is typing in the room. The event is
+// sent as a message with Typing, and is not stored.
+func (s *server) postTyping(ctx context.Context, w http.ResponseWriter, r *http.Request, room string) {
+	var req TypingRequest
+	if !decodeJSON(w, r, &req, int64(s.config.MaxContentSize)) {
+		return
+	}
+
+	// The name of a signed-in user is always the account's name.
+	if name := s.userName(ctx); name != "" {
+		req.Name = name
+	} else if s.loginRequired {
+		msg := "Login is required"
+		writeError(w, r, http.StatusUnauthorized, msg)
+		return
+	}
+	if f := validateField("name", &req.Name, s.config.MaxNameLength); f != nil {
+		writeValidationError(w, r, &ValidationError{
+			Errors: []FieldError{*f},
+		})
+		return
+	}
+
+	typing := Message{
+		Name:      req.Name,
+		CreatedAt: time.Now(),
+		SessionID: sessionID(ctx),
+		Typing:    true,
+	}
+
+	banned, err := s.isBanned(ctx, &poster{
+		sessionID: typing.SessionID,
+		ip:        clientIP(r),
+		name:      typing.Name,
+	})
+	if err != nil {
+		msg := fmt.Sprintf("Ban error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	if banned {
+		msg := "You are banned from posting"
+		writeErrorCode(w, r, http.StatusForbidden, "banned", msg)
+		return
+	}
+
+	filter, err := s.wordFilter(ctx)
+	if err != nil {
+		msg := fmt.Sprintf("Word filter error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+	if !filter.apply(&typing) {
+		writeValidationError(w, r, &ValidationError{
+			Errors: []FieldError{{Field: "name", Message: "must not contain banned words"}},
+		})
+		return
+	}
+
+	var sent bool
+	if err := s.cache.Update(ctx, typingKey(room, typing.SessionID), &sent, typingInterval, func() error {
+		if sent {
+			return errTypingThrottled
+		}
+		sent = true
+		return nil
+	}); err != nil {
+		if err == errTypingThrottled {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		msg := fmt.Sprintf("Typing error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, msg)
+		return
+	}
+
+	s.broadcast(ctx, room, typing)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,159 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// FieldError is an error of a field of a message.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+
+	// format and args are the format of Message and its arguments to
+	// translate the message.
+	format string
+	args   []interface{}
+}
+
+// newFieldError returns the error of the field with the message formatted
+// with args.
+func newFieldError(field string, format string, args ...interface{}) FieldError {
+	return FieldError{
+		Field:   field,
+		Message: fmt.Sprintf(format, args...),
+		format:  format,
+		args:    args,
+	}
+}
+
+// translate returns the message translated into the language.
+func (f *FieldError) translate(lang string) string {
+	if f.format == "" {
+		return translate(lang, f.Message)
+	}
+	return translate(lang, f.format, f.args...)
+}
+
+// ValidationError is returned when a message is invalid.
+type ValidationError struct {
+	Errors []FieldError `json:"errors"`
+
+	// lang is the language of the messages in JSON.
+	lang string
+}
+
+// writeValidationError writes 422 Unprocessable Entity with err, which is
+// usually a *ValidationError, in the language of the request.
+func writeValidationError(w http.ResponseWriter, r *http.Request, err error) {
+	if verr, ok := err.(*ValidationError); ok {
+		v := *verr
+		v.lang = requestLanguage(r)
+		err = &v
+	}
+	writeJSON(w, http.StatusUnprocessableEntity, err)
+}
+
+// validationErrorJSON is the JSON representation of ValidationError. errors
+// is also kept for compatibility.
+type validationErrorJSON struct {
+	Error  APIError     `json:"error"`
+	Errors []FieldError `json:"errors"`
+}
+
+// MarshalJSON encodes the error in the same envelope as the other errors.
+func (e *ValidationError) MarshalJSON() ([]byte, error) {
+	fields := make([]FieldError, len(e.Errors))
+	for i, f := range e.Errors {
+		fields[i] = FieldError{
+			Field:   f.Field,
+			Message: f.translate(e.lang),
+		}
+	}
+	return json.Marshal(&validationErrorJSON{
+		Error: APIError{
+			Code:    errorCode(http.StatusUnprocessableEntity),
+			Message: translate(e.lang, "Some fields are invalid"),
+			Fields:  fields,
+		},
+		Errors: fields,
+	})
+}
+
+func (e *ValidationError) Error() string {
+	var msgs []string
+	for _, f := range e.Errors {
+		msgs = append(msgs, f.Field+": "+f.Message)
+	}
+	return "chatserver: invalid message: " + strings.Join(msgs, ", ")
+}
+
+// stripControls removes control characters like newlines from str.
+func stripControls(str string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, str)
+}
+
+// validateField sanitizes the value of the field and returns an error if the
+// value is invalid.
+func validateField(field string, value *string, maxLength int) *FieldError {
+	if !utf8.ValidString(*value) {
+		f := newFieldError(field, "must be valid UTF-8")
+		return &f
+	}
+	*value = strings.TrimSpace(stripControls(*value))
+	if *value == "" {
+		f := newFieldError(field, "must not be empty")
+		return &f
+	}
+	if n := utf8.RuneCountInString(*value); n > maxLength {
+		f := newFieldError(field, "must be at most %d characters but %d", maxLength, n)
+		return &f
+	}
+	return nil
+}
+
+// Validate removes control characters from the message and checks the
+// message can be posted with the limits in the config. The returned error is
+// a *ValidationError.
+func (m *Message) Validate(config *Config) error {
+	var errs []FieldError
+	if f := validateField("name", &m.Name, config.MaxNameLength); f != nil {
+		errs = append(errs, *f)
+	}
+	if f := validateField("body", &m.Body, config.MaxBodyLength); f != nil {
+		errs = append(errs, *f)
+	}
+	if n := len(m.Attachments); n > maxAttachments {
+		errs = append(errs, newFieldError("attachments", "must be at most %d images but %d", maxAttachments, n))
+	}
+	if m.TTLSeconds < 0 || m.TTLSeconds > maxMessageTTLSeconds {
+		errs = append(errs, newFieldError("ttl_seconds", "must be from 0 to %d", maxMessageTTLSeconds))
+	}
+	if len(errs) > 0 {
+		return &ValidationError{Errors: errs}
+	}
+	return nil
+}
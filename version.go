@@ -0,0 +1,69 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// latestAPIVersion is the latest version of the API served under /v{n}.
+const latestAPIVersion = 1
+
+type apiVersionKey struct{}
+
+// apiVersion returns the API version of the request, or 0 if the request is
+// to the unversioned paths for the existing clients. The versioned API always
+// responds in JSON.
+func apiVersion(r *http.Request) int {
+	v, _ := r.Context().Value(apiVersionKey{}).(int)
+	return v
+}
+
+// versionPrefix returns the prefix of the API version of the request like
+// "/v1", or an empty string for the unversioned paths.
+func versionPrefix(r *http.Request) string {
+	if v := apiVersion(r); v > 0 {
+		return "/v" + strconv.Itoa(v)
+	}
+	return ""
+}
+
+// withAPIVersions returns a handler that serves h also under the versioned
+// prefixes like /v1. The prefix is removed before h, and the version is
+// available by apiVersion.
+func withAPIVersions(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for v := latestAPIVersion; v >= 1; v-- {
+			prefix := "/v" + strconv.Itoa(v)
+			if r.URL.Path != prefix && !strings.HasPrefix(r.URL.Path, prefix+"/") {
+				continue
+			}
+			r2 := r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, v))
+			u := *r.URL
+			u.Path = strings.TrimPrefix(r.URL.Path, prefix)
+			if u.Path == "" {
+				u.Path = "/"
+			}
+			u.RawPath = ""
+			r2.URL = &u
+			h.ServeHTTP(w, r2)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,417 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const webhooksKey = "webhooks"
+
+const (
+	// maxWebhookAttempts is the maximum number of attempts to deliver an
+	// event.
+	maxWebhookAttempts = 5
+
+	// webhookMaxBackoff is the maximum duration to wait before retrying a
+	// delivery.
+	webhookMaxBackoff = time.Minute
+
+	// maxPendingWebhookDeliveries is the maximum number of deliveries
+	// waiting to be sent. The oldest deliveries are dropped when it is
+	// exceeded.
+	maxPendingWebhookDeliveries = 1000
+
+	// maxWebhookDeliveriesPerFlush is the maximum number of deliveries sent
+	// at once not to block a request too long.
+	maxWebhookDeliveriesPerFlush = 10
+
+	// maxWebhookDeliveryLogs is the number of the latest deliveries logged
+	// for each webhook.
+	maxWebhookDeliveryLogs = 50
+
+	webhookDeliveryLogExpiration = 24 * time.Hour
+
+	webhookTimeout = 5 * time.Second
+
+	webhookEventMessageCreated = "message.created"
+)
+
+// Webhook is an outgoing webhook that receives new messages.
+type Webhook struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+
+	// Room is the room to receive messages from. If Room is empty, messages
+	// in all the rooms are sent.
+	Room string `json:"room,omitempty"`
+
+	// Secret is the key to sign the payloads. Secret is shown only when the
+	// webhook is created.
+	Secret string `json:"secret,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebhookPayload is the JSON sent to webhooks.
+type WebhookPayload struct {
+	Event   string  `json:"event"`
+	Room    string  `json:"room"`
+	Message Message `json:"message"`
+}
+
+// WebhookDelivery is a log of an attempt to deliver an event to a webhook.
+type WebhookDelivery struct {
+	ID      string `json:"id"`
+	Event   string `json:"event"`
+	Attempt int    `json:"attempt"`
+
+	// Status is the HTTP status code of the response. Status is 0 if there
+	// is no response.
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+
+	Time time.Time `json:"time"`
+}
+
+// webhookDelivery is an event waiting to be delivered.
+type webhookDelivery struct {
+	id      string
+	webhook Webhook
+	event   string
+	payload []byte
+	attempt int
+	next    time.Time
+}
+
+// webhookDispatcher holds the deliveries to be sent in this instance.
+type webhookDispatcher struct {
+	pending []*webhookDelivery
+	m       sync.Mutex
+}
+
+func (d *webhookDispatcher) enqueue(delivery *webhookDelivery) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	d.pending = append(d.pending, delivery)
+	if n := len(d.pending) - maxPendingWebhookDeliveries; n > 0 {
+		d.pending = d.pending[n:]
+	}
+}
+
+// takeDue removes and returns at most n deliveries to be sent by now.
+func (d *webhookDispatcher) takeDue(now time.Time, n int) []*webhookDelivery {
+	d.m.Lock()
+	defer d.m.Unlock()
+	var due []*webhookDelivery
+	rest := d.pending[:0]
+	for _, delivery := range d.pending {
+		if len(due) < n && !now.Before(delivery.next) {
+			due = append(due, delivery)
+			continue
+		}
+		rest = append(rest, delivery)
+	}
+	d.pending = rest
+	return due
+}
+
+func webhookDeliveriesKey(id string) string {
+	return "webhookdeliveries:" + id
+}
+
+func (s *server) webhookList(ctx context.Context) ([]Webhook, error) {
+	var webhooks []Webhook
+	if err := s.db.Get(ctx, webhooksKey, &webhooks); err != nil && err != ErrNotFound {
+		return nil, err
+	}
+	return webhooks, nil
+}
+
+// enqueueWebhooks queues the new message for the webhooks of the room.
+func (s *server) enqueueWebhooks(ctx context.Context, room string, message Message) {
+	webhooks, err := s.webhookList(ctx)
+	if err != nil {
+		s.logf(ctx, "Webhook error: %v", err)
+		return
+	}
+	if len(webhooks) == 0 {
+		return
+	}
+	payload, err := json.Marshal(&WebhookPayload{
+		Event:   webhookEventMessageCreated,
+		Room:    room,
+		Message: message,
+	})
+	if err != nil {
+		s.logf(ctx, "Webhook error: %v", err)
+		return
+	}
+	for _, hook := range webhooks {
+		if hook.Room != "" && hook.Room != room {
+			continue
+		}
+		id, err := newID()
+		if err != nil {
+			s.logf(ctx, "Webhook error: %v", err)
+			return
+		}
+		s.webhooks.enqueue(&webhookDelivery{
+			id:      id,
+			webhook: hook,
+			event:   webhookEventMessageCreated,
+			payload: payload,
+		})
+	}
+}
+
+// webhookSignature returns the signature of the payload, which is the hex
+// encoded HMAC-SHA256 with the secret.
+func webhookSignature(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliverWebhook sends the delivery, and returns the status code of the
+// response.
+func (s *server) deliverWebhook(ctx context.Context, d *webhookDelivery) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodPost, d.webhook.URL, bytes.NewReader(d.payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Chatserver-Event", d.event)
+	req.Header.Set("X-Chatserver-Delivery", d.id)
+	req.Header.Set("X-Chatserver-Signature", webhookSignature(d.webhook.Secret, d.payload))
+	res, err := s.httpClient(ctx).Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 4096))
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return res.StatusCode, fmt.Errorf("chatserver: webhook %s failed with status %d", d.webhook.ID, res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
+
+// flushWebhooks sends the deliveries to be sent by now. Failed deliveries are
+// retried with exponential backoff up to maxWebhookAttempts times.
+func (s *server) flushWebhooks(ctx context.Context) {
+	for _, d := range s.webhooks.takeDue(time.Now(), maxWebhookDeliveriesPerFlush) {
+		d.attempt++
+		status, err := s.deliverWebhook(ctx, d)
+
+		entry := WebhookDelivery{
+			ID:      d.id,
+			Event:   d.event,
+			Attempt: d.attempt,
+			Status:  status,
+			Time:    time.Now(),
+		}
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		var logs []WebhookDelivery
+		if err := s.cache.Update(ctx, webhookDeliveriesKey(d.webhook.ID), &logs, webhookDeliveryLogExpiration, func() error {
+			logs = append([]WebhookDelivery{entry}, logs...)
+			if len(logs) > maxWebhookDeliveryLogs {
+				logs = logs[:maxWebhookDeliveryLogs]
+			}
+			return nil
+		}); err != nil {
+			s.logf(ctx, "Webhook error: %v", err)
+		}
+
+		if err == nil {
+			continue
+		}
+		if d.attempt >= maxWebhookAttempts {
+			s.logf(ctx, "Webhook error: gave up delivery %s: %v", d.id, err)
+			continue
+		}
+		backoff := time.Second << uint(d.attempt-1)
+		if backoff > webhookMaxBackoff {
+			backoff = webhookMaxBackoff
+		}
+		d.next = time.Now().Add(backoff)
+		s.webhooks.enqueue(d)
+	}
+}
+
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// handleWebhooks handles /admin/webhooks, /admin/webhooks/{id} and
+// /admin/webhooks/{id}/deliveries.
+func (s *server) handleWebhooks(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/webhooks"), "/")
+	deliveries := false
+	if strings.HasSuffix(id, "/deliveries") {
+		id = strings.TrimSuffix(id, "/deliveries")
+		deliveries = true
+	}
+	if strings.Contains(id, "/") {
+		notFound(w, r)
+		return
+	}
+
+	switch {
+	case id == "" && isGet(r):
+		webhooks, err := s.webhookList(ctx)
+		if err != nil {
+			msg := fmt.Sprintf("Webhook error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		result := []Webhook{}
+		for _, hook := range webhooks {
+			hook.Secret = ""
+			result = append(result, hook)
+		}
+		writeJSON(w, http.StatusOK, result)
+
+	case id == "" && r.Method == http.MethodPost:
+		var req struct {
+			URL  string `json:"url"`
+			Room string `json:"room"`
+		}
+		if !decodeJSON(w, r, &req, maxAdminContentSize) {
+			return
+		}
+		u, err := url.Parse(req.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			msg := fmt.Sprintf("Invalid URL: %q", req.URL)
+			writeError(w, r, http.StatusBadRequest, msg)
+			return
+		}
+		if req.Room != "" && !s.hasRoom(ctx, req.Room) {
+			msg := fmt.Sprintf("Invalid room: %q", req.Room)
+			writeError(w, r, http.StatusBadRequest, msg)
+			return
+		}
+
+		webhookID, err := newID()
+		if err != nil {
+			msg := fmt.Sprintf("Webhook error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		secret, err := newWebhookSecret()
+		if err != nil {
+			msg := fmt.Sprintf("Webhook error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		webhook := Webhook{
+			ID:        webhookID,
+			URL:       u.String(),
+			Room:      req.Room,
+			Secret:    secret,
+			CreatedAt: time.Now(),
+		}
+
+		var webhooks []Webhook
+		if err := s.db.Update(ctx, webhooksKey, &webhooks, 0, func() error {
+			webhooks = append(webhooks, webhook)
+			return nil
+		}); err != nil {
+			msg := fmt.Sprintf("Webhook error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		logged := webhook
+		logged.Secret = ""
+		s.audit(ctx, r, "webhook.create", webhook.Room, webhook.ID, nil, &logged)
+		writeJSON(w, http.StatusCreated, &webhook)
+
+	case id != "" && !deliveries && r.Method == http.MethodDelete:
+		var webhooks []Webhook
+		var removed Webhook
+		if err := s.db.Update(ctx, webhooksKey, &webhooks, 0, func() error {
+			found := false
+			rest := []Webhook{}
+			for _, hook := range webhooks {
+				if hook.ID == id {
+					found = true
+					removed = hook
+					continue
+				}
+				rest = append(rest, hook)
+			}
+			if !found {
+				return ErrNotFound
+			}
+			webhooks = rest
+			return nil
+		}); err != nil {
+			if err == ErrNotFound {
+				notFound(w, r)
+				return
+			}
+			msg := fmt.Sprintf("Webhook error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		removed.Secret = ""
+		s.audit(ctx, r, "webhook.delete", removed.Room, id, &removed, nil)
+		w.WriteHeader(http.StatusNoContent)
+
+	case id != "" && deliveries && isGet(r):
+		logs := []WebhookDelivery{}
+		if err := s.cache.Get(ctx, webhookDeliveriesKey(id), &logs); err != nil && err != ErrNotFound {
+			msg := fmt.Sprintf("Webhook error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		writeJSON(w, http.StatusOK, logs)
+
+	default:
+		switch {
+		case id == "":
+			w.Header().Set("Allow", "GET, HEAD, POST")
+		case deliveries:
+			w.Header().Set("Allow", "GET, HEAD")
+		default:
+			w.Header().Set("Allow", "DELETE")
+		}
+		methodNotAllowed(w, r)
+	}
+}
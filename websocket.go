@@ -0,0 +1,74 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"io"
+	"io/ioutil"
+
+	"golang.org/x/net/websocket"
+)
+
+// webSocketMessage is a message sent over WebSocket. BodyHTML is the body
+// rendered for the messages page.
+type webSocketMessage struct {
+	Message
+	BodyHTML string `json:"body_html"`
+}
+
+// handleWebSocket sends new messages in the room specified by the room query
+// parameter. The default room is used if the parameter is empty.
+func (s *server) handleWebSocket(ws *websocket.Conn) {
+	room := ws.Request().URL.Query().Get("room")
+	if room == "" {
+		room = defaultRoom
+	}
+	if !s.hasRoom(ws.Request().Context(), room) {
+		return
+	}
+
+	if !s.beginStream() {
+		return
+	}
+	defer s.endStream()
+
+	ch := s.hub.subscribe(room)
+	defer s.hub.unsubscribe(room, ch)
+
+	// Clients don't send anything. Reading is only for detecting disconnection.
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, ws)
+		close(closed)
+	}()
+
+	for {
+		select {
+		case m := <-ch:
+			msg := &webSocketMessage{
+				Message:  m,
+				BodyHTML: string(renderMarkdown(m.Body)),
+			}
+			if err := websocket.JSON.Send(ws, msg); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		case <-s.draining:
+			// The client reconnects to another instance.
+			return
+		}
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chatserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+const wordFilterKey = "wordfilter"
+
+// WordFilterMode is the action for messages containing banned words.
+type WordFilterMode string
+
+const (
+	// WordFilterReject rejects the message.
+	WordFilterReject WordFilterMode = "reject"
+
+	// WordFilterMask replaces the banned words with asterisks.
+	WordFilterMask WordFilterMode = "mask"
+
+	// WordFilterFlag posts the message as it is with the flagged mark for
+	// moderators.
+	WordFilterFlag WordFilterMode = "flag"
+)
+
+// WordFilter is the setting of banned words. Words are matched
+// case-insensitively in names and bodies.
+type WordFilter struct {
+	Mode  WordFilterMode `json:"mode"`
+	Words []string       `json:"words"`
+}
+
+func (f *WordFilter) validate() error {
+	switch f.Mode {
+	case WordFilterReject, WordFilterMask, WordFilterFlag:
+	default:
+		return fmt.Errorf("invalid mode: %q", f.Mode)
+	}
+	for _, w := range f.Words {
+		if strings.TrimSpace(w) == "" {
+			return fmt.Errorf("words must not be empty")
+		}
+	}
+	return nil
+}
+
+// regexp returns the regular expression matching the banned words, or nil if
+// there are no words.
+func (f *WordFilter) regexp() *regexp.Regexp {
+	if len(f.Words) == 0 {
+		return nil
+	}
+	quoted := make([]string, len(f.Words))
+	for i, w := range f.Words {
+		quoted[i] = regexp.QuoteMeta(w)
+	}
+	return regexp.MustCompile("(?i)" + strings.Join(quoted, "|"))
+}
+
+// apply applies the filter to the message. apply returns false if the
+// message must be rejected.
+func (f *WordFilter) apply(message *Message) bool {
+	re := f.regexp()
+	if re == nil {
+		return true
+	}
+	if !re.MatchString(message.Name) && !re.MatchString(message.Body) {
+		return true
+	}
+	switch f.Mode {
+	case WordFilterReject:
+		return false
+	case WordFilterMask:
+		mask := func(str string) string {
+			return strings.Repeat("*", utf8.RuneCountInString(str))
+		}
+		message.Name = re.ReplaceAllStringFunc(message.Name, mask)
+		message.Body = re.ReplaceAllStringFunc(message.Body, mask)
+	case WordFilterFlag:
+		message.Flagged = true
+	}
+	return true
+}
+
+// wordFilter returns the current word filter.
+func (s *server) wordFilter(ctx context.Context) (*WordFilter, error) {
+	f := &WordFilter{
+		Mode: WordFilterReject,
+	}
+	if err := s.db.Get(ctx, wordFilterKey, f); err != nil && err != ErrNotFound {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (s *server) handleWordFilter(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		f, err := s.wordFilter(ctx)
+		if err != nil {
+			msg := fmt.Sprintf("Word filter error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		writeJSON(w, http.StatusOK, f)
+	case http.MethodPut:
+		var f WordFilter
+		if !decodeJSON(w, r, &f, maxAdminContentSize) {
+			return
+		}
+		if err := f.validate(); err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		prev, err := s.wordFilter(ctx)
+		if err != nil {
+			msg := fmt.Sprintf("Word filter error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		if err := s.db.Set(ctx, wordFilterKey, &f, 0); err != nil {
+			msg := fmt.Sprintf("Word filter error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+		s.audit(ctx, r, "wordfilter.update", "", "", prev, &f)
+		writeJSON(w, http.StatusOK, &f)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT")
+		methodNotAllowed(w, r)
+	}
+}